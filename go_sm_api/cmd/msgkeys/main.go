@@ -0,0 +1,117 @@
+// Command msgkeys manages the keys that encrypt message bodies at rest.
+//
+//	go run ./cmd/msgkeys genkey
+//	go run ./cmd/msgkeys verify [-messages]
+//	go run ./cmd/msgkeys rewrap
+//	go run ./cmd/msgkeys rotate [-conversation group:12]
+//	go run ./cmd/msgkeys reencrypt
+//
+// It opens DB_FILE (default dev.db) with the master keys in
+// MESSAGE_MASTER_KEY or MESSAGE_MASTER_KEY_FILE, like the server; run the
+// server once first so the tables exist.
+//
+// genkey prints a new master key. To rotate the master key, put the new key
+// first and keep the old one after it, run rewrap (the server also does this
+// in the background), then drop the old key. verify unwraps every data key
+// and reports messages still in plaintext or under retired keys; -messages
+// also decrypts every message. It exits 1 if anything fails. rotate retires
+// data keys so new messages get fresh ones; reencrypt moves the existing
+// messages over without waiting for the server.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: msgkeys genkey | verify [-messages] | rewrap | rotate [-conversation c] | reencrypt")
+		os.Exit(2)
+	}
+	if os.Args[1] == "genkey" {
+		key, err := utils.GenerateMasterKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	cipher := openCipher()
+	switch os.Args[1] {
+	case "verify":
+		fs := flag.NewFlagSet("verify", flag.ExitOnError)
+		messages := fs.Bool("messages", false, "decrypt every message too")
+		fs.Parse(os.Args[2:])
+		rep, err := cipher.Verify(*messages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(out))
+		if len(rep.UnwrapFailures) > 0 || len(rep.MessageFailures) > 0 {
+			os.Exit(1)
+		}
+	case "rewrap":
+		n, err := cipher.Rewrap()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("re-wrapped %d data keys\n", n)
+	case "rotate":
+		fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+		conversation := fs.String("conversation", "", `only this conversation ("private:<a>:<b>" or "group:<id>")`)
+		fs.Parse(os.Args[2:])
+		n, err := cipher.Rotate(*conversation)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("retired %d data keys\n", n)
+	case "reencrypt":
+		n, err := cipher.ReencryptAll(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		removed, err := cipher.DeleteUnusedKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("re-encrypted %d messages, deleted %d unused keys\n", n, removed)
+	default:
+		log.Fatalf("unknown command %q", os.Args[1])
+	}
+}
+
+func openCipher() *service.MessageCipher {
+	dbFile := os.Getenv("DB_FILE")
+	if dbFile == "" {
+		dbFile = "dev.db"
+	}
+	db, err := gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("open %s: %v", dbFile, err)
+	}
+	keys, err := utils.LoadMasterKeys(os.Getenv("MESSAGE_MASTER_KEY"), os.Getenv("MESSAGE_MASTER_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("invalid master keys: %v", err)
+	}
+	if keys == nil {
+		log.Fatal("set MESSAGE_MASTER_KEY or MESSAGE_MASTER_KEY_FILE")
+	}
+	cipher := service.NewMessageCipher(db, keys, service.MessageCipherConfig{})
+	if err := cipher.Register(); err != nil {
+		log.Fatal(err)
+	}
+	return cipher
+}
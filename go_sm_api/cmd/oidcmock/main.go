@@ -0,0 +1,280 @@
+// Command oidcmock is a local OpenID Connect provider for exercising single
+// sign-on without a real identity provider.
+//
+//	go run ./cmd/oidcmock [-addr 127.0.0.1:9091] [-client-id mock] [-client-secret s]
+//	    [-email alice@example.com] [-sub alice] [-unverified] [-alg RS256|ES256] [-bad-signature]
+//
+// Point the server at it with
+//
+//	OIDC_PROVIDERS=mock OIDC_MOCK_ISSUER=http://127.0.0.1:9091 OIDC_MOCK_CLIENT_ID=mock
+//
+// It serves discovery, authorize, token and JWKS endpoints. The authorize
+// endpoint approves at once and redirects back with a code; append email= and
+// sub= to the authorization URL to log in as someone else. The token endpoint
+// enforces PKCE (S256 only), one-time codes and the redirect URI. -unverified
+// sends email_verified=false, which must not link or create an account;
+// -bad-signature signs ID tokens with a key missing from the JWKS, which must
+// be rejected.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// grant is an issued authorization code waiting to be redeemed.
+type grant struct {
+	challenge   string
+	redirectURI string
+	nonce       string
+	email       string
+	sub         string
+}
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	verified     bool
+	alg          string
+	kid          string
+	signer       crypto.Signer
+	published    crypto.PublicKey
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9091", "listen address")
+	clientID := flag.String("client-id", "mock", "expected client_id")
+	clientSecret := flag.String("client-secret", "", "expected client secret; empty accepts public clients")
+	email := flag.String("email", "alice@example.com", "default email claim")
+	sub := flag.String("sub", "", "default subject; derived from the email when empty")
+	unverified := flag.Bool("unverified", false, "send email_verified=false")
+	alg := flag.String("alg", "RS256", "ID token algorithm, RS256 or ES256")
+	badSignature := flag.Bool("bad-signature", false, "sign ID tokens with a key not in the JWKS")
+	flag.Parse()
+
+	host := *addr
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+	p := &provider{
+		issuer:       "http://" + host,
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		verified:     !*unverified,
+		alg:          *alg,
+		kid:          randomString(6),
+		grants:       map[string]grant{},
+	}
+	signer, err := newKey(p.alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.signer, p.published = signer, signer.Public()
+	if *badSignature {
+		if p.signer, err = newKey(p.alg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defaultEmail, defaultSub := *email, *sub
+
+	http.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.issuer + "/authorize",
+			"token_endpoint":                        p.issuer + "/token",
+			"jwks_uri":                              p.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{p.alg},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	http.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		redirectURI := q.Get("redirect_uri")
+		switch {
+		case q.Get("client_id") != p.clientID:
+			http.Error(w, "unknown client_id", http.StatusBadRequest)
+			return
+		case redirectURI == "":
+			http.Error(w, "missing redirect_uri", http.StatusBadRequest)
+			return
+		case q.Get("response_type") != "code":
+			http.Error(w, "unsupported response_type", http.StatusBadRequest)
+			return
+		case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+			http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+			return
+		}
+		g := grant{challenge: q.Get("code_challenge"), redirectURI: redirectURI, nonce: q.Get("nonce"), email: defaultEmail, sub: defaultSub}
+		if e := q.Get("email"); e != "" {
+			g.email, g.sub = e, ""
+		}
+		if s := q.Get("sub"); s != "" {
+			g.sub = s
+		}
+		if g.sub == "" {
+			sum := sha256.Sum256([]byte(g.email))
+			g.sub = base64.RawURLEncoding.EncodeToString(sum[:9])
+		}
+		code := randomString(16)
+		p.mu.Lock()
+		p.grants[code] = g
+		p.mu.Unlock()
+		back := url.Values{"code": {code}, "state": {q.Get("state")}}
+		sep := "?"
+		if strings.Contains(redirectURI, "?") {
+			sep = "&"
+		}
+		log.Printf("authorize: %s (sub %s) -> %s", g.email, g.sub, redirectURI)
+		http.Redirect(w, r, redirectURI+sep+back.Encode(), http.StatusFound)
+	})
+	http.HandleFunc("/token", p.token)
+	http.HandleFunc("/jwks", p.jwks)
+	log.Printf("mock OIDC provider at %s (client_id %s, %s, email_verified=%v, bad signature=%v)",
+		p.issuer, p.clientID, p.alg, p.verified, *badSignature)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+	clientID := r.PostForm.Get("client_id")
+	if id, secret, ok := r.BasicAuth(); ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if p.clientSecret != "" && secret != p.clientSecret {
+			tokenError(w, "invalid_client", "bad client secret")
+			return
+		}
+		clientID = id
+	} else if p.clientSecret != "" {
+		tokenError(w, "invalid_client", "client authentication required")
+		return
+	}
+	if clientID != p.clientID {
+		tokenError(w, "invalid_client", "unknown client_id")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "")
+		return
+	}
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.grants[code]
+	delete(p.grants, code) // codes are single use, even when redeeming fails
+	p.mu.Unlock()
+	if !ok {
+		tokenError(w, "invalid_grant", "unknown or used code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != g.redirectURI {
+		tokenError(w, "invalid_grant", "redirect_uri mismatch")
+		return
+	}
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge {
+		log.Printf("token: PKCE verification failed for %s", g.email)
+		tokenError(w, "invalid_grant", "code_verifier does not match code_challenge")
+		return
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            g.sub,
+		"aud":            p.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          g.email,
+		"email_verified": p.verified,
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if p.alg == "ES256" {
+		method = jwt.SigningMethodES256
+	}
+	tok := jwt.NewWithClaims(method, claims)
+	tok.Header["kid"] = p.kid
+	idToken, err := tok.SignedString(p.signer)
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+	log.Printf("token: issued ID token for %s", g.email)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(16),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	key := map[string]string{"kid": p.kid, "use": "sig", "alg": p.alg}
+	switch pub := p.published.(type) {
+	case *rsa.PublicKey:
+		key["kty"] = "RSA"
+		key["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		key["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key["kty"] = "EC"
+		key["crv"] = "P-256"
+		key["x"] = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+		key["y"] = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []interface{}{key}})
+}
+
+func newKey(alg string) (crypto.Signer, error) {
+	if alg == "ES256" {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+// Command webpush is a development harness for Web Push.
+//
+//	go run ./cmd/webpush genkeys
+//	go run ./cmd/webpush fake-endpoint [-addr :9090] [-status 201] [-fail N]
+//
+// genkeys prints a VAPID key pair for VAPID_PUBLIC_KEY / VAPID_PRIVATE_KEY.
+// fake-endpoint acts as a browser push service: it prints a subscription to
+// POST to /api/push/subscriptions, then verifies the VAPID header of every
+// push it receives, decrypts the payload and logs it. -fail answers the first
+// N pushes with 500 to exercise retries; -status 410 simulates an expired
+// subscription. Its endpoint is plain http on a local address, so run the
+// server with PUSH_ALLOW_LOCAL_ENDPOINTS=true.
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: webpush genkeys | fake-endpoint [-addr :9090] [-status 201] [-fail N]")
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "genkeys":
+		pub, priv, err := utils.GenerateVAPIDKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("VAPID_PUBLIC_KEY=%s\nVAPID_PRIVATE_KEY=%s\n", pub, priv)
+	case "fake-endpoint":
+		fakeEndpoint(os.Args[2:])
+	default:
+		log.Fatalf("unknown command %q", os.Args[1])
+	}
+}
+
+func fakeEndpoint(args []string) {
+	fs := flag.NewFlagSet("fake-endpoint", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "listen address")
+	status := fs.Int("status", http.StatusCreated, "status returned for accepted pushes")
+	fail := fs.Int64("fail", 0, "answer the first N pushes with 500")
+	fs.Parse(args)
+
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	if _, err := rand.Read(authSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	host := *addr
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+	origin := "http://" + host
+	var sub entity.PushSubscribeRequest
+	sub.Endpoint = origin + "/push/" + base64.RawURLEncoding.EncodeToString(authSecret[:6])
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(priv.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(authSecret)
+	out, _ := json.Marshal(sub)
+	fmt.Println(string(out))
+
+	var received int64
+	http.HandleFunc("/push/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&received, 1)
+		key, err := utils.VerifyVAPIDAuthorization(r.Header.Get("Authorization"), origin)
+		if err != nil {
+			log.Printf("push #%d: bad VAPID authorization: %v", n, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if n <= *fail {
+			log.Printf("push #%d: failing with 500", n)
+			http.Error(w, "temporary failure", http.StatusInternalServerError)
+			return
+		}
+		plain, err := utils.DecryptWebPush(priv, authSecret, body)
+		if err != nil {
+			log.Printf("push #%d: decrypt failed: %v", n, err)
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		log.Printf("push #%d: ttl=%s urgency=%s vapid=%s…\n  %s", n,
+			r.Header.Get("TTL"), r.Header.Get("Urgency"), key[:12], plain)
+		w.WriteHeader(*status)
+	})
+	log.Printf("fake push service listening on %s", origin)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
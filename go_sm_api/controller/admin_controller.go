@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+type suspendRequest struct {
+	// Hours of suspension; 0 suspends indefinitely.
+	Hours int `json:"hours" binding:"min=0,max=87600"`
+}
+
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type setTwoFactorRequiredRequest struct {
+	Required bool `json:"required"`
+}
+
+// AdminController serves the platform administration API under /admin.
+type AdminController struct {
+	adminSvc   service.AdminService
+	userSvc    service.UserService
+	accountSvc service.AccountService
+	groupSvc   *service.GroupService
+	mod        *service.Moderator
+	auditSvc   service.AuditService
+	hub        *ws.Hub
+}
+
+func NewAdminController(adminSvc service.AdminService, userSvc service.UserService, accountSvc service.AccountService, groupSvc *service.GroupService, mod *service.Moderator, auditSvc service.AuditService, hub *ws.Hub) *AdminController {
+	return &AdminController{adminSvc: adminSvc, userSvc: userSvc, accountSvc: accountSvc, groupSvc: groupSvc, mod: mod, auditSvc: auditSvc, hub: hub}
+}
+
+// ListUsers searches users by email or ID (?q=, ?limit=, ?offset=).
+func (a *AdminController) ListUsers(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	users, total, err := a.adminSvc.SearchUsers(c.Query("q"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users, "total": total})
+}
+
+func (a *AdminController) GetUser(c *gin.Context) {
+	u, err := a.userSvc.GetByID(c.Param("id"))
+	if err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+// Suspend blocks the account and drops its live connections. Admins cannot
+// suspend themselves or each other, which could lock everyone out.
+func (a *AdminController) Suspend(c *gin.Context) {
+	var req suspendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	until, err := suspensionEnd(req.Hours)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	adminID, _ := uidVal.(string)
+	userID := c.Param("id")
+	if userID == adminID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot suspend yourself"})
+		return
+	}
+	target, err := a.userSvc.GetByID(userID)
+	if err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	if target.IsAdmin() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot suspend an admin"})
+		return
+	}
+	if err := a.userSvc.Suspend(userID, &until); err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	a.hub.DisconnectUser(userID)
+	recordAudit(c, a.auditSvc, entity.AuditEvent{
+		Action: entity.AuditUserSuspend, TargetType: "user", TargetID: userID,
+		Details: map[string]interface{}{"until": until, "source": "admin"},
+	})
+	c.JSON(http.StatusOK, gin.H{"suspended_until": until})
+}
+
+func (a *AdminController) Unsuspend(c *gin.Context) {
+	if err := a.userSvc.Suspend(c.Param("id"), nil); err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	recordAudit(c, a.auditSvc, entity.AuditEvent{Action: entity.AuditUserUnsuspend, TargetType: "user", TargetID: c.Param("id")})
+	c.JSON(http.StatusOK, gin.H{"status": "unsuspended"})
+}
+
+// ForceLogout invalidates every token issued to the user and closes their sockets.
+func (a *AdminController) ForceLogout(c *gin.Context) {
+	userID := c.Param("id")
+	if err := a.userSvc.RevokeTokens(userID); err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	a.hub.DisconnectUser(userID)
+	recordAudit(c, a.auditSvc, entity.AuditEvent{
+		Action: entity.AuditTokenRevoke, TargetType: "user", TargetID: userID,
+		Details: map[string]interface{}{"reason": "admin_logout"},
+	})
+	c.JSON(http.StatusOK, gin.H{"status": "logged_out"})
+}
+
+// ResetPassword logs the user out and emails them a password reset link.
+func (a *AdminController) ResetPassword(c *gin.Context) {
+	u, err := a.userSvc.GetByID(c.Param("id"))
+	if err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	if err := a.userSvc.RevokeTokens(u.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	a.hub.DisconnectUser(u.ID)
+	recordAudit(c, a.auditSvc, entity.AuditEvent{
+		Action: entity.AuditTokenRevoke, TargetType: "user", TargetID: u.ID,
+		Details: map[string]interface{}{"reason": "admin_password_reset"},
+	})
+	if err := a.accountSvc.RequestPasswordReset(u.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reset_sent"})
+}
+
+func (a *AdminController) SetRole(c *gin.Context) {
+	var req setRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.Role {
+	case entity.RoleUser, entity.RoleModerator, entity.RoleAdmin:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be user, moderator or admin"})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	adminID, _ := uidVal.(string)
+	if c.Param("id") == adminID && req.Role != entity.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot demote yourself"})
+		return
+	}
+	if err := a.userSvc.SetRole(c.Param("id"), req.Role); err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	recordAudit(c, a.auditSvc, entity.AuditEvent{
+		Action: entity.AuditUserRole, TargetType: "user", TargetID: c.Param("id"),
+		Details: map[string]interface{}{"role": req.Role},
+	})
+	c.JSON(http.StatusOK, gin.H{"role": req.Role})
+}
+
+// SetTwoFactorRequired forces (or stops forcing) 2FA enrollment at next login.
+func (a *AdminController) SetTwoFactorRequired(c *gin.Context) {
+	var req setTwoFactorRequiredRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.userSvc.SetTwoFactorRequired(c.Param("id"), req.Required); err != nil {
+		writeAdminUserError(c, err)
+		return
+	}
+	recordAudit(c, a.auditSvc, entity.AuditEvent{
+		Action: entity.AuditUserTwoFactorReq, TargetType: "user", TargetID: c.Param("id"),
+		Details: map[string]interface{}{"required": req.Required},
+	})
+	c.JSON(http.StatusOK, gin.H{"two_factor_required": req.Required})
+}
+
+// ListGroups lists groups by name (?q=, ?limit=, ?offset=).
+func (a *AdminController) ListGroups(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	groups, total, err := a.groupSvc.ListGroups(c.Query("q"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": groups, "total": total})
+}
+
+func (a *AdminController) DeleteGroup(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+		return
+	}
+	if err := a.groupSvc.DeleteGroup(uint(id)); err != nil {
+		if errors.Is(err, service.ErrGroupNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, a.auditSvc, entity.AuditEvent{Action: entity.AuditGroupDelete, TargetType: "group", TargetID: c.Param("id")})
+	c.Status(http.StatusNoContent)
+}
+
+// Stats reports user, group and message counts (?days=) plus live hub connections.
+func (a *AdminController) Stats(c *gin.Context) {
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "14"))
+	st, err := a.adminSvc.Stats(days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stats": st, "hub": a.hub.Stats()})
+}
+
+// ListGlobalRules returns the moderation rules applied to every group and DM.
+func (a *AdminController) ListGlobalRules(c *gin.Context) {
+	rules, err := a.mod.ListRules(0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (a *AdminController) CreateGlobalRule(c *gin.Context) {
+	var req createRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	rule := &entity.ModerationRule{Kind: req.Kind, Pattern: req.Pattern, Action: req.Action, CreatedBy: userID}
+	if err := a.mod.AddRule(rule); err != nil {
+		if errors.Is(err, service.ErrInvalidRule) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditRule(c, a.auditSvc, entity.AuditModerationRuleAdd, rule.GroupID, rule.ID)
+	c.JSON(http.StatusCreated, rule)
+}
+
+func (a *AdminController) DeleteGlobalRule(c *gin.Context) {
+	ruleID, err := strconv.ParseUint(c.Param("ruleID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+	if err := a.mod.DeleteRule(0, uint(ruleID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditRule(c, a.auditSvc, entity.AuditModerationRuleDel, 0, uint(ruleID))
+	c.Status(http.StatusNoContent)
+}
+
+func writeAdminUserError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -1,21 +1,32 @@
 package controller
 
 import (
+	"errors"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/abeme/go_sm_api/entity"
 	"github.com/abeme/go_sm_api/service"
 	"github.com/abeme/go_sm_api/utils"
+	"github.com/abeme/go_sm_api/ws"
 )
 
 type AuthController struct {
-	svc service.UserService
+	svc          service.UserService
+	accountSvc   service.AccountService
+	twoFactorSvc service.TwoFactorService
+	guard        *service.LoginGuard
+	auditSvc     service.AuditService
+	hub          *ws.Hub
 }
 
-func NewAuthController(svc service.UserService) *AuthController {
-	return &AuthController{svc: svc}
+func NewAuthController(svc service.UserService, accountSvc service.AccountService, twoFactorSvc service.TwoFactorService, guard *service.LoginGuard, auditSvc service.AuditService, hub *ws.Hub) *AuthController {
+	return &AuthController{svc: svc, accountSvc: accountSvc, twoFactorSvc: twoFactorSvc, guard: guard, auditSvc: auditSvc, hub: hub}
 }
 
 func (a *AuthController) SignUp(c *gin.Context) {
@@ -29,6 +40,9 @@ func (a *AuthController) SignUp(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := a.accountSvc.SendVerification(u); err != nil {
+		log.Printf("send verification email to %s failed: %v", u.Email, err)
+	}
 	c.JSON(http.StatusCreated, gin.H{"id": u.ID, "email": u.Email})
 }
 
@@ -38,17 +52,307 @@ func (a *AuthController) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	ctx := c.Request.Context()
+	if wait, err := a.guard.Check(ctx, req.Email, c.ClientIP()); err != nil {
+		log.Printf("login guard check failed: %v", err)
+	} else if wait > 0 {
+		a.auditFailure(c, req.Email, "", "locked_out")
+		tooManyAttempts(c, wait)
+		return
+	}
 	u, err := a.svc.Authenticate(req.Email, req.Password)
+	if errors.Is(err, service.ErrUserSuspended) {
+		a.auditFailure(c, req.Email, "", "suspended")
+		c.JSON(http.StatusForbidden, gin.H{"error": "account suspended"})
+		return
+	}
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidCreds) && a.recordFailure(c, req.Email, "", "invalid_credentials") {
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
-	token, err := utils.GenerateToken(u.ID, u.Email)
+	if !a.twoFactorSvc.IsRequired(u) {
+		if err := a.guard.Succeed(ctx, u.Email); err != nil {
+			log.Printf("login guard reset failed: %v", err)
+		}
+	}
+	respondLogin(c, a.twoFactorSvc, a.auditSvc, u, "password")
+}
+
+// recordFailure audits and counts a failed attempt. When that triggers a lockout
+// it writes the 429 response and returns true.
+func (a *AuthController) recordFailure(c *gin.Context, email, userID, reason string) bool {
+	wait, err := a.guard.Fail(c.Request.Context(), email, c.ClientIP())
+	if err != nil {
+		log.Printf("login guard record failed: %v", err)
+	}
+	if err != nil || wait <= 0 {
+		a.auditFailure(c, email, userID, reason)
+		return false
+	}
+	recordAudit(c, a.auditSvc, loginAuditEvent(entity.AuditLoginLocked, userID, map[string]interface{}{
+		"email": email, "reason": reason, "locked_for": int(math.Ceil(wait.Seconds())),
+	}))
+	tooManyAttempts(c, wait)
+	return true
+}
+
+func (a *AuthController) auditFailure(c *gin.Context, email, userID, reason string) {
+	recordAudit(c, a.auditSvc, loginAuditEvent(entity.AuditLoginFailure, userID, map[string]interface{}{"email": email, "reason": reason}))
+}
+
+// loginAuditEvent builds a login event; the target is only known once the email
+// has been matched to an account.
+func loginAuditEvent(action, userID string, details map[string]interface{}) entity.AuditEvent {
+	e := entity.AuditEvent{Action: action, Details: details}
+	if userID != "" {
+		e.TargetType, e.TargetID = "user", userID
+	}
+	return e
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed login attempts", "retry_after": secs})
+}
+
+// respondLogin finishes a successful first-factor login. With 2FA the caller only
+// earns a challenge; the JWT is then issued by LoginTwoFactor.
+func respondLogin(c *gin.Context, twoFactorSvc service.TwoFactorService, auditSvc service.AuditService, u *entity.User, method string) {
+	if twoFactorSvc.IsRequired(u) {
+		challenge, err := utils.GenerateChallengeToken(u.ID, utils.PurposeTwoFactor, u.TokenVersion)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"enrolled":            u.TOTPEnabled,
+			"challenge_token":     challenge,
+		})
+		return
+	}
+	token, err := utils.GenerateToken(u.ID, u.Email, u.TokenVersion)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
+	auditLogin(c, auditSvc, u, method)
 	c.JSON(http.StatusOK, gin.H{"token": token})
 }
 
+func auditLogin(c *gin.Context, auditSvc service.AuditService, u *entity.User, method string) {
+	recordAudit(c, auditSvc, entity.AuditEvent{
+		Action:     entity.AuditLoginSuccess,
+		ActorID:    u.ID,
+		TargetType: "user",
+		TargetID:   u.ID,
+		Details:    map[string]interface{}{"method": method},
+	})
+}
+
+// LoginTwoFactor completes a login started by Login. Users who have not enrolled yet
+// (because 2FA is enforced) confirm their first code here and receive recovery codes.
+func (a *AuthController) LoginTwoFactor(c *gin.Context) {
+	var req entity.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, ok := a.challengeUser(c, req.ChallengeToken)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if wait, err := a.guard.Check(ctx, u.Email, c.ClientIP()); err != nil {
+		log.Printf("login guard check failed: %v", err)
+	} else if wait > 0 {
+		a.auditFailure(c, u.Email, u.ID, "locked_out")
+		tooManyAttempts(c, wait)
+		return
+	}
+	resp := gin.H{}
+	var err error
+	if u.TOTPEnabled {
+		err = a.twoFactorSvc.Verify(u.ID, req.Code)
+	} else {
+		var codes []string
+		codes, err = a.twoFactorSvc.Confirm(u.ID, req.Code)
+		resp["recovery_codes"] = codes
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidTwoFactorCode) && a.recordFailure(c, u.Email, u.ID, "invalid_2fa_code") {
+			return
+		}
+		writeTwoFactorError(c, err)
+		return
+	}
+	if err := a.guard.Succeed(ctx, u.Email); err != nil {
+		log.Printf("login guard reset failed: %v", err)
+	}
+	token, err := utils.GenerateToken(u.ID, u.Email, u.TokenVersion)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	if !u.TOTPEnabled {
+		recordAudit(c, a.auditSvc, entity.AuditEvent{Action: entity.AuditTwoFactorEnable, ActorID: u.ID, TargetType: "user", TargetID: u.ID})
+	}
+	auditLogin(c, a.auditSvc, u, "password+totp")
+	resp["token"] = token
+	c.JSON(http.StatusOK, resp)
+}
+
+// challengeUser resolves the user behind a 2FA challenge token and re-checks
+// what may have changed since the password step; it writes the error response
+// itself and returns false when the login must not go on.
+func (a *AuthController) challengeUser(c *gin.Context, challenge string) (*entity.User, bool) {
+	claims, err := utils.ValidateChallengeToken(challenge, utils.PurposeTwoFactor)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge token"})
+		return nil, false
+	}
+	u, err := a.svc.GetByID(claims.Subject)
+	if err != nil || claims.Version != u.TokenVersion {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge token"})
+		return nil, false
+	}
+	if u.IsSuspended(time.Now()) {
+		a.auditFailure(c, u.Email, u.ID, "suspended")
+		c.JSON(http.StatusForbidden, gin.H{"error": "account suspended"})
+		return nil, false
+	}
+	return u, true
+}
+
+// LoginTwoFactorEnroll starts enrollment for a user whose login requires 2FA
+// but who has not set it up yet.
+func (a *AuthController) LoginTwoFactorEnroll(c *gin.Context) {
+	var req entity.TwoFactorEnrollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, ok := a.challengeUser(c, req.ChallengeToken)
+	if !ok {
+		return
+	}
+	secret, uri, err := a.twoFactorSvc.Enroll(u.ID)
+	if err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+// VerifyEmail consumes a verification token sent at signup.
+func (a *AuthController) VerifyEmail(c *gin.Context) {
+	var req entity.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := a.accountSvc.VerifyEmail(req.Token)
+	if err != nil {
+		a.writeTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": u.ID, "email": u.Email, "email_verified": u.EmailVerified})
+}
+
+// ResendVerification sends a fresh verification email to the authenticated user.
+func (a *AuthController) ResendVerification(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	u, err := a.svc.GetByID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.accountSvc.SendVerification(u); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send verification email"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"sent": !u.EmailVerified})
+}
+
+// ForgotPassword emails a reset link. It always answers 202 so it cannot be used to probe accounts.
+func (a *AuthController) ForgotPassword(c *gin.Context) {
+	var req entity.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.accountSvc.RequestPasswordReset(req.Email); err != nil {
+		log.Printf("password reset for %s failed: %v", req.Email, err)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "if the account exists, a reset email has been sent"})
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword.
+func (a *AuthController) ResetPassword(c *gin.Context) {
+	var req entity.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := a.accountSvc.ResetPassword(req.Token, req.Password)
+	if err != nil {
+		a.writeTokenError(c, err)
+		return
+	}
+	// the reset revoked every token, so close the sockets opened with them
+	a.hub.DisconnectUser(u.ID)
+	recordAudit(c, a.auditSvc, entity.AuditEvent{Action: entity.AuditPasswordReset, ActorID: u.ID, TargetType: "user", TargetID: u.ID})
+	// proving control of the mailbox lifts any lockout
+	if err := a.guard.Unlock(c.Request.Context(), u.Email); err != nil {
+		log.Printf("login guard unlock failed: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"reset": true})
+}
+
+// ChangePassword updates the authenticated user's password.
+func (a *AuthController) ChangePassword(c *gin.Context) {
+	var req entity.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := a.svc.ChangePassword(userID, req.CurrentPassword, req.NewPassword); err != nil {
+		if errors.Is(err, service.ErrInvalidCreds) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	a.hub.DisconnectUser(userID)
+	recordAudit(c, a.auditSvc, entity.AuditEvent{Action: entity.AuditPasswordChange, TargetType: "user", TargetID: userID})
+	// changing the password revoked every session, including this one
+	u, err := a.svc.GetByID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token, err := utils.GenerateToken(u.ID, u.Email, u.TokenVersion)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": true, "token": token})
+}
+
+func (a *AuthController) writeTokenError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
 // ...existing code...
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// BotController manages the caller's bots and the API tokens of the caller
+// and their bots. Token plaintext is only returned when a token is created.
+type BotController struct {
+	botSvc   service.BotService
+	auditSvc service.AuditService
+	hub      *ws.Hub
+}
+
+func NewBotController(botSvc service.BotService, auditSvc service.AuditService, hub *ws.Hub) *BotController {
+	return &BotController{botSvc: botSvc, auditSvc: auditSvc, hub: hub}
+}
+
+func (b *BotController) ListBots(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	bots, err := b.botSvc.ListBots(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"bots": bots})
+}
+
+func (b *BotController) CreateBot(c *gin.Context) {
+	var req entity.CreateBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	bot, err := b.botSvc.CreateBot(userID, req.Name, req.Handle)
+	if err != nil {
+		writeBotError(c, err)
+		return
+	}
+	recordAudit(c, b.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditBotCreate,
+		TargetType: "user",
+		TargetID:   bot.ID,
+		Details:    map[string]interface{}{"handle": bot.Handle},
+	})
+	c.JSON(http.StatusCreated, bot)
+}
+
+// DeactivateBot revokes the bot's tokens, removes it from its groups and
+// closes its connections.
+func (b *BotController) DeactivateBot(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	botID := c.Param("id")
+	if err := b.botSvc.DeactivateBot(userID, botID); err != nil {
+		writeBotError(c, err)
+		return
+	}
+	b.hub.DisconnectUser(botID)
+	recordAudit(c, b.auditSvc, entity.AuditEvent{Action: entity.AuditBotDeactivate, TargetType: "user", TargetID: botID})
+	c.Status(http.StatusNoContent)
+}
+
+// tokenOwner resolves whose tokens a request manages: the bot in :id when
+// present (it must belong to the caller), otherwise the caller.
+func (b *BotController) tokenOwner(c *gin.Context) (string, bool) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	botID := c.Param("id")
+	if botID == "" {
+		return userID, true
+	}
+	if _, err := b.botSvc.GetBot(userID, botID); err != nil {
+		writeBotError(c, err)
+		return "", false
+	}
+	return botID, true
+}
+
+func (b *BotController) ListTokens(c *gin.Context) {
+	ownerID, ok := b.tokenOwner(c)
+	if !ok {
+		return
+	}
+	toks, err := b.botSvc.ListTokens(ownerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": toks})
+}
+
+func (b *BotController) CreateToken(c *gin.Context) {
+	ownerID, ok := b.tokenOwner(c)
+	if !ok {
+		return
+	}
+	var req entity.CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	raw, tok, err := b.botSvc.CreateToken(ownerID, req.Name, req.Scopes, ttl)
+	if err != nil {
+		writeBotError(c, err)
+		return
+	}
+	recordAudit(c, b.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditAPITokenCreate,
+		TargetType: "user",
+		TargetID:   ownerID,
+		Details:    map[string]interface{}{"token_id": tok.ID, "scopes": tok.Scopes},
+	})
+	c.JSON(http.StatusCreated, gin.H{"token": raw, "api_token": tok})
+}
+
+func (b *BotController) RevokeToken(c *gin.Context) {
+	ownerID, ok := b.tokenOwner(c)
+	if !ok {
+		return
+	}
+	tokenID, err := strconv.ParseUint(c.Param("tokenID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+	if err := b.botSvc.RevokeToken(ownerID, uint(tokenID)); err != nil {
+		writeBotError(c, err)
+		return
+	}
+	if c.Param("id") != "" {
+		// the bot reconnects with its remaining tokens, if any
+		b.hub.DisconnectUser(ownerID)
+	}
+	recordAudit(c, b.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditTokenRevoke,
+		TargetType: "user",
+		TargetID:   ownerID,
+		Details:    map[string]interface{}{"token_id": tokenID},
+	})
+	c.Status(http.StatusNoContent)
+}
+
+func writeBotError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrBotNotFound), errors.Is(err, service.ErrAPITokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInvalidHandle), errors.Is(err, service.ErrInvalidScope),
+		errors.Is(err, service.ErrInvalidTokenTTL):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrHandleTaken), errors.Is(err, service.ErrTooManyBots):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// ChannelController manages the channels of a group under
+// /api/groups/:id/channels; their messages go through MessageController.
+// Changes are sent to the channel's readers as events.
+type ChannelController struct {
+	svc service.ChannelService
+	hub *ws.Hub
+}
+
+func NewChannelController(svc service.ChannelService, hub *ws.Hub) *ChannelController {
+	return &ChannelController{svc: svc, hub: hub}
+}
+
+func (ch *ChannelController) List(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	channels, err := ch.svc.List(userID, groupID)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"channels": channels})
+}
+
+// Create adds a channel; only the group owner may.
+func (ch *ChannelController) Create(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	var req entity.CreateChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	channel, err := ch.svc.Create(userID, groupID, req)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	ch.send(channel.GroupID, channel.ID, map[string]interface{}{"type": "channel_created", "channel": channel})
+	c.JSON(http.StatusCreated, channel)
+}
+
+func (ch *ChannelController) Get(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	channel, err := ch.svc.Get(userID, groupID, channelID)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, channel)
+}
+
+// Update changes the name, topic or post policy of a channel.
+func (ch *ChannelController) Update(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	var req entity.UpdateChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	channel, err := ch.svc.Update(userID, groupID, channelID, req)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	ch.send(groupID, channelID, map[string]interface{}{"type": "channel_updated", "channel": channel, "by": userID})
+	c.JSON(http.StatusOK, channel)
+}
+
+// Delete removes a channel with its messages. Its readers are looked up
+// first, as the channel is gone by the time the event is fanned out.
+func (ch *ChannelController) Delete(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	members, _ := ch.svc.Members(userID, groupID, channelID)
+	if err := ch.svc.Delete(userID, groupID, channelID); err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	if b, err := json.Marshal(map[string]interface{}{"type": "channel_deleted", "groupId": groupID, "channelId": channelID}); err == nil {
+		for _, id := range members {
+			ch.hub.SendToUser(id, b)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+func (ch *ChannelController) Members(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	members, err := ch.svc.Members(userID, groupID, channelID)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// AddMembers lets group members into a restricted channel; its readers, the
+// new ones included, get a "channel_members_added" event.
+func (ch *ChannelController) AddMembers(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	var req entity.ChannelMembersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	added, err := ch.svc.AddMembers(userID, groupID, channelID, req.UserIDs)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	if len(added) > 0 {
+		ids := make([]string, 0, len(added))
+		for _, m := range added {
+			ids = append(ids, m.UserID)
+		}
+		ch.send(groupID, channelID, map[string]interface{}{
+			"type":      "channel_members_added",
+			"groupId":   groupID,
+			"channelId": channelID,
+			"userIds":   ids,
+			"by":        userID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// RemoveMember takes a member out of a restricted channel; the remaining
+// readers and the removed member get a "channel_member_removed" event.
+func (ch *ChannelController) RemoveMember(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	memberID := c.Param("userID")
+	removed, err := ch.svc.RemoveMember(userID, groupID, channelID, memberID)
+	if err != nil {
+		writeChannelError(c, err)
+		return
+	}
+	if removed {
+		evt := map[string]interface{}{
+			"type":      "channel_member_removed",
+			"groupId":   groupID,
+			"channelId": channelID,
+			"userId":    memberID,
+			"by":        userID,
+		}
+		ch.send(groupID, channelID, evt)
+		if b, err := json.Marshal(evt); err == nil {
+			ch.hub.SendToUser(memberID, b)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+func (ch *ChannelController) send(groupID, channelID uint, evt map[string]interface{}) {
+	if b, err := json.Marshal(evt); err == nil {
+		ch.hub.SendToChannel(groupID, channelID, b)
+	}
+}
+
+func parseChannelID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("channelID"), 10, 64)
+	if err != nil || id64 == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid channel id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func parseChannelParams(c *gin.Context) (uint, uint, bool) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return 0, 0, false
+	}
+	channelID, ok := parseChannelID(c)
+	return groupID, channelID, ok
+}
+
+func writeChannelError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrChannelNameRequired), errors.Is(err, service.ErrChannelNotRestricted):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrChannelForbidden), errors.Is(err, service.ErrNotGroupMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrChannelNotFound), errors.Is(err, service.ErrGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrChannelExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
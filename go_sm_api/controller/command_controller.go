@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// CommandController lets bots register slash commands and lets clients list
+// the commands available in a conversation.
+type CommandController struct {
+	cmdSvc   service.CommandService
+	commands *ws.Commands
+	groupSvc *service.GroupService
+}
+
+func NewCommandController(cmdSvc service.CommandService, commands *ws.Commands, groupSvc *service.GroupService) *CommandController {
+	return &CommandController{cmdSvc: cmdSvc, commands: commands, groupSvc: groupSvc}
+}
+
+// botID returns the calling bot, writing a 403 for human users.
+func botID(c *gin.Context) (string, bool) {
+	val, _ := c.Get("user")
+	u, _ := val.(*entity.User)
+	if u == nil || !u.IsBot {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only bots can register commands"})
+		return "", false
+	}
+	return u.ID, true
+}
+
+// Register creates or updates a command; the signing secret is only returned
+// when the command is created.
+func (cc *CommandController) Register(c *gin.Context) {
+	id, ok := botID(c)
+	if !ok {
+		return
+	}
+	var req entity.RegisterCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cmd, secret, err := cc.cmdSvc.Register(id, req)
+	if err != nil {
+		writeCommandError(c, err)
+		return
+	}
+	if secret == "" {
+		c.JSON(http.StatusOK, gin.H{"command": cmd})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"command": cmd, "secret": secret})
+}
+
+func (cc *CommandController) List(c *gin.Context) {
+	id, ok := botID(c)
+	if !ok {
+		return
+	}
+	cmds, err := cc.cmdSvc.List(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": cmds})
+}
+
+func (cc *CommandController) Delete(c *gin.Context) {
+	id, ok := botID(c)
+	if !ok {
+		return
+	}
+	if err := cc.cmdSvc.Delete(id, c.Param("name")); err != nil {
+		writeCommandError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Available lists the built-in and bot commands usable in a group
+// (?group_id=) or in a private chat (?user_id=).
+func (cc *CommandController) Available(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	var groupID uint
+	if raw := c.Query("group_id"); raw != "" {
+		id64, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+			return
+		}
+		groupID = uint(id64)
+		if member, err := cc.groupSvc.IsMember(groupID, userID); err != nil || !member {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a member of this group"})
+			return
+		}
+	}
+	cmds, err := cc.commands.Available(groupID, c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": cmds})
+}
+
+func writeCommandError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrCommandNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInvalidCommandName), errors.Is(err, service.ErrInvalidWebhookURL),
+		errors.Is(err, service.ErrPrivateWebhookURL):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
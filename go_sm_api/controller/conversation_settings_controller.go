@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// ConversationSettingsController serves the inbox and the caller's
+// per-conversation settings. Changes are sent to all of the caller's devices
+// as a "conversation_settings" event.
+type ConversationSettingsController struct {
+	svc service.ConversationSettingsService
+	hub *ws.Hub
+}
+
+func NewConversationSettingsController(svc service.ConversationSettingsService, hub *ws.Hub) *ConversationSettingsController {
+	return &ConversationSettingsController{svc: svc, hub: hub}
+}
+
+// Inbox lists the caller's conversations; ?archived=true lists the archived ones.
+func (s *ConversationSettingsController) Inbox(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	entries, err := s.svc.Inbox(userID, c.Query("archived") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": entries})
+}
+
+func (s *ConversationSettingsController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	settings, err := s.svc.List(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
+
+func (s *ConversationSettingsController) GetPrivate(c *gin.Context) {
+	s.get(c, "private:"+c.Param("otherUserID"))
+}
+
+func (s *ConversationSettingsController) UpdatePrivate(c *gin.Context) {
+	s.update(c, "private:"+c.Param("otherUserID"))
+}
+
+func (s *ConversationSettingsController) GetGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	s.get(c, "group:"+strconv.FormatUint(uint64(groupID), 10))
+}
+
+func (s *ConversationSettingsController) UpdateGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	s.update(c, "group:"+strconv.FormatUint(uint64(groupID), 10))
+}
+
+func (s *ConversationSettingsController) GetGroupDM(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	s.get(c, "group_dm:"+strconv.FormatUint(uint64(id), 10))
+}
+
+func (s *ConversationSettingsController) UpdateGroupDM(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	s.update(c, "group_dm:"+strconv.FormatUint(uint64(id), 10))
+}
+
+func (s *ConversationSettingsController) get(c *gin.Context, conversation string) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	st, err := s.svc.Get(userID, conversation)
+	if err != nil {
+		writeConversationSettingsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+func (s *ConversationSettingsController) update(c *gin.Context, conversation string) {
+	var req entity.UpdateConversationSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	st, err := s.svc.Update(userID, conversation, req)
+	if err != nil {
+		writeConversationSettingsError(c, err)
+		return
+	}
+	if b, err := json.Marshal(map[string]interface{}{"type": "conversation_settings", "settings": st}); err == nil {
+		s.hub.SendToUser(userID, b)
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+func writeConversationSettingsError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidRecipient):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrNotGroupMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrUserNotFound), errors.Is(err, service.ErrGroupNotFound), errors.Is(err, service.ErrGroupDMNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
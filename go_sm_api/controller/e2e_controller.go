@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// E2EController publishes device keys for end-to-end encrypted DMs, hands
+// out pre-key bundles and switches E2E mode per conversation.
+type E2EController struct {
+	svc service.E2EService
+	hub *ws.Hub
+}
+
+func NewE2EController(svc service.E2EService, hub *ws.Hub) *E2EController {
+	return &E2EController{svc: svc, hub: hub}
+}
+
+// ListDevices returns the caller's devices with their remaining one-time
+// pre-key counts, so clients know when to upload more.
+func (e *E2EController) ListDevices(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	devices, err := e.svc.ListDevices(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+func (e *E2EController) RegisterDevice(c *gin.Context) {
+	var req entity.RegisterDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	dev, err := e.svc.RegisterDevice(userID, c.Param("deviceID"), req)
+	if err != nil {
+		writeE2EError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, dev)
+}
+
+func (e *E2EController) DeleteDevice(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := e.svc.DeleteDevice(userID, c.Param("deviceID")); err != nil {
+		writeE2EError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (e *E2EController) UploadPreKeys(c *gin.Context) {
+	var req entity.UploadPreKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	total, err := e.svc.UploadPreKeys(userID, c.Param("deviceID"), req.PreKeys)
+	if err != nil {
+		writeE2EError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"one_time_pre_keys": total})
+}
+
+// Bundles is a POST because every call uses up one-time pre-keys.
+func (e *E2EController) Bundles(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	bundles, err := e.svc.Bundles(userID, c.Param("userID"))
+	if err != nil {
+		writeE2EError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"bundles": bundles})
+}
+
+func (e *E2EController) GetMode(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	enabled, err := e.svc.Enabled(userID, c.Param("otherUserID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled})
+}
+
+// SetMode turns E2E on or off and tells both participants with an
+// "e2e_mode" event, so neither can be downgraded silently.
+func (e *E2EController) SetMode(c *gin.Context) {
+	var req entity.SetE2ERequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	otherID := c.Param("otherUserID")
+	if err := e.svc.SetEnabled(userID, otherID, req.Enabled); err != nil {
+		writeE2EError(c, err)
+		return
+	}
+	evt := map[string]interface{}{"type": "e2e_mode", "enabled": req.Enabled, "by": userID}
+	evt["with"] = otherID
+	if b, err := json.Marshal(evt); err == nil {
+		e.hub.SendToUser(userID, b)
+	}
+	evt["with"] = userID
+	if b, err := json.Marshal(evt); err == nil {
+		e.hub.SendToUser(otherID, b)
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": req.Enabled})
+}
+
+func writeE2EError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidKey), errors.Is(err, service.ErrInvalidDeviceID), errors.Is(err, service.ErrInvalidRecipient):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrDeviceNotFound), errors.Is(err, service.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrTooManyDevices), errors.Is(err, service.ErrTooManyPreKeys), errors.Is(err, service.ErrNoDevices):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
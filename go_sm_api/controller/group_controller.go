@@ -2,9 +2,12 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 
+	"github.com/abeme/go_sm_api/entity"
 	"github.com/abeme/go_sm_api/service"
 	"github.com/abeme/go_sm_api/ws"
 	"github.com/gin-gonic/gin"
@@ -15,12 +18,13 @@ type CreateGroupRequest struct {
 }
 
 type GroupController struct {
-	svc *service.GroupService
-	hub *ws.Hub
+	svc      *service.GroupService
+	notifSvc service.NotificationService
+	hub      *ws.Hub
 }
 
-func NewGroupController(svc *service.GroupService, hub *ws.Hub) *GroupController {
-	return &GroupController{svc: svc, hub: hub}
+func NewGroupController(svc *service.GroupService, notifSvc service.NotificationService, hub *ws.Hub) *GroupController {
+	return &GroupController{svc: svc, notifSvc: notifSvc, hub: hub}
 }
 
 func (g *GroupController) Create(c *gin.Context) {
@@ -49,6 +53,10 @@ func (g *GroupController) Join(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 	uidStr, _ := userID.(string)
 	if err := g.svc.JoinGroup(uint(id64), uidStr); err != nil {
+		if errors.Is(err, service.ErrBannedFromGroup) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -61,3 +69,100 @@ func (g *GroupController) Join(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"joined": true})
 }
+
+// Invite lets a member invite another user; the invitee gets a notification.
+func (g *GroupController) Invite(c *gin.Context) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+		return
+	}
+	var req entity.GroupInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	uidStr, _ := userID.(string)
+	inv, err := g.svc.Invite(uint(id64), uidStr, req.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotGroupMember), errors.Is(err, service.ErrBannedFromGroup):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrAlreadyMember):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	var snippet string
+	if grp, err := g.svc.GetGroup(inv.GroupID); err == nil {
+		snippet = grp.Name
+	}
+	n := &entity.Notification{
+		UserID:   inv.InviteeID,
+		Kind:     entity.NotifyGroupInvite,
+		ActorID:  uidStr,
+		GroupID:  inv.GroupID,
+		InviteID: inv.ID,
+		Snippet:  snippet,
+	}
+	if created, err := g.notifSvc.Create(n); err != nil {
+		log.Printf("group invite notification: %v", err)
+	} else if created && g.hub != nil {
+		g.hub.PushNotifications([]entity.Notification{*n})
+	}
+	c.JSON(http.StatusCreated, inv)
+}
+
+// ListInvites returns the authenticated user's pending group invites.
+func (g *GroupController) ListInvites(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	uidStr, _ := userID.(string)
+	invites, err := g.svc.ListInvites(uidStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invites": invites})
+}
+
+func (g *GroupController) AcceptInvite(c *gin.Context) {
+	g.respondInvite(c, true)
+}
+
+func (g *GroupController) DeclineInvite(c *gin.Context) {
+	g.respondInvite(c, false)
+}
+
+func (g *GroupController) respondInvite(c *gin.Context, accept bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invite id"})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	uidStr, _ := userID.(string)
+	inv, err := g.svc.RespondInvite(uint(id64), uidStr, accept)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInviteNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrBannedFromGroup):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if accept && g.hub != nil {
+		evt := map[string]interface{}{"type": "group_join", "groupId": inv.GroupID, "userId": uidStr}
+		if b, err := json.Marshal(evt); err == nil {
+			g.hub.SendToGroup(inv.GroupID, b)
+		}
+	}
+	c.JSON(http.StatusOK, inv)
+}
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// GroupDMController manages ad-hoc group DMs under /api/group-dms; messages
+// are sent through MessageController. Changes to a conversation are sent to
+// every participant as events.
+type GroupDMController struct {
+	svc service.GroupDMService
+	hub *ws.Hub
+}
+
+func NewGroupDMController(svc service.GroupDMService, hub *ws.Hub) *GroupDMController {
+	return &GroupDMController{svc: svc, hub: hub}
+}
+
+func (g *GroupDMController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	dms, err := g.svc.List(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"group_dms": dms})
+}
+
+// Create starts a group DM with the listed users and the caller.
+func (g *GroupDMController) Create(c *gin.Context) {
+	var req entity.CreateGroupDMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	dm, err := g.svc.Create(userID, req.UserIDs, req.Name)
+	if err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	g.send(participantIDs(dm.Participants), map[string]interface{}{"type": "group_dm_created", "groupDm": dm})
+	c.JSON(http.StatusCreated, dm)
+}
+
+func (g *GroupDMController) Get(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	dm, err := g.svc.Get(userID, id)
+	if err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, dm)
+}
+
+func (g *GroupDMController) Rename(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	var req entity.RenameGroupDMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	dm, err := g.svc.Rename(userID, id, req.Name)
+	if err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	g.send(participantIDs(dm.Participants), map[string]interface{}{
+		"type":      "group_dm_renamed",
+		"groupDmId": id,
+		"name":      dm.Name,
+		"by":        userID,
+	})
+	c.JSON(http.StatusOK, dm)
+}
+
+// AddParticipants adds users to the conversation; every participant, the new
+// ones included, gets a "group_dm_participants_added" event.
+func (g *GroupDMController) AddParticipants(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	var req entity.AddGroupDMParticipantsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	added, err := g.svc.AddParticipants(userID, id, req.UserIDs)
+	if err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	if len(added) > 0 {
+		if participants, err := g.svc.Participants(id); err == nil {
+			g.send(participants, map[string]interface{}{
+				"type":      "group_dm_participants_added",
+				"groupDmId": id,
+				"userIds":   participantIDs(added),
+				"by":        userID,
+			})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// Leave removes the caller; the remaining participants and the caller's
+// other devices get a "group_dm_participant_left" event.
+func (g *GroupDMController) Leave(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := g.svc.Leave(userID, id); err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	participants, _ := g.svc.Participants(id)
+	g.send(append(participants, userID), map[string]interface{}{
+		"type":      "group_dm_participant_left",
+		"groupDmId": id,
+		"userId":    userID,
+	})
+	c.JSON(http.StatusOK, gin.H{"left": true})
+}
+
+// Messages returns a page of messages (?limit=, ?before=) to participants.
+func (g *GroupDMController) Messages(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	before, _ := strconv.ParseUint(c.DefaultQuery("before", "0"), 10, 64)
+	msgs, err := g.svc.Messages(userID, id, limit, uint(before))
+	if err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": msgs})
+}
+
+// MarkRead moves the caller's read position and sends every participant a
+// "group_dm_read" receipt.
+func (g *GroupDMController) MarkRead(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	var req entity.MarkGroupDMReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	updated, err := g.svc.MarkRead(userID, id, req.LastReadID)
+	if err != nil {
+		writeGroupDMError(c, err)
+		return
+	}
+	if updated {
+		if participants, err := g.svc.Participants(id); err == nil {
+			g.send(participants, map[string]interface{}{
+				"type":       "group_dm_read",
+				"groupDmId":  id,
+				"userId":     userID,
+				"lastReadId": req.LastReadID,
+				"ts":         time.Now().Unix(),
+			})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"updated": updated})
+}
+
+func (g *GroupDMController) send(userIDs []string, evt map[string]interface{}) {
+	b, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	for _, userID := range userIDs {
+		g.hub.SendToUser(userID, b)
+	}
+}
+
+func participantIDs(parts []entity.GroupDMParticipant) []string {
+	ids := make([]string, 0, len(parts))
+	for _, p := range parts {
+		ids = append(ids, p.UserID)
+	}
+	return ids
+}
+
+func parseGroupDMID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group DM id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func writeGroupDMError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrGroupDMSize):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrGroupDMNotFound), errors.Is(err, service.ErrUserNotFound), errors.Is(err, service.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
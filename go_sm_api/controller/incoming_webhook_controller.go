@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// IncomingWebhookController lets group owners create secret URLs that post
+// into the group, and serves those URLs.
+type IncomingWebhookController struct {
+	botSvc   service.BotService
+	groupSvc *service.GroupService
+	sender   *ws.Sender
+	limiter  *service.RateLimiter
+	auditSvc service.AuditService
+	baseURL  string
+}
+
+func NewIncomingWebhookController(botSvc service.BotService, groupSvc *service.GroupService, sender *ws.Sender, limiter *service.RateLimiter, auditSvc service.AuditService, baseURL string) *IncomingWebhookController {
+	return &IncomingWebhookController{botSvc: botSvc, groupSvc: groupSvc, sender: sender, limiter: limiter, auditSvc: auditSvc, baseURL: baseURL}
+}
+
+// ownedGroup parses :id and checks the caller owns the group.
+func (i *IncomingWebhookController) ownedGroup(c *gin.Context) (uint, bool) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return 0, false
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	grp, err := i.groupSvc.GetGroup(groupID)
+	if err != nil || grp.OwnerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the group owner can manage incoming webhooks"})
+		return 0, false
+	}
+	return groupID, true
+}
+
+// Create returns the webhook URL; like API tokens it is only shown once.
+func (i *IncomingWebhookController) Create(c *gin.Context) {
+	groupID, ok := i.ownedGroup(c)
+	if !ok {
+		return
+	}
+	var req entity.CreateIncomingWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	raw, hook, err := i.botSvc.CreateIncomingWebhook(groupID, userID, req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, i.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditIncomingHookAdd,
+		TargetType: "group",
+		TargetID:   strconv.FormatUint(uint64(groupID), 10),
+		Details:    map[string]interface{}{"incoming_webhook_id": hook.ID, "bot_id": hook.BotID},
+	})
+	c.JSON(http.StatusCreated, gin.H{"url": i.baseURL + "/hooks/incoming/" + raw, "incoming_webhook": hook})
+}
+
+func (i *IncomingWebhookController) List(c *gin.Context) {
+	groupID, ok := i.ownedGroup(c)
+	if !ok {
+		return
+	}
+	hooks, err := i.botSvc.ListIncomingWebhooks(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"incoming_webhooks": hooks})
+}
+
+func (i *IncomingWebhookController) Delete(c *gin.Context) {
+	groupID, ok := i.ownedGroup(c)
+	if !ok {
+		return
+	}
+	hookID, err := strconv.ParseUint(c.Param("hookID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+		return
+	}
+	if err := i.botSvc.DeleteIncomingWebhook(groupID, uint(hookID)); err != nil {
+		if errors.Is(err, service.ErrIncomingWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, i.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditIncomingHookDel,
+		TargetType: "group",
+		TargetID:   strconv.FormatUint(uint64(groupID), 10),
+		Details:    map[string]interface{}{"incoming_webhook_id": hookID},
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// Post is the public endpoint behind a webhook URL. It takes {"body": ...}
+// or {"text": ...} and posts it to the group as the webhook's bot.
+func (i *IncomingWebhookController) Post(c *gin.Context) {
+	hook, err := i.botSvc.ResolveIncomingWebhook(c.Param("token"))
+	if err != nil {
+		if errors.Is(err, service.ErrIncomingWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var req entity.IncomingWebhookMessage
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	body := req.Body
+	if body == "" {
+		body = req.Text
+	}
+	msg := ws.Outgoing{Kind: "group", SenderID: hook.BotID, GroupID: hook.GroupID, Body: body}
+	if !allowSend(c, i.limiter, msg) {
+		return
+	}
+	sent, err := i.sender.Send(msg)
+	if err != nil {
+		writeSendError(c, err)
+		return
+	}
+	_ = i.sender.Deliver(context.Background(), sent)
+	c.JSON(http.StatusOK, gin.H{"ok": true, "id": sent.Ack(msg, "")["id"]})
+}
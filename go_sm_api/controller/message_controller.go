@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// MessageController sends and lists messages over REST, for bots and scripts
+// that do not hold a WebSocket open. Sends go through the same ws.Sender as
+// socket frames.
+type MessageController struct {
+	sender   *ws.Sender
+	groupSvc *service.GroupService
+	gmSvc    service.GroupMessageService
+	limiter  *service.RateLimiter
+}
+
+func NewMessageController(sender *ws.Sender, groupSvc *service.GroupService, gmSvc service.GroupMessageService, limiter *service.RateLimiter) *MessageController {
+	return &MessageController{sender: sender, groupSvc: groupSvc, gmSvc: gmSvc, limiter: limiter}
+}
+
+// SendPrivate sends a DM; the response is the private_ack event.
+func (m *MessageController) SendPrivate(c *gin.Context) {
+	var req entity.SendPrivateMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m.send(c, ws.Outgoing{Kind: "private", SenderID: userID, To: req.To, Body: req.Body, Envelope: req.Envelope})
+}
+
+// SendGroup posts to a group the caller belongs to; the response is the group_ack event.
+func (m *MessageController) SendGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	var req entity.SendGroupMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m.send(c, ws.Outgoing{Kind: "group", SenderID: userID, GroupID: groupID, Body: req.Body, ReplyTo: req.ReplyTo})
+}
+
+// SendChannel posts to a channel of a group; the response is the group_ack event.
+func (m *MessageController) SendChannel(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	var req entity.SendGroupMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m.send(c, ws.Outgoing{Kind: "group", SenderID: userID, GroupID: groupID, ChannelID: channelID, Body: req.Body, ReplyTo: req.ReplyTo})
+}
+
+// SendGroupDM posts to a group DM the caller is in; the response is the group_dm_ack event.
+func (m *MessageController) SendGroupDM(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	var req entity.SendGroupDMMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m.send(c, ws.Outgoing{Kind: "group_dm", SenderID: userID, GroupDMID: id, Body: req.Body})
+}
+
+func (m *MessageController) send(c *gin.Context, msg ws.Outgoing) {
+	if !allowSend(c, m.limiter, msg) {
+		return
+	}
+	sent, err := m.sender.Send(msg)
+	if err != nil {
+		writeSendError(c, err)
+		return
+	}
+	if err := m.sender.Deliver(context.Background(), sent); err != nil {
+		// stored but not fanned out; clients will see it on their next fetch
+		c.JSON(http.StatusAccepted, sent.Ack(msg, ""))
+		return
+	}
+	c.JSON(http.StatusCreated, sent.Ack(msg, ""))
+}
+
+// Forward copies messages into a DM or group; the response lists the ack of
+// every copy, as the forward_ack event does.
+func (m *MessageController) Forward(c *gin.Context) {
+	var req entity.ForwardRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.To == "") == (req.GroupID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "set exactly one of to and group_id"})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	dest := ws.Outgoing{Kind: "private", SenderID: userID, To: req.To}
+	if req.GroupID != 0 {
+		dest = ws.Outgoing{Kind: "group", SenderID: userID, GroupID: req.GroupID, ChannelID: req.ChannelID}
+	}
+	if !allowAction(c, m.limiter, service.ActionForward, userID) {
+		return
+	}
+	sents, err := m.sender.Forward(dest, req.Messages)
+	for _, sent := range sents {
+		_ = m.sender.Deliver(context.Background(), sent)
+	}
+	if err != nil {
+		writeSendError(c, err)
+		return
+	}
+	acks := make([]map[string]interface{}, 0, len(sents))
+	for _, sent := range sents {
+		acks = append(acks, sent.Ack(dest, ""))
+	}
+	c.JSON(http.StatusCreated, gin.H{"messages": acks})
+}
+
+// ListGroup returns a page of the group's default channel (?limit=, ?before=) to members.
+func (m *MessageController) ListGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	m.list(c, groupID, 0)
+}
+
+// ListChannel returns a page of a channel's messages to those who can read it.
+func (m *MessageController) ListChannel(c *gin.Context) {
+	groupID, channelID, ok := parseChannelParams(c)
+	if !ok {
+		return
+	}
+	m.list(c, groupID, channelID)
+}
+
+func (m *MessageController) list(c *gin.Context, groupID, channelID uint) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if member, err := m.groupSvc.IsChannelMember(groupID, channelID, userID); err != nil || !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not a member of this channel"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	before, _ := strconv.ParseUint(c.DefaultQuery("before", "0"), 10, 64)
+	msgs, err := m.gmSvc.List(groupID, channelID, userID, limit, uint(before))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": msgs})
+}
+
+// allowSend charges a REST send to the same bucket as the equivalent socket
+// frame, writing a 429 when it is empty.
+func allowSend(c *gin.Context, limiter *service.RateLimiter, msg ws.Outgoing) bool {
+	return allowAction(c, limiter, msg.Kind, msg.SenderID)
+}
+
+// allowAction takes a token from the user's bucket for action.
+func allowAction(c *gin.Context, limiter *service.RateLimiter, action, userID string) bool {
+	if limiter == nil {
+		return true
+	}
+	ok, wait := limiter.Allow(c.Request.Context(), action, userID)
+	if !ok {
+		secs := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(secs))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limited", "retry_after": secs})
+	}
+	return ok
+}
+
+func parseGroupID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+// writeSendError maps ws.Sender errors to HTTP responses.
+func writeSendError(c *gin.Context, err error) {
+	var rejected *ws.RejectedError
+	switch {
+	case errors.As(err, &rejected):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": rejected.Error(), "reasons": rejected.Reasons})
+	case errors.Is(err, ws.ErrMissingFields), errors.Is(err, ws.ErrTooManyMessages), errors.Is(err, service.ErrInvalidReply),
+		errors.Is(err, service.ErrInvalidEnvelope), errors.Is(err, service.ErrCannotForward):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrMessageNotFound), errors.Is(err, service.ErrChannelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrE2ERequired):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ws.ErrNotMember), errors.Is(err, service.ErrBlocked), errors.Is(err, service.ErrMemberMuted),
+		errors.Is(err, service.ErrChannelReadOnly):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
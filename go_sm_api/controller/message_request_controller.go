@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+type MessageRequestController struct {
+	reqSvc service.MessageRequestService
+	hub    *ws.Hub
+}
+
+func NewMessageRequestController(reqSvc service.MessageRequestService, hub *ws.Hub) *MessageRequestController {
+	return &MessageRequestController{reqSvc: reqSvc, hub: hub}
+}
+
+// List returns the authenticated user's message requests (pending unless ?status= is given).
+func (m *MessageRequestController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	reqs, err := m.reqSvc.List(userID, c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": reqs})
+}
+
+// Accept moves the conversation with :senderID into the normal inbox.
+func (m *MessageRequestController) Accept(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	senderID := c.Param("senderID")
+	if err := m.reqSvc.Accept(userID, senderID); err != nil {
+		m.writeError(c, err)
+		return
+	}
+	if m.hub != nil {
+		evt := map[string]interface{}{
+			"type": "message_request_accepted",
+			"from": userID,
+			"ts":   time.Now().Unix(),
+		}
+		if b, err := json.Marshal(evt); err == nil {
+			m.hub.SendToUser(senderID, b)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"accepted": true})
+}
+
+// Ignore hides the request from :senderID without telling them.
+func (m *MessageRequestController) Ignore(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := m.reqSvc.Ignore(userID, c.Param("senderID")); err != nil {
+		m.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ignored": true})
+}
+
+// Decline declines the request from :senderID and blocks them.
+func (m *MessageRequestController) Decline(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := m.reqSvc.DeclineAndBlock(userID, c.Param("senderID")); err != nil {
+		m.writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"declined": true, "blocked": true})
+}
+
+func (m *MessageRequestController) writeError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrMessageRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// MessageTTLController reads and changes the disappearing-messages setting
+// of DMs, groups and group DMs. Any DM or group DM participant may change it;
+// in groups only the owner may.
+type MessageTTLController struct {
+	svc        service.MessageTTLService
+	groupSvc   *service.GroupService
+	groupDMSvc service.GroupDMService
+	hub        *ws.Hub
+}
+
+func NewMessageTTLController(svc service.MessageTTLService, groupSvc *service.GroupService, groupDMSvc service.GroupDMService, hub *ws.Hub) *MessageTTLController {
+	return &MessageTTLController{svc: svc, groupSvc: groupSvc, groupDMSvc: groupDMSvc, hub: hub}
+}
+
+func (m *MessageTTLController) GetPrivate(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	ttl, err := m.svc.PrivateTTL(userID, c.Param("otherUserID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl_seconds": int64(ttl / time.Second)})
+}
+
+func (m *MessageTTLController) SetPrivate(c *gin.Context) {
+	var req entity.SetMessageTTLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	otherID := c.Param("otherUserID")
+	if err := m.svc.SetPrivateTTL(userID, otherID, time.Duration(req.TTLSeconds)*time.Second); err != nil {
+		writeTTLError(c, err)
+		return
+	}
+	evt := map[string]interface{}{"type": "message_ttl", "kind": "private", "ttl": req.TTLSeconds, "by": userID}
+	evt["with"] = otherID
+	if b, err := json.Marshal(evt); err == nil {
+		m.hub.SendToUser(userID, b)
+	}
+	evt["with"] = userID
+	if b, err := json.Marshal(evt); err == nil {
+		m.hub.SendToUser(otherID, b)
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl_seconds": req.TTLSeconds})
+}
+
+func (m *MessageTTLController) GetGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if member, err := m.groupSvc.IsMember(groupID, userID); err != nil || !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not a member of this group"})
+		return
+	}
+	ttl, err := m.svc.GroupTTL(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl_seconds": int64(ttl / time.Second)})
+}
+
+func (m *MessageTTLController) SetGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	var req entity.SetMessageTTLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	grp, err := m.groupSvc.GetGroup(groupID)
+	if err != nil {
+		writeTTLError(c, err)
+		return
+	}
+	if grp.OwnerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the group owner can change disappearing messages"})
+		return
+	}
+	if err := m.svc.SetGroupTTL(groupID, time.Duration(req.TTLSeconds)*time.Second); err != nil {
+		writeTTLError(c, err)
+		return
+	}
+	evt := map[string]interface{}{"type": "message_ttl", "kind": "group", "groupId": groupID, "ttl": req.TTLSeconds, "by": userID}
+	if b, err := json.Marshal(evt); err == nil {
+		m.hub.SendToGroup(groupID, b)
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl_seconds": req.TTLSeconds})
+}
+
+func (m *MessageTTLController) GetGroupDM(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if in, err := m.groupDMSvc.IsParticipant(id, userID); err != nil || !in {
+		c.JSON(http.StatusNotFound, gin.H{"error": service.ErrGroupDMNotFound.Error()})
+		return
+	}
+	ttl, err := m.svc.GroupDMTTL(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl_seconds": int64(ttl / time.Second)})
+}
+
+func (m *MessageTTLController) SetGroupDM(c *gin.Context) {
+	id, ok := parseGroupDMID(c)
+	if !ok {
+		return
+	}
+	var req entity.SetMessageTTLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if in, err := m.groupDMSvc.IsParticipant(id, userID); err != nil || !in {
+		c.JSON(http.StatusNotFound, gin.H{"error": service.ErrGroupDMNotFound.Error()})
+		return
+	}
+	if err := m.svc.SetGroupDMTTL(id, time.Duration(req.TTLSeconds)*time.Second); err != nil {
+		writeTTLError(c, err)
+		return
+	}
+	participants, err := m.groupDMSvc.Participants(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	evt := map[string]interface{}{"type": "message_ttl", "kind": "group_dm", "groupDmId": id, "ttl": req.TTLSeconds, "by": userID}
+	if b, err := json.Marshal(evt); err == nil {
+		for _, p := range participants {
+			m.hub.SendToUser(p, b)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"ttl_seconds": req.TTLSeconds})
+}
+
+func writeTTLError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidTTL), errors.Is(err, service.ErrInvalidRecipient):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrUserNotFound), errors.Is(err, service.ErrGroupNotFound), errors.Is(err, service.ErrGroupDMNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
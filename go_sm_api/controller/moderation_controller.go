@@ -0,0 +1,276 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+type createRuleRequest struct {
+	Kind    string `json:"kind" binding:"required"`
+	Pattern string `json:"pattern" binding:"required"`
+	Action  string `json:"action" binding:"required"`
+}
+
+type moderationSettingsRequest struct {
+	MaxLength  int    `json:"max_length"`
+	SpamAction string `json:"spam_action"`
+}
+
+// ModerationController lets group owners manage moderation rules and review held
+// messages; platform moderators can review held messages of any conversation.
+type ModerationController struct {
+	mod      *service.Moderator
+	groupSvc *service.GroupService
+	sender   *ws.Sender
+	auditSvc service.AuditService
+}
+
+func NewModerationController(mod *service.Moderator, groupSvc *service.GroupService, sender *ws.Sender, auditSvc service.AuditService) *ModerationController {
+	return &ModerationController{mod: mod, groupSvc: groupSvc, sender: sender, auditSvc: auditSvc}
+}
+
+// ownedGroup parses :id and checks the caller owns the group, writing the error response otherwise.
+func (m *ModerationController) ownedGroup(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group id"})
+		return 0, false
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if !m.canModerateGroup(uint(id64), userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the group owner can moderate this group"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func (m *ModerationController) canModerateGroup(groupID uint, userID string) bool {
+	grp, err := m.groupSvc.GetGroup(groupID)
+	return err == nil && grp.OwnerID == userID
+}
+
+func (m *ModerationController) ListRules(c *gin.Context) {
+	groupID, ok := m.ownedGroup(c)
+	if !ok {
+		return
+	}
+	rules, err := m.mod.ListRules(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (m *ModerationController) CreateRule(c *gin.Context) {
+	groupID, ok := m.ownedGroup(c)
+	if !ok {
+		return
+	}
+	var req createRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	rule := &entity.ModerationRule{GroupID: groupID, Kind: req.Kind, Pattern: req.Pattern, Action: req.Action, CreatedBy: userID}
+	if err := m.mod.AddRule(rule); err != nil {
+		if errors.Is(err, service.ErrInvalidRule) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditRule(c, m.auditSvc, entity.AuditModerationRuleAdd, groupID, rule.ID)
+	c.JSON(http.StatusCreated, rule)
+}
+
+func (m *ModerationController) DeleteRule(c *gin.Context) {
+	groupID, ok := m.ownedGroup(c)
+	if !ok {
+		return
+	}
+	ruleID, err := strconv.ParseUint(c.Param("ruleID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+	if err := m.mod.DeleteRule(groupID, uint(ruleID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditRule(c, m.auditSvc, entity.AuditModerationRuleDel, groupID, uint(ruleID))
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+func (m *ModerationController) GetSettings(c *gin.Context) {
+	groupID, ok := m.ownedGroup(c)
+	if !ok {
+		return
+	}
+	st, err := m.mod.GetSettings(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+func (m *ModerationController) UpdateSettings(c *gin.Context) {
+	groupID, ok := m.ownedGroup(c)
+	if !ok {
+		return
+	}
+	var req moderationSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	st := &entity.GroupModerationSettings{GroupID: groupID, MaxLength: req.MaxLength, SpamAction: req.SpamAction}
+	if err := m.mod.SaveSettings(st); err != nil {
+		if errors.Is(err, service.ErrInvalidRule) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// ListHeld returns the group's review queue (?status= defaults to pending).
+func (m *ModerationController) ListHeld(c *gin.Context) {
+	groupID, ok := m.ownedGroup(c)
+	if !ok {
+		return
+	}
+	held, err := m.mod.ListHeld("group", groupID, c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"held": held})
+}
+
+// ListHeldPrivate returns held direct messages for platform moderators;
+// ?kind=group_dm lists held group DM messages instead.
+func (m *ModerationController) ListHeldPrivate(c *gin.Context) {
+	kind := c.DefaultQuery("kind", "private")
+	if kind != "private" && kind != "group_dm" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be private or group_dm"})
+		return
+	}
+	held, err := m.mod.ListHeld(kind, 0, c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"held": held})
+}
+
+func (m *ModerationController) Approve(c *gin.Context) {
+	m.review(c, true)
+}
+
+func (m *ModerationController) Reject(c *gin.Context) {
+	m.review(c, false)
+}
+
+// review resolves a held message; approved messages are stored and delivered as
+// if they had just been sent.
+func (m *ModerationController) review(c *gin.Context, approve bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	held, err := m.mod.GetHeld(uint(id64))
+	if err != nil {
+		writeHeldError(c, err)
+		return
+	}
+	userVal, _ := c.Get("user")
+	u, _ := userVal.(*entity.User)
+	platformMod := u != nil && u.IsModerator()
+	if !platformMod && (held.Kind != "group" || !m.canModerateGroup(held.GroupID, userID)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to review this message"})
+		return
+	}
+	held, err = m.mod.Review(held.ID, userID, approve)
+	if err != nil {
+		writeHeldError(c, err)
+		return
+	}
+	recordAudit(c, m.auditSvc, entity.AuditEvent{
+		Action: entity.AuditHeldReview, TargetType: "held_message", TargetID: strconv.FormatUint(uint64(held.ID), 10),
+		Details: map[string]interface{}{"status": held.Status, "sender_id": held.SenderID, "group_id": held.GroupID},
+	})
+	if !approve {
+		c.JSON(http.StatusOK, gin.H{"held": held})
+		return
+	}
+	if err := m.deliver(held); err != nil {
+		if ws.IsTransientSendError(err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// e.g. the sender was removed or blocked while the message waited
+		c.JSON(http.StatusConflict, gin.H{"error": "the sender can no longer send this message", "reason": err.Error(), "held": held})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"held": held})
+}
+
+// deliver sends an approved message through the Sender, so membership,
+// bans, blocks and channel post policies are checked again as of now.
+func (m *ModerationController) deliver(held *entity.HeldMessage) error {
+	sent, err := m.sender.Send(ws.Outgoing{
+		Kind:      held.Kind,
+		SenderID:  held.SenderID,
+		To:        held.RecipientID,
+		GroupID:   held.GroupID,
+		ChannelID: held.ChannelID,
+		GroupDMID: held.GroupDMID,
+		Body:      held.Body,
+		ReplyTo:   held.ReplyToID,
+		Forward:   held.ForwardedFrom,
+		Approved:  true,
+	})
+	if err != nil {
+		return err
+	}
+	// stored but not fanned out; clients will see it on their next fetch
+	_ = m.sender.Deliver(context.Background(), sent)
+	return nil
+}
+
+// auditRule records a moderation rule change; groupID 0 means a global rule.
+func auditRule(c *gin.Context, auditSvc service.AuditService, action string, groupID, ruleID uint) {
+	recordAudit(c, auditSvc, entity.AuditEvent{
+		Action: action, TargetType: "moderation_rule", TargetID: strconv.FormatUint(uint64(ruleID), 10),
+		Details: map[string]interface{}{"group_id": groupID},
+	})
+}
+
+func writeHeldError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrHeldNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrHeldAlreadyReview):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
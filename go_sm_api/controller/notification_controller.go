@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationController struct {
+	svc service.NotificationService
+}
+
+func NewNotificationController(svc service.NotificationService) *NotificationController {
+	return &NotificationController{svc: svc}
+}
+
+// List returns the user's notifications, newest first (?unread=true, ?before=<id>, ?limit=),
+// together with the unread count.
+func (n *NotificationController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	before, _ := strconv.ParseUint(c.DefaultQuery("before", "0"), 10, 64)
+	notes, err := n.svc.List(userID, c.Query("unread") == "true", limit, uint(before))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	unread, err := n.svc.UnreadCount(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notifications": notes, "unread": unread})
+}
+
+// MarkRead marks the given notifications (or all, with an empty body) as read.
+func (n *NotificationController) MarkRead(c *gin.Context) {
+	var req entity.MarkNotificationsReadRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	updated, err := n.svc.MarkRead(userID, req.IDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"updated": updated})
+}
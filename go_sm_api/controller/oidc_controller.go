@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// OIDCController handles single sign-on through external OpenID Connect providers.
+type OIDCController struct {
+	svc          service.OIDCService
+	twoFactorSvc service.TwoFactorService
+	auditSvc     service.AuditService
+}
+
+func NewOIDCController(svc service.OIDCService, twoFactorSvc service.TwoFactorService, auditSvc service.AuditService) *OIDCController {
+	return &OIDCController{svc: svc, twoFactorSvc: twoFactorSvc, auditSvc: auditSvc}
+}
+
+// Providers lists the configured provider names.
+func (o *OIDCController) Providers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": o.svc.Providers()})
+}
+
+// Login returns the authorization URL the client should open for :provider.
+func (o *OIDCController) Login(c *gin.Context) {
+	authURL, err := o.svc.AuthURL(c.Param("provider"))
+	if errors.Is(err, service.ErrUnknownProvider) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("oidc login %s: %v", c.Param("provider"), err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// Callback exchanges the authorization code and logs the user in.
+func (o *OIDCController) Callback(c *gin.Context) {
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": e, "description": c.Query("error_description")})
+		return
+	}
+	u, err := o.svc.Exchange(c.Param("provider"), c.Query("state"), c.Query("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrUnknownProvider):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrInvalidOIDCState), errors.Is(err, service.ErrOIDCEmailRequired):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			log.Printf("oidc callback %s: %v", c.Param("provider"), err)
+			recordAudit(c, o.auditSvc, entity.AuditEvent{
+				Action:  entity.AuditLoginFailure,
+				Details: map[string]interface{}{"method": "oidc:" + c.Param("provider"), "reason": "exchange_failed"},
+			})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "single sign-on failed"})
+		}
+		return
+	}
+	if u.IsSuspended(time.Now()) {
+		recordAudit(c, o.auditSvc, loginAuditEvent(entity.AuditLoginFailure, u.ID, map[string]interface{}{
+			"email": u.Email, "method": "oidc:" + c.Param("provider"), "reason": "suspended",
+		}))
+		c.JSON(http.StatusForbidden, gin.H{"error": "account suspended"})
+		return
+	}
+	respondLogin(c, o.twoFactorSvc, o.auditSvc, u, "oidc:"+c.Param("provider"))
+}
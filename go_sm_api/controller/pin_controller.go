@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// PinController pins messages to groups and DMs and tells the conversation
+// with "pin" and "unpin" events.
+type PinController struct {
+	svc service.PinService
+	hub *ws.Hub
+}
+
+func NewPinController(svc service.PinService, hub *ws.Hub) *PinController {
+	return &PinController{svc: svc, hub: hub}
+}
+
+func (p *PinController) GroupPins(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	pins, err := p.svc.GroupPins(userID, groupID)
+	if err != nil {
+		writePinError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pins": pins})
+}
+
+func (p *PinController) PinGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	messageID, ok := parseMessageID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	pin, added, err := p.svc.PinGroup(userID, groupID, messageID)
+	if err != nil {
+		writePinError(c, err)
+		return
+	}
+	if added {
+		p.sendGroup(pin, "pin", userID)
+	}
+	c.JSON(http.StatusOK, pin)
+}
+
+func (p *PinController) UnpinGroup(c *gin.Context) {
+	groupID, ok := parseGroupID(c)
+	if !ok {
+		return
+	}
+	messageID, ok := parseMessageID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	pin, err := p.svc.UnpinGroup(userID, groupID, messageID)
+	if err != nil {
+		writePinError(c, err)
+		return
+	}
+	if pin != nil {
+		p.sendGroup(pin, "unpin", userID)
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": pin != nil})
+}
+
+func (p *PinController) PrivatePins(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	pins, err := p.svc.PrivatePins(userID, c.Param("otherUserID"))
+	if err != nil {
+		writePinError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pins": pins})
+}
+
+func (p *PinController) PinPrivate(c *gin.Context) {
+	messageID, ok := parseMessageID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	otherID := c.Param("otherUserID")
+	pin, added, err := p.svc.PinPrivate(userID, otherID, messageID)
+	if err != nil {
+		writePinError(c, err)
+		return
+	}
+	if added {
+		p.sendPrivate(userID, otherID, "pin", messageID)
+	}
+	c.JSON(http.StatusOK, pin)
+}
+
+func (p *PinController) UnpinPrivate(c *gin.Context) {
+	messageID, ok := parseMessageID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	otherID := c.Param("otherUserID")
+	removed, err := p.svc.UnpinPrivate(userID, otherID, messageID)
+	if err != nil {
+		writePinError(c, err)
+		return
+	}
+	if removed {
+		p.sendPrivate(userID, otherID, "unpin", messageID)
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// sendGroup tells the readers of the pinned message's channel.
+func (p *PinController) sendGroup(pin *entity.PinnedMessage, typ string, userID string) {
+	evt := map[string]interface{}{
+		"type":      typ,
+		"kind":      "group",
+		"groupId":   pin.GroupID,
+		"messageId": pin.MessageID,
+		"by":        userID,
+		"ts":        time.Now().Unix(),
+	}
+	if pin.ChannelID != 0 {
+		evt["channelId"] = pin.ChannelID
+	}
+	if b, err := json.Marshal(evt); err == nil {
+		p.hub.SendToChannel(pin.GroupID, pin.ChannelID, b)
+	}
+}
+
+func (p *PinController) sendPrivate(userID, otherID, typ string, messageID uint) {
+	evt := map[string]interface{}{
+		"type":      typ,
+		"kind":      "private",
+		"messageId": messageID,
+		"by":        userID,
+		"ts":        time.Now().Unix(),
+	}
+	evt["with"] = otherID
+	if b, err := json.Marshal(evt); err == nil {
+		p.hub.SendToUser(userID, b)
+	}
+	evt["with"] = userID
+	if b, err := json.Marshal(evt); err == nil {
+		p.hub.SendToUser(otherID, b)
+	}
+}
+
+func parseMessageID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("messageID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid message id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func writePinError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrPinForbidden), errors.Is(err, service.ErrNotGroupMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrMessageNotFound), errors.Is(err, service.ErrGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrTooManyPins):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
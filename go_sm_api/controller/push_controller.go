@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// PushController manages the caller's Web Push subscriptions.
+type PushController struct {
+	svc service.PushService
+}
+
+func NewPushController(svc service.PushService) *PushController {
+	return &PushController{svc: svc}
+}
+
+// PublicKey returns the VAPID key browsers pass as applicationServerKey.
+func (p *PushController) PublicKey(c *gin.Context) {
+	key := p.svc.PublicKey()
+	if key == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": service.ErrPushDisabled.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"public_key": key})
+}
+
+func (p *PushController) Subscribe(c *gin.Context) {
+	var req entity.PushSubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	sub, err := p.svc.Subscribe(userID, c.Request.UserAgent(), req)
+	if err != nil {
+		writePushError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, sub)
+}
+
+func (p *PushController) Unsubscribe(c *gin.Context) {
+	var req entity.PushUnsubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := p.svc.Unsubscribe(userID, req.Endpoint); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (p *PushController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	subs, err := p.svc.ListSubscriptions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+// Test queues a push to all of the caller's devices right away.
+func (p *PushController) Test(c *gin.Context) {
+	if p.svc.PublicKey() == "" {
+		writePushError(c, service.ErrPushDisabled)
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	subs, err := p.svc.ListSubscriptions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(subs) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "no push subscriptions registered"})
+		return
+	}
+	msg := service.PushMessage{Kind: "test", Title: "Test notification", Body: "Push notifications are working."}
+	if err := p.svc.Enqueue(userID, msg, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"queued": true})
+}
+
+func writePushError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrPushDisabled):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, utils.ErrInvalidSubscription), errors.Is(err, utils.ErrPushPayloadTooLarge), errors.Is(err, service.ErrInvalidPushEndpoint):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
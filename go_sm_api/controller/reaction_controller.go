@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// ReactionController manages emoji reactions on messages under
+// /api/reactions/:kind/:id, where kind is "private" or "group".
+type ReactionController struct {
+	svc      service.ReactionService
+	notifSvc service.NotificationService
+	hub      *ws.Hub
+}
+
+func NewReactionController(svc service.ReactionService, notifSvc service.NotificationService, hub *ws.Hub) *ReactionController {
+	return &ReactionController{svc: svc, notifSvc: notifSvc, hub: hub}
+}
+
+func (r *ReactionController) List(c *gin.Context) {
+	t, ok := r.target(c)
+	if !ok {
+		return
+	}
+	counts, err := r.svc.List(t)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reactions": counts})
+}
+
+// Add reacts to the message and notifies its author.
+func (r *ReactionController) Add(c *gin.Context) {
+	t, ok := r.target(c)
+	if !ok {
+		return
+	}
+	var req entity.ReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	added, err := r.svc.Add(userID, t, req.Emoji)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidEmoji) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if added {
+		r.broadcast(t, userID, req.Emoji, "add")
+		if t.SenderID != userID {
+			n := &entity.Notification{
+				UserID:      t.SenderID,
+				Kind:        entity.NotifyReaction,
+				ActorID:     userID,
+				GroupID:     t.GroupID,
+				ChannelID:   t.ChannelID,
+				MessageKind: t.Kind,
+				MessageID:   t.MessageID,
+				Emoji:       req.Emoji,
+				Snippet:     service.Snippet(t.Body),
+			}
+			if created, err := r.notifSvc.Create(n); err != nil {
+				log.Printf("reaction notification: %v", err)
+			} else if created {
+				r.hub.PushNotifications([]entity.Notification{*n})
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+func (r *ReactionController) Remove(c *gin.Context) {
+	t, ok := r.target(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	emoji := c.Param("emoji")
+	removed, err := r.svc.Remove(userID, t, emoji)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if removed {
+		r.broadcast(t, userID, emoji, "remove")
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// target resolves :kind/:id to a message the caller can see, writing a 404 otherwise.
+func (r *ReactionController) target(c *gin.Context) (*service.ReactionTarget, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid message id"})
+		return nil, false
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	t, err := r.svc.Target(userID, c.Param("kind"), uint(id))
+	if err != nil {
+		if errors.Is(err, service.ErrMessageNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return t, true
+}
+
+// broadcast tells everyone who can see the message about the change.
+func (r *ReactionController) broadcast(t *service.ReactionTarget, userID, emoji, action string) {
+	evt := map[string]interface{}{
+		"type":      "reaction",
+		"action":    action,
+		"kind":      t.Kind,
+		"messageId": t.MessageID,
+		"userId":    userID,
+		"emoji":     emoji,
+		"ts":        time.Now().Unix(),
+	}
+	if t.Kind == "group" {
+		evt["groupId"] = t.GroupID
+		if t.ChannelID != 0 {
+			evt["channelId"] = t.ChannelID
+		}
+	}
+	b, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	if t.Kind == "group" {
+		if err := r.hub.PublishGroup(context.Background(), ws.GroupTopic(t.GroupID, t.ChannelID), string(b)); err != nil {
+			r.hub.SendToChannel(t.GroupID, t.ChannelID, b)
+		}
+		return
+	}
+	r.hub.SendToUser(t.SenderID, b)
+	r.hub.SendToUser(t.RecipientID, b)
+}
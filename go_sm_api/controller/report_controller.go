@@ -0,0 +1,299 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/ws"
+	"github.com/gin-gonic/gin"
+)
+
+// indefiniteSuspension is used when a moderator suspends without an end date.
+const indefiniteSuspension = 100 * 365 * 24 * time.Hour
+
+// maxSuspensionHours caps suspensions with an end date at ten years, well
+// short of overflowing a time.Duration; longer ones should be indefinite.
+const maxSuspensionHours = 10 * 365 * 24
+
+var errSuspensionHours = errors.New("suspension must end in the future and within ten years")
+
+// suspensionEnd returns when a suspension of hours ends; 0 means indefinite.
+func suspensionEnd(hours int) (time.Time, error) {
+	if hours < 0 || hours > maxSuspensionHours {
+		return time.Time{}, errSuspensionHours
+	}
+	d := indefiniteSuspension
+	if hours > 0 {
+		d = time.Duration(hours) * time.Hour
+	}
+	now := time.Now()
+	until := now.Add(d)
+	if !until.After(now) {
+		return time.Time{}, errSuspensionHours
+	}
+	return until, nil
+}
+
+type ReportController struct {
+	reportSvc service.ReportService
+	userSvc   service.UserService
+	groupSvc  *service.GroupService
+	pmSvc     service.PrivateMessageService
+	gmSvc     service.GroupMessageService
+	auditSvc  service.AuditService
+	hub       *ws.Hub
+}
+
+func NewReportController(reportSvc service.ReportService, userSvc service.UserService, groupSvc *service.GroupService, pmSvc service.PrivateMessageService, gmSvc service.GroupMessageService, auditSvc service.AuditService, hub *ws.Hub) *ReportController {
+	return &ReportController{reportSvc: reportSvc, userSvc: userSvc, groupSvc: groupSvc, pmSvc: pmSvc, gmSvc: gmSvc, auditSvc: auditSvc, hub: hub}
+}
+
+// Create files a report against a message, user or group.
+func (r *ReportController) Create(c *gin.Context) {
+	var req entity.CreateReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	report, err := r.reportSvc.Create(userID, req)
+	if err != nil {
+		if errors.Is(err, service.ErrReportTarget) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, report)
+}
+
+// ListMine returns the reports filed by the authenticated user.
+func (r *ReportController) ListMine(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	reports, err := r.reportSvc.ListByReporter(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+// List returns the moderator queue (?status=open|in_review|resolved|dismissed, ?after=<id>).
+func (r *ReportController) List(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	after, _ := strconv.ParseUint(c.DefaultQuery("after", "0"), 10, 64)
+	reports, err := r.reportSvc.List(c.Query("status"), limit, uint(after))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+func (r *ReportController) Get(c *gin.Context) {
+	id, ok := parseReportID(c)
+	if !ok {
+		return
+	}
+	report, err := r.reportSvc.Get(id)
+	if err != nil {
+		writeReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// Claim assigns an open report to the calling moderator.
+func (r *ReportController) Claim(c *gin.Context) {
+	id, ok := parseReportID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	moderatorID, _ := uidVal.(string)
+	report, err := r.reportSvc.Claim(id, moderatorID)
+	if err != nil {
+		writeReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// Resolve closes the report, carries out the moderator's action and notifies the reporter.
+func (r *ReportController) Resolve(c *gin.Context) {
+	id, ok := parseReportID(c)
+	if !ok {
+		return
+	}
+	var req entity.ResolveReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	moderatorID, _ := uidVal.(string)
+	if req.Status != entity.ReportResolved {
+		req.Action = entity.ReportActionNone
+	}
+	// closing first makes sure only one moderator carries out an action
+	report, err := r.reportSvc.Close(id, moderatorID, req.Status, req.Action, req.Note)
+	if err != nil {
+		writeReportError(c, err)
+		return
+	}
+	if err := r.applyAction(c, report, req, moderatorID); err != nil {
+		if rerr := r.reportSvc.Reopen(id, moderatorID); rerr != nil {
+			log.Printf("report %d: reopen after failed action: %v", id, rerr)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, r.auditSvc, entity.AuditEvent{
+		Action: entity.AuditReportClose, TargetType: "report", TargetID: strconv.FormatUint(uint64(report.ID), 10),
+		Details: map[string]interface{}{"status": report.Status, "action": req.Action},
+	})
+	if r.hub != nil {
+		evt := map[string]interface{}{
+			"type":       "report_resolved",
+			"reportId":   report.ID,
+			"status":     report.Status,
+			"resolution": report.Resolution,
+			"ts":         time.Now().Unix(),
+		}
+		if b, err := json.Marshal(evt); err == nil {
+			r.hub.SendToUser(report.ReporterID, b)
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (r *ReportController) applyAction(c *gin.Context, report *entity.Report, req entity.ResolveReportRequest, moderatorID string) error {
+	details := map[string]interface{}{"report_id": report.ID}
+	switch req.Action {
+	case "", entity.ReportActionNone:
+		return nil
+	case entity.ReportActionDeleteMessage:
+		if report.TargetType != entity.ReportTargetMessage {
+			return errors.New("report does not target a message")
+		}
+		msgID, _ := strconv.ParseUint(report.TargetID, 10, 64)
+		if err := r.deleteMessage(report.MessageKind, uint(msgID)); err != nil {
+			return err
+		}
+		details["kind"] = report.MessageKind
+		details["sender_id"] = report.ReportedUserID
+		recordAudit(c, r.auditSvc, entity.AuditEvent{Action: entity.AuditMessageDelete, TargetType: "message", TargetID: report.TargetID, Details: details})
+		return nil
+	case entity.ReportActionSuspendUser:
+		if report.ReportedUserID == "" {
+			return errors.New("report has no user to suspend")
+		}
+		until, err := suspensionEnd(req.SuspendHours)
+		if err != nil {
+			return err
+		}
+		target, err := r.userSvc.GetByID(report.ReportedUserID)
+		if err != nil {
+			return err
+		}
+		val, _ := c.Get("user")
+		if caller, _ := val.(*entity.User); caller == nil || !caller.Outranks(target) {
+			return errors.New("cannot suspend a user whose role is at or above yours")
+		}
+		if err := r.userSvc.Suspend(report.ReportedUserID, &until); err != nil {
+			return err
+		}
+		r.hub.DisconnectUser(report.ReportedUserID)
+		details["until"] = until
+		recordAudit(c, r.auditSvc, entity.AuditEvent{Action: entity.AuditUserSuspend, TargetType: "user", TargetID: report.ReportedUserID, Details: details})
+		return nil
+	case entity.ReportActionBanFromGroup:
+		if report.GroupID == 0 || report.ReportedUserID == "" {
+			return errors.New("report has no group member to ban")
+		}
+		if grp, err := r.groupSvc.GetGroup(report.GroupID); err == nil && grp.OwnerID == report.ReportedUserID {
+			return errors.New("cannot ban the group owner")
+		}
+		if err := r.groupSvc.BanMember(report.GroupID, report.ReportedUserID, moderatorID, report.Reason); err != nil {
+			return err
+		}
+		evt := map[string]interface{}{"type": "group_ban", "groupId": report.GroupID, "userId": report.ReportedUserID}
+		if b, err := json.Marshal(evt); err == nil {
+			r.hub.SendToGroup(report.GroupID, b)
+			r.hub.SendToUser(report.ReportedUserID, b)
+		}
+		details["group_id"] = report.GroupID
+		recordAudit(c, r.auditSvc, entity.AuditEvent{Action: entity.AuditGroupBan, TargetType: "user", TargetID: report.ReportedUserID, Details: details})
+		return nil
+	}
+	return errors.New("unknown action")
+}
+
+// deleteMessage removes a message and tells the clients that hold a copy.
+func (r *ReportController) deleteMessage(kind string, id uint) error {
+	evt := map[string]interface{}{"type": "message_deleted", "kind": kind, "id": id}
+	switch kind {
+	case "private":
+		pm, err := r.pmSvc.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := r.pmSvc.Delete(id); err != nil {
+			return err
+		}
+		if b, err := json.Marshal(evt); err == nil {
+			r.hub.SendToUser(pm.SenderID, b)
+			r.hub.SendToUser(pm.RecipientID, b)
+		}
+	case "group":
+		gm, err := r.gmSvc.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := r.gmSvc.Delete(id); err != nil {
+			return err
+		}
+		evt["groupId"] = gm.GroupID
+		if gm.ChannelID != 0 {
+			evt["channelId"] = gm.ChannelID
+		}
+		if b, err := json.Marshal(evt); err == nil {
+			if err := r.hub.PublishGroup(context.Background(), ws.GroupTopic(gm.GroupID, gm.ChannelID), string(b)); err != nil {
+				log.Printf("publish message_deleted: %v", err)
+			}
+		}
+	default:
+		return errors.New("unknown message kind")
+	}
+	return nil
+}
+
+func parseReportID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func writeReportError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrReportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrReportNotClaimable), errors.Is(err, service.ErrReportClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// RetentionController serves the message retention admin API under
+// /admin/retention: rules, a dry-run report, manual purges and metrics.
+type RetentionController struct {
+	svc      service.RetentionService
+	auditSvc service.AuditService
+}
+
+func NewRetentionController(svc service.RetentionService, auditSvc service.AuditService) *RetentionController {
+	return &RetentionController{svc: svc, auditSvc: auditSvc}
+}
+
+func (r *RetentionController) ListRules(c *gin.Context) {
+	rules, err := r.svc.ListRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (r *RetentionController) SetRule(c *gin.Context) {
+	var req entity.SetRetentionRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	rule, err := r.svc.SetRule(userID, req)
+	if err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+	recordAudit(c, r.auditSvc, entity.AuditEvent{
+		Action: entity.AuditRetentionSet, TargetType: "retention", TargetID: strconv.FormatUint(uint64(rule.ID), 10),
+		Details: map[string]interface{}{"scope": rule.Scope, "group_id": rule.GroupID, "user_a": rule.UserA, "user_b": rule.UserB, "days": rule.Days},
+	})
+	c.JSON(http.StatusOK, rule)
+}
+
+func (r *RetentionController) DeleteRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("ruleID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+	if err := r.svc.DeleteRule(uint(id)); err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+	recordAudit(c, r.auditSvc, entity.AuditEvent{Action: entity.AuditRetentionDelete, TargetType: "retention", TargetID: c.Param("ruleID")})
+	c.Status(http.StatusNoContent)
+}
+
+// Report is the dry run: how many messages each rule would delete now.
+func (r *RetentionController) Report(c *gin.Context) {
+	rep, err := r.svc.Report()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rep)
+}
+
+// Purge starts a purge right away and returns before it finishes; follow it
+// through /admin/retention/runs.
+func (r *RetentionController) Purge(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	run, err := r.svc.StartPurge(entity.RetentionTriggerManual, userID)
+	if err != nil {
+		writeRetentionError(c, err)
+		return
+	}
+	recordAudit(c, r.auditSvc, entity.AuditEvent{Action: entity.AuditRetentionPurge, TargetType: "retention_run", TargetID: strconv.FormatUint(uint64(run.ID), 10)})
+	c.JSON(http.StatusAccepted, run)
+}
+
+func (r *RetentionController) Runs(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	runs, err := r.svc.Runs(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+func (r *RetentionController) Metrics(c *gin.Context) {
+	m, err := r.svc.Metrics()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func writeRetentionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidRetentionRule):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrRetentionRuleNotFound), errors.Is(err, service.ErrGroupNotFound), errors.Is(err, service.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPurgeRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
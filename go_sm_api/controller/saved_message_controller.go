@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// SavedMessageController manages the caller's bookmarks under /api/saved;
+// single bookmarks are addressed as /api/saved/:kind/:id like reactions.
+type SavedMessageController struct {
+	svc service.SavedMessageService
+}
+
+func NewSavedMessageController(svc service.SavedMessageService) *SavedMessageController {
+	return &SavedMessageController{svc: svc}
+}
+
+func (s *SavedMessageController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	saved, total, err := s.svc.List(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"saved": saved, "total": total})
+}
+
+// Save bookmarks the message; saving it again replaces the note.
+func (s *SavedMessageController) Save(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid message id"})
+		return
+	}
+	var req entity.SaveMessageRequest
+	// the body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	sm, err := s.svc.Save(userID, c.Param("kind"), uint(id), req.Note)
+	if err != nil {
+		if errors.Is(err, service.ErrMessageNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sm)
+}
+
+func (s *SavedMessageController) Unsave(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid message id"})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	removed, err := s.svc.Unsave(userID, c.Param("kind"), uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
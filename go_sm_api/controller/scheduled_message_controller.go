@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduledMessageController lets users queue messages for later and manage
+// them until they are sent.
+type ScheduledMessageController struct {
+	svc service.ScheduledMessageService
+}
+
+func NewScheduledMessageController(svc service.ScheduledMessageService) *ScheduledMessageController {
+	return &ScheduledMessageController{svc: svc}
+}
+
+func (s *ScheduledMessageController) Create(c *gin.Context) {
+	var req entity.CreateScheduledMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m, err := s.svc.Create(userID, req)
+	if err != nil {
+		writeScheduledError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, m)
+}
+
+// List returns the caller's scheduled messages by send time; ?status filters.
+func (s *ScheduledMessageController) List(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	msgs, total, err := s.svc.List(userID, c.Query("status"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scheduled_messages": msgs, "total": total})
+}
+
+func (s *ScheduledMessageController) Get(c *gin.Context) {
+	id, ok := parseScheduledID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m, err := s.svc.Get(userID, id)
+	if err != nil {
+		writeScheduledError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func (s *ScheduledMessageController) Update(c *gin.Context) {
+	id, ok := parseScheduledID(c)
+	if !ok {
+		return
+	}
+	var req entity.UpdateScheduledMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	m, err := s.svc.Update(userID, id, req)
+	if err != nil {
+		writeScheduledError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func (s *ScheduledMessageController) Cancel(c *gin.Context) {
+	id, ok := parseScheduledID(c)
+	if !ok {
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := s.svc.Cancel(userID, id); err != nil {
+		writeScheduledError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func parseScheduledID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func writeScheduledError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrScheduledNotFound), errors.Is(err, service.ErrUserNotFound), errors.Is(err, service.ErrChannelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInvalidSendAt), errors.Is(err, service.ErrEmptyBody), errors.Is(err, service.ErrInvalidRecipient):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrNotGroupMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrScheduledLocked), errors.Is(err, service.ErrTooManyScheduled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
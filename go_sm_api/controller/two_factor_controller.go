@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// TwoFactorController lets an authenticated user manage their TOTP settings.
+type TwoFactorController struct {
+	svc      service.TwoFactorService
+	auditSvc service.AuditService
+}
+
+func NewTwoFactorController(svc service.TwoFactorService, auditSvc service.AuditService) *TwoFactorController {
+	return &TwoFactorController{svc: svc, auditSvc: auditSvc}
+}
+
+// Enroll returns a new TOTP secret and otpauth URI; 2FA stays off until Confirm.
+func (t *TwoFactorController) Enroll(c *gin.Context) {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	secret, uri, err := t.svc.Enroll(userID)
+	if err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+// Confirm enables 2FA with a code from the authenticator and returns recovery codes.
+func (t *TwoFactorController) Confirm(c *gin.Context) {
+	var req entity.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	codes, err := t.svc.Confirm(userID, req.Code)
+	if err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	recordAudit(c, t.auditSvc, entity.AuditEvent{Action: entity.AuditTwoFactorEnable, TargetType: "user", TargetID: userID})
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+func (t *TwoFactorController) Disable(c *gin.Context) {
+	var req entity.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	if err := t.svc.Disable(userID, req.Code); err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	recordAudit(c, t.auditSvc, entity.AuditEvent{Action: entity.AuditTwoFactorDisable, TargetType: "user", TargetID: userID})
+	c.JSON(http.StatusOK, gin.H{"enabled": false})
+}
+
+// RecoveryCodes replaces the user's recovery codes.
+func (t *TwoFactorController) RecoveryCodes(c *gin.Context) {
+	var req entity.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	codes, err := t.svc.RegenerateRecoveryCodes(userID, req.Code)
+	if err != nil {
+		writeTwoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func writeTwoFactorError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidTwoFactorCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrTwoFactorNotEnrolled), errors.Is(err, service.ErrTwoFactorEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrTwoFactorRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// UserController serves the authenticated user's own profile.
+type UserController struct {
+	svc service.UserService
+}
+
+func NewUserController(svc service.UserService) *UserController {
+	return &UserController{svc: svc}
+}
+
+func (u *UserController) Me(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user, _ := userVal.(*entity.User)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// SetHandle changes the @handle other users mention; an empty handle clears it.
+func (u *UserController) SetHandle(c *gin.Context) {
+	var req entity.SetHandleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	handle, err := u.svc.SetHandle(userID, req.Handle)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidHandle):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrHandleTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"handle": handle})
+}
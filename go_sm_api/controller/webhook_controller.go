@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookController manages outgoing webhooks. Mounted under /api it works on
+// the caller's own webhooks; under /admin (global set) it creates webhooks
+// that receive every event and can manage anyone's.
+type WebhookController struct {
+	svc      service.WebhookService
+	auditSvc service.AuditService
+	global   bool
+}
+
+func NewWebhookController(svc service.WebhookService, auditSvc service.AuditService, global bool) *WebhookController {
+	return &WebhookController{svc: svc, auditSvc: auditSvc, global: global}
+}
+
+// owner is the ownerID passed to the service: the caller, or "" for admins.
+func (w *WebhookController) owner(c *gin.Context) string {
+	if w.global {
+		return ""
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	return userID
+}
+
+// EventTypes lists the event types webhooks can subscribe to.
+func (w *WebhookController) EventTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"events": entity.WebhookEventTypes})
+}
+
+// Create registers a webhook. The signing secret is only returned here and by
+// RotateSecret.
+func (w *WebhookController) Create(c *gin.Context) {
+	var req entity.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(string)
+	hook, err := w.svc.Create(userID, w.global, req)
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	recordAudit(c, w.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditWebhookCreate,
+		TargetType: "webhook",
+		TargetID:   strconv.FormatUint(uint64(hook.ID), 10),
+		Details:    map[string]interface{}{"url": hook.URL, "events": hook.Events, "global": hook.Global},
+	})
+	c.JSON(http.StatusCreated, gin.H{"webhook": hook, "secret": hook.Secret})
+}
+
+func (w *WebhookController) List(c *gin.Context) {
+	hooks, err := w.svc.List(w.owner(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+func (w *WebhookController) Get(c *gin.Context) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	hook, err := w.svc.Get(w.owner(c), id)
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+// Update changes the URL, events, description or enabled flag.
+func (w *WebhookController) Update(c *gin.Context) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	var req entity.UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hook, err := w.svc.Update(w.owner(c), id, req)
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+func (w *WebhookController) Delete(c *gin.Context) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	if err := w.svc.Delete(w.owner(c), id); err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	recordAudit(c, w.auditSvc, entity.AuditEvent{
+		Action:     entity.AuditWebhookDelete,
+		TargetType: "webhook",
+		TargetID:   strconv.FormatUint(uint64(id), 10),
+	})
+	c.Status(http.StatusNoContent)
+}
+
+func (w *WebhookController) RotateSecret(c *gin.Context) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	hook, err := w.svc.RotateSecret(w.owner(c), id)
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": hook, "secret": hook.Secret})
+}
+
+// Deliveries is the delivery log (?status=pending|delivered|dead, ?limit=, ?offset=).
+func (w *WebhookController) Deliveries(c *gin.Context) {
+	w.deliveries(c, c.Query("status"))
+}
+
+// DeadLetters lists deliveries that ran out of retries.
+func (w *WebhookController) DeadLetters(c *gin.Context) {
+	w.deliveries(c, entity.WebhookDead)
+}
+
+func (w *WebhookController) deliveries(c *gin.Context, status string) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	deliveries, total, err := w.svc.Deliveries(w.owner(c), id, status, limit, offset)
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "total": total})
+}
+
+// Redeliver queues a past delivery again, e.g. from the dead-letter list.
+func (w *WebhookController) Redeliver(c *gin.Context) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseUint(c.Param("deliveryID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery id"})
+		return
+	}
+	d, err := w.svc.Redeliver(w.owner(c), id, uint(deliveryID))
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, d)
+}
+
+// Ping queues a "ping" event so the receiver can be tested.
+func (w *WebhookController) Ping(c *gin.Context) {
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	d, err := w.svc.Ping(w.owner(c), id)
+	if err != nil {
+		writeWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, d)
+}
+
+func parseWebhookID(c *gin.Context) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+func writeWebhookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrWebhookNotFound), errors.Is(err, service.ErrDeliveryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInvalidWebhookURL), errors.Is(err, service.ErrPrivateWebhookURL),
+		errors.Is(err, service.ErrInvalidWebhookEvent):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,81 @@
+package entity
+
+import "time"
+
+// API token scopes.
+const (
+	// ScopeMessagesRead allows reading messages and receiving events over the WebSocket.
+	ScopeMessagesRead = "messages:read"
+	// ScopeMessagesWrite allows sending messages and reactions.
+	ScopeMessagesWrite = "messages:write"
+	// ScopeGroupsWrite allows joining groups and answering invites.
+	ScopeGroupsWrite = "groups:write"
+	// ScopeCommandsWrite allows a bot to register slash commands.
+	ScopeCommandsWrite = "commands:write"
+)
+
+var APITokenScopes = []string{ScopeMessagesRead, ScopeMessagesWrite, ScopeGroupsWrite, ScopeCommandsWrite}
+
+// APITokenPrefix starts every API token so it can be told apart from a JWT.
+const APITokenPrefix = "smb_"
+
+// APIToken is a long-lived bearer token for a bot or a user's scripts. Only
+// the SHA-256 hash is stored; Prefix is kept to recognise it in listings.
+type APIToken struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     string     `json:"user_id" gorm:"index;size:64"`
+	Name       string     `json:"name" gorm:"size:64"`
+	Prefix     string     `json:"prefix" gorm:"size:16"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;size:64"`
+	Scopes     []string   `json:"scopes" gorm:"serializer:json"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IncomingWebhook lets an external system post to a group through a secret
+// URL. Messages are sent by BotID, a bot created for the webhook.
+type IncomingWebhook struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	GroupID    uint       `json:"group_id" gorm:"index"`
+	CreatorID  string     `json:"creator_id" gorm:"size:64"`
+	BotID      string     `json:"bot_id" gorm:"index;size:64"`
+	Name       string     `json:"name" gorm:"size:64"`
+	Prefix     string     `json:"prefix" gorm:"size:16"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;size:64"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type CreateBotRequest struct {
+	Name   string `json:"name" binding:"required,max=64"`
+	Handle string `json:"handle" binding:"required"`
+}
+
+type CreateAPITokenRequest struct {
+	Name   string   `json:"name" binding:"required,max=64"`
+	Scopes []string `json:"scopes" binding:"required,min=1"`
+	// ExpiresInDays of 0 means the token does not expire.
+	ExpiresInDays int `json:"expires_in_days" binding:"min=0,max=3650"`
+}
+
+type CreateIncomingWebhookRequest struct {
+	Name string `json:"name" binding:"required,max=64"`
+}
+
+// IncomingWebhookMessage is what external systems POST; Text is accepted as
+// an alias of Body for Slack-style senders.
+type IncomingWebhookMessage struct {
+	Body string `json:"body"`
+	Text string `json:"text"`
+}
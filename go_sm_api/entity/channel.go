@@ -0,0 +1,55 @@
+package entity
+
+import "time"
+
+// Who may post in a channel.
+const (
+	ChannelPostMembers = "members"
+	ChannelPostOwner   = "owner"
+)
+
+// Channel is a room of a group, which acts as the channel's workspace. Each
+// channel has its own message history; the group's messages outside any
+// channel (ChannelID 0) form its default channel. Names are unique within a
+// group only.
+type Channel struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	GroupID   uint      `json:"group_id" gorm:"uniqueIndex:idx_group_channel"`
+	Name      string    `json:"name" gorm:"uniqueIndex:idx_group_channel;size:80"`
+	Topic     string    `json:"topic,omitempty" gorm:"size:191"`
+	CreatedBy string    `json:"created_by" gorm:"size:64"`
+	// Restricted channels are open to their ChannelMembers only; the others
+	// inherit the group's membership.
+	Restricted bool `json:"restricted"`
+	// PostPolicy is ChannelPostMembers, or ChannelPostOwner to let only the
+	// group owner post.
+	PostPolicy string `json:"post_policy" gorm:"size:16;default:members"`
+}
+
+// ChannelMember lets a group member into a restricted channel.
+type ChannelMember struct {
+	ChannelID uint      `json:"-" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"primaryKey;size:64;index"`
+	AddedBy   string    `json:"added_by,omitempty" gorm:"size:64"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateChannelRequest struct {
+	Name       string `json:"name" binding:"required,max=80"`
+	Topic      string `json:"topic" binding:"max=191"`
+	Restricted bool   `json:"restricted"`
+	PostPolicy string `json:"post_policy" binding:"omitempty,oneof=members owner"`
+}
+
+// UpdateChannelRequest changes the fields that are set.
+type UpdateChannelRequest struct {
+	Name       *string `json:"name" binding:"omitempty,min=1,max=80"`
+	Topic      *string `json:"topic" binding:"omitempty,max=191"`
+	PostPolicy *string `json:"post_policy" binding:"omitempty,oneof=members owner"`
+}
+
+type ChannelMembersRequest struct {
+	UserIDs []string `json:"user_ids" binding:"required,min=1,dive,required"`
+}
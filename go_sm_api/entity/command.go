@@ -0,0 +1,61 @@
+package entity
+
+import "time"
+
+// BuiltinCommands are the slash commands handled by the server; bots cannot
+// register these names.
+var BuiltinCommands = []string{"help", "me", "topic", "invite", "kick", "mute", "unmute"}
+
+// Bot command reply types.
+const (
+	// CommandReplyEphemeral is shown only to the user who ran the command.
+	CommandReplyEphemeral = "ephemeral"
+	// CommandReplyPublic is posted to the conversation by the bot.
+	CommandReplyPublic = "public"
+)
+
+// BotCommand is a slash command registered by a bot. It can be used in
+// groups the bot belongs to and in private chats with the bot; running it
+// POSTs a CommandInvocation to URL, signed with Secret.
+type BotCommand struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	BotID       string    `json:"bot_id" gorm:"uniqueIndex:idx_bot_command;size:64"`
+	Name        string    `json:"name" gorm:"uniqueIndex:idx_bot_command;size:32"`
+	Description string    `json:"description,omitempty" gorm:"size:191"`
+	URL         string    `json:"url" gorm:"size:512"`
+	Secret      string    `json:"-" gorm:"size:64"`
+}
+
+type RegisterCommandRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description" binding:"max=191"`
+	URL         string `json:"url" binding:"required"`
+}
+
+// CommandInvocation is the body POSTed to a bot command's URL. GroupID is set
+// for group chats; private chats with the bot leave it 0.
+type CommandInvocation struct {
+	Command string `json:"command"`
+	Args    string `json:"args"`
+	UserID  string `json:"user_id"`
+	GroupID uint   `json:"group_id,omitempty"`
+	BotID   string `json:"bot_id"`
+	TS      int64  `json:"ts"`
+}
+
+// CommandReply is what a bot command's URL may answer with. An empty Text
+// means no reply; ResponseType defaults to ephemeral.
+type CommandReply struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type"`
+}
+
+// CommandInfo describes a command available in a conversation.
+type CommandInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Usage       string `json:"usage,omitempty"`
+	BotID       string `json:"bot_id,omitempty"`
+}
@@ -0,0 +1,53 @@
+package entity
+
+import "time"
+
+// Notification levels of a conversation.
+const (
+	NotifyLevelAll      = "all"
+	NotifyLevelMentions = "mentions"
+	NotifyLevelNone     = "none"
+)
+
+// ConversationSetting is one user's preferences for a DM, group DM or group.
+// Conversation is "private:<otherUserID>", "group_dm:<id>" or "group:<id>",
+// the key push messages use. A conversation without a row has the defaults.
+type ConversationSetting struct {
+	UserID       string `json:"-" gorm:"primaryKey;size:64"`
+	Conversation string `json:"conversation" gorm:"primaryKey;size:80"`
+	// MutedUntil silences notifications and pushes until then.
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	// ArchivedAt hides the conversation from the inbox until a message
+	// newer than it arrives.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	// PinnedAt keeps the conversation at the top of the inbox, oldest pin first.
+	PinnedAt    *time.Time `json:"pinned_at,omitempty"`
+	NotifyLevel string     `json:"notify_level" gorm:"size:16;default:all"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// UpdateConversationSettingsRequest changes the fields that are set.
+type UpdateConversationSettingsRequest struct {
+	// MuteFor mutes for this many seconds, at most ten years; 0 unmutes and
+	// -1 mutes until unmuted.
+	MuteFor     *int64  `json:"mute_for" binding:"omitempty,min=-1,max=315360000"`
+	Archived    *bool   `json:"archived"`
+	Pinned      *bool   `json:"pinned"`
+	NotifyLevel *string `json:"notify_level" binding:"omitempty,oneof=all mentions none"`
+}
+
+// InboxEntry is one conversation in a user's inbox with its latest message
+// and the user's settings for it.
+type InboxEntry struct {
+	Conversation string    `json:"conversation"`
+	UserID       string    `json:"user_id,omitempty"`
+	GroupID      uint      `json:"group_id,omitempty"`
+	GroupName    string    `json:"group_name,omitempty"`
+	GroupDM      *GroupDM  `json:"group_dm,omitempty"`
+	LastActivity time.Time `json:"last_activity"`
+
+	PrivateMessage *PrivateMessage     `json:"private_message,omitempty"`
+	GroupMessage   *GroupMessage       `json:"group_message,omitempty"`
+	GroupDMMessage *GroupDMMessage     `json:"group_dm_message,omitempty"`
+	Settings       ConversationSetting `json:"settings"`
+}
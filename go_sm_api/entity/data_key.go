@@ -0,0 +1,17 @@
+package entity
+
+import "time"
+
+// DataKey encrypts the message bodies of one conversation ("private:<a>:<b>"
+// with sorted user IDs, or "group:<id>"). WrappedKey is the key encrypted by
+// the master key MasterKeyID, which lives in the config, never in the
+// database. Rotation retires a key; its messages are then re-encrypted under
+// the conversation's new key and the retired key is deleted once unused.
+type DataKey struct {
+	ID           string     `json:"id" gorm:"primaryKey;size:16"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Conversation string     `json:"conversation" gorm:"size:150;index"`
+	MasterKeyID  string     `json:"master_key_id" gorm:"size:16;index"`
+	WrappedKey   []byte     `json:"-"`
+	RetiredAt    *time.Time `json:"retired_at" gorm:"index"`
+}
@@ -0,0 +1,88 @@
+package entity
+
+import "time"
+
+// E2EDevice holds the public keys one client install publishes for end-to-end
+// encrypted DMs. The server never sees private keys and does not check the
+// signed pre-key signature; clients verify it against IdentityKey. Keys are
+// base64.
+type E2EDevice struct {
+	ID                    uint      `json:"-" gorm:"primaryKey"`
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+	UserID                string    `json:"user_id" gorm:"size:64;uniqueIndex:idx_e2e_device"`
+	DeviceID              string    `json:"device_id" gorm:"size:64;uniqueIndex:idx_e2e_device"`
+	IdentityKey           string    `json:"identity_key" gorm:"size:64"`
+	SignedPreKeyID        uint32    `json:"signed_pre_key_id"`
+	SignedPreKey          string    `json:"signed_pre_key" gorm:"size:64"`
+	SignedPreKeySignature string    `json:"signed_pre_key_signature" gorm:"size:128"`
+	// OneTimePreKeys is how many unused one-time pre-keys are left.
+	OneTimePreKeys int64 `json:"one_time_pre_keys" gorm:"-"`
+}
+
+// OneTimePreKey is handed out with at most one bundle and then deleted.
+type OneTimePreKey struct {
+	ID        uint   `json:"-" gorm:"primaryKey"`
+	UserID    string `json:"-" gorm:"size:64;uniqueIndex:idx_one_time_pre_key"`
+	DeviceID  string `json:"-" gorm:"size:64;uniqueIndex:idx_one_time_pre_key"`
+	KeyID     uint32 `json:"key_id" gorm:"uniqueIndex:idx_one_time_pre_key"`
+	PublicKey string `json:"public_key" gorm:"size:64"`
+}
+
+// PreKeyBundle is what a client needs to open a session with one device.
+// OneTimePreKey is nil once the device has run out of them.
+type PreKeyBundle struct {
+	UserID                string         `json:"user_id"`
+	DeviceID              string         `json:"device_id"`
+	IdentityKey           string         `json:"identity_key"`
+	SignedPreKeyID        uint32         `json:"signed_pre_key_id"`
+	SignedPreKey          string         `json:"signed_pre_key"`
+	SignedPreKeySignature string         `json:"signed_pre_key_signature"`
+	OneTimePreKey         *OneTimePreKey `json:"one_time_pre_key,omitempty"`
+}
+
+// ConversationE2E marks a DM as end-to-end encrypted; while the row exists
+// the server only accepts encrypted messages in it. UserA and UserB are
+// sorted, as in ConversationTTL.
+type ConversationE2E struct {
+	UserA     string    `json:"user_a" gorm:"primaryKey;size:64"`
+	UserB     string    `json:"user_b" gorm:"primaryKey;size:64"`
+	EnabledBy string    `json:"enabled_by" gorm:"size:64"`
+	EnabledAt time.Time `json:"enabled_at" gorm:"autoCreateTime"`
+}
+
+// EncryptedEnvelope replaces Body on an encrypted DM. It carries one
+// ciphertext per device the sender encrypted for: the recipient's devices and
+// the sender's other devices.
+type EncryptedEnvelope struct {
+	SenderDevice string             `json:"sender_device"`
+	Ciphertexts  []DeviceCiphertext `json:"ciphertexts"`
+}
+
+// DeviceCiphertext is the message encrypted for one device. Header is the
+// session header; PreKey is set on the first message of a session, which the
+// device needs to set the session up.
+type DeviceCiphertext struct {
+	UserID     string `json:"user_id"`
+	DeviceID   string `json:"device_id"`
+	PreKey     bool   `json:"pre_key,omitempty"`
+	Header     string `json:"header"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// RegisterDeviceRequest publishes or replaces a device's identity and signed
+// pre-key. Replacing the identity key discards the old one-time pre-keys.
+type RegisterDeviceRequest struct {
+	IdentityKey           string `json:"identity_key" binding:"required"`
+	SignedPreKeyID        uint32 `json:"signed_pre_key_id"`
+	SignedPreKey          string `json:"signed_pre_key" binding:"required"`
+	SignedPreKeySignature string `json:"signed_pre_key_signature" binding:"required"`
+}
+
+type UploadPreKeysRequest struct {
+	PreKeys []OneTimePreKey `json:"pre_keys" binding:"required,min=1,max=100"`
+}
+
+type SetE2ERequest struct {
+	Enabled bool `json:"enabled"`
+}
@@ -0,0 +1,29 @@
+package entity
+
+// ForwardSource records where a forwarded message was copied from. A copy of
+// a copy keeps the original source.
+type ForwardSource struct {
+	Kind      string `json:"kind"`
+	MessageID uint   `json:"message_id"`
+	SenderID  string `json:"sender_id"`
+	GroupID   uint   `json:"group_id,omitempty"`
+	ChannelID uint   `json:"channel_id,omitempty"`
+	// UserA and UserB are the participants of a private source, in sorted order.
+	UserA string `json:"user_a,omitempty"`
+	UserB string `json:"user_b,omitempty"`
+}
+
+// ForwardRef names a message to forward.
+type ForwardRef struct {
+	Kind string `json:"kind" binding:"required,oneof=private group"`
+	ID   uint   `json:"id" binding:"required"`
+}
+
+// ForwardRequest copies messages into a DM (To) or a group (GroupID), in
+// its ChannelID if set.
+type ForwardRequest struct {
+	Messages  []ForwardRef `json:"messages" binding:"required,min=1,max=20,dive"`
+	To        string       `json:"to"`
+	GroupID   uint         `json:"group_id"`
+	ChannelID uint         `json:"channel_id"`
+}
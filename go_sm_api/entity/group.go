@@ -1,11 +1,18 @@
 package entity
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Group struct {
 	gorm.Model
 	Name    string `json:"name" gorm:"uniqueIndex;size:191"`
 	OwnerID string `json:"owner_id" gorm:"index;size:64"`
+	Topic   string `json:"topic,omitempty" gorm:"size:191"`
+	// MessageTTL is how long new messages live, in seconds; 0 keeps them.
+	MessageTTL int64 `json:"message_ttl,omitempty"`
 }
 
 type GroupMember struct {
@@ -13,3 +20,43 @@ type GroupMember struct {
 	GroupID uint   `json:"group_id" gorm:"index"`
 	UserID  string `json:"user_id" gorm:"index;size:64"`
 }
+
+// Group invite statuses.
+const (
+	InvitePending  = "pending"
+	InviteAccepted = "accepted"
+	InviteDeclined = "declined"
+)
+
+// GroupInvite is a member's invitation for another user to join a group.
+type GroupInvite struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	GroupID   uint      `json:"group_id" gorm:"index"`
+	InviterID string    `json:"inviter_id" gorm:"size:64"`
+	InviteeID string    `json:"invitee_id" gorm:"index;size:64"`
+	Status    string    `json:"status" gorm:"size:16"`
+}
+
+type GroupInviteRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+// GroupBan removes a user from a group and prevents them from rejoining.
+type GroupBan struct {
+	gorm.Model
+	GroupID  uint   `json:"group_id" gorm:"index"`
+	UserID   string `json:"user_id" gorm:"index;size:64"`
+	BannedBy string `json:"banned_by" gorm:"size:64"`
+	Reason   string `json:"reason" gorm:"size:191"`
+}
+
+// GroupMute stops a member from posting to a group until Until.
+type GroupMute struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	GroupID   uint      `json:"group_id" gorm:"uniqueIndex:idx_group_mute"`
+	UserID    string    `json:"user_id" gorm:"uniqueIndex:idx_group_mute;size:64"`
+	MutedBy   string    `json:"muted_by" gorm:"size:64"`
+	Until     time.Time `json:"until"`
+}
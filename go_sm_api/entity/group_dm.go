@@ -0,0 +1,66 @@
+package entity
+
+import "time"
+
+// GroupDM is an ad-hoc conversation of 3 to 10 users. Unlike a Group it has
+// no owner and its Name, empty by default, need not be unique.
+type GroupDM struct {
+	ID           uint                 `json:"id" gorm:"primaryKey"`
+	CreatedAt    time.Time            `json:"created_at"`
+	CreatedBy    string               `json:"created_by" gorm:"size:64"`
+	Name         string               `json:"name,omitempty" gorm:"size:191"`
+	Participants []GroupDMParticipant `json:"participants,omitempty" gorm:"foreignKey:GroupDMID"`
+	// Unread counts the messages from others after the viewer's read position.
+	Unread int64 `json:"unread" gorm:"-"`
+	// MessageTTL is how long new messages live, in seconds; 0 keeps them.
+	MessageTTL int64 `json:"message_ttl,omitempty"`
+}
+
+// GroupDMParticipant is a user in a GroupDM. LastReadID is the newest message
+// they have read; their own messages count as read.
+type GroupDMParticipant struct {
+	GroupDMID  uint       `json:"-" gorm:"primaryKey"`
+	UserID     string     `json:"user_id" gorm:"primaryKey;size:64;index"`
+	AddedBy    string     `json:"added_by,omitempty" gorm:"size:64"`
+	CreatedAt  time.Time  `json:"joined_at"`
+	LastReadID uint       `json:"last_read_id"`
+	ReadAt     *time.Time `json:"read_at,omitempty"`
+}
+
+// GroupDMMessage is a message posted to a GroupDM.
+type GroupDMMessage struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	GroupDMID uint      `json:"group_dm_id" gorm:"index"`
+	SenderID  string    `json:"sender_id" gorm:"index;size:64"`
+	Body      string    `json:"body" gorm:"type:text"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	// BodyKeyID is the DataKey Body is encrypted with at rest; empty while
+	// the stored body is still plaintext.
+	BodyKeyID string `json:"-" gorm:"size:16;index;default:''"`
+	// ExpiresAt is set when the group DM had a message TTL at send time.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" gorm:"index"`
+}
+
+// CreateGroupDMRequest lists the other participants; the caller joins too.
+type CreateGroupDMRequest struct {
+	UserIDs []string `json:"user_ids" binding:"required,min=2,max=9,dive,required"`
+	Name    string   `json:"name" binding:"max=191"`
+}
+
+type AddGroupDMParticipantsRequest struct {
+	UserIDs []string `json:"user_ids" binding:"required,min=1,max=8,dive,required"`
+}
+
+// RenameGroupDMRequest sets the name; an empty name makes it unnamed again.
+type RenameGroupDMRequest struct {
+	Name string `json:"name" binding:"max=191"`
+}
+
+type SendGroupDMMessageRequest struct {
+	Body string `json:"body" binding:"required"`
+}
+
+// MarkGroupDMReadRequest moves the caller's read position forward to LastReadID.
+type MarkGroupDMReadRequest struct {
+	LastReadID uint `json:"last_read_id" binding:"required"`
+}
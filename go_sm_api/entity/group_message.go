@@ -2,10 +2,31 @@ package entity
 
 import "time"
 
+// GroupMessage is a message posted to a group. ReplyToID references another
+// message of the same group; Mentions are parsed from Body when it is sent.
 type GroupMessage struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	GroupID   uint      `json:"group_id" gorm:"index"`
+	ID      uint `json:"id" gorm:"primaryKey"`
+	GroupID uint `json:"group_id" gorm:"index"`
+	// ChannelID is the Channel of the group the message was posted in; 0 is
+	// the group's default channel.
+	ChannelID uint      `json:"channel_id,omitempty" gorm:"index;default:0"`
 	SenderID  string    `json:"sender_id" gorm:"index;size:64"`
 	Body      string    `json:"body" gorm:"type:text"`
-	CreatedAt time.Time `json:"created_at"`
+	ReplyToID uint      `json:"reply_to_id,omitempty" gorm:"index"`
+	Mentions  []Mention `json:"mentions,omitempty" gorm:"foreignKey:MessageID"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	// ExpiresAt is set when the group had a message TTL at send time.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" gorm:"index"`
+	// BodyKeyID is the DataKey Body is encrypted with at rest; empty while
+	// the stored body is still plaintext.
+	BodyKeyID string `json:"-" gorm:"size:16;index;default:''"`
+	// Forwarded copies keep their source in ForwardedFrom, which is cleared
+	// for viewers who cannot access the source conversation.
+	Forwarded     bool           `json:"forwarded,omitempty"`
+	ForwardedFrom *ForwardSource `json:"forwarded_from,omitempty" gorm:"serializer:json"`
+}
+
+type SendGroupMessageRequest struct {
+	Body    string `json:"body" binding:"required"`
+	ReplyTo uint   `json:"reply_to"`
 }
@@ -0,0 +1,21 @@
+package entity
+
+// Mention kinds.
+const (
+	MentionUser     = "user"
+	MentionHere     = "here"
+	MentionEveryone = "everyone"
+)
+
+// Mention is an @handle, @here or @everyone found in a group message body.
+// Offset and Length are byte positions of the token (including the "@").
+// UserID is set for MentionUser when the handle matched a group member.
+type Mention struct {
+	ID        uint   `json:"-" gorm:"primaryKey"`
+	MessageID uint   `json:"-" gorm:"index"`
+	Kind      string `json:"kind" gorm:"size:16"`
+	Handle    string `json:"handle,omitempty" gorm:"size:32"`
+	UserID    string `json:"user_id,omitempty" gorm:"index;size:64"`
+	Offset    int    `json:"offset"`
+	Length    int    `json:"length"`
+}
@@ -0,0 +1,31 @@
+package entity
+
+import "time"
+
+// Message request statuses.
+const (
+	MessageRequestPending  = "pending"
+	MessageRequestAccepted = "accepted"
+	MessageRequestIgnored  = "ignored"
+	MessageRequestDeclined = "declined"
+)
+
+// MessageRequest tracks first contact from SenderID to RecipientID.
+// Direct messages between users with no prior conversation are held as
+// pending until the recipient accepts, ignores or declines the request.
+type MessageRequest struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	SenderID    string    `json:"sender_id" gorm:"uniqueIndex:idx_msg_request_pair;size:64"`
+	RecipientID string    `json:"recipient_id" gorm:"uniqueIndex:idx_msg_request_pair;index;size:64"`
+	Status      string    `json:"status" gorm:"index;size:16"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// UserBlock records that BlockerID no longer accepts messages from BlockedID.
+type UserBlock struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	BlockerID string    `json:"blocker_id" gorm:"uniqueIndex:idx_user_block_pair;size:64"`
+	BlockedID string    `json:"blocked_id" gorm:"uniqueIndex:idx_user_block_pair;size:64"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,20 @@
+package entity
+
+import "time"
+
+// ConversationTTL is the disappearing-messages setting of a private
+// conversation. UserA and UserB are the two participants in sorted order,
+// so each pair has one row.
+type ConversationTTL struct {
+	UserA     string    `json:"user_a" gorm:"primaryKey;size:64"`
+	UserB     string    `json:"user_b" gorm:"primaryKey;size:64"`
+	TTL       int64     `json:"ttl_seconds"`
+	UpdatedBy string    `json:"updated_by" gorm:"size:64"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetMessageTTLRequest sets how long new messages live; 0 turns
+// disappearing messages off.
+type SetMessageTTLRequest struct {
+	TTLSeconds int64 `json:"ttl_seconds" binding:"min=0"`
+}
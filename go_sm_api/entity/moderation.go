@@ -0,0 +1,70 @@
+package entity
+
+import "time"
+
+// Moderation actions, from least to most severe.
+const (
+	ModerationAllow  = "allow"
+	ModerationMask   = "mask"
+	ModerationHold   = "hold"
+	ModerationReject = "reject"
+)
+
+// Moderation rule kinds.
+const (
+	RuleWord  = "word"
+	RuleRegex = "regex"
+	RuleLink  = "link"
+)
+
+// ModerationRule is a word, regex or link-domain filter. GroupID 0 applies the
+// rule to every conversation.
+type ModerationRule struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	GroupID   uint      `json:"group_id" gorm:"index"`
+	Kind      string    `json:"kind" gorm:"size:16"`
+	Pattern   string    `json:"pattern" gorm:"size:512"`
+	Action    string    `json:"action" gorm:"size:16"`
+	CreatedBy string    `json:"created_by" gorm:"size:64"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GroupModerationSettings overrides the global moderation config for a group.
+// Zero values fall back to the global setting.
+type GroupModerationSettings struct {
+	GroupID    uint      `json:"group_id" gorm:"primaryKey;autoIncrement:false"`
+	MaxLength  int       `json:"max_length"`
+	SpamAction string    `json:"spam_action" gorm:"size:16"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Held message statuses.
+const (
+	HeldPending  = "pending"
+	HeldApproved = "approved"
+	HeldRejected = "rejected"
+)
+
+// HeldMessage is a message shadow-held for review: the sender sees it as sent,
+// but it is only stored and delivered once a moderator approves it.
+type HeldMessage struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Kind        string     `json:"kind" gorm:"size:16"` // "private", "group" or "group_dm"
+	GroupID     uint       `json:"group_id" gorm:"index"`
+	ChannelID   uint       `json:"channel_id,omitempty"`
+	GroupDMID   uint       `json:"group_dm_id,omitempty"`
+	SenderID    string     `json:"sender_id" gorm:"index;size:64"`
+	RecipientID string     `json:"recipient_id" gorm:"size:64"`
+	Body        string     `json:"body" gorm:"type:text"`
+	Reason      string     `json:"reason" gorm:"size:191"`
+	Status      string     `json:"status" gorm:"index;size:16"`
+	ReviewedBy  string     `json:"reviewed_by" gorm:"size:64"`
+	ReviewedAt  *time.Time `json:"reviewed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// BodyKeyID is the DataKey Body is encrypted with at rest, as for messages.
+	BodyKeyID string `json:"-" gorm:"size:16;index;default:''"`
+	// ReplyToID and ForwardedFrom carry the thread and attribution of held
+	// replies and forwards over to the approved message.
+	ReplyToID     uint           `json:"reply_to_id,omitempty"`
+	ForwardedFrom *ForwardSource `json:"forwarded_from,omitempty" gorm:"serializer:json"`
+}
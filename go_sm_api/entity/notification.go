@@ -0,0 +1,37 @@
+package entity
+
+import "time"
+
+// Notification kinds.
+const (
+	NotifyMention     = "mention"
+	NotifyReply       = "reply"
+	NotifyReaction    = "reaction"
+	NotifyGroupInvite = "group_invite"
+)
+
+// Notification is an entry in a user's notifications feed. Which of the
+// reference fields are set depends on Kind: mentions and replies point at a
+// group message, reactions at the reacted-to message and invites at InviteID.
+type Notification struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      string     `json:"user_id" gorm:"index:idx_notifications_user_read;size:64"`
+	Kind        string     `json:"kind" gorm:"size:16"`
+	ActorID     string     `json:"actor_id" gorm:"size:64"`
+	GroupID     uint       `json:"group_id,omitempty"`
+	ChannelID   uint       `json:"channel_id,omitempty"`
+	MessageKind string     `json:"message_kind,omitempty" gorm:"size:16"`
+	MessageID   uint       `json:"message_id,omitempty"`
+	InviteID    uint       `json:"invite_id,omitempty"`
+	Emoji       string     `json:"emoji,omitempty" gorm:"size:32"`
+	Snippet     string     `json:"snippet,omitempty" gorm:"type:text"`
+	ReadAt      *time.Time `json:"read_at" gorm:"index:idx_notifications_user_read"`
+	// SnippetKeyID is the DataKey Snippet is encrypted with at rest.
+	SnippetKeyID string `json:"-" gorm:"size:16;index;default:''"`
+}
+
+type MarkNotificationsReadRequest struct {
+	// IDs to mark read; empty marks every notification read.
+	IDs []uint `json:"ids"`
+}
@@ -0,0 +1,38 @@
+package entity
+
+import "time"
+
+// PinnedMessage is a message pinned to its conversation. Group pins carry
+// GroupID and the message's ChannelID; DM pins carry the participants in
+// sorted order in UserA and UserB.
+type PinnedMessage struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time `json:"created_at"`
+	MessageKind string    `json:"message_kind" gorm:"size:16;uniqueIndex:idx_pinned_message"`
+	MessageID   uint      `json:"message_id" gorm:"uniqueIndex:idx_pinned_message"`
+	GroupID     uint      `json:"group_id,omitempty" gorm:"index"`
+	ChannelID   uint      `json:"channel_id,omitempty"`
+	UserA       string    `json:"-" gorm:"size:64;index:idx_pinned_pair"`
+	UserB       string    `json:"-" gorm:"size:64;index:idx_pinned_pair"`
+	PinnedBy    string    `json:"pinned_by" gorm:"size:64"`
+
+	PrivateMessage *PrivateMessage `json:"private_message,omitempty" gorm:"-"`
+	GroupMessage   *GroupMessage   `json:"group_message,omitempty" gorm:"-"`
+}
+
+// SavedMessage is a private bookmark of a message the user can see.
+type SavedMessage struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time `json:"created_at"`
+	UserID      string    `json:"-" gorm:"size:64;uniqueIndex:idx_saved_message"`
+	MessageKind string    `json:"message_kind" gorm:"size:16;uniqueIndex:idx_saved_message"`
+	MessageID   uint      `json:"message_id" gorm:"uniqueIndex:idx_saved_message"`
+	Note        string    `json:"note,omitempty" gorm:"size:500"`
+
+	PrivateMessage *PrivateMessage `json:"private_message,omitempty" gorm:"-"`
+	GroupMessage   *GroupMessage   `json:"group_message,omitempty" gorm:"-"`
+}
+
+type SaveMessageRequest struct {
+	Note string `json:"note" binding:"max=500"`
+}
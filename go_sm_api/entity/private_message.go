@@ -5,11 +5,34 @@ import "time"
 // PrivateMessage represents a direct message between two users.
 // SenderID and RecipientID reference User.ID (string).
 // ReadAt is null until the recipient marks the message as read.
+// Pending is set while the message belongs to an unanswered message request.
+// Expired messages are hidden at once and deleted by the expiry sweeper.
+// Encrypted messages have an empty Body and carry an Envelope instead.
 type PrivateMessage struct {
 	ID          uint       `json:"id" gorm:"primaryKey"`
 	SenderID    string     `json:"sender_id" gorm:"index;size:64"`
 	RecipientID string     `json:"recipient_id" gorm:"index;size:64"`
 	Body        string     `json:"body" gorm:"type:text"`
-	CreatedAt   time.Time  `json:"created_at"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"index"`
 	ReadAt      *time.Time `json:"read_at"`
+	Pending     bool       `json:"pending" gorm:"index"`
+	// ExpiresAt is set when the conversation had a message TTL at send time.
+	ExpiresAt *time.Time         `json:"expires_at,omitempty" gorm:"index"`
+	Encrypted bool               `json:"encrypted,omitempty"`
+	Envelope  *EncryptedEnvelope `json:"envelope,omitempty" gorm:"serializer:json"`
+	// BodyKeyID is the DataKey Body is encrypted with at rest; empty while
+	// the stored body is still plaintext.
+	BodyKeyID string `json:"-" gorm:"size:16;index;default:''"`
+	// Forwarded copies keep their source in ForwardedFrom, which is cleared
+	// for viewers who cannot access the source conversation.
+	Forwarded     bool           `json:"forwarded,omitempty"`
+	ForwardedFrom *ForwardSource `json:"forwarded_from,omitempty" gorm:"serializer:json"`
+}
+
+// SendPrivateMessageRequest carries either Body or, in an end-to-end
+// encrypted conversation, Envelope.
+type SendPrivateMessageRequest struct {
+	To       string             `json:"to" binding:"required"`
+	Body     string             `json:"body"`
+	Envelope *EncryptedEnvelope `json:"envelope"`
 }
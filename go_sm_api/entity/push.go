@@ -0,0 +1,56 @@
+package entity
+
+import "time"
+
+// PushSubscription is one browser/device registered for Web Push. Endpoint,
+// P256dh and Auth come straight from the browser's PushSubscription.
+type PushSubscription struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     string     `json:"user_id" gorm:"index;size:64"`
+	Endpoint   string     `json:"endpoint" gorm:"uniqueIndex;size:512"`
+	P256dh     string     `json:"-" gorm:"size:128"`
+	Auth       string     `json:"-" gorm:"size:64"`
+	UserAgent  string     `json:"user_agent,omitempty" gorm:"size:255"`
+	LastPushAt *time.Time `json:"last_push_at"`
+}
+
+// Push job statuses.
+const (
+	PushPending = "pending"
+	PushSent    = "sent"
+	PushAcked   = "acked"
+	PushMuted   = "muted"
+	PushFailed  = "failed"
+	PushExpired = "expired"
+)
+
+// PushJob is a queued push to one subscription. It is skipped when the user
+// acknowledges the event (Kind, RefID) on any device before NextAttemptAt.
+type PushJob struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt      time.Time `json:"created_at"`
+	UserID         string    `json:"user_id" gorm:"index:idx_push_jobs_ack;size:64"`
+	SubscriptionID uint      `json:"subscription_id" gorm:"index"`
+	Kind           string    `json:"kind" gorm:"index:idx_push_jobs_ack;size:16"`
+	RefID          uint      `json:"ref_id" gorm:"index:idx_push_jobs_ack"`
+	Conversation   string    `json:"conversation" gorm:"size:80"`
+	Payload        string    `json:"payload" gorm:"type:text"`
+	Status         string    `json:"status" gorm:"index:idx_push_jobs_due;size:16"`
+	NextAttemptAt  time.Time `json:"next_attempt_at" gorm:"index:idx_push_jobs_due"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty" gorm:"size:255"`
+}
+
+// PushSubscribeRequest mirrors PushSubscription.toJSON() in the browser.
+type PushSubscribeRequest struct {
+	Endpoint string `json:"endpoint" binding:"required,url"`
+	Keys     struct {
+		P256dh string `json:"p256dh" binding:"required"`
+		Auth   string `json:"auth" binding:"required"`
+	} `json:"keys"`
+}
+
+type PushUnsubscribeRequest struct {
+	Endpoint string `json:"endpoint" binding:"required"`
+}
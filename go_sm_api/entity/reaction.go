@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// Reaction is one user's emoji on a private or group message.
+type Reaction struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time `json:"created_at"`
+	MessageKind string    `json:"message_kind" gorm:"size:16;uniqueIndex:idx_reactions_unique"`
+	MessageID   uint      `json:"message_id" gorm:"uniqueIndex:idx_reactions_unique"`
+	UserID      string    `json:"user_id" gorm:"size:64;uniqueIndex:idx_reactions_unique"`
+	Emoji       string    `json:"emoji" gorm:"size:32;uniqueIndex:idx_reactions_unique"`
+}
+
+// ReactionCount aggregates the reactions on a message per emoji.
+type ReactionCount struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"user_ids"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required,max=32"`
+}
@@ -0,0 +1,13 @@
+package entity
+
+import "time"
+
+// RecoveryCode is a single-use fallback for a user's TOTP device.
+// Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    string     `json:"user_id" gorm:"index;size:64"`
+	CodeHash  string     `json:"-" gorm:"index;size:64"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
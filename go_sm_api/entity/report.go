@@ -0,0 +1,67 @@
+package entity
+
+import "time"
+
+// Report target types.
+const (
+	ReportTargetMessage = "message"
+	ReportTargetUser    = "user"
+	ReportTargetGroup   = "group"
+)
+
+// Report statuses: open -> in_review (claimed by a moderator) -> resolved or dismissed.
+const (
+	ReportOpen      = "open"
+	ReportInReview  = "in_review"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// Resolution actions a moderator can take.
+const (
+	ReportActionNone          = "none"
+	ReportActionDeleteMessage = "delete_message"
+	ReportActionSuspendUser   = "suspend_user"
+	ReportActionBanFromGroup  = "ban_from_group"
+)
+
+// Report flags a message, user or group for moderator review.
+// For messages, MessageKind is "private" or "group" and TargetID is the message ID;
+// Snapshot keeps the reported body even if the message is deleted later.
+type Report struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	ReporterID     string     `json:"reporter_id" gorm:"index;size:64"`
+	TargetType     string     `json:"target_type" gorm:"size:16"`
+	TargetID       string     `json:"target_id" gorm:"size:64"`
+	MessageKind    string     `json:"message_kind,omitempty" gorm:"size:16"`
+	GroupID        uint       `json:"group_id,omitempty" gorm:"index"`
+	ReportedUserID string     `json:"reported_user_id,omitempty" gorm:"index;size:64"`
+	Snapshot       string     `json:"snapshot,omitempty" gorm:"type:text"`
+	Reason         string     `json:"reason" gorm:"size:64"`
+	Details        string     `json:"details" gorm:"type:text"`
+	Status         string     `json:"status" gorm:"index;size:16"`
+	AssigneeID     string     `json:"assignee_id" gorm:"index;size:64"`
+	Resolution     string     `json:"resolution" gorm:"size:32"`
+	ResolutionNote string     `json:"resolution_note" gorm:"type:text"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+	// SnapshotKeyID is the DataKey Snapshot is encrypted with at rest.
+	SnapshotKeyID string `json:"-" gorm:"size:16;index;default:''"`
+}
+
+type CreateReportRequest struct {
+	TargetType  string `json:"target_type" binding:"required,oneof=message user group"`
+	TargetID    string `json:"target_id" binding:"required"`
+	MessageKind string `json:"message_kind" binding:"omitempty,oneof=private group"`
+	Reason      string `json:"reason" binding:"required,max=64"`
+	Details     string `json:"details" binding:"max=2000"`
+}
+
+type ResolveReportRequest struct {
+	Status string `json:"status" binding:"required,oneof=resolved dismissed"`
+	Action string `json:"action" binding:"omitempty,oneof=none delete_message suspend_user ban_from_group"`
+	// SuspendHours applies to suspend_user; 0 suspends indefinitely.
+	SuspendHours int    `json:"suspend_hours" binding:"min=0,max=87600"`
+	Note         string `json:"note" binding:"max=2000"`
+}
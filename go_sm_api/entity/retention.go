@@ -0,0 +1,67 @@
+package entity
+
+import "time"
+
+// Retention rule scopes, from least to most specific.
+const (
+	RetentionGlobal  = "global"
+	RetentionGroup   = "group"
+	RetentionPrivate = "private"
+)
+
+// Retention run triggers.
+const (
+	RetentionTriggerSchedule = "schedule"
+	RetentionTriggerManual   = "manual"
+)
+
+// RetentionRule deletes messages older than Days. A group or DM rule replaces
+// the global rule for that conversation, whether it is shorter or longer;
+// group DMs always follow the global rule.
+// Private rules store the two participants in sorted order, like
+// ConversationTTL.
+type RetentionRule struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Scope     string    `json:"scope" gorm:"size:16;uniqueIndex:idx_retention_target"`
+	GroupID   uint      `json:"group_id,omitempty" gorm:"uniqueIndex:idx_retention_target"`
+	UserA     string    `json:"user_a,omitempty" gorm:"size:64;uniqueIndex:idx_retention_target"`
+	UserB     string    `json:"user_b,omitempty" gorm:"size:64;uniqueIndex:idx_retention_target"`
+	Days      int       `json:"days"`
+	UpdatedBy string    `json:"updated_by" gorm:"size:64"`
+}
+
+// SetRetentionRuleRequest creates or replaces the rule for a target: nothing
+// for global, GroupID for group, UserID and OtherUserID for private.
+type SetRetentionRuleRequest struct {
+	Scope       string `json:"scope" binding:"required,oneof=global group private"`
+	GroupID     uint   `json:"group_id"`
+	UserID      string `json:"user_id"`
+	OtherUserID string `json:"other_user_id"`
+	Days        int    `json:"days" binding:"required,min=1,max=36500"`
+}
+
+// RetentionRun records one purge. FinishedAt is nil while it runs or if the
+// instance died during it; Error holds why it stopped early.
+type RetentionRun struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	StartedAt      time.Time  `json:"started_at" gorm:"index"`
+	FinishedAt     *time.Time `json:"finished_at"`
+	Trigger        string     `json:"trigger" gorm:"size:16"`
+	TriggeredBy    string     `json:"triggered_by,omitempty" gorm:"size:64"`
+	PrivateDeleted int64      `json:"private_deleted"`
+	GroupDeleted   int64      `json:"group_deleted"`
+	Batches        int        `json:"batches"`
+	Error          string     `json:"error,omitempty" gorm:"size:255"`
+	// GroupDMDeleted counts group DM messages, which only the global rule expires.
+	GroupDMDeleted int64 `json:"group_dm_deleted"`
+}
+
+// JobLease lets one instance at a time run a cluster-wide job. Holders renew
+// it while working; anyone may take it over once ExpiresAt has passed.
+type JobLease struct {
+	Name      string    `json:"name" gorm:"primaryKey;size:64"`
+	Holder    string    `json:"holder" gorm:"size:64"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
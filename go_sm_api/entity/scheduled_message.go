@@ -0,0 +1,55 @@
+package entity
+
+import "time"
+
+// Scheduled message statuses.
+const (
+	ScheduledPending  = "scheduled"
+	ScheduledSent     = "sent"
+	ScheduledCanceled = "canceled"
+	ScheduledFailed   = "failed"
+)
+
+// ScheduledMessage is a private or group message to be sent at SendAt.
+// NextAttemptAt starts equal to SendAt; the scheduler moves it forward to
+// lease the row while sending and to back off after a transient failure.
+type ScheduledMessage struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	SenderID      string     `json:"sender_id" gorm:"index;size:64"`
+	Kind          string     `json:"kind" gorm:"size:16"`
+	RecipientID   string     `json:"to,omitempty" gorm:"size:64"`
+	GroupID       uint       `json:"group_id,omitempty"`
+	Body          string     `json:"body" gorm:"type:text"`
+	ReplyToID     uint       `json:"reply_to,omitempty"`
+	SendAt        time.Time  `json:"send_at"`
+	Status        string     `json:"status" gorm:"index:idx_scheduled_due;size:16"`
+	NextAttemptAt time.Time  `json:"-" gorm:"index:idx_scheduled_due"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty" gorm:"size:255"`
+	MessageID     uint       `json:"message_id,omitempty"`
+	SentAt        *time.Time `json:"sent_at"`
+	// BodyKeyID is the DataKey Body is encrypted with at rest, as for messages.
+	BodyKeyID string `json:"-" gorm:"size:16;index;default:''"`
+	// ChannelID picks a channel of GroupID; 0 is the default channel.
+	ChannelID uint `json:"channel_id,omitempty"`
+}
+
+type CreateScheduledMessageRequest struct {
+	Kind    string    `json:"kind" binding:"required,oneof=private group"`
+	To      string    `json:"to"`
+	GroupID uint      `json:"group_id"`
+	Body    string    `json:"body" binding:"required"`
+	ReplyTo uint      `json:"reply_to"`
+	SendAt  time.Time `json:"send_at" binding:"required"`
+	// ChannelID picks a channel of GroupID; 0 is the default channel.
+	ChannelID uint `json:"channel_id"`
+}
+
+// UpdateScheduledMessageRequest edits a message that has not been sent yet;
+// nil fields are left unchanged.
+type UpdateScheduledMessageRequest struct {
+	Body   *string    `json:"body"`
+	SendAt *time.Time `json:"send_at"`
+}
@@ -1,9 +1,68 @@
 package entity
 
+import "time"
+
+// Platform roles.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type User struct {
-	ID           string `json:"id" gorm:"primaryKey;size:64"`
-	Email        string `json:"email" gorm:"uniqueIndex;size:191"`
-	PasswordHash string `json:"-" gorm:"size:191"`
+	ID            string `json:"id" gorm:"primaryKey;size:64"`
+	Email         string `json:"email" gorm:"uniqueIndex;size:191"`
+	PasswordHash  string `json:"-" gorm:"size:191"`
+	EmailVerified bool   `json:"email_verified"`
+	// Handle is the optional @name other users mention; stored lowercase.
+	Handle string `json:"handle,omitempty" gorm:"size:32;uniqueIndex:idx_users_handle,where:handle <> ''"`
+	// TOTP two-factor authentication; the secret is set at enrollment and
+	// TOTPEnabled once the user has confirmed a code.
+	TOTPSecret        string `json:"-" gorm:"size:64"`
+	TOTPEnabled       bool   `json:"totp_enabled"`
+	TOTPLastStep      int64  `json:"-"`
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	// Role is empty or RoleUser for regular accounts.
+	Role           string     `json:"role" gorm:"size:16"`
+	SuspendedUntil *time.Time `json:"suspended_until"`
+	// IsBot marks an automated account owned by BotOwnerID. Bots cannot log
+	// in and authenticate with API tokens only.
+	IsBot       bool   `json:"is_bot"`
+	BotOwnerID  string `json:"bot_owner_id,omitempty" gorm:"index;size:64"`
+	DisplayName string `json:"display_name,omitempty" gorm:"size:64"`
+	// TokenVersion is embedded in issued JWTs; bumping it revokes them all.
+	TokenVersion int       `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IsSuspended reports whether the account is suspended at t.
+func (u *User) IsSuspended(t time.Time) bool {
+	return u.SuspendedUntil != nil && u.SuspendedUntil.After(t)
+}
+
+// IsModerator reports whether the user may work the report queue.
+// Admins are moderators too.
+func (u *User) IsModerator() bool {
+	return u.Role == RoleModerator || u.Role == RoleAdmin
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// Outranks reports whether u's platform role is above other's.
+func (u *User) Outranks(other *User) bool {
+	return roleRank(u.Role) > roleRank(other.Role)
+}
+
+func roleRank(role string) int {
+	switch role {
+	case RoleAdmin:
+		return 2
+	case RoleModerator:
+		return 1
+	}
+	return 0
 }
 
 type SignUpRequest struct {
@@ -15,3 +74,38 @@ type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
 }
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+type TwoFactorEnrollRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+type SetHandleRequest struct {
+	Handle string `json:"handle"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// UserIdentity links a User to an account at an external OpenID Connect provider.
+type UserIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"index;size:64"`
+	Provider  string    `json:"provider" gorm:"uniqueIndex:idx_identity_subject;size:64"`
+	Subject   string    `json:"subject" gorm:"uniqueIndex:idx_identity_subject;size:191"`
+	Email     string    `json:"email" gorm:"size:191"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCLoginState holds the PKCE verifier and nonce of an authorization request
+// between the redirect to the provider and its callback.
+type OIDCLoginState struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	State        string    `json:"-" gorm:"uniqueIndex;size:64"`
+	Provider     string    `json:"provider" gorm:"size:64"`
+	CodeVerifier string    `json:"-" gorm:"size:128"`
+	Nonce        string    `json:"-" gorm:"size:64"`
+	ExpiresAt    time.Time `json:"expires_at" gorm:"index"`
+}
@@ -0,0 +1,21 @@
+package entity
+
+import "time"
+
+// Token purposes.
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenPasswordReset = "password_reset"
+)
+
+// UserToken is a single-use, expiring token sent to a user by email.
+// Only the SHA-256 hash of the token is stored.
+type UserToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    string     `json:"user_id" gorm:"index;size:64"`
+	Purpose   string     `json:"purpose" gorm:"index;size:32"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;size:64"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
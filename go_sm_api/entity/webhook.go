@@ -0,0 +1,91 @@
+package entity
+
+import "time"
+
+// WebhookEventAll subscribes a webhook to every event type.
+const WebhookEventAll = "*"
+
+// WebhookEventTypes are the Hub event types a webhook may subscribe to.
+var WebhookEventTypes = []string{
+	"private",
+	"private_read",
+	"message_request",
+	"message_request_accepted",
+	"group",
+	"group_join",
+	"group_ban",
+	"group_kick",
+	"group_mute",
+	"group_topic",
+	"reaction",
+	"message_deleted",
+	"message_expired",
+	"message_ttl",
+	"notification",
+	"report_resolved",
+}
+
+// Webhook is an HTTP endpoint that receives Hub events. A user's webhook gets
+// the events delivered to that user and to groups they belong to; a global
+// webhook (created by an admin) gets every event once.
+type Webhook struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	OwnerID     string    `json:"owner_id" gorm:"index;size:64"`
+	Global      bool      `json:"global" gorm:"index"`
+	URL         string    `json:"url" gorm:"size:512"`
+	Description string    `json:"description,omitempty" gorm:"size:255"`
+	Events      []string  `json:"events" gorm:"serializer:json"`
+	// Secret signs deliveries; it is only shown when created or rotated.
+	Secret  string `json:"-" gorm:"size:64"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Subscribed reports whether the webhook wants events of type evtType.
+func (w *Webhook) Subscribed(evtType string) bool {
+	for _, e := range w.Events {
+		if e == WebhookEventAll || e == evtType {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook delivery statuses. Dead deliveries ran out of attempts and stay in
+// the dead-letter list until redelivered.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// WebhookDelivery is one event queued for one webhook. Every delivery of the
+// same event shares EventID, which receivers can use to drop duplicates.
+type WebhookDelivery struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt      time.Time  `json:"created_at"`
+	WebhookID      uint       `json:"webhook_id" gorm:"index"`
+	EventID        string     `json:"event_id" gorm:"index;size:32"`
+	EventType      string     `json:"event_type" gorm:"size:32"`
+	Payload        string     `json:"payload" gorm:"type:text"`
+	Status         string     `json:"status" gorm:"index:idx_webhook_deliveries_due;size:16"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" gorm:"index:idx_webhook_deliveries_due"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty" gorm:"size:255"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL         string   `json:"url" binding:"required,url"`
+	Description string   `json:"description"`
+	Events      []string `json:"events" binding:"required,min=1"`
+}
+
+type UpdateWebhookRequest struct {
+	URL         *string  `json:"url" binding:"omitempty,url"`
+	Description *string  `json:"description"`
+	Events      []string `json:"events"`
+	Enabled     *bool    `json:"enabled"`
+}
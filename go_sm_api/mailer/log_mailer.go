@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogMailer is meant for local development and tests. It appends each message
+// as a JSON line to a file, or writes it to the standard logger when no file is set.
+type LogMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{path: path}
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	if m.path == "" {
+		log.Printf("mail to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+	line, err := json.Marshal(map[string]interface{}{
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.Body,
+		"ts":      time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
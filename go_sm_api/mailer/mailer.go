@@ -0,0 +1,13 @@
+package mailer
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(msg Message) error
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/abeme/go_sm_api/controller"
 	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/mailer"
 	"github.com/abeme/go_sm_api/middleware"
 	"github.com/abeme/go_sm_api/service"
+	"github.com/abeme/go_sm_api/utils"
 	"github.com/abeme/go_sm_api/ws"
 
 	"github.com/redis/go-redis/v9"
@@ -39,44 +45,416 @@ func main() {
 		&entity.GroupMessage{},
 		&entity.Group{},
 		&entity.GroupMember{},
+		&entity.MessageRequest{},
+		&entity.UserBlock{},
+		&entity.UserToken{},
+		&entity.RecoveryCode{},
+		&entity.UserIdentity{},
+		&entity.OIDCLoginState{},
+		&entity.ModerationRule{},
+		&entity.GroupModerationSettings{},
+		&entity.HeldMessage{},
+		&entity.Report{},
+		&entity.GroupBan{},
+		&entity.AuditEvent{},
+		&entity.Mention{},
+		&entity.Notification{},
+		&entity.Reaction{},
+		&entity.GroupInvite{},
+		&entity.PushSubscription{},
+		&entity.PushJob{},
+		&entity.Webhook{},
+		&entity.WebhookDelivery{},
+		&entity.APIToken{},
+		&entity.IncomingWebhook{},
+		&entity.GroupMute{},
+		&entity.BotCommand{},
+		&entity.ScheduledMessage{},
+		&entity.ConversationTTL{},
+		&entity.RetentionRule{},
+		&entity.RetentionRun{},
+		&entity.JobLease{},
+		&entity.E2EDevice{},
+		&entity.OneTimePreKey{},
+		&entity.ConversationE2E{},
+		&entity.DataKey{},
+		&entity.PinnedMessage{},
+		&entity.SavedMessage{},
+		&entity.ConversationSetting{},
+		&entity.GroupDM{},
+		&entity.GroupDMParticipant{},
+		&entity.GroupDMMessage{},
+		&entity.Channel{},
+		&entity.ChannelMember{},
 	); err != nil {
 		log.Fatalf("migrate failed: %v", err)
 	}
 
+	// message bodies are encrypted at rest when MESSAGE_MASTER_KEY (or a file
+	// named by MESSAGE_MASTER_KEY_FILE) holds master keys, current first;
+	// manage them with `go run ./cmd/msgkeys`
+	masterKeys, err := utils.LoadMasterKeys(os.Getenv("MESSAGE_MASTER_KEY"), os.Getenv("MESSAGE_MASTER_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("invalid message master keys: %v", err)
+	}
+	msgCipher := service.NewMessageCipher(db, masterKeys, service.MessageCipherConfig{})
+	if err := msgCipher.Register(); err != nil {
+		log.Fatalf("message encryption: %v", err)
+	}
+	go msgCipher.Run(context.Background())
+
 	// init redis
 	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
 
+	// mailer: SMTP when MAILER=smtp, otherwise log to MAIL_LOG_FILE (or stdout)
+	var mail mailer.Mailer
+	if os.Getenv("MAILER") == "smtp" {
+		mail = mailer.NewSMTPMailer(os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT"),
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+	} else {
+		mail = mailer.NewLogMailer(os.Getenv("MAIL_LOG_FILE"))
+	}
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
 	// services
 	userSvc := service.NewUserService(db)
+	accountSvc := service.NewAccountService(db, userSvc, mail, baseURL)
+	// REQUIRE_2FA=true enforces two-factor authentication for every account
+	twoFactorSvc := service.NewTwoFactorService(db, "GoApp", os.Getenv("REQUIRE_2FA") == "true")
+	oidcSvc := service.NewOIDCService(db, nil, oidcProvidersFromEnv(baseURL))
+	loginGuard := service.NewLoginGuard(service.NewRedisAttemptStore(rdb), service.DefaultAccountPolicy, service.DefaultIPPolicy)
+	// RATE_LIMITS overrides per-action token buckets, e.g. "private=5:10,rest_write=2:20"
+	rateLimits, err := service.ParseRateLimits(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		log.Fatalf("invalid RATE_LIMITS: %v", err)
+	}
+	limiter := service.NewRateLimiter(rdb, rateLimits)
+	maxLength, _ := strconv.Atoi(os.Getenv("MODERATION_MAX_LENGTH"))
+	moderator := service.NewModerator(db, service.ModerationConfig{
+		MaxLength:      maxLength,
+		BlockedWords:   splitList(os.Getenv("MODERATION_BLOCKED_WORDS")),
+		BlockedDomains: splitList(os.Getenv("MODERATION_BLOCKED_DOMAINS")),
+		SpamAction:     os.Getenv("MODERATION_SPAM_ACTION"),
+	})
 	groupSvc := service.NewGroupService(db, rdb)
 	pmSvc := service.NewPrivateMessageService(db)
 	gmSvc := service.NewGroupMessageService(db)
+	msgReqSvc := service.NewMessageRequestService(db)
+	reportSvc := service.NewReportService(db)
+	adminSvc := service.NewAdminService(db)
+	auditSvc := service.NewAuditService(db)
+	notifSvc := service.NewNotificationService(db, groupSvc)
+	reactionSvc := service.NewReactionService(db, groupSvc)
+	convSettingsSvc := service.NewConversationSettingsService(db, groupSvc)
+	// Web Push is enabled when VAPID_PRIVATE_KEY (and VAPID_PUBLIC_KEY) are set;
+	// generate a pair with `go run ./cmd/webpush genkeys`
+	var vapidKeys *utils.VAPIDKeys
+	if priv := os.Getenv("VAPID_PRIVATE_KEY"); priv != "" {
+		vapidKeys, err = utils.ParseVAPIDKeys(os.Getenv("VAPID_PUBLIC_KEY"), priv)
+		if err != nil {
+			log.Fatalf("invalid VAPID keys: %v", err)
+		}
+	}
+	// PUSH_ACK_WINDOW is how long a connected user has to acknowledge an event before it is pushed;
+	// PUSH_ALLOW_LOCAL_ENDPOINTS=true accepts http endpoints on local addresses, for development
+	ackWindow, _ := time.ParseDuration(os.Getenv("PUSH_ACK_WINDOW"))
+	pushSvc := service.NewPushService(db, nil, vapidKeys, service.PushConfig{
+		Subject:             os.Getenv("VAPID_SUBJECT"),
+		AckWindow:           ackWindow,
+		AllowLocalEndpoints: os.Getenv("PUSH_ALLOW_LOCAL_ENDPOINTS") == "true",
+	}, convSettingsSvc)
+	go pushSvc.Run(context.Background())
+	// WEBHOOK_ALLOW_PRIVATE_NETWORKS=true lets webhooks and bot commands call
+	// localhost and private addresses, for development
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true" {
+		service.AllowPrivateOutbound()
+	}
+	webhookSvc := service.NewWebhookService(db, groupSvc, nil, service.WebhookConfig{})
+	go webhookSvc.Run(context.Background())
+	botSvc := service.NewBotService(db, userSvc)
+	cmdSvc := service.NewCommandService(db, nil)
+	scheduledSvc := service.NewScheduledMessageService(db, groupSvc)
+	ttlSvc := service.NewMessageTTLService(db)
+	// RETENTION_PURGE_INTERVAL (e.g. "6h") and RETENTION_BATCH_SIZE tune the
+	// purge job; rules are managed under /admin/retention
+	retentionInterval, _ := time.ParseDuration(os.Getenv("RETENTION_PURGE_INTERVAL"))
+	retentionBatch, _ := strconv.Atoi(os.Getenv("RETENTION_BATCH_SIZE"))
+	retentionSvc := service.NewRetentionService(db, service.RetentionConfig{Interval: retentionInterval, BatchSize: retentionBatch})
+	go retentionSvc.Run(context.Background())
+	e2eSvc := service.NewE2EService(db)
+	pinSvc := service.NewPinService(db, groupSvc)
+	savedSvc := service.NewSavedMessageService(db, groupSvc)
+	groupDMSvc := service.NewGroupDMService(db)
+	channelSvc := service.NewChannelService(db, groupSvc)
+
+	// ADMIN_EMAILS / MODERATOR_EMAILS promote existing accounts at startup
+	promoteUsers(userSvc, os.Getenv("ADMIN_EMAILS"), entity.RoleAdmin)
+	promoteUsers(userSvc, os.Getenv("MODERATOR_EMAILS"), entity.RoleModerator)
 
 	// ws hub (init before controllers needing it)
-	hub := ws.NewHub(rdb, groupSvc)
+	hub := ws.NewHub(rdb, groupSvc, notifSvc, pushSvc, webhookSvc, msgReqSvc)
+	sender := ws.NewSender(hub, pmSvc, groupSvc, gmSvc, groupDMSvc, userSvc, moderator)
+	commands := ws.NewCommands(hub, sender, groupSvc, userSvc, notifSvc, cmdSvc, auditSvc)
+	// every instance runs the scheduler; due messages are leased row by row
+	go ws.NewScheduler(scheduledSvc, sender, hub, 0).Run(context.Background())
+	go ws.NewExpirySweeper(ttlSvc, groupDMSvc, hub, 0).Run(context.Background())
 
 	// controllers
-	authCtrl := controller.NewAuthController(userSvc)
-	groupCtrl := controller.NewGroupController(groupSvc, hub)
+	authCtrl := controller.NewAuthController(userSvc, accountSvc, twoFactorSvc, loginGuard, auditSvc, hub)
+	twoFactorCtrl := controller.NewTwoFactorController(twoFactorSvc, auditSvc)
+	oidcCtrl := controller.NewOIDCController(oidcSvc, twoFactorSvc, auditSvc)
+	modCtrl := controller.NewModerationController(moderator, groupSvc, sender, auditSvc)
+	reportCtrl := controller.NewReportController(reportSvc, userSvc, groupSvc, pmSvc, gmSvc, auditSvc, hub)
+	groupCtrl := controller.NewGroupController(groupSvc, notifSvc, hub)
+	userCtrl := controller.NewUserController(userSvc)
+	notifCtrl := controller.NewNotificationController(notifSvc)
+	reactionCtrl := controller.NewReactionController(reactionSvc, notifSvc, hub)
+	pushCtrl := controller.NewPushController(pushSvc)
 	pmCtrl := controller.NewPrivateMessageController(pmSvc, userSvc, hub)
+	msgReqCtrl := controller.NewMessageRequestController(msgReqSvc, hub)
+	adminCtrl := controller.NewAdminController(adminSvc, userSvc, accountSvc, groupSvc, moderator, auditSvc, hub)
+	auditCtrl := controller.NewAuditController(auditSvc)
+	webhookCtrl := controller.NewWebhookController(webhookSvc, auditSvc, false)
+	adminWebhookCtrl := controller.NewWebhookController(webhookSvc, auditSvc, true)
+	msgCtrl := controller.NewMessageController(sender, groupSvc, gmSvc, limiter)
+	botCtrl := controller.NewBotController(botSvc, auditSvc, hub)
+	incomingCtrl := controller.NewIncomingWebhookController(botSvc, groupSvc, sender, limiter, auditSvc, baseURL)
+	cmdCtrl := controller.NewCommandController(cmdSvc, commands, groupSvc)
+	scheduledCtrl := controller.NewScheduledMessageController(scheduledSvc)
+	ttlCtrl := controller.NewMessageTTLController(ttlSvc, groupSvc, groupDMSvc, hub)
+	retentionCtrl := controller.NewRetentionController(retentionSvc, auditSvc)
+	e2eCtrl := controller.NewE2EController(e2eSvc, hub)
+	pinCtrl := controller.NewPinController(pinSvc, hub)
+	savedCtrl := controller.NewSavedMessageController(savedSvc)
+	convSettingsCtrl := controller.NewConversationSettingsController(convSettingsSvc, hub)
+	groupDMCtrl := controller.NewGroupDMController(groupDMSvc, hub)
+	channelCtrl := controller.NewChannelController(channelSvc, hub)
+
+	// API tokens (bots and scripts) may only call these routes, each needing
+	// the listed scope; everything else requires a user session.
+	tokenRoutes := middleware.TokenRoutes{
+		"GET /api/me":                            entity.ScopeMessagesRead,
+		"GET /api/notifications":                 entity.ScopeMessagesRead,
+		"GET /api/invites":                       entity.ScopeMessagesRead,
+		"GET /api/groups/:id/messages":           entity.ScopeMessagesRead,
+		"GET /api/messages/private/:otherUserID": entity.ScopeMessagesRead,
+		"GET /api/reactions/:kind/:id":           entity.ScopeMessagesRead,
+		"POST /api/messages/private":             entity.ScopeMessagesWrite,
+		"POST /api/messages/private/read":        entity.ScopeMessagesWrite,
+		"POST /api/groups/:id/messages":          entity.ScopeMessagesWrite,
+		"POST /api/reactions/:kind/:id":          entity.ScopeMessagesWrite,
+		"DELETE /api/reactions/:kind/:id/:emoji": entity.ScopeMessagesWrite,
+		"POST /api/groups/:id/join":              entity.ScopeGroupsWrite,
+		"POST /api/invites/:id/accept":           entity.ScopeGroupsWrite,
+		"POST /api/invites/:id/decline":          entity.ScopeGroupsWrite,
+		"GET /api/commands/available":            entity.ScopeMessagesRead,
+		"GET /api/commands":                      entity.ScopeCommandsWrite,
+		"POST /api/commands":                     entity.ScopeCommandsWrite,
+		"DELETE /api/commands/:name":             entity.ScopeCommandsWrite,
+		"GET /api/scheduled-messages":            entity.ScopeMessagesRead,
+		"GET /api/scheduled-messages/:id":        entity.ScopeMessagesRead,
+		"POST /api/scheduled-messages":           entity.ScopeMessagesWrite,
+		"PATCH /api/scheduled-messages/:id":      entity.ScopeMessagesWrite,
+		"DELETE /api/scheduled-messages/:id":     entity.ScopeMessagesWrite,
+	}
 
 	r.POST("/signup", authCtrl.SignUp)
 	r.POST("/login", authCtrl.Login)
+	r.POST("/login/2fa", authCtrl.LoginTwoFactor)
+	r.POST("/login/2fa/enroll", authCtrl.LoginTwoFactorEnroll)
+	r.GET("/auth/oidc", oidcCtrl.Providers)
+	r.GET("/auth/oidc/:provider/login", oidcCtrl.Login)
+	r.GET("/auth/oidc/:provider/callback", oidcCtrl.Callback)
+	r.POST("/verify-email", authCtrl.VerifyEmail)
+	r.POST("/password/forgot", authCtrl.ForgotPassword)
+	r.POST("/password/reset", authCtrl.ResetPassword)
 
 	protected := r.Group("/api")
-	protected.Use(middleware.AuthMiddleware())
+	protected.Use(middleware.AuthMiddleware(userSvc, botSvc, tokenRoutes))
+	protected.Use(middleware.RateLimitWrites(limiter))
+	protected.POST("/verify-email/resend", authCtrl.ResendVerification)
+	protected.POST("/password/change", authCtrl.ChangePassword)
+	protected.POST("/2fa/enroll", twoFactorCtrl.Enroll)
+	protected.POST("/2fa/confirm", twoFactorCtrl.Confirm)
+	protected.POST("/2fa/disable", twoFactorCtrl.Disable)
+	protected.POST("/2fa/recovery-codes", twoFactorCtrl.RecoveryCodes)
 	protected.POST("/groups", groupCtrl.Create)
 	protected.POST("/groups/:id/join", groupCtrl.Join)
+	protected.POST("/groups/:id/invites", groupCtrl.Invite)
+	protected.GET("/invites", groupCtrl.ListInvites)
+	protected.POST("/invites/:id/accept", groupCtrl.AcceptInvite)
+	protected.POST("/invites/:id/decline", groupCtrl.DeclineInvite)
+	protected.GET("/me", userCtrl.Me)
+	protected.PUT("/me/handle", userCtrl.SetHandle)
+	protected.GET("/notifications", notifCtrl.List)
+	protected.POST("/notifications/read", notifCtrl.MarkRead)
+	protected.GET("/push/public-key", pushCtrl.PublicKey)
+	protected.GET("/push/subscriptions", pushCtrl.List)
+	protected.POST("/push/subscriptions", pushCtrl.Subscribe)
+	protected.DELETE("/push/subscriptions", pushCtrl.Unsubscribe)
+	protected.POST("/push/test", pushCtrl.Test)
+	// reactions on private or group messages (:kind is "private" or "group")
+	protected.GET("/reactions/:kind/:id", reactionCtrl.List)
+	protected.POST("/reactions/:kind/:id", reactionCtrl.Add)
+	protected.DELETE("/reactions/:kind/:id/:emoji", reactionCtrl.Remove)
+	// moderation (group owners)
+	protected.GET("/groups/:id/moderation/rules", modCtrl.ListRules)
+	protected.POST("/groups/:id/moderation/rules", modCtrl.CreateRule)
+	protected.DELETE("/groups/:id/moderation/rules/:ruleID", modCtrl.DeleteRule)
+	protected.GET("/groups/:id/moderation/settings", modCtrl.GetSettings)
+	protected.PUT("/groups/:id/moderation/settings", modCtrl.UpdateSettings)
+	protected.GET("/groups/:id/moderation/held", modCtrl.ListHeld)
+	protected.POST("/moderation/held/:id/approve", modCtrl.Approve)
+	protected.POST("/moderation/held/:id/reject", modCtrl.Reject)
+	// reports
+	protected.POST("/reports", reportCtrl.Create)
+	protected.GET("/reports", reportCtrl.ListMine)
+	reports := protected.Group("/moderation/reports")
+	reports.Use(middleware.RequireRole(entity.RoleModerator, entity.RoleAdmin))
+	reports.GET("", reportCtrl.List)
+	reports.GET("/:id", reportCtrl.Get)
+	reports.POST("/:id/claim", reportCtrl.Claim)
+	reports.POST("/:id/resolve", reportCtrl.Resolve)
+	protected.GET("/moderation/held", middleware.RequireRole(entity.RoleModerator, entity.RoleAdmin), modCtrl.ListHeldPrivate)
 	protected.GET("/protected", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "You are authenticated"})
 	})
 	// private messages REST
 	protected.GET("/messages/private/:otherUserID", pmCtrl.ListConversation)
 	protected.POST("/messages/private/read", pmCtrl.MarkRead)
+	// message requests inbox (first-contact DMs from strangers)
+	protected.GET("/messages/requests", msgReqCtrl.List)
+	protected.POST("/messages/requests/:senderID/accept", msgReqCtrl.Accept)
+	protected.POST("/messages/requests/:senderID/ignore", msgReqCtrl.Ignore)
+	protected.POST("/messages/requests/:senderID/decline", msgReqCtrl.Decline)
+	// outgoing webhooks for the caller's own events
+	webhookRoutes(protected.Group("/webhooks"), webhookCtrl)
+
+	protected.POST("/messages/private", msgCtrl.SendPrivate)
+	protected.POST("/messages/forward", msgCtrl.Forward)
+	protected.GET("/groups/:id/messages", msgCtrl.ListGroup)
+	protected.POST("/groups/:id/messages", msgCtrl.SendGroup)
+
+	protected.GET("/bots", botCtrl.ListBots)
+	protected.POST("/bots", botCtrl.CreateBot)
+	protected.DELETE("/bots/:id", botCtrl.DeactivateBot)
+	protected.GET("/bots/:id/tokens", botCtrl.ListTokens)
+	protected.POST("/bots/:id/tokens", botCtrl.CreateToken)
+	protected.DELETE("/bots/:id/tokens/:tokenID", botCtrl.RevokeToken)
+	protected.GET("/tokens", botCtrl.ListTokens)
+	protected.POST("/tokens", botCtrl.CreateToken)
+	protected.DELETE("/tokens/:tokenID", botCtrl.RevokeToken)
+
+	protected.GET("/groups/:id/incoming-webhooks", incomingCtrl.List)
+	protected.POST("/groups/:id/incoming-webhooks", incomingCtrl.Create)
+	protected.DELETE("/groups/:id/incoming-webhooks/:hookID", incomingCtrl.Delete)
+
+	protected.GET("/commands/available", cmdCtrl.Available)
+	protected.GET("/commands", cmdCtrl.List)
+	protected.POST("/commands", cmdCtrl.Register)
+	protected.DELETE("/commands/:name", cmdCtrl.Delete)
+
+	protected.GET("/messages/private/:otherUserID/ttl", ttlCtrl.GetPrivate)
+	protected.PUT("/messages/private/:otherUserID/ttl", ttlCtrl.SetPrivate)
+	protected.GET("/groups/:id/ttl", ttlCtrl.GetGroup)
+	protected.PUT("/groups/:id/ttl", ttlCtrl.SetGroup)
+	protected.GET("/messages/private/:otherUserID/e2e", e2eCtrl.GetMode)
+	protected.PUT("/messages/private/:otherUserID/e2e", e2eCtrl.SetMode)
+	protected.GET("/keys/devices", e2eCtrl.ListDevices)
+	protected.PUT("/keys/devices/:deviceID", e2eCtrl.RegisterDevice)
+	protected.DELETE("/keys/devices/:deviceID", e2eCtrl.DeleteDevice)
+	protected.POST("/keys/devices/:deviceID/prekeys", e2eCtrl.UploadPreKeys)
+	protected.POST("/keys/users/:userID/bundles", e2eCtrl.Bundles)
+	// pins: group owners in groups, either participant in DMs
+	protected.GET("/groups/:id/pins", pinCtrl.GroupPins)
+	protected.PUT("/groups/:id/pins/:messageID", pinCtrl.PinGroup)
+	protected.DELETE("/groups/:id/pins/:messageID", pinCtrl.UnpinGroup)
+	protected.GET("/messages/private/:otherUserID/pins", pinCtrl.PrivatePins)
+	protected.PUT("/messages/private/:otherUserID/pins/:messageID", pinCtrl.PinPrivate)
+	protected.DELETE("/messages/private/:otherUserID/pins/:messageID", pinCtrl.UnpinPrivate)
+	// saved messages (:kind is "private" or "group")
+	protected.GET("/saved", savedCtrl.List)
+	protected.PUT("/saved/:kind/:id", savedCtrl.Save)
+	protected.DELETE("/saved/:kind/:id", savedCtrl.Unsave)
+	// inbox and per-conversation mute/archive/pin/notification settings
+	protected.GET("/conversations", convSettingsCtrl.Inbox)
+	protected.GET("/conversations/settings", convSettingsCtrl.List)
+	protected.GET("/messages/private/:otherUserID/settings", convSettingsCtrl.GetPrivate)
+	protected.PATCH("/messages/private/:otherUserID/settings", convSettingsCtrl.UpdatePrivate)
+	protected.GET("/groups/:id/settings", convSettingsCtrl.GetGroup)
+	protected.PATCH("/groups/:id/settings", convSettingsCtrl.UpdateGroup)
+	// group DMs: unnamed conversations of 3 to 10 users, outside the group namespace
+	protected.GET("/group-dms", groupDMCtrl.List)
+	protected.POST("/group-dms", groupDMCtrl.Create)
+	protected.GET("/group-dms/:id", groupDMCtrl.Get)
+	protected.PATCH("/group-dms/:id", groupDMCtrl.Rename)
+	protected.POST("/group-dms/:id/participants", groupDMCtrl.AddParticipants)
+	protected.POST("/group-dms/:id/leave", groupDMCtrl.Leave)
+	protected.GET("/group-dms/:id/messages", groupDMCtrl.Messages)
+	protected.POST("/group-dms/:id/messages", msgCtrl.SendGroupDM)
+	protected.POST("/group-dms/:id/read", groupDMCtrl.MarkRead)
+	protected.GET("/group-dms/:id/ttl", ttlCtrl.GetGroupDM)
+	protected.PUT("/group-dms/:id/ttl", ttlCtrl.SetGroupDM)
+	protected.GET("/group-dms/:id/settings", convSettingsCtrl.GetGroupDM)
+	protected.PATCH("/group-dms/:id/settings", convSettingsCtrl.UpdateGroupDM)
+	// channels: group owners manage them; the group's own messages form its default channel
+	protected.GET("/groups/:id/channels", channelCtrl.List)
+	protected.POST("/groups/:id/channels", channelCtrl.Create)
+	protected.GET("/groups/:id/channels/:channelID", channelCtrl.Get)
+	protected.PATCH("/groups/:id/channels/:channelID", channelCtrl.Update)
+	protected.DELETE("/groups/:id/channels/:channelID", channelCtrl.Delete)
+	protected.GET("/groups/:id/channels/:channelID/members", channelCtrl.Members)
+	protected.POST("/groups/:id/channels/:channelID/members", channelCtrl.AddMembers)
+	protected.DELETE("/groups/:id/channels/:channelID/members/:userID", channelCtrl.RemoveMember)
+	protected.GET("/groups/:id/channels/:channelID/messages", msgCtrl.ListChannel)
+	protected.POST("/groups/:id/channels/:channelID/messages", msgCtrl.SendChannel)
+
+	protected.GET("/scheduled-messages", scheduledCtrl.List)
+	protected.POST("/scheduled-messages", scheduledCtrl.Create)
+	protected.GET("/scheduled-messages/:id", scheduledCtrl.Get)
+	protected.PATCH("/scheduled-messages/:id", scheduledCtrl.Update)
+	protected.DELETE("/scheduled-messages/:id", scheduledCtrl.Cancel)
+
+	// incoming webhook URLs carry their own secret
+	hooks := r.Group("/hooks")
+	hooks.Use(middleware.RateLimitWrites(limiter))
+	hooks.POST("/incoming/:token", incomingCtrl.Post)
+
+	// platform administration
+	admin := r.Group("/admin")
+	admin.Use(middleware.AuthMiddleware(userSvc, nil, nil), middleware.AdminMiddleware())
+	admin.GET("/users", adminCtrl.ListUsers)
+	admin.GET("/users/:id", adminCtrl.GetUser)
+	admin.POST("/users/:id/suspend", adminCtrl.Suspend)
+	admin.POST("/users/:id/unsuspend", adminCtrl.Unsuspend)
+	admin.POST("/users/:id/logout", adminCtrl.ForceLogout)
+	admin.POST("/users/:id/reset-password", adminCtrl.ResetPassword)
+	admin.PUT("/users/:id/role", adminCtrl.SetRole)
+	admin.PUT("/users/:id/2fa-required", adminCtrl.SetTwoFactorRequired)
+	admin.GET("/groups", adminCtrl.ListGroups)
+	admin.DELETE("/groups/:id", adminCtrl.DeleteGroup)
+	admin.GET("/stats", adminCtrl.Stats)
+	admin.GET("/moderation/rules", adminCtrl.ListGlobalRules)
+	admin.POST("/moderation/rules", adminCtrl.CreateGlobalRule)
+	admin.DELETE("/moderation/rules/:ruleID", adminCtrl.DeleteGlobalRule)
+	admin.GET("/audit", auditCtrl.List)
+	admin.GET("/audit/export", auditCtrl.Export)
+	admin.GET("/retention/rules", retentionCtrl.ListRules)
+	admin.PUT("/retention/rules", retentionCtrl.SetRule)
+	admin.DELETE("/retention/rules/:ruleID", retentionCtrl.DeleteRule)
+	admin.GET("/retention/report", retentionCtrl.Report)
+	admin.POST("/retention/purge", retentionCtrl.Purge)
+	admin.GET("/retention/runs", retentionCtrl.Runs)
+	admin.GET("/retention/metrics", retentionCtrl.Metrics)
+	// global webhooks receive every event; admins can also manage users' webhooks
+	webhookRoutes(admin.Group("/webhooks"), adminWebhookCtrl)
 
 	// ws endpoint
 	r.GET("/ws", func(c *gin.Context) {
-		ws.ServeWS(hub, pmSvc, groupSvc, gmSvc, userSvc, c)
+		ws.ServeWS(hub, sender, commands, userSvc, botSvc, limiter, c)
 	})
 
 	log.Println("Starting server on :8080")
@@ -84,3 +462,68 @@ func main() {
 		log.Fatalf("server failed: %v", err)
 	}
 }
+
+// webhookRoutes mounts the webhook management API on g.
+func webhookRoutes(g *gin.RouterGroup, ctrl *controller.WebhookController) {
+	g.GET("/events", ctrl.EventTypes)
+	g.GET("", ctrl.List)
+	g.POST("", ctrl.Create)
+	g.GET("/:id", ctrl.Get)
+	g.PATCH("/:id", ctrl.Update)
+	g.DELETE("/:id", ctrl.Delete)
+	g.POST("/:id/rotate-secret", ctrl.RotateSecret)
+	g.POST("/:id/ping", ctrl.Ping)
+	g.GET("/:id/deliveries", ctrl.Deliveries)
+	g.GET("/:id/dead-letters", ctrl.DeadLetters)
+	g.POST("/:id/deliveries/:deliveryID/redeliver", ctrl.Redeliver)
+}
+
+// promoteUsers grants role to the listed emails unless they already have one.
+func promoteUsers(userSvc service.UserService, emails, role string) {
+	for _, email := range splitList(emails) {
+		if u, err := userSvc.GetByEmail(email); err == nil && u.Role == "" {
+			if err := userSvc.SetRole(u.ID, role); err != nil {
+				log.Printf("promote %s to %s: %v", email, role, err)
+			}
+		}
+	}
+}
+
+// splitList splits a comma separated env value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// oidcProvidersFromEnv reads OIDC_PROVIDERS (comma separated names) and, for each
+// name, OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and _SCOPES.
+func oidcProvidersFromEnv(baseURL string) []service.OIDCProviderConfig {
+	var configs []service.OIDCProviderConfig
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := service.OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if cfg.RedirectURL == "" {
+			cfg.RedirectURL = baseURL + "/auth/oidc/" + name + "/callback"
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Fields(scopes)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs
+}
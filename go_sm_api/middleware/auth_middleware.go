@@ -3,12 +3,23 @@ package middleware
 import (
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
 	"github.com/abeme/go_sm_api/utils"
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// TokenRoutes lists the routes reachable with an API token, keyed by
+// "METHOD /full/path" as registered, and the scope each one needs. Every other
+// route requires a JWT session.
+type TokenRoutes map[string]string
+
+// AuthMiddleware accepts a JWT session or, on the routes in tokenRoutes, an API
+// token carrying the route's scope. botSvc and tokenRoutes may be nil to allow
+// sessions only.
+func AuthMiddleware(userSvc service.UserService, botSvc service.BotService, tokenRoutes TokenRoutes) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := c.GetHeader("Authorization")
 		if auth == "" {
@@ -24,6 +35,11 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(parts[1], entity.APITokenPrefix) {
+			authenticateAPIToken(c, botSvc, tokenRoutes, parts[1])
+			return
+		}
+
 		claims, err := utils.ValidateToken(parts[1])
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
@@ -31,8 +47,89 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		u, err := userSvc.GetByID(claims.Subject)
+		if err != nil || claims.Version != u.TokenVersion {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			c.Abort()
+			return
+		}
+		if u.IsSuspended(time.Now()) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "account suspended"})
+			c.Abort()
+			return
+		}
+
 		// set user id in context
 		c.Set("user_id", claims.Subject)
+		c.Set("user", u)
+		c.Next()
+	}
+}
+
+func authenticateAPIToken(c *gin.Context, botSvc service.BotService, tokenRoutes TokenRoutes, raw string) {
+	scope, ok := tokenRoutes[c.Request.Method+" "+c.FullPath()]
+	if botSvc == nil || !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "this endpoint requires a user session"})
+		c.Abort()
+		return
+	}
+	u, tok, err := botSvc.Authenticate(raw)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		c.Abort()
+		return
+	}
+	if !tok.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "token lacks scope " + scope})
+		c.Abort()
+		return
+	}
+	if u.IsSuspended(time.Now()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account suspended"})
+		c.Abort()
+		return
+	}
+	c.Set("user_id", u.ID)
+	c.Set("user", u)
+	c.Set("api_token", tok)
+	c.Next()
+}
+
+// AdminMiddleware guards the /admin routes: the caller must be an admin who has
+// two-factor authentication enabled. It must run after AuthMiddleware.
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		val, _ := c.Get("user")
+		u, _ := val.(*entity.User)
+		if u == nil || !u.IsAdmin() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "admin only"})
+			c.Abort()
+			return
+		}
+		if !u.TOTPEnabled {
+			c.JSON(http.StatusForbidden, gin.H{"error": "enable two-factor authentication to use admin endpoints"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
+
+// RequireRole allows only users whose platform role is one of roles.
+// It must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		val, _ := c.Get("user")
+		u, _ := val.(*entity.User)
+		if u != nil {
+			for _, r := range roles {
+				if u.Role == r {
+					c.Next()
+					return
+				}
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient role"})
+		c.Abort()
+	}
+}
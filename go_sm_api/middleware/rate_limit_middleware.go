@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitWrites limits non-GET requests per authenticated user (or client IP
+// before authentication) under the rest_write action.
+func RateLimitWrites(limiter *service.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		key := c.GetString("user_id")
+		if key == "" {
+			key = "ip:" + c.ClientIP()
+		}
+		ok, wait := limiter.Allow(c.Request.Context(), service.ActionRESTWrite, key)
+		if !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(secs))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limited", "retry_after": secs})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
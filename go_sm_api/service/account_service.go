@@ -0,0 +1,158 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/mailer"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+)
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	passwordResetTTL = time.Hour
+)
+
+// AccountService handles email verification and password reset flows.
+type AccountService interface {
+	SendVerification(u *entity.User) error
+	VerifyEmail(token string) (*entity.User, error)
+	RequestPasswordReset(email string) error
+	ResetPassword(token, newPassword string) (*entity.User, error)
+}
+
+type DBAccountService struct {
+	db      *gorm.DB
+	userSvc UserService
+	mail    mailer.Mailer
+	baseURL string
+}
+
+// NewAccountService creates an AccountService; baseURL is used to build links in emails.
+func NewAccountService(db *gorm.DB, userSvc UserService, mail mailer.Mailer, baseURL string) *DBAccountService {
+	return &DBAccountService{db: db, userSvc: userSvc, mail: mail, baseURL: baseURL}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken stores a new token for the user and returns its plaintext value.
+// Outstanding tokens for the same purpose are invalidated.
+func (s *DBAccountService) issueToken(userID, purpose string, ttl time.Duration) (string, error) {
+	token := generateID(32)
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&entity.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", &now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&entity.UserToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hashToken(token),
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeToken marks a token as used and returns its owner. A token can only be consumed once.
+func (s *DBAccountService) consumeToken(token, purpose string) (string, error) {
+	var t entity.UserToken
+	if err := s.db.Where("token_hash = ? AND purpose = ?", hashToken(token), purpose).First(&t).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrInvalidToken
+		}
+		return "", err
+	}
+	now := time.Now()
+	res := s.db.Model(&entity.UserToken{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", t.ID, now).
+		Update("used_at", &now)
+	if res.Error != nil {
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		return "", ErrInvalidToken
+	}
+	return t.UserID, nil
+}
+
+func (s *DBAccountService) SendVerification(u *entity.User) error {
+	if u.EmailVerified {
+		return nil
+	}
+	token, err := s.issueToken(u.ID, entity.TokenVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	return s.mail.Send(mailer.Message{
+		To:      u.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm your email address by opening the link below:\n\n%s/verify-email?token=%s\n\nThe link expires in %s.",
+			s.baseURL, token, verifyEmailTTL),
+	})
+}
+
+func (s *DBAccountService) VerifyEmail(token string) (*entity.User, error) {
+	userID, err := s.consumeToken(token, entity.TokenVerifyEmail)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userSvc.MarkEmailVerified(userID); err != nil {
+		return nil, err
+	}
+	return s.userSvc.GetByID(userID)
+}
+
+// RequestPasswordReset emails a reset link. Unknown emails are ignored so callers
+// cannot probe which addresses have accounts.
+func (s *DBAccountService) RequestPasswordReset(email string) error {
+	u, err := s.userSvc.GetByEmail(email)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, err := s.issueToken(u.ID, entity.TokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	return s.mail.Send(mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for this account. If it was you, open the link below:\n\n%s/reset-password?token=%s\n\nThe link expires in %s. If you did not ask for this, ignore this email.",
+			s.baseURL, token, passwordResetTTL),
+	})
+}
+
+func (s *DBAccountService) ResetPassword(token, newPassword string) (*entity.User, error) {
+	userID, err := s.consumeToken(token, entity.TokenPasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userSvc.SetPassword(userID, newPassword); err != nil {
+		return nil, err
+	}
+	// receiving the reset email proves ownership of the address
+	if err := s.userSvc.MarkEmailVerified(userID); err != nil {
+		return nil, err
+	}
+	return s.userSvc.GetByID(userID)
+}
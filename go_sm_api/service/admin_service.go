@@ -0,0 +1,115 @@
+package service
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+// DailyCount is the number of messages sent on one day (UTC).
+type DailyCount struct {
+	Day     string `json:"day"`
+	Private int64  `json:"private"`
+	Group   int64  `json:"group"`
+}
+
+// SystemStats is the platform overview shown to admins.
+type SystemStats struct {
+	Users          int64        `json:"users"`
+	SuspendedUsers int64        `json:"suspended_users"`
+	Groups         int64        `json:"groups"`
+	OpenReports    int64        `json:"open_reports"`
+	MessagesPerDay []DailyCount `json:"messages_per_day"`
+}
+
+// AdminService provides platform-wide queries for administrators.
+type AdminService interface {
+	SearchUsers(query string, limit, offset int) ([]entity.User, int64, error)
+	Stats(days int) (*SystemStats, error)
+}
+
+type DBAdminService struct {
+	db *gorm.DB
+}
+
+func NewAdminService(db *gorm.DB) *DBAdminService {
+	return &DBAdminService{db: db}
+}
+
+// SearchUsers matches query against email and ID; an empty query lists everyone.
+func (s *DBAdminService) SearchUsers(query string, limit, offset int) ([]entity.User, int64, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := s.db.Model(&entity.User{})
+	if query != "" {
+		like := "%" + query + "%"
+		q = q.Where("email LIKE ? OR id = ?", like, query)
+	}
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var users []entity.User
+	if err := q.Order("email").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (s *DBAdminService) Stats(days int) (*SystemStats, error) {
+	if days <= 0 || days > 90 {
+		days = 14
+	}
+	st := &SystemStats{}
+	if err := s.db.Model(&entity.User{}).Count(&st.Users).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&entity.User{}).Where("suspended_until > ?", time.Now()).Count(&st.SuspendedUsers).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&entity.Group{}).Count(&st.Groups).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&entity.Report{}).Where("status IN ?", []string{entity.ReportOpen, entity.ReportInReview}).Count(&st.OpenReports).Error; err != nil {
+		return nil, err
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Truncate(24 * time.Hour)
+	byDay := make(map[string]*DailyCount, days)
+	for i := 0; i < days; i++ {
+		day := since.AddDate(0, 0, i).Format("2006-01-02")
+		st.MessagesPerDay = append(st.MessagesPerDay, DailyCount{Day: day})
+	}
+	for i := range st.MessagesPerDay {
+		byDay[st.MessagesPerDay[i].Day] = &st.MessagesPerDay[i]
+	}
+	type row struct {
+		Day string
+		N   int64
+	}
+	// timestamps are stored as "YYYY-MM-DD hh:mm:ss..." so the day is the first 10 chars
+	for _, m := range []struct {
+		model interface{}
+		set   func(*DailyCount, int64)
+	}{
+		{&entity.PrivateMessage{}, func(d *DailyCount, n int64) { d.Private = n }},
+		{&entity.GroupMessage{}, func(d *DailyCount, n int64) { d.Group = n }},
+	} {
+		var rows []row
+		if err := s.db.Model(m.model).
+			Select("substr(created_at, 1, 10) AS day, COUNT(*) AS n").
+			Where("created_at >= ?", since).
+			Group("day").Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			if d, ok := byDay[r.Day]; ok {
+				m.set(d, r.N)
+			}
+		}
+	}
+	return st, nil
+}
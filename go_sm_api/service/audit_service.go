@@ -0,0 +1,116 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+// AuditFilter narrows audit queries. Action may end in "*" to match a prefix
+// ("login.*"); zero values are ignored.
+type AuditFilter struct {
+	Action   string
+	ActorID  string
+	TargetID string
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	AfterID  uint
+	Limit    int
+}
+
+// AuditService appends to and reads the audit log. There is deliberately no way
+// to change or remove events.
+type AuditService interface {
+	Record(e *entity.AuditEvent) error
+	// List returns matching events, newest first. AfterID pages backwards.
+	List(f AuditFilter) ([]entity.AuditEvent, error)
+	// Export streams matching events, oldest first, as JSON lines.
+	Export(f AuditFilter, w io.Writer) error
+}
+
+type DBAuditService struct {
+	db *gorm.DB
+}
+
+func NewAuditService(db *gorm.DB) *DBAuditService {
+	return &DBAuditService{db: db}
+}
+
+func (s *DBAuditService) Record(e *entity.AuditEvent) error {
+	e.ID = 0
+	return s.db.Create(e).Error
+}
+
+func (s *DBAuditService) List(f AuditFilter) ([]entity.AuditEvent, error) {
+	if f.Limit <= 0 || f.Limit > 500 {
+		f.Limit = 100
+	}
+	q := s.filter(f)
+	if f.AfterID > 0 {
+		q = q.Where("id < ?", f.AfterID)
+	}
+	var events []entity.AuditEvent
+	if err := q.Order("id DESC").Limit(f.Limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *DBAuditService) Export(f AuditFilter, w io.Writer) error {
+	q := s.filter(f)
+	if f.AfterID > 0 {
+		q = q.Where("id > ?", f.AfterID)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	rows, err := q.Order("id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var e entity.AuditEvent
+		if err := s.db.ScanRows(rows, &e); err != nil {
+			return err
+		}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *DBAuditService) filter(f AuditFilter) *gorm.DB {
+	q := s.db.Model(&entity.AuditEvent{})
+	if f.Action != "" {
+		if prefix, ok := strings.CutSuffix(f.Action, "*"); ok {
+			q = q.Where("action LIKE ?", prefix+"%")
+		} else {
+			q = q.Where("action = ?", f.Action)
+		}
+	}
+	if f.ActorID != "" {
+		q = q.Where("actor_id = ?", f.ActorID)
+	}
+	if f.TargetID != "" {
+		q = q.Where("target_id = ?", f.TargetID)
+	}
+	if f.IP != "" {
+		q = q.Where("ip = ?", f.IP)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	return q
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrBotNotFound             = errors.New("bot not found")
+	ErrTooManyBots             = errors.New("bot limit reached")
+	ErrAPITokenNotFound        = errors.New("api token not found")
+	ErrInvalidAPIToken         = errors.New("invalid api token")
+	ErrInvalidScope            = errors.New("unknown token scope")
+	ErrInvalidTokenTTL         = errors.New("token lifetime must be between 0 and 3650 days")
+	ErrIncomingWebhookNotFound = errors.New("incoming webhook not found")
+)
+
+const maxBotsPerOwner = 25
+
+// botEmailDomain gives bots a unique, undeliverable address so they fit the
+// users table; .invalid is reserved and never resolves.
+const botEmailDomain = "@bots.invalid"
+
+// lastUsedGranularity limits how often LastUsedAt is written for busy tokens.
+const lastUsedGranularity = time.Minute
+
+// BotService manages bot accounts, API tokens and incoming webhooks.
+type BotService interface {
+	// CreateBot creates a bot owned by ownerID, reachable as @handle.
+	CreateBot(ownerID, name, handle string) (*entity.User, error)
+	ListBots(ownerID string) ([]entity.User, error)
+	GetBot(ownerID, botID string) (*entity.User, error)
+	// DeactivateBot revokes the bot's tokens, removes it from its groups and
+	// suspends it.
+	DeactivateBot(ownerID, botID string) error
+
+	// CreateToken issues a token for userID and returns its plaintext value,
+	// which is not stored. A ttl of 0 never expires.
+	CreateToken(userID, name string, scopes []string, ttl time.Duration) (string, *entity.APIToken, error)
+	ListTokens(userID string) ([]entity.APIToken, error)
+	RevokeToken(userID string, tokenID uint) error
+	// Authenticate resolves a plaintext API token to its user.
+	Authenticate(raw string) (*entity.User, *entity.APIToken, error)
+
+	// CreateIncomingWebhook creates a webhook bot in the group and returns
+	// the secret part of the webhook URL.
+	CreateIncomingWebhook(groupID uint, creatorID, name string) (string, *entity.IncomingWebhook, error)
+	ListIncomingWebhooks(groupID uint) ([]entity.IncomingWebhook, error)
+	DeleteIncomingWebhook(groupID, id uint) error
+	ResolveIncomingWebhook(raw string) (*entity.IncomingWebhook, error)
+}
+
+type DBBotService struct {
+	db      *gorm.DB
+	userSvc UserService
+}
+
+func NewBotService(db *gorm.DB, userSvc UserService) *DBBotService {
+	return &DBBotService{db: db, userSvc: userSvc}
+}
+
+// newBotUser stores a bot account; it has no password so it cannot log in.
+func (s *DBBotService) newBotUser(ownerID, name string) (*entity.User, error) {
+	id := generateID(8)
+	bot := &entity.User{
+		ID:            id,
+		Email:         "bot-" + id + botEmailDomain,
+		EmailVerified: true,
+		IsBot:         true,
+		BotOwnerID:    ownerID,
+		DisplayName:   name,
+	}
+	if err := s.db.Create(bot).Error; err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
+
+func (s *DBBotService) CreateBot(ownerID, name, handle string) (*entity.User, error) {
+	var cnt int64
+	if err := s.activeBots(ownerID).Model(&entity.User{}).Count(&cnt).Error; err != nil {
+		return nil, err
+	}
+	if cnt >= maxBotsPerOwner {
+		return nil, ErrTooManyBots
+	}
+	if strings.TrimSpace(handle) == "" {
+		return nil, ErrInvalidHandle
+	}
+	bot, err := s.newBotUser(ownerID, name)
+	if err != nil {
+		return nil, err
+	}
+	if bot.Handle, err = s.userSvc.SetHandle(bot.ID, handle); err != nil {
+		s.db.Delete(bot)
+		return nil, err
+	}
+	return bot, nil
+}
+
+func (s *DBBotService) ListBots(ownerID string) ([]entity.User, error) {
+	var bots []entity.User
+	if err := s.activeBots(ownerID).Order("created_at").Find(&bots).Error; err != nil {
+		return nil, err
+	}
+	return bots, nil
+}
+
+// activeBots scopes a query to ownerID's bots. Incoming webhook bots have no
+// handle and deactivated bots lose theirs, so both are left out.
+func (s *DBBotService) activeBots(ownerID string) *gorm.DB {
+	return s.db.Where("bot_owner_id = ? AND is_bot = ? AND handle <> ''", ownerID, true)
+}
+
+func (s *DBBotService) GetBot(ownerID, botID string) (*entity.User, error) {
+	var bot entity.User
+	if err := s.activeBots(ownerID).Where("id = ?", botID).First(&bot).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrBotNotFound
+		}
+		return nil, err
+	}
+	return &bot, nil
+}
+
+func (s *DBBotService) DeactivateBot(ownerID, botID string) error {
+	bot, err := s.GetBot(ownerID, botID)
+	if err != nil {
+		return err
+	}
+	return s.deactivate(s.db, bot.ID)
+}
+
+func (s *DBBotService) deactivate(db *gorm.DB, botID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&entity.APIToken{}).Where("user_id = ? AND revoked_at IS NULL", botID).
+			Update("revoked_at", &now).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", botID).Delete(&entity.GroupMember{}).Error; err != nil {
+			return err
+		}
+		// free the handle and keep the account around for message history
+		forever := time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+		return tx.Model(&entity.User{}).Where("id = ?", botID).Updates(map[string]interface{}{
+			"handle":          "",
+			"suspended_until": &forever,
+			"token_version":   gorm.Expr("token_version + 1"),
+		}).Error
+	})
+}
+
+func validateScopes(scopes []string) error {
+	for _, sc := range scopes {
+		known := false
+		for _, k := range entity.APITokenScopes {
+			if sc == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrInvalidScope, sc)
+		}
+	}
+	return nil
+}
+
+// maxAPITokenTTL is the longest lifetime a token can be created with.
+const maxAPITokenTTL = 3650 * 24 * time.Hour
+
+func (s *DBBotService) CreateToken(userID, name string, scopes []string, ttl time.Duration) (string, *entity.APIToken, error) {
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: no scopes", ErrInvalidScope)
+	}
+	if err := validateScopes(scopes); err != nil {
+		return "", nil, err
+	}
+	// a negative ttl is also what an overflowed days-to-duration conversion yields
+	if ttl < 0 || ttl > maxAPITokenTTL {
+		return "", nil, ErrInvalidTokenTTL
+	}
+	raw := entity.APITokenPrefix + generateID(20)
+	tok := entity.APIToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    raw[:len(entity.APITokenPrefix)+6],
+		TokenHash: hashToken(raw),
+		Scopes:    scopes,
+	}
+	if ttl > 0 {
+		exp := time.Now().Add(ttl)
+		tok.ExpiresAt = &exp
+	}
+	if err := s.db.Create(&tok).Error; err != nil {
+		return "", nil, err
+	}
+	return raw, &tok, nil
+}
+
+func (s *DBBotService) ListTokens(userID string) ([]entity.APIToken, error) {
+	var toks []entity.APIToken
+	if err := s.db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("id").Find(&toks).Error; err != nil {
+		return nil, err
+	}
+	return toks, nil
+}
+
+func (s *DBBotService) RevokeToken(userID string, tokenID uint) error {
+	now := time.Now()
+	res := s.db.Model(&entity.APIToken{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID).
+		Update("revoked_at", &now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+func (s *DBBotService) Authenticate(raw string) (*entity.User, *entity.APIToken, error) {
+	if !strings.HasPrefix(raw, entity.APITokenPrefix) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	var tok entity.APIToken
+	if err := s.db.Where("token_hash = ? AND revoked_at IS NULL", hashToken(raw)).First(&tok).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidAPIToken
+		}
+		return nil, nil, err
+	}
+	now := time.Now()
+	if tok.ExpiresAt != nil && tok.ExpiresAt.Before(now) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	u, err := s.userSvc.GetByID(tok.UserID)
+	if err != nil {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	if tok.LastUsedAt == nil || now.Sub(*tok.LastUsedAt) > lastUsedGranularity {
+		tok.LastUsedAt = &now
+		s.db.Model(&tok).Update("last_used_at", &now)
+	}
+	return u, &tok, nil
+}
+
+func (s *DBBotService) CreateIncomingWebhook(groupID uint, creatorID, name string) (string, *entity.IncomingWebhook, error) {
+	raw := generateID(24)
+	var hook entity.IncomingWebhook
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		txSvc := &DBBotService{db: tx, userSvc: s.userSvc}
+		bot, err := txSvc.newBotUser(creatorID, name)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&entity.GroupMember{GroupID: groupID, UserID: bot.ID}).Error; err != nil {
+			return err
+		}
+		hook = entity.IncomingWebhook{
+			GroupID:   groupID,
+			CreatorID: creatorID,
+			BotID:     bot.ID,
+			Name:      name,
+			Prefix:    raw[:6],
+			TokenHash: hashToken(raw),
+		}
+		return tx.Create(&hook).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return raw, &hook, nil
+}
+
+func (s *DBBotService) ListIncomingWebhooks(groupID uint) ([]entity.IncomingWebhook, error) {
+	var hooks []entity.IncomingWebhook
+	if err := s.db.Where("group_id = ?", groupID).Order("id").Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (s *DBBotService) DeleteIncomingWebhook(groupID, id uint) error {
+	var hook entity.IncomingWebhook
+	if err := s.db.Where("id = ? AND group_id = ?", id, groupID).First(&hook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrIncomingWebhookNotFound
+		}
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&hook).Error; err != nil {
+			return err
+		}
+		return s.deactivate(tx, hook.BotID)
+	})
+}
+
+func (s *DBBotService) ResolveIncomingWebhook(raw string) (*entity.IncomingWebhook, error) {
+	var hook entity.IncomingWebhook
+	if err := s.db.Where("token_hash = ?", hashToken(raw)).First(&hook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrIncomingWebhookNotFound
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if hook.LastUsedAt == nil || now.Sub(*hook.LastUsedAt) > lastUsedGranularity {
+		s.db.Model(&hook).Update("last_used_at", &now)
+	}
+	return &hook, nil
+}
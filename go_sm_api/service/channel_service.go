@@ -0,0 +1,313 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrChannelNotFound      = errors.New("channel not found")
+	ErrChannelExists        = errors.New("channel already exists in this group")
+	ErrChannelForbidden     = errors.New("only the group owner can manage channels")
+	ErrChannelReadOnly      = errors.New("only the group owner can post in this channel")
+	ErrChannelNotRestricted = errors.New("channel is open to every group member")
+	ErrChannelNameRequired  = errors.New("channel name is required")
+)
+
+// ChannelService manages the channels of a group. The group owner creates,
+// changes and deletes them and picks who may enter restricted ones; members
+// see the channels they can read.
+type ChannelService interface {
+	Create(userID string, groupID uint, req entity.CreateChannelRequest) (*entity.Channel, error)
+	// List returns the channels userID can read by name; the owner sees all of them.
+	List(userID string, groupID uint) ([]entity.Channel, error)
+	Get(userID string, groupID, channelID uint) (*entity.Channel, error)
+	Update(userID string, groupID, channelID uint, req entity.UpdateChannelRequest) (*entity.Channel, error)
+	// Delete removes the channel together with its messages.
+	Delete(userID string, groupID, channelID uint) error
+	// Members lists who can read the channel.
+	Members(userID string, groupID, channelID uint) ([]string, error)
+	// AddMembers lets group members into a restricted channel and returns
+	// those who were not in yet.
+	AddMembers(userID string, groupID, channelID uint, userIDs []string) ([]entity.ChannelMember, error)
+	// RemoveMember takes a member out of a restricted channel; members may
+	// remove themselves.
+	RemoveMember(userID string, groupID, channelID uint, memberID string) (bool, error)
+}
+
+type DBChannelService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewChannelService(db *gorm.DB, groupSvc *GroupService) *DBChannelService {
+	return &DBChannelService{db: db, groupSvc: groupSvc}
+}
+
+func (s *DBChannelService) Create(userID string, groupID uint, req entity.CreateChannelRequest) (*entity.Channel, error) {
+	if _, err := s.requireOwner(userID, groupID); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req.Name)
+	if err := s.checkName(groupID, 0, name); err != nil {
+		return nil, err
+	}
+	ch := &entity.Channel{
+		GroupID:    groupID,
+		Name:       name,
+		Topic:      req.Topic,
+		CreatedBy:  userID,
+		Restricted: req.Restricted,
+		PostPolicy: req.PostPolicy,
+	}
+	if ch.PostPolicy == "" {
+		ch.PostPolicy = entity.ChannelPostMembers
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(ch).Error; err != nil {
+			return err
+		}
+		if !ch.Restricted {
+			return nil
+		}
+		// the owner starts out in their restricted channel
+		return tx.Create(&entity.ChannelMember{ChannelID: ch.ID, UserID: userID, AddedBy: userID}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (s *DBChannelService) List(userID string, groupID uint) ([]entity.Channel, error) {
+	grp, err := s.groupSvc.GetGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireMember(groupID, userID); err != nil {
+		return nil, err
+	}
+	q := s.db.Where("group_id = ?", groupID)
+	if grp.OwnerID != userID {
+		q = q.Where("(restricted = ? OR id IN (?))", false,
+			s.db.Model(&entity.ChannelMember{}).Select("channel_id").Where("user_id = ?", userID))
+	}
+	var channels []entity.Channel
+	if err := q.Order("name").Find(&channels).Error; err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+func (s *DBChannelService) Get(userID string, groupID, channelID uint) (*entity.Channel, error) {
+	grp, err := s.groupSvc.GetGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireMember(groupID, userID); err != nil {
+		return nil, err
+	}
+	ch, err := s.groupSvc.GetChannel(groupID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if grp.OwnerID != userID {
+		// restricted channels do not exist for those left out
+		ok, err := s.groupSvc.IsChannelMember(groupID, channelID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrChannelNotFound
+		}
+	}
+	return ch, nil
+}
+
+func (s *DBChannelService) Update(userID string, groupID, channelID uint, req entity.UpdateChannelRequest) (*entity.Channel, error) {
+	if _, err := s.requireOwner(userID, groupID); err != nil {
+		return nil, err
+	}
+	ch, err := s.groupSvc.GetChannel(groupID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if err := s.checkName(groupID, channelID, name); err != nil {
+			return nil, err
+		}
+		updates["name"] = name
+	}
+	if req.Topic != nil {
+		updates["topic"] = *req.Topic
+	}
+	if req.PostPolicy != nil {
+		updates["post_policy"] = *req.PostPolicy
+	}
+	if len(updates) == 0 {
+		return ch, nil
+	}
+	if err := s.db.Model(ch).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return s.groupSvc.GetChannel(groupID, channelID)
+}
+
+func (s *DBChannelService) Delete(userID string, groupID, channelID uint) error {
+	if _, err := s.requireOwner(userID, groupID); err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND group_id = ?", channelID, groupID).Delete(&entity.Channel{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrChannelNotFound
+		}
+		msgIDs := tx.Model(&entity.GroupMessage{}).Select("id").Where("group_id = ? AND channel_id = ?", groupID, channelID)
+		if err := tx.Where("message_id IN (?)", msgIDs).Delete(&entity.Mention{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_kind = ? AND message_id IN (?)", "group", msgIDs).Delete(&entity.Reaction{}).Error; err != nil {
+			return err
+		}
+		if err := forgetMessages(tx, "group", msgIDs); err != nil {
+			return err
+		}
+		if err := tx.Where("message_kind = ? AND message_id IN (?)", "group", msgIDs).Delete(&entity.Notification{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ? AND channel_id = ?", groupID, channelID).Delete(&entity.GroupMessage{}).Error; err != nil {
+			return err
+		}
+		// held and scheduled messages would otherwise be posted to a channel
+		// that no longer exists
+		for _, model := range []interface{}{&entity.HeldMessage{}, &entity.ScheduledMessage{}} {
+			if err := tx.Where("group_id = ? AND channel_id = ?", groupID, channelID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("channel_id = ?", channelID).Delete(&entity.ChannelMember{}).Error
+	})
+}
+
+func (s *DBChannelService) Members(userID string, groupID, channelID uint) ([]string, error) {
+	if _, err := s.Get(userID, groupID, channelID); err != nil {
+		return nil, err
+	}
+	return s.groupSvc.ChannelMembers(groupID, channelID)
+}
+
+func (s *DBChannelService) AddMembers(userID string, groupID, channelID uint, userIDs []string) ([]entity.ChannelMember, error) {
+	if _, err := s.requireOwner(userID, groupID); err != nil {
+		return nil, err
+	}
+	ch, err := s.groupSvc.GetChannel(groupID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if !ch.Restricted {
+		return nil, ErrChannelNotRestricted
+	}
+	for _, id := range userIDs {
+		if err := s.requireMember(groupID, id); err != nil {
+			return nil, err
+		}
+	}
+	var added []entity.ChannelMember
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, id := range userIDs {
+			var cnt int64
+			if err := tx.Model(&entity.ChannelMember{}).Where("channel_id = ? AND user_id = ?", channelID, id).Count(&cnt).Error; err != nil {
+				return err
+			}
+			if cnt > 0 {
+				continue
+			}
+			m := entity.ChannelMember{ChannelID: channelID, UserID: id, AddedBy: userID}
+			if err := tx.Create(&m).Error; err != nil {
+				return err
+			}
+			added = append(added, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+func (s *DBChannelService) RemoveMember(userID string, groupID, channelID uint, memberID string) (bool, error) {
+	if memberID != userID {
+		if _, err := s.requireOwner(userID, groupID); err != nil {
+			return false, err
+		}
+	}
+	ch, err := s.groupSvc.GetChannel(groupID, channelID)
+	if err != nil {
+		return false, err
+	}
+	if !ch.Restricted {
+		return false, ErrChannelNotRestricted
+	}
+	res := s.db.Where("channel_id = ? AND user_id = ?", channelID, memberID).Delete(&entity.ChannelMember{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *DBChannelService) requireOwner(userID string, groupID uint) (*entity.Group, error) {
+	grp, err := s.groupSvc.GetGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if grp.OwnerID != userID {
+		return nil, ErrChannelForbidden
+	}
+	return grp, nil
+}
+
+func (s *DBChannelService) requireMember(groupID uint, userID string) error {
+	ok, err := s.groupSvc.IsMember(groupID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotGroupMember
+	}
+	return nil
+}
+
+// checkName fails when another channel of the group, other than exceptID, has name.
+func (s *DBChannelService) checkName(groupID, exceptID uint, name string) error {
+	if name == "" {
+		return ErrChannelNameRequired
+	}
+	var cnt int64
+	if err := s.db.Model(&entity.Channel{}).Where("group_id = ? AND name = ? AND id <> ?", groupID, name, exceptID).
+		Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return ErrChannelExists
+	}
+	return nil
+}
+
+// readableChannels scopes a query on a table with a channel_id column to the
+// group channels userID can read: the default channel, open channels and the
+// restricted channels they were let into. Group membership is checked apart.
+func readableChannels(userID string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		fresh := db.Session(&gorm.Session{NewDB: true})
+		return db.Where("(channel_id = 0 OR channel_id IN (?) OR channel_id IN (?))",
+			fresh.Model(&entity.Channel{}).Select("id").Where("restricted = ?", false),
+			fresh.Model(&entity.ChannelMember{}).Select("channel_id").Where("user_id = ?", userID))
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+var (
+	ErrCommandNotFound    = errors.New("command not found")
+	ErrInvalidCommandName = errors.New("command name must be 1-32 lowercase letters, digits, - or _ and not a built-in")
+	ErrCommandFailed      = errors.New("command endpoint failed")
+)
+
+var commandNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// CommandTimeout bounds how long a bot command's endpoint may take to answer;
+// the invoking socket waits for it.
+const CommandTimeout = 3 * time.Second
+
+// maxCommandReply caps how much of an endpoint's answer is read.
+const maxCommandReply = 8 << 10
+
+// CommandService stores bot slash commands and calls their endpoints.
+type CommandService interface {
+	// Register creates or updates the bot's command. The signing secret is
+	// returned when the command is created and "" on update.
+	Register(botID string, req entity.RegisterCommandRequest) (*entity.BotCommand, string, error)
+	List(botID string) ([]entity.BotCommand, error)
+	Delete(botID, name string) error
+	// Available lists the bot commands usable in a group (groupID != 0) or in
+	// a private chat with peerID.
+	Available(groupID uint, peerID string) ([]entity.BotCommand, error)
+	// Find resolves name among the Available commands.
+	Find(groupID uint, peerID, name string) (*entity.BotCommand, error)
+	// Invoke POSTs inv to the command's URL and returns the bot's reply.
+	Invoke(ctx context.Context, cmd *entity.BotCommand, inv entity.CommandInvocation) (*entity.CommandReply, error)
+}
+
+type DBCommandService struct {
+	db     *gorm.DB
+	client *http.Client
+}
+
+// NewCommandService returns a CommandService; a nil client uses one with
+// CommandTimeout.
+func NewCommandService(db *gorm.DB, client *http.Client) *DBCommandService {
+	if client == nil {
+		client = newOutboundClient(CommandTimeout)
+	}
+	return &DBCommandService{db: db, client: client}
+}
+
+func validateCommandName(name string) error {
+	if !commandNameRe.MatchString(name) {
+		return ErrInvalidCommandName
+	}
+	for _, b := range entity.BuiltinCommands {
+		if name == b {
+			return ErrInvalidCommandName
+		}
+	}
+	return nil
+}
+
+func (s *DBCommandService) Register(botID string, req entity.RegisterCommandRequest) (*entity.BotCommand, string, error) {
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Name), "/"))
+	if err := validateCommandName(name); err != nil {
+		return nil, "", err
+	}
+	if err := validateWebhookURL(req.URL); err != nil {
+		return nil, "", err
+	}
+	var cmd entity.BotCommand
+	err := s.db.Where("bot_id = ? AND name = ?", botID, name).First(&cmd).Error
+	switch {
+	case err == nil:
+		cmd.Description = req.Description
+		cmd.URL = req.URL
+		if err := s.db.Save(&cmd).Error; err != nil {
+			return nil, "", err
+		}
+		return &cmd, "", nil
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		cmd = entity.BotCommand{BotID: botID, Name: name, Description: req.Description, URL: req.URL, Secret: generateID(24)}
+		if err := s.db.Create(&cmd).Error; err != nil {
+			return nil, "", err
+		}
+		return &cmd, cmd.Secret, nil
+	default:
+		return nil, "", err
+	}
+}
+
+func (s *DBCommandService) List(botID string) ([]entity.BotCommand, error) {
+	var cmds []entity.BotCommand
+	if err := s.db.Where("bot_id = ?", botID).Order("name").Find(&cmds).Error; err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
+
+func (s *DBCommandService) Delete(botID, name string) error {
+	res := s.db.Where("bot_id = ? AND name = ?", botID, strings.ToLower(name)).Delete(&entity.BotCommand{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCommandNotFound
+	}
+	return nil
+}
+
+// available scopes a BotCommand query to a conversation. When two bots in a
+// group register the same name, the older registration wins.
+func (s *DBCommandService) available(groupID uint, peerID string) *gorm.DB {
+	q := s.db.Model(&entity.BotCommand{}).Order("name").Order("id")
+	if groupID != 0 {
+		return q.Where("bot_id IN (?)", s.db.Model(&entity.GroupMember{}).Select("user_id").Where("group_id = ?", groupID))
+	}
+	return q.Where("bot_id = ?", peerID)
+}
+
+func (s *DBCommandService) Available(groupID uint, peerID string) ([]entity.BotCommand, error) {
+	var cmds []entity.BotCommand
+	if err := s.available(groupID, peerID).Find(&cmds).Error; err != nil {
+		return nil, err
+	}
+	// drop shadowed duplicates, keeping the first of each name
+	out := cmds[:0]
+	for i, c := range cmds {
+		if i == 0 || c.Name != cmds[i-1].Name {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (s *DBCommandService) Find(groupID uint, peerID, name string) (*entity.BotCommand, error) {
+	var cmd entity.BotCommand
+	if err := s.available(groupID, peerID).Where("name = ?", strings.ToLower(name)).First(&cmd).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCommandNotFound
+		}
+		return nil, err
+	}
+	return &cmd, nil
+}
+
+func (s *DBCommandService) Invoke(ctx context.Context, cmd *entity.BotCommand, inv entity.CommandInvocation) (*entity.CommandReply, error) {
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cmd.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go_sm_api-commands/1")
+	req.Header.Set("X-Webhook-Event", "command")
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-Webhook-Signature", utils.SignWebhook(cmd.Secret, now, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCommandFailed, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxCommandReply))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCommandFailed, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%w: endpoint returned %d", ErrCommandFailed, resp.StatusCode)
+	}
+	var reply entity.CommandReply
+	if len(bytes.TrimSpace(raw)) > 0 {
+		if err := json.Unmarshal(raw, &reply); err != nil {
+			// plain text answers are shown to the invoker
+			reply.Text = string(raw)
+		}
+	}
+	if reply.ResponseType != entity.CommandReplyPublic {
+		reply.ResponseType = entity.CommandReplyEphemeral
+	}
+	return &reply, nil
+}
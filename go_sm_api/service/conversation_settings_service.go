@@ -0,0 +1,382 @@
+package service
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+// mutedForever is the MutedUntil of a conversation muted until unmuted.
+var mutedForever = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxMuteSeconds is the longest timed mute, ten years, matching the request
+// binding.
+const maxMuteSeconds = 10 * 365 * 24 * 60 * 60
+
+// ConversationSettingsService stores each user's mute, archive, pin and
+// notification level per conversation, and builds the inbox from them.
+// Conversations are keyed "private:<otherUserID>", "group_dm:<id>" or
+// "group:<id>".
+type ConversationSettingsService interface {
+	// Get returns the user's settings for conversation, or the defaults.
+	Get(userID, conversation string) (*entity.ConversationSetting, error)
+	// List returns every conversation the user changed a setting of, so a new
+	// device can sync them.
+	List(userID string) ([]entity.ConversationSetting, error)
+	// Update applies the fields set in req. Groups and group DMs require
+	// membership.
+	Update(userID, conversation string, req entity.UpdateConversationSettingsRequest) (*entity.ConversationSetting, error)
+	// Inbox lists the user's DMs, group DMs and groups with their latest message: pinned
+	// first, then by activity. Archived conversations are listed only when
+	// archived is true, and come back on their own once a newer message arrives.
+	Inbox(userID string, archived bool) ([]entity.InboxEntry, error)
+	PushMuteChecker
+}
+
+type DBConversationSettingsService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewConversationSettingsService(db *gorm.DB, groupSvc *GroupService) *DBConversationSettingsService {
+	return &DBConversationSettingsService{db: db, groupSvc: groupSvc}
+}
+
+func (s *DBConversationSettingsService) Get(userID, conversation string) (*entity.ConversationSetting, error) {
+	if err := s.checkConversation(userID, conversation); err != nil {
+		return nil, err
+	}
+	sts, err := conversationSettings(s.db, []string{userID}, conversation)
+	if err != nil {
+		return nil, err
+	}
+	st := sts[userID]
+	return &st, nil
+}
+
+func (s *DBConversationSettingsService) List(userID string) ([]entity.ConversationSetting, error) {
+	var sts []entity.ConversationSetting
+	err := s.db.Where("user_id = ?", userID).Order("conversation").Find(&sts).Error
+	return sts, err
+}
+
+func (s *DBConversationSettingsService) Update(userID, conversation string, req entity.UpdateConversationSettingsRequest) (*entity.ConversationSetting, error) {
+	if err := s.checkConversation(userID, conversation); err != nil {
+		return nil, err
+	}
+	var st entity.ConversationSetting
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		sts, err := conversationSettings(tx, []string{userID}, conversation)
+		if err != nil {
+			return err
+		}
+		st = sts[userID]
+		now := time.Now()
+		if req.MuteFor != nil {
+			switch {
+			case *req.MuteFor == 0:
+				st.MutedUntil = nil
+			case *req.MuteFor < 0 || *req.MuteFor > maxMuteSeconds:
+				// also keeps the duration below from overflowing
+				st.MutedUntil = &mutedForever
+			default:
+				until := now.Add(time.Duration(*req.MuteFor) * time.Second)
+				st.MutedUntil = &until
+			}
+		}
+		if req.Archived != nil {
+			st.ArchivedAt = nil
+			if *req.Archived {
+				st.ArchivedAt = &now
+			}
+		}
+		if req.Pinned != nil && *req.Pinned != (st.PinnedAt != nil) {
+			st.PinnedAt = nil
+			if *req.Pinned {
+				st.PinnedAt = &now
+			}
+		}
+		if req.NotifyLevel != nil {
+			st.NotifyLevel = *req.NotifyLevel
+		}
+		st.UpdatedAt = now
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&st).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// checkConversation validates a conversation key from the user's side.
+func (s *DBConversationSettingsService) checkConversation(userID, conversation string) error {
+	kind, ref, _ := strings.Cut(conversation, ":")
+	switch kind {
+	case "private":
+		if ref == "" || ref == userID {
+			return ErrInvalidRecipient
+		}
+		var cnt int64
+		if err := s.db.Model(&entity.User{}).Where("id = ?", ref).Count(&cnt).Error; err != nil {
+			return err
+		}
+		if cnt == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	case "group":
+		groupID, err := strconv.ParseUint(ref, 10, 64)
+		if err != nil {
+			return ErrGroupNotFound
+		}
+		ok, err := s.groupSvc.IsMember(uint(groupID), userID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNotGroupMember
+		}
+		return nil
+	case "group_dm":
+		id, err := strconv.ParseUint(ref, 10, 64)
+		if err != nil {
+			return ErrGroupDMNotFound
+		}
+		var cnt int64
+		if err := s.db.Model(&entity.GroupDMParticipant{}).Where("group_dm_id = ? AND user_id = ?", id, userID).Count(&cnt).Error; err != nil {
+			return err
+		}
+		if cnt == 0 {
+			return ErrGroupDMNotFound
+		}
+		return nil
+	}
+	return ErrInvalidRecipient
+}
+
+func (s *DBConversationSettingsService) Inbox(userID string, archived bool) ([]entity.InboxEntry, error) {
+	var dms []struct {
+		Other  string
+		LastID uint
+	}
+	if err := s.db.Model(&entity.PrivateMessage{}).Scopes(unexpired).
+		Select("CASE WHEN sender_id = ? THEN recipient_id ELSE sender_id END AS other, MAX(id) AS last_id", userID).
+		Where("sender_id = ? OR (recipient_id = ? AND pending = ?)", userID, userID, false).
+		Group("other").Scan(&dms).Error; err != nil {
+		return nil, err
+	}
+	var memberships []entity.GroupMember
+	if err := s.db.Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	groupIDs := make([]uint, 0, len(memberships))
+	for _, m := range memberships {
+		groupIDs = append(groupIDs, m.GroupID)
+	}
+	var groups []entity.Group
+	var latest []struct {
+		GroupID uint
+		LastID  uint
+	}
+	if len(groupIDs) > 0 {
+		if err := s.db.Where("id IN ?", groupIDs).Find(&groups).Error; err != nil {
+			return nil, err
+		}
+		if err := s.db.Model(&entity.GroupMessage{}).Scopes(unexpired, readableChannels(userID)).Select("group_id, MAX(id) AS last_id").
+			Where("group_id IN ?", groupIDs).Group("group_id").Scan(&latest).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	pmIDs := make([]uint, 0, len(dms))
+	for _, dm := range dms {
+		pmIDs = append(pmIDs, dm.LastID)
+	}
+	lastGroupMsg := make(map[uint]uint, len(latest))
+	gmIDs := make([]uint, 0, len(latest))
+	for _, l := range latest {
+		lastGroupMsg[l.GroupID] = l.LastID
+		gmIDs = append(gmIDs, l.LastID)
+	}
+	pms, gms, err := loadMessages(s.db, userID, pmIDs, gmIDs)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := s.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	byConversation := make(map[string]entity.ConversationSetting, len(settings))
+	for _, st := range settings {
+		byConversation[st.Conversation] = st
+	}
+
+	var entries []entity.InboxEntry
+	for _, dm := range dms {
+		pm := pms[dm.LastID]
+		if pm == nil {
+			continue
+		}
+		entries = append(entries, entity.InboxEntry{
+			Conversation:   "private:" + dm.Other,
+			UserID:         dm.Other,
+			LastActivity:   pm.CreatedAt,
+			PrivateMessage: pm,
+		})
+	}
+	joined := make(map[uint]time.Time, len(memberships))
+	for _, m := range memberships {
+		joined[m.GroupID] = m.CreatedAt
+	}
+	for _, g := range groups {
+		e := entity.InboxEntry{
+			Conversation: "group:" + strconv.FormatUint(uint64(g.ID), 10),
+			GroupID:      g.ID,
+			GroupName:    g.Name,
+			LastActivity: joined[g.ID],
+		}
+		if gm := gms[lastGroupMsg[g.ID]]; gm != nil {
+			e.GroupMessage = gm
+			e.LastActivity = gm.CreatedAt
+		}
+		entries = append(entries, e)
+	}
+	dmEntries, err := groupDMEntries(s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, dmEntries...)
+
+	out := entries[:0]
+	for _, e := range entries {
+		st, ok := byConversation[e.Conversation]
+		if !ok {
+			st = defaultConversationSetting(userID, e.Conversation)
+		}
+		e.Settings = st
+		isArchived := st.ArchivedAt != nil && !e.LastActivity.After(*st.ArchivedAt)
+		if isArchived == archived {
+			out = append(out, e)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		pi, pj := out[i].Settings.PinnedAt, out[j].Settings.PinnedAt
+		switch {
+		case pi != nil && pj != nil:
+			return pi.Before(*pj)
+		case pi != nil || pj != nil:
+			return pi != nil
+		}
+		return out[i].LastActivity.After(out[j].LastActivity)
+	})
+	return out, nil
+}
+
+// groupDMEntries builds the inbox entries of the user's group DMs.
+func groupDMEntries(db *gorm.DB, userID string) ([]entity.InboxEntry, error) {
+	var parts []entity.GroupDMParticipant
+	if err := db.Where("user_id = ?", userID).Find(&parts).Error; err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, 0, len(parts))
+	for _, p := range parts {
+		ids = append(ids, p.GroupDMID)
+	}
+	var dms []entity.GroupDM
+	if err := db.Preload("Participants", byJoined).Where("id IN ?", ids).Find(&dms).Error; err != nil {
+		return nil, err
+	}
+	unread, err := groupDMUnread(db, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []entity.GroupDMMessage
+	if err := db.Where("id IN (?)", db.Model(&entity.GroupDMMessage{}).Scopes(unexpired).Select("MAX(id)").
+		Where("group_dm_id IN ?", ids).Group("group_dm_id")).Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	latest := make(map[uint]*entity.GroupDMMessage, len(msgs))
+	for i := range msgs {
+		latest[msgs[i].GroupDMID] = &msgs[i]
+	}
+	joined := make(map[uint]time.Time, len(parts))
+	for _, p := range parts {
+		joined[p.GroupDMID] = p.CreatedAt
+	}
+	entries := make([]entity.InboxEntry, 0, len(dms))
+	for i := range dms {
+		dm := &dms[i]
+		dm.Unread = unread[dm.ID]
+		e := entity.InboxEntry{
+			Conversation: groupDMConversation(dm.ID),
+			GroupDM:      dm,
+			LastActivity: joined[dm.ID],
+		}
+		if msg := latest[dm.ID]; msg != nil {
+			e.GroupDMMessage = msg
+			e.LastActivity = msg.CreatedAt
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// PushMuted silences a push when the user muted the conversation or its
+// notification level excludes it. Group pushes are only sent for mentions;
+// DM and group DM pushes are plain messages.
+func (s *DBConversationSettingsService) PushMuted(userID, conversation string) bool {
+	sts, err := conversationSettings(s.db, []string{userID}, conversation)
+	if err != nil {
+		return false
+	}
+	kind := ""
+	if strings.HasPrefix(conversation, "group:") {
+		kind = entity.NotifyMention
+	}
+	return silences(sts[userID], kind, time.Now())
+}
+
+func defaultConversationSetting(userID, conversation string) entity.ConversationSetting {
+	return entity.ConversationSetting{UserID: userID, Conversation: conversation, NotifyLevel: entity.NotifyLevelAll}
+}
+
+// conversationSettings loads the settings of userIDs for conversation,
+// filling in the defaults for users without a row.
+func conversationSettings(db *gorm.DB, userIDs []string, conversation string) (map[string]entity.ConversationSetting, error) {
+	var rows []entity.ConversationSetting
+	if err := db.Where("conversation = ? AND user_id IN ?", conversation, userIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[string]entity.ConversationSetting, len(userIDs))
+	for _, id := range userIDs {
+		out[id] = defaultConversationSetting(id, conversation)
+	}
+	for _, st := range rows {
+		out[st.UserID] = st
+	}
+	return out, nil
+}
+
+// silences reports whether st suppresses a notification of kind; kind is ""
+// for a plain message.
+func silences(st entity.ConversationSetting, kind string, now time.Time) bool {
+	if st.MutedUntil != nil && st.MutedUntil.After(now) {
+		return true
+	}
+	switch st.NotifyLevel {
+	case entity.NotifyLevelNone:
+		return true
+	case entity.NotifyLevelMentions:
+		return kind != entity.NotifyMention
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"regexp"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrInvalidKey      = errors.New("keys must be base64 public keys of 32 or 33 bytes, signatures 64 bytes")
+	ErrInvalidDeviceID = errors.New("device IDs are 1-64 letters, digits, '-' or '_'")
+	ErrDeviceNotFound  = errors.New("device not found")
+	ErrTooManyDevices  = errors.New("too many devices")
+	ErrTooManyPreKeys  = errors.New("too many one-time pre-keys stored for this device")
+	ErrNoDevices       = errors.New("both participants need a registered device for end-to-end encryption")
+	ErrE2ERequired     = errors.New("this conversation is end-to-end encrypted")
+	ErrInvalidEnvelope = errors.New("invalid encrypted envelope")
+)
+
+const (
+	maxE2EDevices     = 10
+	maxOneTimePreKeys = 500
+)
+
+var deviceIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// E2EService distributes the public keys of end-to-end encrypted DMs and
+// keeps the per-conversation E2E setting. Encryption itself happens on the
+// clients.
+type E2EService interface {
+	RegisterDevice(userID, deviceID string, req entity.RegisterDeviceRequest) (*entity.E2EDevice, error)
+	ListDevices(userID string) ([]entity.E2EDevice, error)
+	DeleteDevice(userID, deviceID string) error
+	// UploadPreKeys stores more one-time pre-keys and returns how many the
+	// device has now.
+	UploadPreKeys(userID, deviceID string, keys []entity.OneTimePreKey) (int64, error)
+	// Bundles returns one bundle per device of userID, using up one
+	// one-time pre-key of each.
+	Bundles(requesterID, userID string) ([]entity.PreKeyBundle, error)
+	Enabled(userID, otherID string) (bool, error)
+	// SetEnabled turns E2E on or off for a DM. Either participant may; turning
+	// it on needs both to have a device.
+	SetEnabled(userID, otherID string, enabled bool) error
+}
+
+type DBE2EService struct {
+	db *gorm.DB
+}
+
+func NewE2EService(db *gorm.DB) *DBE2EService {
+	return &DBE2EService{db: db}
+}
+
+func validPublicKey(s string) bool {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && (len(b) == 32 || len(b) == 33)
+}
+
+func validSignature(s string) bool {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(b) == 64
+}
+
+func e2eEnabled(db *gorm.DB, userID, otherID string) (bool, error) {
+	a, b := conversationPair(userID, otherID)
+	var cnt int64
+	err := db.Model(&entity.ConversationE2E{}).Where("user_a = ? AND user_b = ?", a, b).Count(&cnt).Error
+	return cnt > 0, err
+}
+
+// validateEnvelope checks that env comes from one of the sender's devices
+// and is addressed only to registered devices of the two participants, at
+// least one of them the recipient's. The ciphertexts themselves are opaque.
+func validateEnvelope(db *gorm.DB, senderID, recipientID string, env *entity.EncryptedEnvelope) error {
+	if env == nil || len(env.Ciphertexts) == 0 || len(env.Ciphertexts) > 2*maxE2EDevices {
+		return ErrInvalidEnvelope
+	}
+	var devices []entity.E2EDevice
+	if err := db.Where("user_id IN ?", []string{senderID, recipientID}).Find(&devices).Error; err != nil {
+		return err
+	}
+	known := map[[2]string]bool{}
+	for _, d := range devices {
+		known[[2]string{d.UserID, d.DeviceID}] = true
+	}
+	if !known[[2]string{senderID, env.SenderDevice}] {
+		return ErrInvalidEnvelope
+	}
+	seen := map[[2]string]bool{}
+	toRecipient := false
+	for _, ct := range env.Ciphertexts {
+		key := [2]string{ct.UserID, ct.DeviceID}
+		if !known[key] || seen[key] || key == [2]string{senderID, env.SenderDevice} || ct.Ciphertext == "" {
+			return ErrInvalidEnvelope
+		}
+		if _, err := base64.StdEncoding.DecodeString(ct.Ciphertext); err != nil {
+			return ErrInvalidEnvelope
+		}
+		if _, err := base64.StdEncoding.DecodeString(ct.Header); err != nil {
+			return ErrInvalidEnvelope
+		}
+		seen[key] = true
+		toRecipient = toRecipient || ct.UserID == recipientID
+	}
+	if !toRecipient {
+		return ErrInvalidEnvelope
+	}
+	return nil
+}
+
+func (s *DBE2EService) RegisterDevice(userID, deviceID string, req entity.RegisterDeviceRequest) (*entity.E2EDevice, error) {
+	if !deviceIDRe.MatchString(deviceID) {
+		return nil, ErrInvalidDeviceID
+	}
+	if !validPublicKey(req.IdentityKey) || !validPublicKey(req.SignedPreKey) || !validSignature(req.SignedPreKeySignature) {
+		return nil, ErrInvalidKey
+	}
+	var dev entity.E2EDevice
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Limit(1).Find(&dev).Error
+		if err != nil {
+			return err
+		}
+		if dev.ID == 0 {
+			var cnt int64
+			if err := tx.Model(&entity.E2EDevice{}).Where("user_id = ?", userID).Count(&cnt).Error; err != nil {
+				return err
+			}
+			if cnt >= maxE2EDevices {
+				return ErrTooManyDevices
+			}
+			dev = entity.E2EDevice{UserID: userID, DeviceID: deviceID}
+		} else if dev.IdentityKey != req.IdentityKey {
+			// a reinstalled device: pre-keys made for the old identity are useless
+			if err := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&entity.OneTimePreKey{}).Error; err != nil {
+				return err
+			}
+		}
+		dev.IdentityKey = req.IdentityKey
+		dev.SignedPreKeyID = req.SignedPreKeyID
+		dev.SignedPreKey = req.SignedPreKey
+		dev.SignedPreKeySignature = req.SignedPreKeySignature
+		if err := tx.Save(&dev).Error; err != nil {
+			return err
+		}
+		return tx.Model(&entity.OneTimePreKey{}).Where("user_id = ? AND device_id = ?", userID, deviceID).Count(&dev.OneTimePreKeys).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+func (s *DBE2EService) ListDevices(userID string) ([]entity.E2EDevice, error) {
+	var devices []entity.E2EDevice
+	if err := s.db.Where("user_id = ?", userID).Order("created_at").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		if err := s.db.Model(&entity.OneTimePreKey{}).
+			Where("user_id = ? AND device_id = ?", userID, devices[i].DeviceID).Count(&devices[i].OneTimePreKeys).Error; err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+func (s *DBE2EService) DeleteDevice(userID, deviceID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&entity.E2EDevice{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrDeviceNotFound
+		}
+		return tx.Where("user_id = ? AND device_id = ?", userID, deviceID).Delete(&entity.OneTimePreKey{}).Error
+	})
+}
+
+func (s *DBE2EService) UploadPreKeys(userID, deviceID string, keys []entity.OneTimePreKey) (int64, error) {
+	for _, k := range keys {
+		if !validPublicKey(k.PublicKey) {
+			return 0, ErrInvalidKey
+		}
+	}
+	var total int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var cnt int64
+		if err := tx.Model(&entity.E2EDevice{}).Where("user_id = ? AND device_id = ?", userID, deviceID).Count(&cnt).Error; err != nil {
+			return err
+		}
+		if cnt == 0 {
+			return ErrDeviceNotFound
+		}
+		rows := make([]entity.OneTimePreKey, len(keys))
+		for i, k := range keys {
+			rows[i] = entity.OneTimePreKey{UserID: userID, DeviceID: deviceID, KeyID: k.KeyID, PublicKey: k.PublicKey}
+		}
+		// re-uploading a key ID keeps the stored key
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&entity.OneTimePreKey{}).Where("user_id = ? AND device_id = ?", userID, deviceID).Count(&total).Error; err != nil {
+			return err
+		}
+		if total > maxOneTimePreKeys {
+			return ErrTooManyPreKeys
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (s *DBE2EService) Bundles(requesterID, userID string) ([]entity.PreKeyBundle, error) {
+	if requesterID != userID {
+		blocked, err := isBlocked(s.db, userID, requesterID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, ErrBlocked
+		}
+	}
+	var devices []entity.E2EDevice
+	if err := s.db.Where("user_id = ?", userID).Order("created_at").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	bundles := make([]entity.PreKeyBundle, 0, len(devices))
+	for _, d := range devices {
+		b := entity.PreKeyBundle{
+			UserID:                d.UserID,
+			DeviceID:              d.DeviceID,
+			IdentityKey:           d.IdentityKey,
+			SignedPreKeyID:        d.SignedPreKeyID,
+			SignedPreKey:          d.SignedPreKey,
+			SignedPreKeySignature: d.SignedPreKeySignature,
+		}
+		key, err := s.takePreKey(d.UserID, d.DeviceID)
+		if err != nil {
+			return nil, err
+		}
+		b.OneTimePreKey = key
+		bundles = append(bundles, b)
+	}
+	return bundles, nil
+}
+
+// takePreKey deletes and returns the oldest one-time pre-key of a device. A
+// key is only handed out by whoever deletes its row, so concurrent fetches
+// never get the same one.
+func (s *DBE2EService) takePreKey(userID, deviceID string) (*entity.OneTimePreKey, error) {
+	for {
+		var keys []entity.OneTimePreKey
+		if err := s.db.Where("user_id = ? AND device_id = ?", userID, deviceID).Order("id").Limit(1).Find(&keys).Error; err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		res := s.db.Delete(&entity.OneTimePreKey{}, keys[0].ID)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			return &keys[0], nil
+		}
+	}
+}
+
+func (s *DBE2EService) Enabled(userID, otherID string) (bool, error) {
+	return e2eEnabled(s.db, userID, otherID)
+}
+
+func (s *DBE2EService) SetEnabled(userID, otherID string, enabled bool) error {
+	if userID == otherID {
+		return ErrInvalidRecipient
+	}
+	a, b := conversationPair(userID, otherID)
+	if !enabled {
+		return s.db.Where("user_a = ? AND user_b = ?", a, b).Delete(&entity.ConversationE2E{}).Error
+	}
+	var users int64
+	if err := s.db.Model(&entity.User{}).Where("id IN ?", []string{a, b}).Count(&users).Error; err != nil {
+		return err
+	}
+	if users != 2 {
+		return ErrUserNotFound
+	}
+	var withDevices int64
+	if err := s.db.Model(&entity.E2EDevice{}).Where("user_id IN ?", []string{a, b}).
+		Distinct("user_id").Count(&withDevices).Error; err != nil {
+		return err
+	}
+	if withDevices != 2 {
+		return ErrNoDevices
+	}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&entity.ConversationE2E{UserA: a, UserB: b, EnabledBy: userID}).Error
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var ErrCannotForward = errors.New("end-to-end encrypted messages cannot be forwarded")
+
+// PrivateForwardSource is the attribution a copy of pm carries.
+func PrivateForwardSource(pm *entity.PrivateMessage) *entity.ForwardSource {
+	if pm.ForwardedFrom != nil {
+		return pm.ForwardedFrom
+	}
+	a, b := conversationPair(pm.SenderID, pm.RecipientID)
+	return &entity.ForwardSource{Kind: "private", MessageID: pm.ID, SenderID: pm.SenderID, UserA: a, UserB: b}
+}
+
+// GroupForwardSource is the attribution a copy of gm carries.
+func GroupForwardSource(gm *entity.GroupMessage) *entity.ForwardSource {
+	if gm.ForwardedFrom != nil {
+		return gm.ForwardedFrom
+	}
+	return &entity.ForwardSource{Kind: "group", MessageID: gm.ID, SenderID: gm.SenderID, GroupID: gm.GroupID, ChannelID: gm.ChannelID}
+}
+
+// hideForwardSources clears the attribution of forwarded messages whose
+// source conversation viewerID cannot access: a DM they are not part of, a
+// group they are not (or no longer) a member of, or a restricted channel
+// they are not in.
+func hideForwardSources(db *gorm.DB, viewerID string, pms []entity.PrivateMessage, gms []entity.GroupMessage) error {
+	var fields []**entity.ForwardSource
+	for i := range pms {
+		if pms[i].ForwardedFrom != nil {
+			fields = append(fields, &pms[i].ForwardedFrom)
+		}
+	}
+	for i := range gms {
+		if gms[i].ForwardedFrom != nil {
+			fields = append(fields, &gms[i].ForwardedFrom)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	var groupIDs, channelIDs []uint
+	for _, f := range fields {
+		if src := *f; src.Kind == "group" {
+			groupIDs = append(groupIDs, src.GroupID)
+			if src.ChannelID != 0 {
+				channelIDs = append(channelIDs, src.ChannelID)
+			}
+		}
+	}
+	member := map[uint]bool{}
+	if len(groupIDs) > 0 {
+		var ids []uint
+		if err := db.Model(&entity.GroupMember{}).Where("user_id = ? AND group_id IN ?", viewerID, groupIDs).
+			Pluck("group_id", &ids).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			member[id] = true
+		}
+	}
+	readable := map[uint]bool{0: true}
+	if len(channelIDs) > 0 {
+		var ids []uint
+		if err := db.Model(&entity.Channel{}).Where("id IN ?", channelIDs).
+			Where("(restricted = ? OR id IN (?))", false, db.Model(&entity.ChannelMember{}).Select("channel_id").Where("user_id = ?", viewerID)).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			readable[id] = true
+		}
+	}
+	for _, f := range fields {
+		src := *f
+		visible := member[src.GroupID] && readable[src.ChannelID]
+		if src.Kind == "private" {
+			visible = viewerID == src.UserA || viewerID == src.UserB
+		}
+		if !visible {
+			*f = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrGroupDMNotFound = errors.New("group DM not found")
+	ErrGroupDMSize     = errors.New("group DMs have 3 to 10 participants")
+)
+
+// Group DM size limits, counting every participant.
+const (
+	minGroupDMParticipants = 3
+	maxGroupDMParticipants = 10
+)
+
+// GroupDMService manages ad-hoc conversations between 3 to 10 users. They
+// are not groups: there is no owner or name to reserve, and any participant
+// can add others or leave. Non-participants get ErrGroupDMNotFound.
+type GroupDMService interface {
+	// Create starts a conversation between creatorID and userIDs.
+	Create(creatorID string, userIDs []string, name string) (*entity.GroupDM, error)
+	// Get returns the conversation with every participant's read position.
+	Get(userID string, id uint) (*entity.GroupDM, error)
+	// List returns the user's group DMs with their unread counts, newest first.
+	List(userID string) ([]entity.GroupDM, error)
+	Rename(userID string, id uint, name string) (*entity.GroupDM, error)
+	// AddParticipants adds those of userIDs who are not participants yet and
+	// returns them. They see the history but start with nothing unread.
+	AddParticipants(userID string, id uint, userIDs []string) ([]entity.GroupDMParticipant, error)
+	// Leave removes the user; the conversation is deleted with its last participant.
+	Leave(userID string, id uint) error
+	IsParticipant(id uint, userID string) (bool, error)
+	Participants(id uint) ([]string, error)
+	// Send stores a message; callers check the sender is a participant.
+	Send(id uint, senderID, body string) (*entity.GroupDMMessage, error)
+	// Messages returns messages newest first. If beforeID > 0, returns
+	// messages with ID < beforeID for pagination.
+	Messages(userID string, id uint, limit int, beforeID uint) ([]entity.GroupDMMessage, error)
+	// MarkRead moves the user's read position forward to lastReadID and
+	// reports whether it moved.
+	MarkRead(userID string, id, lastReadID uint) (bool, error)
+}
+
+type DBGroupDMService struct {
+	db *gorm.DB
+}
+
+func NewGroupDMService(db *gorm.DB) *DBGroupDMService {
+	return &DBGroupDMService{db: db}
+}
+
+func (s *DBGroupDMService) Create(creatorID string, userIDs []string, name string) (*entity.GroupDM, error) {
+	others := otherUsers(userIDs, creatorID)
+	if n := len(others) + 1; n < minGroupDMParticipants || n > maxGroupDMParticipants {
+		return nil, ErrGroupDMSize
+	}
+	dm := &entity.GroupDM{CreatedBy: creatorID, Name: name}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkNewParticipants(tx, creatorID, others); err != nil {
+			return err
+		}
+		if err := tx.Create(dm).Error; err != nil {
+			return err
+		}
+		parts := []entity.GroupDMParticipant{{GroupDMID: dm.ID, UserID: creatorID}}
+		for _, id := range others {
+			parts = append(parts, entity.GroupDMParticipant{GroupDMID: dm.ID, UserID: id, AddedBy: creatorID})
+		}
+		if err := tx.Create(&parts).Error; err != nil {
+			return err
+		}
+		dm.Participants = parts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+func (s *DBGroupDMService) Get(userID string, id uint) (*entity.GroupDM, error) {
+	if err := s.participant(id, userID); err != nil {
+		return nil, err
+	}
+	var dm entity.GroupDM
+	if err := s.db.Preload("Participants", byJoined).First(&dm, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrGroupDMNotFound
+		}
+		return nil, err
+	}
+	unread, err := groupDMUnread(s.db, userID, []uint{id})
+	if err != nil {
+		return nil, err
+	}
+	dm.Unread = unread[id]
+	return &dm, nil
+}
+
+func (s *DBGroupDMService) List(userID string) ([]entity.GroupDM, error) {
+	var dms []entity.GroupDM
+	if err := s.db.Preload("Participants", byJoined).
+		Where("id IN (?)", s.db.Model(&entity.GroupDMParticipant{}).Select("group_dm_id").Where("user_id = ?", userID)).
+		Order("id DESC").Find(&dms).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(dms))
+	for _, dm := range dms {
+		ids = append(ids, dm.ID)
+	}
+	unread, err := groupDMUnread(s.db, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dms {
+		dms[i].Unread = unread[dms[i].ID]
+	}
+	return dms, nil
+}
+
+func (s *DBGroupDMService) Rename(userID string, id uint, name string) (*entity.GroupDM, error) {
+	if err := s.participant(id, userID); err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&entity.GroupDM{}).Where("id = ?", id).Update("name", name).Error; err != nil {
+		return nil, err
+	}
+	return s.Get(userID, id)
+}
+
+func (s *DBGroupDMService) AddParticipants(userID string, id uint, userIDs []string) ([]entity.GroupDMParticipant, error) {
+	if err := s.participant(id, userID); err != nil {
+		return nil, err
+	}
+	var added []entity.GroupDMParticipant
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		current, err := groupDMParticipants(tx, id)
+		if err != nil {
+			return err
+		}
+		in := make(map[string]bool, len(current))
+		for _, p := range current {
+			in[p] = true
+		}
+		var fresh []string
+		for _, u := range otherUsers(userIDs, userID) {
+			if !in[u] {
+				fresh = append(fresh, u)
+			}
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		if len(current)+len(fresh) > maxGroupDMParticipants {
+			return ErrGroupDMSize
+		}
+		if err := checkNewParticipants(tx, userID, fresh); err != nil {
+			return err
+		}
+		var lastID uint
+		if err := tx.Model(&entity.GroupDMMessage{}).Select("COALESCE(MAX(id), 0)").
+			Where("group_dm_id = ?", id).Scan(&lastID).Error; err != nil {
+			return err
+		}
+		for _, u := range fresh {
+			added = append(added, entity.GroupDMParticipant{GroupDMID: id, UserID: u, AddedBy: userID, LastReadID: lastID})
+		}
+		return tx.Create(&added).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+func (s *DBGroupDMService) Leave(userID string, id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("group_dm_id = ? AND user_id = ?", id, userID).Delete(&entity.GroupDMParticipant{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrGroupDMNotFound
+		}
+		if err := tx.Where("user_id = ? AND conversation = ?", userID, groupDMConversation(id)).
+			Delete(&entity.ConversationSetting{}).Error; err != nil {
+			return err
+		}
+		var left int64
+		if err := tx.Model(&entity.GroupDMParticipant{}).Where("group_dm_id = ?", id).Count(&left).Error; err != nil {
+			return err
+		}
+		if left > 0 {
+			return nil
+		}
+		if err := tx.Where("group_dm_id = ?", id).Delete(&entity.GroupDMMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&entity.GroupDM{}, id).Error
+	})
+}
+
+func (s *DBGroupDMService) IsParticipant(id uint, userID string) (bool, error) {
+	var cnt int64
+	if err := s.db.Model(&entity.GroupDMParticipant{}).
+		Where("group_dm_id = ? AND user_id = ?", id, userID).Count(&cnt).Error; err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+func (s *DBGroupDMService) Participants(id uint) ([]string, error) {
+	return groupDMParticipants(s.db, id)
+}
+
+func (s *DBGroupDMService) Send(id uint, senderID, body string) (*entity.GroupDMMessage, error) {
+	ttl, err := groupDMTTL(s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	msg := &entity.GroupDMMessage{GroupDMID: id, SenderID: senderID, Body: body, ExpiresAt: expiryAt(ttl)}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+		return tx.Model(&entity.GroupDMParticipant{}).Where("group_dm_id = ? AND user_id = ?", id, senderID).
+			Updates(map[string]interface{}{"last_read_id": msg.ID, "read_at": msg.CreatedAt}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *DBGroupDMService) Messages(userID string, id uint, limit int, beforeID uint) ([]entity.GroupDMMessage, error) {
+	if err := s.participant(id, userID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	q := s.db.Scopes(unexpired).Where("group_dm_id = ?", id)
+	if beforeID > 0 {
+		q = q.Where("id < ?", beforeID)
+	}
+	var msgs []entity.GroupDMMessage
+	if err := q.Order("id DESC").Limit(limit).Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (s *DBGroupDMService) MarkRead(userID string, id, lastReadID uint) (bool, error) {
+	if err := s.participant(id, userID); err != nil {
+		return false, err
+	}
+	var cnt int64
+	if err := s.db.Model(&entity.GroupDMMessage{}).Where("id = ? AND group_dm_id = ?", lastReadID, id).Count(&cnt).Error; err != nil {
+		return false, err
+	}
+	if cnt == 0 {
+		return false, ErrMessageNotFound
+	}
+	res := s.db.Model(&entity.GroupDMParticipant{}).
+		Where("group_dm_id = ? AND user_id = ? AND last_read_id < ?", id, userID, lastReadID).
+		Updates(map[string]interface{}{"last_read_id": lastReadID, "read_at": time.Now()})
+	return res.RowsAffected > 0, res.Error
+}
+
+// participant returns ErrGroupDMNotFound unless userID is in the conversation.
+func (s *DBGroupDMService) participant(id uint, userID string) error {
+	ok, err := s.IsParticipant(id, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupDMNotFound
+	}
+	return nil
+}
+
+// groupDMConversation is the conversation key of a group DM.
+func groupDMConversation(id uint) string {
+	return "group_dm:" + strconv.FormatUint(uint64(id), 10)
+}
+
+func byJoined(db *gorm.DB) *gorm.DB {
+	return db.Order("created_at, user_id")
+}
+
+func groupDMParticipants(db *gorm.DB, id uint) ([]string, error) {
+	var ids []string
+	err := db.Model(&entity.GroupDMParticipant{}).Where("group_dm_id = ?", id).Order("created_at, user_id").Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// groupDMUnread counts, per group DM, the messages from others after the
+// user's read position.
+func groupDMUnread(db *gorm.DB, userID string, ids []uint) (map[uint]int64, error) {
+	out := make(map[uint]int64, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	var counts []struct {
+		GroupDMID uint
+		Unread    int64
+	}
+	if err := db.Table("group_dm_messages AS m").Select("m.group_dm_id, COUNT(*) AS unread").
+		Joins("JOIN group_dm_participants AS p ON p.group_dm_id = m.group_dm_id AND p.user_id = ?", userID).
+		Where("m.group_dm_id IN ? AND m.id > p.last_read_id AND m.sender_id <> ?", ids, userID).
+		Where("(m.expires_at IS NULL OR m.expires_at > ?)", time.Now()).
+		Group("m.group_dm_id").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		out[c.GroupDMID] = c.Unread
+	}
+	return out, nil
+}
+
+// otherUsers drops duplicates and selfID from userIDs.
+func otherUsers(userIDs []string, selfID string) []string {
+	seen := map[string]bool{selfID: true}
+	var out []string
+	for _, id := range userIDs {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// checkNewParticipants requires userIDs to exist and not to have blocked adderID.
+func checkNewParticipants(db *gorm.DB, adderID string, userIDs []string) error {
+	var cnt int64
+	if err := db.Model(&entity.User{}).Where("id IN ?", userIDs).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt != int64(len(userIDs)) {
+		return ErrUserNotFound
+	}
+	if err := db.Model(&entity.UserBlock{}).
+		Where("blocker_id IN ? AND blocked_id = ?", userIDs, adderID).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return ErrBlocked
+	}
+	return nil
+}
@@ -1,13 +1,26 @@
 package service
 
 import (
+	"errors"
+
 	"github.com/abeme/go_sm_api/entity"
 	"gorm.io/gorm"
 )
 
+var ErrInvalidReply = errors.New("replied-to message not found in this channel")
+
+// GroupMessageService stores the messages of a group's channels; channelID 0
+// is the group's default channel.
 type GroupMessageService interface {
-	Send(groupID uint, senderID, body string) (*entity.GroupMessage, error)
-	List(groupID uint, limit int, beforeID uint) ([]entity.GroupMessage, error)
+	Send(groupID, channelID uint, senderID, body string) (*entity.GroupMessage, error)
+	// SendReply stores a message that replies to replyToID, which must belong to the same channel.
+	SendReply(groupID, channelID uint, senderID, body string, replyToID uint) (*entity.GroupMessage, error)
+	// Forward stores a copy of another message attributed to src.
+	Forward(groupID, channelID uint, senderID, body string, src *entity.ForwardSource) (*entity.GroupMessage, error)
+	// List hides the source of forwarded messages viewerID cannot access.
+	List(groupID, channelID uint, viewerID string, limit int, beforeID uint) ([]entity.GroupMessage, error)
+	Get(id uint) (*entity.GroupMessage, error)
+	Delete(id uint) error
 }
 
 type DBGroupMessageService struct {
@@ -18,25 +31,91 @@ func NewGroupMessageService(db *gorm.DB) *DBGroupMessageService {
 	return &DBGroupMessageService{db: db}
 }
 
-func (s *DBGroupMessageService) Send(groupID uint, senderID, body string) (*entity.GroupMessage, error) {
-	gm := &entity.GroupMessage{GroupID: groupID, SenderID: senderID, Body: body}
+func (s *DBGroupMessageService) Send(groupID, channelID uint, senderID, body string) (*entity.GroupMessage, error) {
+	ttl, err := groupTTL(s.db, groupID)
+	if err != nil {
+		return nil, err
+	}
+	gm := &entity.GroupMessage{GroupID: groupID, ChannelID: channelID, SenderID: senderID, Body: body, ExpiresAt: expiryAt(ttl)}
+	if err := s.db.Create(gm).Error; err != nil {
+		return nil, err
+	}
+	return gm, nil
+}
+
+func (s *DBGroupMessageService) SendReply(groupID, channelID uint, senderID, body string, replyToID uint) (*entity.GroupMessage, error) {
+	var cnt int64
+	if err := s.db.Model(&entity.GroupMessage{}).Scopes(unexpired).
+		Where("id = ? AND group_id = ? AND channel_id = ?", replyToID, groupID, channelID).Count(&cnt).Error; err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return nil, ErrInvalidReply
+	}
+	ttl, err := groupTTL(s.db, groupID)
+	if err != nil {
+		return nil, err
+	}
+	gm := &entity.GroupMessage{GroupID: groupID, ChannelID: channelID, SenderID: senderID, Body: body, ReplyToID: replyToID, ExpiresAt: expiryAt(ttl)}
 	if err := s.db.Create(gm).Error; err != nil {
 		return nil, err
 	}
 	return gm, nil
 }
 
-func (s *DBGroupMessageService) List(groupID uint, limit int, beforeID uint) ([]entity.GroupMessage, error) {
+func (s *DBGroupMessageService) Forward(groupID, channelID uint, senderID, body string, src *entity.ForwardSource) (*entity.GroupMessage, error) {
+	ttl, err := groupTTL(s.db, groupID)
+	if err != nil {
+		return nil, err
+	}
+	gm := &entity.GroupMessage{GroupID: groupID, ChannelID: channelID, SenderID: senderID, Body: body, ExpiresAt: expiryAt(ttl), Forwarded: true, ForwardedFrom: src}
+	if err := s.db.Create(gm).Error; err != nil {
+		return nil, err
+	}
+	return gm, nil
+}
+
+func (s *DBGroupMessageService) List(groupID, channelID uint, viewerID string, limit int, beforeID uint) ([]entity.GroupMessage, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 100
 	}
 	var msgs []entity.GroupMessage
-	q := s.db.Model(&entity.GroupMessage{}).Where("group_id = ?", groupID)
+	q := s.db.Model(&entity.GroupMessage{}).Scopes(unexpired).Where("group_id = ? AND channel_id = ?", groupID, channelID)
 	if beforeID > 0 {
 		q = q.Where("id < ?", beforeID)
 	}
-	if err := q.Order("id DESC").Limit(limit).Find(&msgs).Error; err != nil {
+	if err := q.Preload("Mentions").Order("id DESC").Limit(limit).Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	if err := hideForwardSources(s.db, viewerID, nil, msgs); err != nil {
 		return nil, err
 	}
 	return msgs, nil
 }
+
+func (s *DBGroupMessageService) Get(id uint) (*entity.GroupMessage, error) {
+	var gm entity.GroupMessage
+	if err := s.db.Scopes(unexpired).First(&gm, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return &gm, nil
+}
+
+func (s *DBGroupMessageService) Delete(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&entity.GroupMessage{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrMessageNotFound
+		}
+		if err := tx.Where("message_id = ?", id).Delete(&entity.Mention{}).Error; err != nil {
+			return err
+		}
+		return forgetMessages(tx, "group", []uint{id})
+	})
+}
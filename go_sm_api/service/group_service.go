@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"strconv"
+	"time"
 
 	"github.com/abeme/go_sm_api/entity"
 	"github.com/redis/go-redis/v9"
@@ -11,7 +12,13 @@ import (
 )
 
 var (
-	ErrGroupExists = errors.New("group already exists")
+	ErrGroupExists     = errors.New("group already exists")
+	ErrGroupNotFound   = errors.New("group not found")
+	ErrBannedFromGroup = errors.New("banned from group")
+	ErrNotGroupMember  = errors.New("not a member of this group")
+	ErrAlreadyMember   = errors.New("user is already a member")
+	ErrInviteNotFound  = errors.New("invite not found")
+	ErrMemberMuted     = errors.New("muted in this group")
 )
 
 type GroupService struct {
@@ -36,7 +43,25 @@ func (s *GroupService) CreateGroup(name string, ownerID string) (*entity.Group,
 	return g, nil
 }
 
+func (s *GroupService) GetGroup(groupID uint) (*entity.Group, error) {
+	var g entity.Group
+	if err := s.db.First(&g, groupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+	return &g, nil
+}
+
 func (s *GroupService) JoinGroup(groupID uint, userID string) error {
+	banned, err := s.IsBanned(groupID, userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return ErrBannedFromGroup
+	}
 	// check exists
 	var count int64
 	if err := s.db.Model(&entity.GroupMember{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&count).Error; err != nil {
@@ -73,6 +98,270 @@ func (s *GroupService) IsMember(groupID uint, userID string) (bool, error) {
 	return cnt > 0, nil
 }
 
+// GetChannel returns a channel of the group.
+func (s *GroupService) GetChannel(groupID, channelID uint) (*entity.Channel, error) {
+	var ch entity.Channel
+	if err := s.db.Where("id = ? AND group_id = ?", channelID, groupID).First(&ch).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrChannelNotFound
+		}
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// ChannelMembers returns who can read a channel of the group: every member
+// for the default channel (0) and open channels, only the members let in for
+// restricted ones.
+func (s *GroupService) ChannelMembers(groupID, channelID uint) ([]string, error) {
+	if channelID == 0 {
+		return s.GetMembers(groupID)
+	}
+	ch, err := s.GetChannel(groupID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if !ch.Restricted {
+		return s.GetMembers(groupID)
+	}
+	var ids []string
+	err = s.db.Model(&entity.ChannelMember{}).
+		Where("channel_id = ? AND user_id IN (?)", channelID, s.db.Model(&entity.GroupMember{}).Select("user_id").Where("group_id = ?", groupID)).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// IsChannelMember reports whether a user can read a channel of the group;
+// channelID 0 is the default channel.
+func (s *GroupService) IsChannelMember(groupID, channelID uint, userID string) (bool, error) {
+	ok, err := s.IsMember(groupID, userID)
+	if err != nil || !ok || channelID == 0 {
+		return ok, err
+	}
+	ch, err := s.GetChannel(groupID, channelID)
+	if errors.Is(err, ErrChannelNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !ch.Restricted {
+		return true, nil
+	}
+	var cnt int64
+	if err := s.db.Model(&entity.ChannelMember{}).Where("channel_id = ? AND user_id = ?", channelID, userID).Count(&cnt).Error; err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// BanMember removes a user from a group and prevents them from rejoining.
+func (s *GroupService) BanMember(groupID uint, userID, bannedBy, reason string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&entity.GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := leaveChannels(tx, groupID, userID); err != nil {
+			return err
+		}
+		var cnt int64
+		if err := tx.Model(&entity.GroupBan{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&cnt).Error; err != nil {
+			return err
+		}
+		if cnt > 0 {
+			return nil
+		}
+		return tx.Create(&entity.GroupBan{GroupID: groupID, UserID: userID, BannedBy: bannedBy, Reason: reason}).Error
+	})
+}
+
+// RemoveMember takes a user out of a group without banning them.
+func (s *GroupService) RemoveMember(groupID uint, userID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&entity.GroupMember{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotGroupMember
+		}
+		return leaveChannels(tx, groupID, userID)
+	})
+}
+
+// leaveChannels drops a user from the restricted channels of a group they
+// left, so rejoining does not restore them.
+func leaveChannels(tx *gorm.DB, groupID uint, userID string) error {
+	return tx.Where("user_id = ? AND channel_id IN (?)", userID, tx.Model(&entity.Channel{}).Select("id").Where("group_id = ?", groupID)).
+		Delete(&entity.ChannelMember{}).Error
+}
+
+// SetTopic changes the group's topic; "" clears it.
+func (s *GroupService) SetTopic(groupID uint, topic string) error {
+	return s.db.Model(&entity.Group{}).Where("id = ?", groupID).Update("topic", topic).Error
+}
+
+// MuteMember stops a member posting until the given time, replacing any
+// earlier mute.
+func (s *GroupService) MuteMember(groupID uint, userID, mutedBy string, until time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&entity.GroupMute{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&entity.GroupMute{GroupID: groupID, UserID: userID, MutedBy: mutedBy, Until: until}).Error
+	})
+}
+
+func (s *GroupService) UnmuteMember(groupID uint, userID string) error {
+	return s.db.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(&entity.GroupMute{}).Error
+}
+
+// MutedUntil returns when the member's mute ends, or nil when they may post.
+func (s *GroupService) MutedUntil(groupID uint, userID string) (*time.Time, error) {
+	var m entity.GroupMute
+	err := s.db.Where("group_id = ? AND user_id = ? AND until > ?", groupID, userID, time.Now()).First(&m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m.Until, nil
+}
+
+func (s *GroupService) IsBanned(groupID uint, userID string) (bool, error) {
+	var cnt int64
+	if err := s.db.Model(&entity.GroupBan{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&cnt).Error; err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// Invite lets a member invite another user. An existing pending invite for the
+// same user is returned instead of creating a second one.
+func (s *GroupService) Invite(groupID uint, inviterID, inviteeID string) (*entity.GroupInvite, error) {
+	if ok, err := s.IsMember(groupID, inviterID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNotGroupMember
+	}
+	var users int64
+	if err := s.db.Model(&entity.User{}).Where("id = ?", inviteeID).Count(&users).Error; err != nil {
+		return nil, err
+	}
+	if users == 0 {
+		return nil, ErrUserNotFound
+	}
+	if ok, err := s.IsMember(groupID, inviteeID); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, ErrAlreadyMember
+	}
+	if banned, err := s.IsBanned(groupID, inviteeID); err != nil {
+		return nil, err
+	} else if banned {
+		return nil, ErrBannedFromGroup
+	}
+	inv := &entity.GroupInvite{GroupID: groupID, InviteeID: inviteeID, Status: entity.InvitePending}
+	if err := s.db.Where(inv).Attrs(entity.GroupInvite{InviterID: inviterID}).FirstOrCreate(inv).Error; err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// ListInvites returns the user's pending invites, newest first.
+func (s *GroupService) ListInvites(userID string) ([]entity.GroupInvite, error) {
+	var invites []entity.GroupInvite
+	if err := s.db.Where("invitee_id = ? AND status = ?", userID, entity.InvitePending).Order("id DESC").Find(&invites).Error; err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// RespondInvite accepts (joining the group) or declines a pending invite.
+func (s *GroupService) RespondInvite(inviteID uint, userID string, accept bool) (*entity.GroupInvite, error) {
+	var inv entity.GroupInvite
+	err := s.db.Where("id = ? AND invitee_id = ? AND status = ?", inviteID, userID, entity.InvitePending).First(&inv).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv.Status = entity.InviteDeclined
+	if accept {
+		if err := s.JoinGroup(inv.GroupID, userID); err != nil {
+			return nil, err
+		}
+		inv.Status = entity.InviteAccepted
+	}
+	if err := s.db.Model(&inv).Update("status", inv.Status).Error; err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// ListGroups lists groups whose name contains query, newest first.
+func (s *GroupService) ListGroups(query string, limit, offset int) ([]entity.Group, int64, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := s.db.Model(&entity.Group{})
+	if query != "" {
+		q = q.Where("name LIKE ?", "%"+query+"%")
+	}
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var groups []entity.Group
+	if err := q.Order("id DESC").Limit(limit).Offset(offset).Find(&groups).Error; err != nil {
+		return nil, 0, err
+	}
+	return groups, total, nil
+}
+
+// DeleteGroup removes a group together with its members, bans, channels and messages.
+func (s *GroupService) DeleteGroup(groupID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		msgIDs := tx.Model(&entity.GroupMessage{}).Select("id").Where("group_id = ?", groupID)
+		if err := tx.Where("message_id IN (?)", msgIDs).Delete(&entity.Mention{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_kind = ? AND message_id IN (?)", "group", msgIDs).Delete(&entity.Reaction{}).Error; err != nil {
+			return err
+		}
+		if err := forgetMessages(tx, "group", msgIDs); err != nil {
+			return err
+		}
+		if err := tx.Where("conversation = ?", "group:"+strconv.FormatUint(uint64(groupID), 10)).Delete(&entity.ConversationSetting{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("channel_id IN (?)", tx.Model(&entity.Channel{}).Select("id").Where("group_id = ?", groupID)).
+			Delete(&entity.ChannelMember{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&entity.GroupMember{}, &entity.GroupBan{}, &entity.GroupMute{}, &entity.GroupMessage{}, &entity.GroupInvite{},
+			&entity.ModerationRule{}, &entity.GroupModerationSettings{}, &entity.RetentionRule{}, &entity.Channel{},
+			&entity.IncomingWebhook{}, &entity.Notification{}, &entity.HeldMessage{}, &entity.ScheduledMessage{},
+		} {
+			if err := tx.Unscoped().Where("group_id = ?", groupID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// hard delete, so the group's name can be taken again
+		res := tx.Unscoped().Delete(&entity.Group{}, groupID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrGroupNotFound
+		}
+		return nil
+	})
+}
+
 func (s *GroupService) PublishGroupMessage(ctx context.Context, groupID uint, msg string) error {
 	ch := "group:" + strconv.FormatUint(uint64(groupID), 10)
 	return s.rdb.Publish(ctx, ch, msg).Err()
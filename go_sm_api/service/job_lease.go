@@ -0,0 +1,38 @@
+package service
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+// acquireLease takes the named lease for holder, or extends it if holder
+// already has it. It reports false while another holder's lease is current.
+func acquireLease(db *gorm.DB, name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&entity.JobLease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)})
+	if res.Error != nil || res.RowsAffected == 1 {
+		return res.Error == nil, res.Error
+	}
+	res = db.Model(&entity.JobLease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, holder, now).
+		Updates(map[string]interface{}{"holder": holder, "expires_at": now.Add(ttl)})
+	return res.RowsAffected == 1, res.Error
+}
+
+// releaseLease gives the lease up early so the next run need not wait for it
+// to expire.
+func releaseLease(db *gorm.DB, name, holder string) error {
+	return db.Where("name = ? AND holder = ?", name, holder).Delete(&entity.JobLease{}).Error
+}
+
+// leaseHeld reports whether anyone holds a current lease on name.
+func leaseHeld(db *gorm.DB, name string) (bool, error) {
+	var cnt int64
+	err := db.Model(&entity.JobLease{}).Where("name = ? AND expires_at >= ?", name, time.Now()).Count(&cnt).Error
+	return cnt > 0, err
+}
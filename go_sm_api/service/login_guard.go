@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AttemptStore keeps failed-attempt counters and lockouts. Implementations must
+// be shared by all instances for limits to hold across them.
+type AttemptStore interface {
+	// RecordFailure increments the failure counter for key and returns the new count.
+	// Counters expire window after the first failure.
+	RecordFailure(ctx context.Context, key string, window time.Duration) (int64, error)
+	Lock(ctx context.Context, key string, d time.Duration) error
+	// LockedFor returns the remaining lockout for key, or 0.
+	LockedFor(ctx context.Context, key string) (time.Duration, error)
+	Clear(ctx context.Context, key string) error
+}
+
+// LoginPolicy controls when failures turn into lockouts. After Threshold failures
+// within Window the key is locked for BaseLockout, doubling with every further
+// failure up to MaxLockout.
+type LoginPolicy struct {
+	Threshold   int64
+	Window      time.Duration
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+var (
+	DefaultAccountPolicy = LoginPolicy{Threshold: 5, Window: 15 * time.Minute, BaseLockout: time.Minute, MaxLockout: time.Hour}
+	DefaultIPPolicy      = LoginPolicy{Threshold: 20, Window: 15 * time.Minute, BaseLockout: time.Minute, MaxLockout: time.Hour}
+)
+
+func (p LoginPolicy) lockout(failures int64) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.BaseLockout
+	for i := p.Threshold; i < failures && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
+
+// LoginGuard tracks failed logins per account and per client IP.
+type LoginGuard struct {
+	store   AttemptStore
+	account LoginPolicy
+	ip      LoginPolicy
+}
+
+func NewLoginGuard(store AttemptStore, account, ip LoginPolicy) *LoginGuard {
+	return &LoginGuard{store: store, account: account, ip: ip}
+}
+
+func accountKey(email string) string { return "acct:" + strings.ToLower(strings.TrimSpace(email)) }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// Check returns how long the caller must wait before trying to log in again, or 0.
+func (g *LoginGuard) Check(ctx context.Context, email, ip string) (time.Duration, error) {
+	acct, err := g.store.LockedFor(ctx, accountKey(email))
+	if err != nil {
+		return 0, err
+	}
+	byIP, err := g.store.LockedFor(ctx, ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	if byIP > acct {
+		return byIP, nil
+	}
+	return acct, nil
+}
+
+// Fail records a failed attempt and returns the resulting lockout, or 0.
+func (g *LoginGuard) Fail(ctx context.Context, email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, k := range []struct {
+		key    string
+		policy LoginPolicy
+	}{{accountKey(email), g.account}, {ipKey(ip), g.ip}} {
+		n, err := g.store.RecordFailure(ctx, k.key, k.policy.Window)
+		if err != nil {
+			return 0, err
+		}
+		if d := k.policy.lockout(n); d > 0 {
+			if err := g.store.Lock(ctx, k.key, d); err != nil {
+				return 0, err
+			}
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait, nil
+}
+
+// Succeed resets the account's failure count after a successful login.
+func (g *LoginGuard) Succeed(ctx context.Context, email string) error {
+	return g.store.Clear(ctx, accountKey(email))
+}
+
+// Unlock lifts an account lockout, e.g. after a password reset.
+func (g *LoginGuard) Unlock(ctx context.Context, email string) error {
+	return g.store.Clear(ctx, accountKey(email))
+}
+
+// RedisAttemptStore keeps counters in Redis and falls back to process memory
+// while Redis is unreachable.
+type RedisAttemptStore struct {
+	rdb      *redis.Client
+	fallback *MemoryAttemptStore
+}
+
+func NewRedisAttemptStore(rdb *redis.Client) *RedisAttemptStore {
+	return &RedisAttemptStore{rdb: rdb, fallback: NewMemoryAttemptStore()}
+}
+
+func (s *RedisAttemptStore) RecordFailure(ctx context.Context, key string, window time.Duration) (int64, error) {
+	k := "login:fail:" + key
+	n, err := s.rdb.Incr(ctx, k).Result()
+	if err == nil && n == 1 {
+		err = s.rdb.Expire(ctx, k, window).Err()
+	}
+	if err != nil {
+		log.Printf("login guard: redis unavailable, using memory: %v", err)
+		return s.fallback.RecordFailure(ctx, key, window)
+	}
+	return n, nil
+}
+
+func (s *RedisAttemptStore) Lock(ctx context.Context, key string, d time.Duration) error {
+	if err := s.rdb.Set(ctx, "login:lock:"+key, 1, d).Err(); err != nil {
+		return s.fallback.Lock(ctx, key, d)
+	}
+	return nil
+}
+
+func (s *RedisAttemptStore) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.rdb.PTTL(ctx, "login:lock:"+key).Result()
+	if err != nil {
+		return s.fallback.LockedFor(ctx, key)
+	}
+	if ttl < 0 {
+		// missing key (-2) or no expiry (-1); also honour locks taken during an outage
+		return s.fallback.LockedFor(ctx, key)
+	}
+	return ttl, nil
+}
+
+func (s *RedisAttemptStore) Clear(ctx context.Context, key string) error {
+	_ = s.fallback.Clear(ctx, key)
+	return s.rdb.Del(ctx, "login:fail:"+key, "login:lock:"+key).Err()
+}
+
+// MemoryAttemptStore is a single-instance AttemptStore.
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	entries map[string]*attemptEntry
+}
+
+type attemptEntry struct {
+	failures    int64
+	expires     time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{entries: make(map[string]*attemptEntry)}
+}
+
+// entry returns the live entry for key, dropping it once both the counter and the lock expired.
+func (s *MemoryAttemptStore) entry(key string, now time.Time) *attemptEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if now.After(e.expires) {
+		e.failures = 0
+	}
+	if e.failures == 0 && now.After(e.lockedUntil) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (s *MemoryAttemptStore) RecordFailure(_ context.Context, key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.entries) > 10000 {
+		for k := range s.entries {
+			s.entry(k, now)
+		}
+	}
+	e := s.entry(key, now)
+	if e == nil {
+		e = &attemptEntry{}
+		s.entries[key] = e
+	}
+	if e.failures == 0 {
+		e.expires = now.Add(window)
+	}
+	e.failures++
+	return e.failures, nil
+}
+
+func (s *MemoryAttemptStore) Lock(_ context.Context, key string, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &attemptEntry{}
+		s.entries[key] = e
+	}
+	e.lockedUntil = time.Now().Add(d)
+	return nil
+}
+
+func (s *MemoryAttemptStore) LockedFor(_ context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e := s.entry(key, now); e != nil && e.lockedUntil.After(now) {
+		return e.lockedUntil.Sub(now), nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryAttemptStore) Clear(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
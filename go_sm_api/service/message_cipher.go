@@ -0,0 +1,611 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+var ErrMasterKeyMissing = errors.New("message bodies are encrypted but no master key is configured")
+
+// MessageCipherConfig tunes the background re-encryption.
+type MessageCipherConfig struct {
+	Interval   time.Duration
+	BatchSize  int
+	BatchPause time.Duration
+	// RetiredGrace is how long a retired key is kept after its last message
+	// moved off it, in case a write that picked it just before rotation is
+	// still in flight.
+	RetiredGrace time.Duration
+}
+
+var DefaultMessageCipherConfig = MessageCipherConfig{
+	Interval:     time.Minute,
+	BatchSize:    200,
+	BatchPause:   50 * time.Millisecond,
+	RetiredGrace: time.Hour,
+}
+
+// CipherReport is the result of Verify.
+type CipherReport struct {
+	CurrentMasterKey string           `json:"current_master_key"`
+	DataKeys         int64            `json:"data_keys"`
+	RetiredKeys      int64            `json:"retired_keys"`
+	ByMasterKey      map[string]int64 `json:"by_master_key"`
+	StaleWraps       int64            `json:"stale_wraps"`
+	UnwrapFailures   []string         `json:"unwrap_failures,omitempty"`
+	Plaintext        int64            `json:"plaintext_messages"`
+	PendingRotation  int64            `json:"pending_rotation_messages"`
+	MessagesChecked  int64            `json:"messages_checked"`
+	MessageFailures  []string         `json:"message_failures,omitempty"`
+}
+
+// MessageCipher encrypts PrivateMessage, GroupMessage and GroupDMMessage
+// bodies at rest with per-conversation data keys, along with the copies other
+// tables keep of them: held messages, report snapshots, scheduled messages and
+// notification snippets. Register installs it as GORM callbacks, so services
+// store and read plaintext as before: bodies are sealed just before insert and
+// opened right after every query. End-to-end encrypted DMs have no body and
+// are left alone.
+type MessageCipher struct {
+	db   *gorm.DB
+	keys *utils.MasterKeys
+	cfg  MessageCipherConfig
+
+	// unwrapped data keys by ID; IDs are random, so a key created in a
+	// transaction that rolled back can never be confused with a later one
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// NewMessageCipher returns a cipher for db. With keys nil new bodies are
+// stored in plaintext and reading an encrypted one fails.
+func NewMessageCipher(db *gorm.DB, keys *utils.MasterKeys, cfg MessageCipherConfig) *MessageCipher {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultMessageCipherConfig.Interval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultMessageCipherConfig.BatchSize
+	}
+	if cfg.BatchPause <= 0 {
+		cfg.BatchPause = DefaultMessageCipherConfig.BatchPause
+	}
+	if cfg.RetiredGrace <= 0 {
+		cfg.RetiredGrace = DefaultMessageCipherConfig.RetiredGrace
+	}
+	return &MessageCipher{db: db, keys: keys, cfg: cfg, cache: map[string][]byte{}}
+}
+
+// Register installs the callbacks on db. Call it before anything writes
+// messages.
+func (c *MessageCipher) Register() error {
+	if err := c.db.Callback().Create().Before("gorm:create").Register("cipher:seal", c.sealCallback); err != nil {
+		return err
+	}
+	if err := c.db.Callback().Create().After("gorm:create").Register("cipher:open_created", c.openCallback); err != nil {
+		return err
+	}
+	if err := c.db.Callback().Update().Before("gorm:update").Register("cipher:seal_update", c.sealUpdateCallback); err != nil {
+		return err
+	}
+	return c.db.Callback().Query().After("gorm:query").Register("cipher:open", c.openCallback)
+}
+
+// sealedTable is a table holding message text; column is sealed with the key
+// named in column + "_key_id".
+type sealedTable struct {
+	name   string
+	column string
+	// rows returns a pointer to an empty slice of the table's rows
+	rows func() interface{}
+}
+
+func (t sealedTable) keyColumn() string {
+	return t.column + "_key_id"
+}
+
+var sealedTables = []sealedTable{
+	{"private_messages", "body", func() interface{} { return &[]entity.PrivateMessage{} }},
+	{"group_messages", "body", func() interface{} { return &[]entity.GroupMessage{} }},
+	{"group_dm_messages", "body", func() interface{} { return &[]entity.GroupDMMessage{} }},
+	{"held_messages", "body", func() interface{} { return &[]entity.HeldMessage{} }},
+	{"reports", "snapshot", func() interface{} { return &[]entity.Report{} }},
+	{"scheduled_messages", "body", func() interface{} { return &[]entity.ScheduledMessage{} }},
+	{"notifications", "snippet", func() interface{} { return &[]entity.Notification{} }},
+}
+
+func sealedTableNamed(name string) (sealedTable, bool) {
+	for _, t := range sealedTables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return sealedTable{}, false
+}
+
+// conversationOf names the conversation of a private, group or group DM
+// message; "" when the kind has none.
+func conversationOf(kind, userA, userB string, groupID, groupDMID uint) string {
+	switch kind {
+	case "private":
+		a, b := conversationPair(userA, userB)
+		return "private:" + a + ":" + b
+	case "group":
+		return "group:" + strconv.FormatUint(uint64(groupID), 10)
+	case "group_dm":
+		return groupDMConversation(groupDMID)
+	}
+	return ""
+}
+
+// messageBody returns the sealed text fields of a row and the conversation
+// whose key seals them. Copies of a message use the message's conversation;
+// group invites in notifications use the group's.
+func messageBody(v interface{}) (body, keyID *string, conversation string, ok bool) {
+	switch m := v.(type) {
+	case *entity.PrivateMessage:
+		if m.Encrypted {
+			return nil, nil, "", false
+		}
+		conversation = conversationOf("private", m.SenderID, m.RecipientID, 0, 0)
+		body, keyID = &m.Body, &m.BodyKeyID
+	case *entity.GroupMessage:
+		conversation = conversationOf("group", "", "", m.GroupID, 0)
+		body, keyID = &m.Body, &m.BodyKeyID
+	case *entity.GroupDMMessage:
+		conversation = conversationOf("group_dm", "", "", 0, m.GroupDMID)
+		body, keyID = &m.Body, &m.BodyKeyID
+	case *entity.HeldMessage:
+		conversation = conversationOf(m.Kind, m.SenderID, m.RecipientID, m.GroupID, m.GroupDMID)
+		body, keyID = &m.Body, &m.BodyKeyID
+	case *entity.Report:
+		// a reported DM is between the reporter and its sender
+		conversation = conversationOf(m.MessageKind, m.ReporterID, m.ReportedUserID, m.GroupID, 0)
+		body, keyID = &m.Snapshot, &m.SnapshotKeyID
+	case *entity.ScheduledMessage:
+		conversation = conversationOf(m.Kind, m.SenderID, m.RecipientID, m.GroupID, 0)
+		body, keyID = &m.Body, &m.BodyKeyID
+	case *entity.Notification:
+		kind := m.MessageKind
+		if kind == "" && m.GroupID != 0 {
+			kind = "group"
+		}
+		// reactions notify the sender, so the actor is the other participant
+		conversation = conversationOf(kind, m.UserID, m.ActorID, m.GroupID, 0)
+		body, keyID = &m.Snippet, &m.SnippetKeyID
+	}
+	return body, keyID, conversation, conversation != ""
+}
+
+// eachMessage calls fn for every message the statement reads or writes,
+// stopping at the first error.
+func eachMessage(db *gorm.DB, fn func(body, keyID *string, conversation string) error) {
+	eachSealed(db, db.Statement.ReflectValue, fn)
+}
+
+// eachSealed calls fn for every row of a sealed table in rv.
+func eachSealed(db *gorm.DB, rv reflect.Value, fn func(body, keyID *string, conversation string) error) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+	if _, ok := sealedTableNamed(db.Statement.Schema.Table); !ok {
+		return
+	}
+	visit := func(v reflect.Value) error {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+		if !v.CanAddr() {
+			return nil
+		}
+		if body, keyID, conv, ok := messageBody(v.Addr().Interface()); ok {
+			return fn(body, keyID, conv)
+		}
+		return nil
+	}
+	var err error
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len() && err == nil; i++ {
+			err = visit(rv.Index(i))
+		}
+	default:
+		err = visit(rv)
+	}
+	if err != nil {
+		_ = db.AddError(err)
+	}
+}
+
+func (c *MessageCipher) sealCallback(db *gorm.DB) {
+	if c.keys == nil {
+		return
+	}
+	// the statement may be inside a transaction; key lookups must use it
+	eachMessage(db, c.sealWith(db.Session(&gorm.Session{NewDB: true})))
+}
+
+// sealWith returns an eachSealed callback sealing plaintext fields with keys
+// looked up through tx.
+func (c *MessageCipher) sealWith(tx *gorm.DB) func(body, keyID *string, conv string) error {
+	return func(body, keyID *string, conv string) error {
+		if *body == "" || *keyID != "" {
+			return nil
+		}
+		sealed, id, err := c.seal(tx, conv, *body)
+		if err != nil {
+			return err
+		}
+		*body, *keyID = sealed, id
+		return nil
+	}
+}
+
+// sealUpdateCallback seals updates made with a whole row, e.g.
+// Select("body", "body_key_id").Updates(&row) with BodyKeyID cleared. Map
+// updates are not sealed and must not write sealed columns.
+func (c *MessageCipher) sealUpdateCallback(db *gorm.DB) {
+	if c.keys == nil || db.Statement.Dest == nil {
+		return
+	}
+	eachSealed(db, reflect.ValueOf(db.Statement.Dest), c.sealWith(db.Session(&gorm.Session{NewDB: true})))
+}
+
+func (c *MessageCipher) openCallback(db *gorm.DB) {
+	tx := db.Session(&gorm.Session{NewDB: true})
+	eachMessage(db, func(body, keyID *string, _ string) error {
+		if *keyID == "" || *body == "" {
+			return nil
+		}
+		plain, err := c.open(tx, *keyID, *body)
+		if err != nil {
+			return err
+		}
+		*body = plain
+		return nil
+	})
+}
+
+func (c *MessageCipher) seal(db *gorm.DB, conversation, body string) (string, string, error) {
+	id, key, err := c.activeKey(db, conversation)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := utils.SealAESGCM(key, []byte(body), nil)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), id, nil
+}
+
+func (c *MessageCipher) open(db *gorm.DB, keyID, body string) (string, error) {
+	key, err := c.dataKey(db, keyID)
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return "", utils.ErrDecrypt
+	}
+	plain, err := utils.OpenAESGCM(key, raw, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// activeKey returns the conversation's current data key, creating it on
+// first use. It is looked up on every write rather than cached so that a
+// rotation on another instance takes effect at once.
+func (c *MessageCipher) activeKey(db *gorm.DB, conversation string) (string, []byte, error) {
+	var keys []entity.DataKey
+	if err := db.Where("conversation = ? AND retired_at IS NULL", conversation).
+		Order("created_at, id").Limit(1).Find(&keys).Error; err != nil {
+		return "", nil, err
+	}
+	if len(keys) == 1 {
+		key, err := c.unwrap(&keys[0])
+		return keys[0].ID, key, err
+	}
+	key, err := utils.GenerateDataKey()
+	if err != nil {
+		return "", nil, err
+	}
+	dk := entity.DataKey{ID: generateID(8), Conversation: conversation, MasterKeyID: c.keys.Current.ID}
+	if dk.WrappedKey, err = c.keys.Current.Wrap(key, []byte(dk.ID)); err != nil {
+		return "", nil, err
+	}
+	if err := db.Create(&dk).Error; err != nil {
+		return "", nil, err
+	}
+	c.mu.Lock()
+	c.cache[dk.ID] = key
+	c.mu.Unlock()
+	return dk.ID, key, nil
+}
+
+func (c *MessageCipher) dataKey(db *gorm.DB, id string) ([]byte, error) {
+	c.mu.Lock()
+	key, ok := c.cache[id]
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	var dk entity.DataKey
+	if err := db.First(&dk, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return c.unwrap(&dk)
+}
+
+func (c *MessageCipher) unwrap(dk *entity.DataKey) ([]byte, error) {
+	c.mu.Lock()
+	key, ok := c.cache[dk.ID]
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if c.keys == nil {
+		return nil, ErrMasterKeyMissing
+	}
+	mk, err := c.keys.Get(dk.MasterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	key, err = mk.Unwrap(dk.WrappedKey, []byte(dk.ID))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cache[dk.ID] = key
+	c.mu.Unlock()
+	return key, nil
+}
+
+// Rotate retires the active data key of conversation, or of every
+// conversation when it is empty. New messages get a fresh key right away;
+// Reencrypt moves the old ones over.
+func (c *MessageCipher) Rotate(conversation string) (int64, error) {
+	q := c.db.Model(&entity.DataKey{}).Where("retired_at IS NULL")
+	if conversation != "" {
+		q = q.Where("conversation = ?", conversation)
+	}
+	res := q.Update("retired_at", time.Now())
+	return res.RowsAffected, res.Error
+}
+
+// Rewrap wraps every data key still under an old master key with the current
+// one. Messages are untouched, so this is cheap; afterwards old master keys
+// can be dropped from the config.
+func (c *MessageCipher) Rewrap() (int64, error) {
+	if c.keys == nil {
+		return 0, ErrMasterKeyMissing
+	}
+	var stale []entity.DataKey
+	if err := c.db.Where("master_key_id <> ?", c.keys.Current.ID).Find(&stale).Error; err != nil {
+		return 0, err
+	}
+	var n int64
+	for i := range stale {
+		dk := &stale[i]
+		key, err := c.unwrap(dk)
+		if err != nil {
+			return n, err
+		}
+		wrapped, err := c.keys.Current.Wrap(key, []byte(dk.ID))
+		if err != nil {
+			return n, err
+		}
+		res := c.db.Model(&entity.DataKey{}).Where("id = ? AND master_key_id = ?", dk.ID, dk.MasterKeyID).
+			Updates(map[string]interface{}{"wrapped_key": wrapped, "master_key_id": c.keys.Current.ID})
+		if res.Error != nil {
+			return n, res.Error
+		}
+		n += res.RowsAffected
+	}
+	return n, nil
+}
+
+// pendingScope selects rows of t whose stored text is plaintext or sealed
+// with a retired key.
+func pendingScope(t sealedTable) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		key := t.keyColumn()
+		return db.Where(t.column+" <> ''").Where("("+key+" = '' OR "+key+" IS NULL OR "+key+" IN (?))",
+			db.Session(&gorm.Session{NewDB: true}).Model(&entity.DataKey{}).Select("id").Where("retired_at IS NOT NULL"))
+	}
+}
+
+// Reencrypt seals up to BatchSize plaintext or retired-key rows of each
+// sealed table under their conversation's active key and returns how many it
+// moved. Each row is updated only if nobody changed its key meanwhile, so it
+// is safe on several instances.
+func (c *MessageCipher) Reencrypt() (int64, error) {
+	if c.keys == nil {
+		return 0, ErrMasterKeyMissing
+	}
+	var moved int64
+	for _, t := range sealedTables {
+		q := c.db.Scopes(pendingScope(t))
+		if t.name == "private_messages" {
+			q = q.Where("encrypted = ?", false)
+		}
+		rows := t.rows()
+		if err := q.Order("id").Limit(c.cfg.BatchSize).Find(rows).Error; err != nil {
+			return moved, err
+		}
+		rv := reflect.ValueOf(rows).Elem()
+		for i := 0; i < rv.Len(); i++ {
+			n, err := c.reseal(t, rv.Index(i).Addr().Interface())
+			if err != nil {
+				return moved, err
+			}
+			moved += n
+		}
+	}
+	return moved, nil
+}
+
+// reseal stores row of t, already decrypted by the query, under the active key.
+func (c *MessageCipher) reseal(t sealedTable, row interface{}) (int64, error) {
+	body, keyID, conv, ok := messageBody(row)
+	if !ok {
+		return 0, nil
+	}
+	sealed, newKeyID, err := c.seal(c.db, conv, *body)
+	if err != nil {
+		return 0, err
+	}
+	id := reflect.ValueOf(row).Elem().FieldByName("ID").Uint()
+	res := c.db.Table(t.name).Where("id = ? AND "+t.keyColumn()+" = ?", id, *keyID).
+		UpdateColumns(map[string]interface{}{t.column: sealed, t.keyColumn(): newKeyID})
+	return res.RowsAffected, res.Error
+}
+
+// DeleteUnusedKeys removes retired keys no row refers to any more.
+func (c *MessageCipher) DeleteUnusedKeys() (int64, error) {
+	q := c.db.Where("retired_at < ?", time.Now().Add(-c.cfg.RetiredGrace))
+	for _, t := range sealedTables {
+		q = q.Where("id NOT IN (?)", c.db.Table(t.name).Select(t.keyColumn()).Where(t.keyColumn()+" IS NOT NULL"))
+	}
+	res := q.Delete(&entity.DataKey{})
+	return res.RowsAffected, res.Error
+}
+
+// Verify unwraps every data key and counts messages still waiting for
+// (re-)encryption. With checkMessages it also decrypts every message.
+func (c *MessageCipher) Verify(checkMessages bool) (*CipherReport, error) {
+	rep := &CipherReport{ByMasterKey: map[string]int64{}}
+	if c.keys != nil {
+		rep.CurrentMasterKey = c.keys.Current.ID
+	}
+	var keys []entity.DataKey
+	if err := c.db.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		dk := &keys[i]
+		rep.DataKeys++
+		rep.ByMasterKey[dk.MasterKeyID]++
+		if dk.RetiredAt != nil {
+			rep.RetiredKeys++
+		}
+		if dk.MasterKeyID != rep.CurrentMasterKey {
+			rep.StaleWraps++
+		}
+		if _, err := c.unwrap(dk); err != nil {
+			rep.UnwrapFailures = append(rep.UnwrapFailures, dk.ID+": "+err.Error())
+		}
+	}
+	for _, t := range sealedTables {
+		var n int64
+		key := t.keyColumn()
+		if err := c.db.Table(t.name).Where(t.column + " <> '' AND (" + key + " = '' OR " + key + " IS NULL)").Count(&n).Error; err != nil {
+			return nil, err
+		}
+		rep.Plaintext += n
+		if err := c.db.Table(t.name).Where(key+" IN (?)",
+			c.db.Model(&entity.DataKey{}).Select("id").Where("retired_at IS NOT NULL")).Count(&n).Error; err != nil {
+			return nil, err
+		}
+		rep.PendingRotation += n
+	}
+	if checkMessages {
+		if err := c.verifyMessages(rep); err != nil {
+			return nil, err
+		}
+	}
+	return rep, nil
+}
+
+// verifyMessages reads the raw rows, bypassing the callbacks, so every
+// failure is reported instead of aborting the query.
+func (c *MessageCipher) verifyMessages(rep *CipherReport) error {
+	type row struct {
+		ID        uint
+		Body      string
+		BodyKeyID string
+	}
+	for _, t := range sealedTables {
+		var lastID uint
+		key := t.keyColumn()
+		for {
+			var rows []row
+			if err := c.db.Table(t.name).Select("id, "+t.column+" AS body, "+key+" AS body_key_id").
+				Where("id > ? AND "+key+" <> '' AND "+key+" IS NOT NULL", lastID).
+				Order("id").Limit(500).Scan(&rows).Error; err != nil {
+				return err
+			}
+			for _, r := range rows {
+				rep.MessagesChecked++
+				if _, err := c.open(c.db, r.BodyKeyID, r.Body); err != nil {
+					rep.MessageFailures = append(rep.MessageFailures, t.name+"/"+strconv.FormatUint(uint64(r.ID), 10)+": "+err.Error())
+				}
+				lastID = r.ID
+			}
+			if len(rows) < 500 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ReencryptAll runs Reencrypt until nothing is left, pausing between
+// batches so other writers get the database.
+func (c *MessageCipher) ReencryptAll(ctx context.Context) (int64, error) {
+	var total int64
+	for {
+		n, err := c.Reencrypt()
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(c.cfg.BatchPause):
+		}
+	}
+}
+
+// Run re-wraps, re-encrypts and cleans up every Interval until ctx is done.
+// It does nothing without a master key.
+func (c *MessageCipher) Run(ctx context.Context) {
+	if c.keys == nil {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Rewrap(); err != nil {
+			log.Printf("message keys: rewrap: %v", err)
+		}
+		if n, err := c.ReencryptAll(ctx); err != nil {
+			log.Printf("message keys: re-encrypt: %v", err)
+		} else if n > 0 {
+			log.Printf("message keys: re-encrypted %d messages", n)
+		}
+		if _, err := c.DeleteUnusedKeys(); err != nil {
+			log.Printf("message keys: cleanup: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrBlocked                = errors.New("recipient is not accepting messages from sender")
+	ErrMessageRequestNotFound = errors.New("message request not found")
+)
+
+// MessageRequestService manages the inbox of first-contact DMs from strangers.
+type MessageRequestService interface {
+	List(recipientID, status string) ([]entity.MessageRequest, error)
+	Accept(recipientID, senderID string) error
+	Ignore(recipientID, senderID string) error
+	DeclineAndBlock(recipientID, senderID string) error
+	// Ignored reports whether recipientID ignored the request from senderID.
+	Ignored(recipientID, senderID string) (bool, error)
+}
+
+type DBMessageRequestService struct {
+	db *gorm.DB
+}
+
+func NewMessageRequestService(db *gorm.DB) *DBMessageRequestService {
+	return &DBMessageRequestService{db: db}
+}
+
+// List returns requests addressed to recipientID, newest first.
+// An empty status lists pending requests.
+func (s *DBMessageRequestService) List(recipientID, status string) ([]entity.MessageRequest, error) {
+	if status == "" {
+		status = entity.MessageRequestPending
+	}
+	var reqs []entity.MessageRequest
+	if err := s.db.Where("recipient_id = ? AND status = ?", recipientID, status).
+		Order("updated_at DESC").Find(&reqs).Error; err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// Accept moves the conversation to the normal inbox and releases held messages.
+func (s *DBMessageRequestService) Accept(recipientID, senderID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return acceptMessageRequest(tx, recipientID, senderID)
+	})
+}
+
+// Ignore hides the request without notifying or blocking the sender.
+func (s *DBMessageRequestService) Ignore(recipientID, senderID string) error {
+	return s.setStatus(recipientID, senderID, entity.MessageRequestIgnored)
+}
+
+// DeclineAndBlock declines the request and blocks further messages from the sender.
+func (s *DBMessageRequestService) DeclineAndBlock(recipientID, senderID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&entity.MessageRequest{}).
+			Where("sender_id = ? AND recipient_id = ?", senderID, recipientID).
+			Updates(map[string]interface{}{"status": entity.MessageRequestDeclined, "updated_at": time.Now()})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrMessageRequestNotFound
+		}
+		block := &entity.UserBlock{BlockerID: recipientID, BlockedID: senderID}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(block).Error
+	})
+}
+
+func (s *DBMessageRequestService) Ignored(recipientID, senderID string) (bool, error) {
+	var cnt int64
+	if err := s.db.Model(&entity.MessageRequest{}).
+		Where("sender_id = ? AND recipient_id = ? AND status = ?", senderID, recipientID, entity.MessageRequestIgnored).
+		Count(&cnt).Error; err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+func (s *DBMessageRequestService) setStatus(recipientID, senderID, status string) error {
+	res := s.db.Model(&entity.MessageRequest{}).
+		Where("sender_id = ? AND recipient_id = ?", senderID, recipientID).
+		Updates(map[string]interface{}{"status": status, "updated_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrMessageRequestNotFound
+	}
+	return nil
+}
+
+func acceptMessageRequest(tx *gorm.DB, recipientID, senderID string) error {
+	res := tx.Model(&entity.MessageRequest{}).
+		Where("sender_id = ? AND recipient_id = ?", senderID, recipientID).
+		Updates(map[string]interface{}{"status": entity.MessageRequestAccepted, "updated_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrMessageRequestNotFound
+	}
+	return tx.Model(&entity.PrivateMessage{}).
+		Where("sender_id = ? AND recipient_id = ? AND pending = ?", senderID, recipientID, true).
+		Update("pending", false).Error
+}
+
+// isBlocked reports whether blockerID has blocked blockedID.
+func isBlocked(db *gorm.DB, blockerID, blockedID string) (bool, error) {
+	var cnt int64
+	if err := db.Model(&entity.UserBlock{}).
+		Where("blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Count(&cnt).Error; err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// resolveMessageRequest returns the status of the request a DM from senderID to
+// recipientID is held under, or "" when it can be delivered directly.
+// Replying to someone else's request accepts it.
+func resolveMessageRequest(tx *gorm.DB, senderID, recipientID string) (string, error) {
+	var incoming entity.MessageRequest
+	err := tx.Where("sender_id = ? AND recipient_id = ?", recipientID, senderID).First(&incoming).Error
+	if err == nil {
+		if incoming.Status == entity.MessageRequestAccepted {
+			return "", nil
+		}
+		return "", acceptMessageRequest(tx, senderID, recipientID)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+
+	var outgoing entity.MessageRequest
+	err = tx.Where("sender_id = ? AND recipient_id = ?", senderID, recipientID).First(&outgoing).Error
+	if err == nil {
+		if outgoing.Status == entity.MessageRequestAccepted {
+			return "", nil
+		}
+		return outgoing.Status, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+
+	// conversations that predate message requests count as contacts
+	var cnt int64
+	if err := tx.Model(&entity.PrivateMessage{}).
+		Where("((sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)) AND pending = ?",
+			senderID, recipientID, recipientID, senderID, false).
+		Count(&cnt).Error; err != nil {
+		return "", err
+	}
+	if cnt > 0 {
+		return "", nil
+	}
+	req := &entity.MessageRequest{SenderID: senderID, RecipientID: recipientID, Status: entity.MessageRequestPending}
+	if err := tx.Create(req).Error; err != nil {
+		return "", err
+	}
+	return req.Status, nil
+}
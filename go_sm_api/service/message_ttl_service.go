@@ -0,0 +1,248 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var ErrInvalidTTL = errors.New("ttl must be 0 or between 1 minute and 365 days")
+
+const (
+	minMessageTTL = time.Minute
+	maxMessageTTL = 365 * 24 * time.Hour
+)
+
+// MessageTTLService manages disappearing messages: the per-conversation
+// setting and the deletion of expired messages. The setting applies to
+// messages sent after it changes.
+type MessageTTLService interface {
+	PrivateTTL(userID, otherID string) (time.Duration, error)
+	SetPrivateTTL(userID, otherID string, ttl time.Duration) error
+	GroupTTL(groupID uint) (time.Duration, error)
+	SetGroupTTL(groupID uint, ttl time.Duration) error
+	GroupDMTTL(groupDMID uint) (time.Duration, error)
+	SetGroupDMTTL(groupDMID uint, ttl time.Duration) error
+	// DeleteExpired hard-deletes up to limit expired messages of each kind
+	// and returns the ones this call removed.
+	DeleteExpired(limit int) ([]entity.PrivateMessage, []entity.GroupMessage, []entity.GroupDMMessage, error)
+}
+
+type DBMessageTTLService struct {
+	db *gorm.DB
+}
+
+func NewMessageTTLService(db *gorm.DB) *DBMessageTTLService {
+	return &DBMessageTTLService{db: db}
+}
+
+// unexpired hides messages whose ExpiresAt has passed; the sweeper deletes
+// them a little later.
+func unexpired(db *gorm.DB) *gorm.DB {
+	return db.Where("(expires_at IS NULL OR expires_at > ?)", time.Now())
+}
+
+// conversationPair orders two user IDs the way ConversationTTL stores them.
+func conversationPair(a, b string) (string, string) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
+
+// expiryAt returns when a message sent now with ttl expires, or nil.
+func expiryAt(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	t := time.Now().Add(ttl)
+	return &t
+}
+
+func privateTTL(db *gorm.DB, userID, otherID string) (time.Duration, error) {
+	a, b := conversationPair(userID, otherID)
+	var row entity.ConversationTTL
+	err := db.Where("user_a = ? AND user_b = ?", a, b).Limit(1).Find(&row).Error
+	return time.Duration(row.TTL) * time.Second, err
+}
+
+func groupTTL(db *gorm.DB, groupID uint) (time.Duration, error) {
+	var ttl int64
+	err := db.Model(&entity.Group{}).Where("id = ?", groupID).Select("message_ttl").Scan(&ttl).Error
+	return time.Duration(ttl) * time.Second, err
+}
+
+func groupDMTTL(db *gorm.DB, groupDMID uint) (time.Duration, error) {
+	var ttl int64
+	err := db.Model(&entity.GroupDM{}).Where("id = ?", groupDMID).Select("message_ttl").Scan(&ttl).Error
+	return time.Duration(ttl) * time.Second, err
+}
+
+func validateTTL(ttl time.Duration) error {
+	if ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		return ErrInvalidTTL
+	}
+	return nil
+}
+
+func (s *DBMessageTTLService) PrivateTTL(userID, otherID string) (time.Duration, error) {
+	return privateTTL(s.db, userID, otherID)
+}
+
+func (s *DBMessageTTLService) SetPrivateTTL(userID, otherID string, ttl time.Duration) error {
+	if err := validateTTL(ttl); err != nil {
+		return err
+	}
+	if userID == otherID {
+		return ErrInvalidRecipient
+	}
+	var cnt int64
+	if err := s.db.Model(&entity.User{}).Where("id = ?", otherID).Count(&cnt).Error; err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrUserNotFound
+	}
+	a, b := conversationPair(userID, otherID)
+	row := entity.ConversationTTL{UserA: a, UserB: b, TTL: int64(ttl / time.Second), UpdatedBy: userID}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_a"}, {Name: "user_b"}},
+		DoUpdates: clause.AssignmentColumns([]string{"ttl", "updated_by", "updated_at"}),
+	}).Create(&row).Error
+}
+
+func (s *DBMessageTTLService) GroupTTL(groupID uint) (time.Duration, error) {
+	return groupTTL(s.db, groupID)
+}
+
+func (s *DBMessageTTLService) SetGroupTTL(groupID uint, ttl time.Duration) error {
+	if err := validateTTL(ttl); err != nil {
+		return err
+	}
+	res := s.db.Model(&entity.Group{}).Where("id = ?", groupID).Update("message_ttl", int64(ttl/time.Second))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+func (s *DBMessageTTLService) GroupDMTTL(groupDMID uint) (time.Duration, error) {
+	return groupDMTTL(s.db, groupDMID)
+}
+
+func (s *DBMessageTTLService) SetGroupDMTTL(groupDMID uint, ttl time.Duration) error {
+	if err := validateTTL(ttl); err != nil {
+		return err
+	}
+	res := s.db.Model(&entity.GroupDM{}).Where("id = ?", groupDMID).Update("message_ttl", int64(ttl/time.Second))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrGroupDMNotFound
+	}
+	return nil
+}
+
+// DeleteExpired deletes row by row so that, with several instances sweeping,
+// each message is reported by exactly one of them.
+func (s *DBMessageTTLService) DeleteExpired(limit int) ([]entity.PrivateMessage, []entity.GroupMessage, []entity.GroupDMMessage, error) {
+	now := time.Now()
+	var pms []entity.PrivateMessage
+	if err := s.db.Where("expires_at <= ?", now).Order("expires_at").Limit(limit).Find(&pms).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	deletedPMs := pms[:0]
+	for _, pm := range pms {
+		var deleted bool
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Delete(&entity.PrivateMessage{}, pm.ID)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			deleted = true
+			if err := tx.Where("message_kind = ? AND message_id = ?", "private", pm.ID).Delete(&entity.Reaction{}).Error; err != nil {
+				return err
+			}
+			if err := forgetMessages(tx, "private", []uint{pm.ID}); err != nil {
+				return err
+			}
+			return tx.Where("message_kind = ? AND message_id = ?", "private", pm.ID).Delete(&entity.Notification{}).Error
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if deleted {
+			deletedPMs = append(deletedPMs, pm)
+		}
+	}
+
+	var gms []entity.GroupMessage
+	if err := s.db.Where("expires_at <= ?", now).Order("expires_at").Limit(limit).Find(&gms).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	deletedGMs := gms[:0]
+	for _, gm := range gms {
+		var deleted bool
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Delete(&entity.GroupMessage{}, gm.ID)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			deleted = true
+			if err := tx.Where("message_id = ?", gm.ID).Delete(&entity.Mention{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("message_kind = ? AND message_id = ?", "group", gm.ID).Delete(&entity.Reaction{}).Error; err != nil {
+				return err
+			}
+			if err := forgetMessages(tx, "group", []uint{gm.ID}); err != nil {
+				return err
+			}
+			return tx.Where("message_kind = ? AND message_id = ?", "group", gm.ID).Delete(&entity.Notification{}).Error
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if deleted {
+			deletedGMs = append(deletedGMs, gm)
+		}
+	}
+
+	var dms []entity.GroupDMMessage
+	if err := s.db.Where("expires_at <= ?", now).Order("expires_at").Limit(limit).Find(&dms).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	deletedDMs := dms[:0]
+	for _, dm := range dms {
+		var deleted bool
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Delete(&entity.GroupDMMessage{}, dm.ID)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			deleted = true
+			if err := tx.Where("message_kind = ? AND message_id = ?", "group_dm", dm.ID).Delete(&entity.Reaction{}).Error; err != nil {
+				return err
+			}
+			if err := forgetMessages(tx, "group_dm", []uint{dm.ID}); err != nil {
+				return err
+			}
+			return tx.Where("message_kind = ? AND message_id = ?", "group_dm", dm.ID).Delete(&entity.Notification{}).Error
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if deleted {
+			deletedDMs = append(deletedDMs, dm)
+		}
+	}
+	return deletedPMs, deletedGMs, deletedDMs, nil
+}
@@ -0,0 +1,460 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrInvalidRule       = errors.New("invalid moderation rule")
+	ErrHeldNotFound      = errors.New("held message not found")
+	ErrHeldAlreadyReview = errors.New("held message already reviewed")
+)
+
+// ModerationConfig is the global moderation policy.
+type ModerationConfig struct {
+	MaxLength      int
+	BlockedWords   []string
+	BlockedDomains []string
+	// SpamAction applies to repeated identical bodies and bursts (default hold).
+	SpamAction string
+}
+
+// ModerationMessage is a message on its way to persistence. Hooks may rewrite Body.
+type ModerationMessage struct {
+	Kind        string // "private", "group" or "group_dm"
+	SenderID    string
+	RecipientID string
+	GroupID     uint
+	ChannelID   uint
+	GroupDMID   uint
+	Body        string
+	// ReplyToID and Forward are kept on held messages for their approval.
+	ReplyToID uint
+	Forward   *entity.ForwardSource
+}
+
+// ModerationPolicy is the effective policy for one conversation.
+type ModerationPolicy struct {
+	MaxLength  int
+	SpamAction string
+	Rules      []entity.ModerationRule
+}
+
+// ModerationVerdict is a hook's decision. Reason is empty for allow.
+type ModerationVerdict struct {
+	Action string
+	Reason string
+}
+
+// ModerationResult is the outcome of the whole chain.
+type ModerationResult struct {
+	Action  string
+	Body    string
+	Reasons []string
+}
+
+// ModerationHook inspects a message before it is stored.
+type ModerationHook interface {
+	Moderate(msg *ModerationMessage, policy *ModerationPolicy) ModerationVerdict
+}
+
+var actionSeverity = map[string]int{
+	entity.ModerationAllow:  0,
+	entity.ModerationMask:   1,
+	entity.ModerationHold:   2,
+	entity.ModerationReject: 3,
+}
+
+// Moderator runs the hook chain and manages rules, settings and the review queue.
+type Moderator struct {
+	db    *gorm.DB
+	cfg   ModerationConfig
+	hooks []ModerationHook
+}
+
+// NewModerator builds the default chain: normalisation, length, word/regex
+// filters, link blocklist and the spam heuristic.
+func NewModerator(db *gorm.DB, cfg ModerationConfig) *Moderator {
+	if cfg.MaxLength <= 0 {
+		cfg.MaxLength = 4000
+	}
+	if cfg.SpamAction == "" {
+		cfg.SpamAction = entity.ModerationHold
+	}
+	m := &Moderator{db: db, cfg: cfg}
+	m.hooks = []ModerationHook{
+		normalizeHook{},
+		lengthHook{},
+		newFilterHook(),
+		&linkHook{},
+		newSpamHook(),
+	}
+	return m
+}
+
+// Use appends a hook to the end of the chain.
+func (m *Moderator) Use(h ModerationHook) {
+	m.hooks = append(m.hooks, h)
+}
+
+// Policy resolves the effective policy for a conversation (groupID 0 for DMs).
+func (m *Moderator) Policy(groupID uint) (*ModerationPolicy, error) {
+	p := &ModerationPolicy{MaxLength: m.cfg.MaxLength, SpamAction: m.cfg.SpamAction}
+	for _, w := range m.cfg.BlockedWords {
+		p.Rules = append(p.Rules, entity.ModerationRule{Kind: entity.RuleWord, Pattern: w, Action: entity.ModerationMask})
+	}
+	for _, d := range m.cfg.BlockedDomains {
+		p.Rules = append(p.Rules, entity.ModerationRule{Kind: entity.RuleLink, Pattern: d, Action: entity.ModerationReject})
+	}
+	var rules []entity.ModerationRule
+	if err := m.db.Where("group_id IN ?", []uint{0, groupID}).Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	p.Rules = append(p.Rules, rules...)
+	if groupID > 0 {
+		var st entity.GroupModerationSettings
+		err := m.db.Where("group_id = ?", groupID).First(&st).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if st.MaxLength > 0 {
+			p.MaxLength = st.MaxLength
+		}
+		if st.SpamAction != "" {
+			p.SpamAction = st.SpamAction
+		}
+	}
+	return p, nil
+}
+
+// Moderate runs the chain. The most severe verdict wins; a reject stops the chain.
+func (m *Moderator) Moderate(msg ModerationMessage) (ModerationResult, error) {
+	policy, err := m.Policy(msg.GroupID)
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	res := ModerationResult{Action: entity.ModerationAllow}
+	for _, h := range m.hooks {
+		v := h.Moderate(&msg, policy)
+		if v.Action == "" || v.Action == entity.ModerationAllow {
+			continue
+		}
+		res.Reasons = append(res.Reasons, v.Reason)
+		if actionSeverity[v.Action] > actionSeverity[res.Action] {
+			res.Action = v.Action
+		}
+		if v.Action == entity.ModerationReject {
+			break
+		}
+	}
+	// masking only rewrites the body; the message is still allowed
+	if res.Action == entity.ModerationMask {
+		res.Action = entity.ModerationAllow
+	}
+	res.Body = msg.Body
+	return res, nil
+}
+
+// Hold stores a message for review instead of delivering it.
+func (m *Moderator) Hold(msg ModerationMessage, reasons []string) (*entity.HeldMessage, error) {
+	h := &entity.HeldMessage{
+		Kind:          msg.Kind,
+		GroupID:       msg.GroupID,
+		ChannelID:     msg.ChannelID,
+		GroupDMID:     msg.GroupDMID,
+		SenderID:      msg.SenderID,
+		RecipientID:   msg.RecipientID,
+		Body:          msg.Body,
+		Reason:        strings.Join(reasons, ","),
+		Status:        entity.HeldPending,
+		ReplyToID:     msg.ReplyToID,
+		ForwardedFrom: msg.Forward,
+	}
+	if err := m.db.Create(h).Error; err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ListHeld returns held messages of a conversation kind, oldest first.
+// groupID is only used for group messages.
+func (m *Moderator) ListHeld(kind string, groupID uint, status string) ([]entity.HeldMessage, error) {
+	if status == "" {
+		status = entity.HeldPending
+	}
+	q := m.db.Where("kind = ? AND status = ?", kind, status)
+	if kind == "group" {
+		q = q.Where("group_id = ?", groupID)
+	}
+	var held []entity.HeldMessage
+	if err := q.Order("id").Find(&held).Error; err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+func (m *Moderator) GetHeld(id uint) (*entity.HeldMessage, error) {
+	var h entity.HeldMessage
+	if err := m.db.First(&h, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrHeldNotFound
+		}
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Review approves or rejects a pending held message. Delivering an approved
+// message is up to the caller.
+func (m *Moderator) Review(id uint, reviewerID string, approve bool) (*entity.HeldMessage, error) {
+	status := entity.HeldRejected
+	if approve {
+		status = entity.HeldApproved
+	}
+	now := time.Now()
+	res := m.db.Model(&entity.HeldMessage{}).
+		Where("id = ? AND status = ?", id, entity.HeldPending).
+		Updates(map[string]interface{}{"status": status, "reviewed_by": reviewerID, "reviewed_at": &now})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := m.GetHeld(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrHeldAlreadyReview
+	}
+	return m.GetHeld(id)
+}
+
+func (m *Moderator) ListRules(groupID uint) ([]entity.ModerationRule, error) {
+	var rules []entity.ModerationRule
+	if err := m.db.Where("group_id = ?", groupID).Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (m *Moderator) AddRule(rule *entity.ModerationRule) error {
+	switch rule.Kind {
+	case entity.RuleWord, entity.RuleLink:
+	case entity.RuleRegex:
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return ErrInvalidRule
+		}
+	default:
+		return ErrInvalidRule
+	}
+	if _, ok := actionSeverity[rule.Action]; !ok || rule.Action == entity.ModerationAllow || strings.TrimSpace(rule.Pattern) == "" {
+		return ErrInvalidRule
+	}
+	return m.db.Create(rule).Error
+}
+
+func (m *Moderator) DeleteRule(groupID, ruleID uint) error {
+	return m.db.Where("id = ? AND group_id = ?", ruleID, groupID).Delete(&entity.ModerationRule{}).Error
+}
+
+func (m *Moderator) GetSettings(groupID uint) (*entity.GroupModerationSettings, error) {
+	st := entity.GroupModerationSettings{GroupID: groupID}
+	err := m.db.Where("group_id = ?", groupID).First(&st).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (m *Moderator) SaveSettings(st *entity.GroupModerationSettings) error {
+	if st.SpamAction != "" {
+		if _, ok := actionSeverity[st.SpamAction]; !ok || st.SpamAction == entity.ModerationMask {
+			return ErrInvalidRule
+		}
+	}
+	return m.db.Save(st).Error
+}
+
+// normalizeHook applies NFKC normalisation and strips control and zero-width
+// characters that are commonly used to dodge filters.
+type normalizeHook struct{}
+
+func (normalizeHook) Moderate(msg *ModerationMessage, _ *ModerationPolicy) ModerationVerdict {
+	body := norm.NFKC.String(msg.Body)
+	body = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, body)
+	msg.Body = strings.TrimSpace(body)
+	if msg.Body == "" {
+		return ModerationVerdict{Action: entity.ModerationReject, Reason: "empty"}
+	}
+	return ModerationVerdict{}
+}
+
+type lengthHook struct{}
+
+func (lengthHook) Moderate(msg *ModerationMessage, policy *ModerationPolicy) ModerationVerdict {
+	if utf8.RuneCountInString(msg.Body) > policy.MaxLength {
+		return ModerationVerdict{Action: entity.ModerationReject, Reason: "too_long"}
+	}
+	return ModerationVerdict{}
+}
+
+// filterHook applies word and regex rules.
+type filterHook struct {
+	mu    sync.Mutex
+	cache map[string]*regexp.Regexp
+}
+
+func newFilterHook() *filterHook {
+	return &filterHook{cache: make(map[string]*regexp.Regexp)}
+}
+
+func (f *filterHook) compile(rule entity.ModerationRule) *regexp.Regexp {
+	key := rule.Kind + ":" + rule.Pattern
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if re, ok := f.cache[key]; ok {
+		return re
+	}
+	expr := rule.Pattern
+	if rule.Kind == entity.RuleWord {
+		expr = `(?i)\b` + regexp.QuoteMeta(rule.Pattern) + `\b`
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		re = nil
+	}
+	if len(f.cache) > 1000 {
+		f.cache = make(map[string]*regexp.Regexp)
+	}
+	f.cache[key] = re
+	return re
+}
+
+func (f *filterHook) Moderate(msg *ModerationMessage, policy *ModerationPolicy) ModerationVerdict {
+	verdict := ModerationVerdict{}
+	for _, rule := range policy.Rules {
+		if rule.Kind != entity.RuleWord && rule.Kind != entity.RuleRegex {
+			continue
+		}
+		re := f.compile(rule)
+		if re == nil || !re.MatchString(msg.Body) {
+			continue
+		}
+		if rule.Action == entity.ModerationMask {
+			msg.Body = re.ReplaceAllStringFunc(msg.Body, func(s string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(s))
+			})
+		}
+		if actionSeverity[rule.Action] > actionSeverity[verdict.Action] {
+			verdict = ModerationVerdict{Action: rule.Action, Reason: "filtered_" + rule.Kind}
+		}
+	}
+	return verdict
+}
+
+// linkHook matches link hosts against blocked domains and their subdomains.
+type linkHook struct{}
+
+var linkHostRe = regexp.MustCompile(`(?i)(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})`)
+
+func (*linkHook) Moderate(msg *ModerationMessage, policy *ModerationPolicy) ModerationVerdict {
+	verdict := ModerationVerdict{}
+	matches := linkHostRe.FindAllStringSubmatch(msg.Body, -1)
+	if len(matches) == 0 {
+		return verdict
+	}
+	for _, rule := range policy.Rules {
+		if rule.Kind != entity.RuleLink {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(rule.Pattern), "."))
+		for _, mt := range matches {
+			host := strings.ToLower(mt[1])
+			if host != domain && !strings.HasSuffix(host, "."+domain) {
+				continue
+			}
+			if rule.Action == entity.ModerationMask {
+				msg.Body = strings.ReplaceAll(msg.Body, mt[0], "[link removed]")
+			}
+			if actionSeverity[rule.Action] > actionSeverity[verdict.Action] {
+				verdict = ModerationVerdict{Action: rule.Action, Reason: "blocked_link"}
+			}
+		}
+	}
+	return verdict
+}
+
+// spamHook flags senders who repeat the same body or send in bursts. State is
+// kept per instance; cross-instance flooding is bounded by the rate limiter.
+type spamHook struct {
+	mu     sync.Mutex
+	recent map[string][]spamEntry
+}
+
+type spamEntry struct {
+	at   time.Time
+	body string
+}
+
+const (
+	spamRepeatWindow = time.Minute
+	spamRepeatMax    = 3
+	spamBurstWindow  = 10 * time.Second
+	spamBurstMax     = 8
+)
+
+func newSpamHook() *spamHook {
+	return &spamHook{recent: make(map[string][]spamEntry)}
+}
+
+func (s *spamHook) Moderate(msg *ModerationMessage, policy *ModerationPolicy) ModerationVerdict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.recent) > 10000 {
+		for k, entries := range s.recent {
+			if len(entries) == 0 || now.Sub(entries[len(entries)-1].at) > spamRepeatWindow {
+				delete(s.recent, k)
+			}
+		}
+	}
+	kept := s.recent[msg.SenderID][:0]
+	repeats, burst := 0, 0
+	for _, e := range s.recent[msg.SenderID] {
+		if now.Sub(e.at) > spamRepeatWindow {
+			continue
+		}
+		kept = append(kept, e)
+		if e.body == msg.Body {
+			repeats++
+		}
+		if now.Sub(e.at) <= spamBurstWindow {
+			burst++
+		}
+	}
+	s.recent[msg.SenderID] = append(kept, spamEntry{at: now, body: msg.Body})
+	switch {
+	case repeats+1 >= spamRepeatMax:
+		return ModerationVerdict{Action: policy.SpamAction, Reason: "spam_repeated"}
+	case burst+1 > spamBurstMax:
+		return ModerationVerdict{Action: policy.SpamAction, Reason: "spam_burst"}
+	}
+	return ModerationVerdict{}
+}
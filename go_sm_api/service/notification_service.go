@@ -0,0 +1,227 @@
+package service
+
+import (
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+// snippetLength is the number of runes of a message body copied into a notification.
+const snippetLength = 140
+
+// NotificationService stores per-user notifications. Delivering them to
+// connected clients is up to the caller (see ws.Hub.PushNotifications).
+type NotificationService interface {
+	// NotifyGroupMessage parses @mentions in gm, stores them on gm.Mentions and
+	// notifies mentioned members and the author of the replied-to message,
+	// unless their conversation settings silence it.
+	// online filters member IDs down to those currently connected (for @here).
+	NotifyGroupMessage(gm *entity.GroupMessage, online func(userIDs []string) []string) ([]entity.Notification, error)
+	// Create stores n; created is false when the user silenced the conversation.
+	Create(n *entity.Notification) (created bool, err error)
+	// List returns the newest notifications first; beforeID pages backwards.
+	List(userID string, unreadOnly bool, limit int, beforeID uint) ([]entity.Notification, error)
+	UnreadCount(userID string) (int64, error)
+	// MarkRead marks the given notifications read, or all of them when ids is empty.
+	MarkRead(userID string, ids []uint) (int64, error)
+}
+
+type DBNotificationService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewNotificationService(db *gorm.DB, groupSvc *GroupService) *DBNotificationService {
+	return &DBNotificationService{db: db, groupSvc: groupSvc}
+}
+
+func (s *DBNotificationService) NotifyGroupMessage(gm *entity.GroupMessage, online func(userIDs []string) []string) ([]entity.Notification, error) {
+	tokens := utils.ParseMentions(gm.Body)
+	if len(tokens) == 0 && gm.ReplyToID == 0 {
+		return nil, nil
+	}
+	// only those who can read the channel are notified
+	members, err := s.groupSvc.ChannelMembers(gm.GroupID, gm.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	memberSet := make(map[string]bool, len(members))
+	for _, id := range members {
+		memberSet[id] = true
+	}
+
+	// resolve @handles to members in one query
+	var handles []string
+	for _, t := range tokens {
+		if t.Handle != entity.MentionHere && t.Handle != entity.MentionEveryone {
+			handles = append(handles, t.Handle)
+		}
+	}
+	byHandle := map[string]string{}
+	if len(handles) > 0 {
+		var users []entity.User
+		if err := s.db.Select("id", "handle").Where("handle IN ?", handles).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			if memberSet[u.ID] {
+				byHandle[u.Handle] = u.ID
+			}
+		}
+	}
+
+	// one notification per recipient; being mentioned takes precedence over
+	// being replied to
+	recipients := map[string]string{}
+	var order []string
+	notify := func(userID, kind string) {
+		if userID == gm.SenderID || recipients[userID] != "" {
+			return
+		}
+		recipients[userID] = kind
+		order = append(order, userID)
+	}
+	var mentions []entity.Mention
+	var here, everyone bool
+	for _, t := range tokens {
+		m := entity.Mention{MessageID: gm.ID, Offset: t.Offset, Length: t.Length}
+		switch t.Handle {
+		case entity.MentionHere:
+			m.Kind, here = entity.MentionHere, true
+		case entity.MentionEveryone:
+			m.Kind, everyone = entity.MentionEveryone, true
+		default:
+			userID, ok := byHandle[t.Handle]
+			if !ok {
+				continue
+			}
+			m.Kind, m.Handle, m.UserID = entity.MentionUser, t.Handle, userID
+			notify(userID, entity.NotifyMention)
+		}
+		mentions = append(mentions, m)
+	}
+	switch {
+	case everyone:
+		for _, id := range members {
+			notify(id, entity.NotifyMention)
+		}
+	case here && online != nil:
+		for _, id := range online(members) {
+			notify(id, entity.NotifyMention)
+		}
+	}
+	if gm.ReplyToID != 0 {
+		var parent entity.GroupMessage
+		if err := s.db.Select("id", "sender_id").First(&parent, gm.ReplyToID).Error; err == nil && memberSet[parent.SenderID] {
+			notify(parent.SenderID, entity.NotifyReply)
+		}
+	}
+
+	settings, err := conversationSettings(s.db, order, "group:"+strconv.FormatUint(uint64(gm.GroupID), 10))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notes := make([]entity.Notification, 0, len(order))
+	for _, userID := range order {
+		if silences(settings[userID], recipients[userID], now) {
+			continue
+		}
+		notes = append(notes, entity.Notification{
+			UserID:      userID,
+			Kind:        recipients[userID],
+			ActorID:     gm.SenderID,
+			GroupID:     gm.GroupID,
+			ChannelID:   gm.ChannelID,
+			MessageKind: "group",
+			MessageID:   gm.ID,
+			Snippet:     Snippet(gm.Body),
+		})
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if len(mentions) > 0 {
+			if err := tx.Create(&mentions).Error; err != nil {
+				return err
+			}
+		}
+		if len(notes) > 0 {
+			return tx.Create(&notes).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	gm.Mentions = mentions
+	return notes, nil
+}
+
+func (s *DBNotificationService) Create(n *entity.Notification) (bool, error) {
+	var conversation string
+	switch {
+	case n.MessageKind == "private":
+		conversation = "private:" + n.ActorID
+	case n.GroupID != 0:
+		conversation = "group:" + strconv.FormatUint(uint64(n.GroupID), 10)
+	}
+	if conversation != "" {
+		settings, err := conversationSettings(s.db, []string{n.UserID}, conversation)
+		if err != nil {
+			return false, err
+		}
+		if silences(settings[n.UserID], n.Kind, time.Now()) {
+			return false, nil
+		}
+	}
+	if err := s.db.Create(n).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *DBNotificationService) List(userID string, unreadOnly bool, limit int, beforeID uint) ([]entity.Notification, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := s.db.Where("user_id = ?", userID)
+	if unreadOnly {
+		q = q.Where("read_at IS NULL")
+	}
+	if beforeID > 0 {
+		q = q.Where("id < ?", beforeID)
+	}
+	var notes []entity.Notification
+	if err := q.Order("id DESC").Limit(limit).Find(&notes).Error; err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (s *DBNotificationService) UnreadCount(userID string) (int64, error) {
+	var n int64
+	err := s.db.Model(&entity.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&n).Error
+	return n, err
+}
+
+func (s *DBNotificationService) MarkRead(userID string, ids []uint) (int64, error) {
+	q := s.db.Model(&entity.Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	if len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+	res := q.Update("read_at", time.Now())
+	return res.RowsAffected, res.Error
+}
+
+// Snippet shortens a message body for previews such as notifications.
+func Snippet(body string) string {
+	if utf8.RuneCountInString(body) <= snippetLength {
+		return body
+	}
+	r := []rune(body)
+	return string(r[:snippetLength-1]) + "…"
+}
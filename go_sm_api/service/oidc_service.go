@@ -0,0 +1,364 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrUnknownProvider   = errors.New("unknown identity provider")
+	ErrInvalidOIDCState  = errors.New("invalid or expired login state")
+	ErrOIDCEmailRequired = errors.New("identity provider did not return a verified email")
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// OIDCProviderConfig configures one OpenID Connect provider.
+type OIDCProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// OIDCService implements the authorization code flow with PKCE.
+type OIDCService interface {
+	Providers() []string
+	// AuthURL starts a login and returns the provider URL to send the browser to.
+	AuthURL(provider string) (string, error)
+	// Exchange completes a login from the callback and returns the local user,
+	// linking or creating it as needed.
+	Exchange(provider, state, code string) (*entity.User, error)
+}
+
+type DBOIDCService struct {
+	db        *gorm.DB
+	client    *http.Client
+	providers map[string]*oidcProvider
+}
+
+type oidcProvider struct {
+	cfg OIDCProviderConfig
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]interface{}
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Nonce         string      `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+func NewOIDCService(db *gorm.DB, client *http.Client, configs []OIDCProviderConfig) *DBOIDCService {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	providers := make(map[string]*oidcProvider, len(configs))
+	for _, cfg := range configs {
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+		providers[cfg.Name] = &oidcProvider{cfg: cfg}
+	}
+	return &DBOIDCService{db: db, client: client, providers: providers}
+}
+
+func (s *DBOIDCService) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *DBOIDCService) AuthURL(provider string) (string, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+	disc, err := s.discover(p)
+	if err != nil {
+		return "", err
+	}
+	st := &entity.OIDCLoginState{
+		State:        generateID(16),
+		Provider:     provider,
+		CodeVerifier: generateID(32),
+		Nonce:        generateID(16),
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	}
+	// opportunistically drop abandoned logins
+	if err := s.db.Where("expires_at < ?", time.Now()).Delete(&entity.OIDCLoginState{}).Error; err != nil {
+		return "", err
+	}
+	if err := s.db.Create(st).Error; err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(st.CodeVerifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return disc.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+func (s *DBOIDCService) Exchange(provider, state, code string) (*entity.User, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	st, err := s.takeState(provider, state)
+	if err != nil {
+		return nil, err
+	}
+	disc, err := s.discover(p)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, err := s.redeemCode(p, disc, code, st.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := s.verifyIDToken(p, disc, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != st.Nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	return s.resolveUser(provider, claims)
+}
+
+// takeState consumes a pending login state so each callback can be used once.
+func (s *DBOIDCService) takeState(provider, state string) (*entity.OIDCLoginState, error) {
+	if state == "" {
+		return nil, ErrInvalidOIDCState
+	}
+	var st entity.OIDCLoginState
+	if err := s.db.Where("state = ? AND provider = ?", state, provider).First(&st).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidOIDCState
+		}
+		return nil, err
+	}
+	res := s.db.Delete(&entity.OIDCLoginState{}, st.ID)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 || time.Now().After(st.ExpiresAt) {
+		return nil, ErrInvalidOIDCState
+	}
+	return &st, nil
+}
+
+func (s *DBOIDCService) redeemCode(p *oidcProvider, disc *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token endpoint: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: status %d %s", resp.StatusCode, tok.Error)
+	}
+	return tok.IDToken, nil
+}
+
+func (s *DBOIDCService) verifyIDToken(p *oidcProvider, disc *oidcDiscovery, raw string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return s.signingKey(p, disc, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(disc.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %w", err)
+	}
+	if claims.ExpiresAt == nil || claims.Subject == "" {
+		return nil, errors.New("id token: missing exp or sub")
+	}
+	return claims, nil
+}
+
+// resolveUser finds the user linked to the external identity, links an existing
+// user by verified email, or creates a new one.
+func (s *DBOIDCService) resolveUser(provider string, claims *idTokenClaims) (*entity.User, error) {
+	var u entity.User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var ident entity.UserIdentity
+		err := tx.Where("provider = ? AND subject = ?", provider, claims.Subject).First(&ident).Error
+		if err == nil {
+			return tx.Where("id = ?", ident.UserID).First(&u).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+		if claims.Email == "" || !verified {
+			return ErrOIDCEmailRequired
+		}
+		err = tx.Where("email = ?", claims.Email).First(&u).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// just-in-time provisioning; no password, so only SSO can log in
+			u = entity.User{ID: generateID(8), Email: claims.Email, EmailVerified: true}
+			err = tx.Create(&u).Error
+		} else if err == nil && !u.EmailVerified {
+			err = tx.Model(&u).Update("email_verified", true).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Create(&entity.UserIdentity{
+			UserID:   u.ID,
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *DBOIDCService) discover(p *oidcProvider) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var disc oidcDiscovery
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := s.getJSON(wellKnown, &disc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if disc.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", disc.Issuer, p.cfg.Issuer)
+	}
+	p.discovery = &disc
+	return p.discovery, nil
+}
+
+// signingKey returns the JWKS key for kid, refetching the key set once when the
+// provider has rotated keys.
+func (s *DBOIDCService) signingKey(p *oidcProvider, disc *oidcDiscovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := s.getJSON(disc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	p.keys = make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("jwks: no key with kid %q", kid)
+}
+
+func (s *DBOIDCService) getJSON(u string, v interface{}) error {
+	resp, err := s.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
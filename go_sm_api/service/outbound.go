@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var ErrPrivateWebhookURL = errors.New("webhook url must not point to a loopback, private or link-local address")
+
+// allowPrivateOutbound lets webhooks and bot commands reach internal
+// addresses; see AllowPrivateOutbound.
+var allowPrivateOutbound bool
+
+// AllowPrivateOutbound turns off the address checks on webhook and bot command
+// URLs, so endpoints on localhost or the local network can be used in
+// development. It must be called before serving.
+func AllowPrivateOutbound() {
+	allowPrivateOutbound = true
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// net.IP.IsPrivate does not cover.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// internalIP reports whether ip is an address outbound requests must not reach:
+// loopback, private, link-local (cloud metadata at 169.254.169.254 included),
+// unspecified or multicast.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+// checkOutboundHost resolves host and fails when any of its addresses is
+// internal. The dialer checks again, as DNS may answer differently later.
+func checkOutboundHost(ctx context.Context, host string) error {
+	if allowPrivateOutbound {
+		return nil
+	}
+	return checkPublicHost(ctx, host)
+}
+
+// checkPublicHost is checkOutboundHost regardless of AllowPrivateOutbound.
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if internalIP(ip) {
+			return ErrPrivateWebhookURL
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%w: cannot resolve %s", ErrInvalidWebhookURL, host)
+	}
+	for _, a := range addrs {
+		if internalIP(a.IP) {
+			return ErrPrivateWebhookURL
+		}
+	}
+	return nil
+}
+
+// dialControl refuses connections to internal addresses once DNS has been
+// resolved, which also covers redirects and rebinding.
+func dialControl(network, address string, c syscall.RawConn) error {
+	if allowPrivateOutbound {
+		return nil
+	}
+	return publicDialControl(network, address, c)
+}
+
+// publicDialControl is dialControl regardless of AllowPrivateOutbound.
+func publicDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateWebhookURL, host)
+	}
+	return nil
+}
+
+// newOutboundClient returns the client webhooks and bot commands are called
+// with. It does not use proxies, whose address would be checked instead of
+// the endpoint's.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return newGuardedClient(timeout, dialControl)
+}
+
+// newGuardedClient is newOutboundClient with its own dial check; nil
+// control allows every address.
+func newGuardedClient(timeout time.Duration, control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: control}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrPinForbidden = errors.New("only the group owner can pin messages")
+	ErrTooManyPins  = errors.New("too many pinned messages in this conversation")
+)
+
+// maxPins caps the pinned messages of one conversation.
+const maxPins = 50
+
+// PinService pins messages to their conversation. In groups only the owner
+// pins and unpins; in DMs either participant may.
+type PinService interface {
+	// PinGroup pins a message of the group; added is false when it was already pinned.
+	PinGroup(userID string, groupID, messageID uint) (pin *entity.PinnedMessage, added bool, err error)
+	// UnpinGroup returns the removed pin, or nil when the message was not pinned.
+	UnpinGroup(userID string, groupID, messageID uint) (*entity.PinnedMessage, error)
+	// GroupPins lists the pins of the group's channels userID can read with
+	// their messages, newest first.
+	GroupPins(userID string, groupID uint) ([]entity.PinnedMessage, error)
+	PinPrivate(userID, otherID string, messageID uint) (*entity.PinnedMessage, bool, error)
+	UnpinPrivate(userID, otherID string, messageID uint) (bool, error)
+	PrivatePins(userID, otherID string) ([]entity.PinnedMessage, error)
+}
+
+type DBPinService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewPinService(db *gorm.DB, groupSvc *GroupService) *DBPinService {
+	return &DBPinService{db: db, groupSvc: groupSvc}
+}
+
+func (s *DBPinService) PinGroup(userID string, groupID, messageID uint) (*entity.PinnedMessage, bool, error) {
+	if err := s.requireOwner(userID, groupID); err != nil {
+		return nil, false, err
+	}
+	t, err := messageTarget(s.db, s.groupSvc, userID, "group", messageID)
+	if err != nil {
+		return nil, false, err
+	}
+	if t.GroupID != groupID {
+		return nil, false, ErrMessageNotFound
+	}
+	// each channel has its own pins
+	return s.pin(&entity.PinnedMessage{MessageKind: "group", MessageID: messageID, GroupID: groupID, ChannelID: t.ChannelID, PinnedBy: userID},
+		s.db.Where("message_kind = ? AND group_id = ? AND channel_id = ?", "group", groupID, t.ChannelID))
+}
+
+func (s *DBPinService) UnpinGroup(userID string, groupID, messageID uint) (*entity.PinnedMessage, error) {
+	if err := s.requireOwner(userID, groupID); err != nil {
+		return nil, err
+	}
+	var pin entity.PinnedMessage
+	err := s.db.Where("message_kind = ? AND group_id = ? AND message_id = ?", "group", groupID, messageID).First(&pin).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := s.db.Delete(&pin)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	return &pin, nil
+}
+
+func (s *DBPinService) GroupPins(userID string, groupID uint) ([]entity.PinnedMessage, error) {
+	ok, err := s.groupSvc.IsMember(groupID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotGroupMember
+	}
+	var pins []entity.PinnedMessage
+	if err := s.db.Where("message_kind = ? AND group_id = ?", "group", groupID).Scopes(readableChannels(userID)).
+		Order("id DESC").Find(&pins).Error; err != nil {
+		return nil, err
+	}
+	return s.withMessages(userID, pins)
+}
+
+func (s *DBPinService) PinPrivate(userID, otherID string, messageID uint) (*entity.PinnedMessage, bool, error) {
+	t, err := messageTarget(s.db, s.groupSvc, userID, "private", messageID)
+	if err != nil {
+		return nil, false, err
+	}
+	// the other participant cannot see a pending request yet
+	if t.Pending || (t.SenderID != otherID && t.RecipientID != otherID) {
+		return nil, false, ErrMessageNotFound
+	}
+	a, b := conversationPair(userID, otherID)
+	return s.pin(&entity.PinnedMessage{MessageKind: "private", MessageID: messageID, UserA: a, UserB: b, PinnedBy: userID},
+		s.db.Where("message_kind = ? AND user_a = ? AND user_b = ?", "private", a, b))
+}
+
+func (s *DBPinService) UnpinPrivate(userID, otherID string, messageID uint) (bool, error) {
+	a, b := conversationPair(userID, otherID)
+	res := s.db.Where("message_kind = ? AND user_a = ? AND user_b = ? AND message_id = ?", "private", a, b, messageID).
+		Delete(&entity.PinnedMessage{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *DBPinService) PrivatePins(userID, otherID string) ([]entity.PinnedMessage, error) {
+	a, b := conversationPair(userID, otherID)
+	var pins []entity.PinnedMessage
+	if err := s.db.Where("message_kind = ? AND user_a = ? AND user_b = ?", "private", a, b).Order("id DESC").Find(&pins).Error; err != nil {
+		return nil, err
+	}
+	return s.withMessages(userID, pins)
+}
+
+func (s *DBPinService) requireOwner(userID string, groupID uint) error {
+	grp, err := s.groupSvc.GetGroup(groupID)
+	if err != nil {
+		return err
+	}
+	if grp.OwnerID != userID {
+		return ErrPinForbidden
+	}
+	return nil
+}
+
+// pin creates p unless the message is already pinned; conversation selects
+// the conversation's existing pins for the limit.
+func (s *DBPinService) pin(p *entity.PinnedMessage, conversation *gorm.DB) (*entity.PinnedMessage, bool, error) {
+	var existing entity.PinnedMessage
+	err := s.db.Where("message_kind = ? AND message_id = ?", p.MessageKind, p.MessageID).First(&existing).Error
+	if err == nil {
+		return &existing, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+	var cnt int64
+	if err := conversation.Model(&entity.PinnedMessage{}).Count(&cnt).Error; err != nil {
+		return nil, false, err
+	}
+	if cnt >= maxPins {
+		return nil, false, ErrTooManyPins
+	}
+	res := s.db.Where(entity.PinnedMessage{MessageKind: p.MessageKind, MessageID: p.MessageID}).FirstOrCreate(p)
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+	return p, res.RowsAffected > 0, nil
+}
+
+// withMessages attaches each pin's message, dropping pins whose message has
+// expired in the meantime.
+func (s *DBPinService) withMessages(viewerID string, pins []entity.PinnedMessage) ([]entity.PinnedMessage, error) {
+	ids := map[string][]uint{}
+	for _, p := range pins {
+		ids[p.MessageKind] = append(ids[p.MessageKind], p.MessageID)
+	}
+	pms, gms, err := loadMessages(s.db, viewerID, ids["private"], ids["group"])
+	if err != nil {
+		return nil, err
+	}
+	out := pins[:0]
+	for _, p := range pins {
+		switch {
+		case pms[p.MessageID] != nil && p.MessageKind == "private":
+			p.PrivateMessage = pms[p.MessageID]
+		case gms[p.MessageID] != nil && p.MessageKind == "group":
+			p.GroupMessage = gms[p.MessageID]
+		default:
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// loadMessages fetches the unexpired private and group messages with the
+// given IDs, keyed by ID, as viewerID sees them.
+func loadMessages(db *gorm.DB, viewerID string, pmIDs, gmIDs []uint) (map[uint]*entity.PrivateMessage, map[uint]*entity.GroupMessage, error) {
+	var pmRows []entity.PrivateMessage
+	var gmRows []entity.GroupMessage
+	if len(pmIDs) > 0 {
+		if err := db.Scopes(unexpired).Where("id IN ?", pmIDs).Find(&pmRows).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(gmIDs) > 0 {
+		if err := db.Scopes(unexpired).Where("id IN ?", gmIDs).Find(&gmRows).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := hideForwardSources(db, viewerID, pmRows, gmRows); err != nil {
+		return nil, nil, err
+	}
+	pms := map[uint]*entity.PrivateMessage{}
+	gms := map[uint]*entity.GroupMessage{}
+	for i := range pmRows {
+		pms[pmRows[i].ID] = &pmRows[i]
+	}
+	for i := range gmRows {
+		gms[gmRows[i].ID] = &gmRows[i]
+	}
+	return pms, gms, nil
+}
+
+// forgetMessages deletes the pins and bookmarks of deleted messages; ids is
+// a slice of IDs or a subquery.
+func forgetMessages(tx *gorm.DB, kind string, ids interface{}) error {
+	if err := tx.Where("message_kind = ? AND message_id IN (?)", kind, ids).Delete(&entity.PinnedMessage{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("message_kind = ? AND message_id IN (?)", kind, ids).Delete(&entity.SavedMessage{}).Error
+}
@@ -9,11 +9,23 @@ import (
 	"github.com/abeme/go_sm_api/entity"
 )
 
+var (
+	ErrMessageNotFound = errors.New("message not found")
+)
+
 // PrivateMessageService defines operations for direct messages.
 type PrivateMessageService interface {
 	Send(senderID, recipientID, body string) (*entity.PrivateMessage, error)
+	// SendEncrypted stores an end-to-end encrypted message. The server cannot
+	// read it, so it only checks who the envelope is addressed to.
+	SendEncrypted(senderID, recipientID string, env *entity.EncryptedEnvelope) (*entity.PrivateMessage, error)
+	// Forward stores a copy of another message attributed to src.
+	Forward(senderID, recipientID, body string, src *entity.ForwardSource) (*entity.PrivateMessage, error)
+	// ListConversation hides the source of forwarded messages userID cannot access.
 	ListConversation(userID, otherUserID string, limit int, beforeID uint) ([]entity.PrivateMessage, error)
 	MarkRead(recipientID, senderID string, ids []uint) (int64, error)
+	Get(id uint) (*entity.PrivateMessage, error)
+	Delete(id uint) error
 }
 
 type DBPrivateMessageService struct {
@@ -25,11 +37,54 @@ func NewPrivateMessageService(db *gorm.DB) *DBPrivateMessageService {
 }
 
 func (s *DBPrivateMessageService) Send(senderID, recipientID, body string) (*entity.PrivateMessage, error) {
+	return s.send(&entity.PrivateMessage{SenderID: senderID, RecipientID: recipientID, Body: body})
+}
+
+func (s *DBPrivateMessageService) SendEncrypted(senderID, recipientID string, env *entity.EncryptedEnvelope) (*entity.PrivateMessage, error) {
+	return s.send(&entity.PrivateMessage{SenderID: senderID, RecipientID: recipientID, Encrypted: true, Envelope: env})
+}
+
+func (s *DBPrivateMessageService) Forward(senderID, recipientID, body string, src *entity.ForwardSource) (*entity.PrivateMessage, error) {
+	return s.send(&entity.PrivateMessage{SenderID: senderID, RecipientID: recipientID, Body: body, Forwarded: true, ForwardedFrom: src})
+}
+
+// send stores pm; plaintext is refused once the conversation is end-to-end
+// encrypted.
+func (s *DBPrivateMessageService) send(pm *entity.PrivateMessage) (*entity.PrivateMessage, error) {
+	senderID, recipientID := pm.SenderID, pm.RecipientID
 	if senderID == recipientID {
 		return nil, errors.New("cannot send to self")
 	}
-	pm := &entity.PrivateMessage{SenderID: senderID, RecipientID: recipientID, Body: body}
-	if err := s.db.Create(pm).Error; err != nil {
+	blocked, err := isBlocked(s.db, recipientID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, ErrBlocked
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if pm.Encrypted {
+			if err := validateEnvelope(tx, senderID, recipientID, pm.Envelope); err != nil {
+				return err
+			}
+		} else if e2e, err := e2eEnabled(tx, senderID, recipientID); err != nil {
+			return err
+		} else if e2e {
+			return ErrE2ERequired
+		}
+		status, err := resolveMessageRequest(tx, senderID, recipientID)
+		if err != nil {
+			return err
+		}
+		pm.Pending = status != ""
+		ttl, err := privateTTL(tx, senderID, recipientID)
+		if err != nil {
+			return err
+		}
+		pm.ExpiresAt = expiryAt(ttl)
+		return tx.Create(pm).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return pm, nil
@@ -42,7 +97,7 @@ func (s *DBPrivateMessageService) ListConversation(userID, otherUserID string, l
 		limit = 50
 	}
 	var msgs []entity.PrivateMessage
-	q := s.db.Model(&entity.PrivateMessage{}).
+	q := s.db.Model(&entity.PrivateMessage{}).Scopes(unexpired).
 		Where("((sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?))", userID, otherUserID, otherUserID, userID)
 	if beforeID > 0 {
 		q = q.Where("id < ?", beforeID)
@@ -50,6 +105,9 @@ func (s *DBPrivateMessageService) ListConversation(userID, otherUserID string, l
 	if err := q.Order("id DESC").Limit(limit).Find(&msgs).Error; err != nil {
 		return nil, err
 	}
+	if err := hideForwardSources(s.db, userID, msgs, nil); err != nil {
+		return nil, err
+	}
 	return msgs, nil
 }
 
@@ -64,3 +122,27 @@ func (s *DBPrivateMessageService) MarkRead(recipientID, senderID string, ids []u
 		Updates(map[string]interface{}{"read_at": &now})
 	return res.RowsAffected, res.Error
 }
+
+func (s *DBPrivateMessageService) Get(id uint) (*entity.PrivateMessage, error) {
+	var pm entity.PrivateMessage
+	if err := s.db.Scopes(unexpired).First(&pm, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return &pm, nil
+}
+
+func (s *DBPrivateMessageService) Delete(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&entity.PrivateMessage{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrMessageNotFound
+		}
+		return forgetMessages(tx, "private", []uint{id})
+	})
+}
@@ -0,0 +1,419 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+var (
+	ErrPushDisabled        = errors.New("web push is not configured")
+	ErrInvalidPushEndpoint = errors.New("push endpoint must be an https URL on a public address")
+)
+
+// Push kinds, used together with a reference ID to acknowledge delivery.
+const (
+	PushKindPrivate      = "private"
+	PushKindGroupDM      = "group_dm"
+	PushKindNotification = "notification"
+)
+
+// PushMessage is the JSON payload the service worker receives.
+type PushMessage struct {
+	Kind  string `json:"kind"`
+	RefID uint   `json:"ref_id"`
+	// Conversation is "private:<otherUserID>" or "group:<id>"; it is what mute
+	// settings are keyed on.
+	Conversation string                 `json:"conversation"`
+	Title        string                 `json:"title"`
+	Body         string                 `json:"body"`
+	Data         map[string]interface{} `json:"data,omitempty"`
+}
+
+// PushMuteChecker reports whether a user has silenced pushes for a conversation.
+type PushMuteChecker interface {
+	PushMuted(userID, conversation string) bool
+}
+
+// PushConfig tunes the dispatcher. An online user has AckWindow to acknowledge
+// an event over the WebSocket before it is pushed anyway; offline users are
+// pushed right away. Jobs older than TTL are dropped.
+type PushConfig struct {
+	Subject      string
+	AckWindow    time.Duration
+	TTL          time.Duration
+	MaxAttempts  int
+	RetryBase    time.Duration
+	PollInterval time.Duration
+	// AllowLocalEndpoints accepts plain http endpoints on loopback and
+	// private addresses, such as cmd/webpush fake-endpoint, for development.
+	AllowLocalEndpoints bool
+}
+
+var DefaultPushConfig = PushConfig{
+	AckWindow:    30 * time.Second,
+	TTL:          24 * time.Hour,
+	MaxAttempts:  5,
+	RetryBase:    30 * time.Second,
+	PollInterval: 2 * time.Second,
+}
+
+// claimLease is how long a dispatcher owns a job it picked up; if it crashes
+// mid-send another instance retries after the lease.
+const claimLease = time.Minute
+
+// PushService manages Web Push subscriptions and the delivery queue.
+type PushService interface {
+	// PublicKey is the VAPID applicationServerKey, or "" when push is disabled.
+	PublicKey() string
+	Subscribe(userID, userAgent string, req entity.PushSubscribeRequest) (*entity.PushSubscription, error)
+	Unsubscribe(userID, endpoint string) error
+	ListSubscriptions(userID string) ([]entity.PushSubscription, error)
+	// Enqueue queues msg for every device of userID.
+	Enqueue(userID string, msg PushMessage, online bool) error
+	// Ack cancels pending pushes for an event the user has seen.
+	Ack(userID, kind string, refID uint) error
+}
+
+type DBPushService struct {
+	db     *gorm.DB
+	client *http.Client
+	keys   *utils.VAPIDKeys
+	cfg    PushConfig
+	mute   PushMuteChecker
+}
+
+// NewPushService builds the push service. With nil keys push is disabled and
+// Enqueue is a no-op; mute may be nil. The default client refuses internal
+// addresses unless cfg.AllowLocalEndpoints is set.
+func NewPushService(db *gorm.DB, client *http.Client, keys *utils.VAPIDKeys, cfg PushConfig, mute PushMuteChecker) *DBPushService {
+	if client == nil {
+		control := publicDialControl
+		if cfg.AllowLocalEndpoints {
+			control = nil
+		}
+		client = newGuardedClient(10*time.Second, control)
+	}
+	def := DefaultPushConfig
+	if cfg.AckWindow <= 0 {
+		cfg.AckWindow = def.AckWindow
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = def.TTL
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = def.MaxAttempts
+	}
+	if cfg.RetryBase <= 0 {
+		cfg.RetryBase = def.RetryBase
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = def.PollInterval
+	}
+	return &DBPushService{db: db, client: client, keys: keys, cfg: cfg, mute: mute}
+}
+
+func (s *DBPushService) PublicKey() string {
+	if s.keys == nil {
+		return ""
+	}
+	return s.keys.PublicKey
+}
+
+// Subscribe registers a device. Re-subscribing an endpoint moves it to userID
+// and refreshes its keys.
+func (s *DBPushService) Subscribe(userID, userAgent string, req entity.PushSubscribeRequest) (*entity.PushSubscription, error) {
+	if s.keys == nil {
+		return nil, ErrPushDisabled
+	}
+	if err := s.validateEndpoint(req.Endpoint); err != nil {
+		return nil, err
+	}
+	// reject keys we could never encrypt to
+	if _, err := utils.EncryptWebPush(req.Keys.P256dh, req.Keys.Auth, nil); err != nil {
+		return nil, err
+	}
+	sub := entity.PushSubscription{Endpoint: req.Endpoint}
+	err := s.db.Where(entity.PushSubscription{Endpoint: req.Endpoint}).
+		Assign(entity.PushSubscription{UserID: userID, P256dh: req.Keys.P256dh, Auth: req.Keys.Auth, UserAgent: userAgent}).
+		FirstOrCreate(&sub).Error
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// validateEndpoint requires an https endpoint that resolves to public
+// addresses only, so subscriptions cannot point the dispatcher at internal
+// services. The dispatcher's dialer checks again on every push.
+func (s *DBPushService) validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Hostname() == "" {
+		return ErrInvalidPushEndpoint
+	}
+	if s.cfg.AllowLocalEndpoints {
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return ErrInvalidPushEndpoint
+		}
+		return nil
+	}
+	if u.Scheme != "https" {
+		return ErrInvalidPushEndpoint
+	}
+	if err := checkPublicHost(context.Background(), u.Hostname()); err != nil {
+		return ErrInvalidPushEndpoint
+	}
+	return nil
+}
+
+func (s *DBPushService) Unsubscribe(userID, endpoint string) error {
+	var sub entity.PushSubscription
+	if err := s.db.Where("user_id = ? AND endpoint = ?", userID, endpoint).First(&sub).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	return s.removeSubscription(sub.ID)
+}
+
+func (s *DBPushService) ListSubscriptions(userID string) ([]entity.PushSubscription, error) {
+	var subs []entity.PushSubscription
+	if err := s.db.Where("user_id = ?", userID).Order("id").Find(&subs).Error; err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func (s *DBPushService) Enqueue(userID string, msg PushMessage, online bool) error {
+	if s.keys == nil {
+		return nil
+	}
+	var subIDs []uint
+	if err := s.db.Model(&entity.PushSubscription{}).Where("user_id = ?", userID).Pluck("id", &subIDs).Error; err != nil {
+		return err
+	}
+	if len(subIDs) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	due := time.Now()
+	if online {
+		due = due.Add(s.cfg.AckWindow)
+	}
+	jobs := make([]entity.PushJob, 0, len(subIDs))
+	for _, id := range subIDs {
+		jobs = append(jobs, entity.PushJob{
+			UserID:         userID,
+			SubscriptionID: id,
+			Kind:           msg.Kind,
+			RefID:          msg.RefID,
+			Conversation:   msg.Conversation,
+			Payload:        string(payload),
+			Status:         entity.PushPending,
+			NextAttemptAt:  due,
+		})
+	}
+	return s.db.Create(&jobs).Error
+}
+
+func (s *DBPushService) Ack(userID, kind string, refID uint) error {
+	return s.db.Model(&entity.PushJob{}).
+		Where("user_id = ? AND kind = ? AND ref_id = ? AND status = ?", userID, kind, refID, entity.PushPending).
+		Update("status", entity.PushAcked).Error
+}
+
+// Run dispatches due jobs until ctx is done. It is safe to run on every instance.
+func (s *DBPushService) Run(ctx context.Context) {
+	if s.keys == nil {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.DispatchDue(ctx); err != nil {
+			log.Printf("push dispatch: %v", err)
+		}
+		if time.Since(lastCleanup) > time.Hour {
+			lastCleanup = time.Now()
+			cutoff := time.Now().Add(-7 * 24 * time.Hour)
+			if err := s.db.Where("status <> ? AND created_at < ?", entity.PushPending, cutoff).Delete(&entity.PushJob{}).Error; err != nil {
+				log.Printf("push cleanup: %v", err)
+			}
+		}
+	}
+}
+
+// DispatchDue sends every job whose time has come.
+func (s *DBPushService) DispatchDue(ctx context.Context) error {
+	for {
+		var jobs []entity.PushJob
+		now := time.Now()
+		if err := s.db.Where("status = ? AND next_attempt_at <= ?", entity.PushPending, now).
+			Order("next_attempt_at").Limit(100).Find(&jobs).Error; err != nil {
+			return err
+		}
+		claimed := 0
+		for i := range jobs {
+			job := &jobs[i]
+			// claim by moving the job past the lease; whoever updates the row first owns it
+			res := s.db.Model(&entity.PushJob{}).
+				Where("id = ? AND status = ? AND next_attempt_at = ?", job.ID, entity.PushPending, job.NextAttemptAt).
+				Update("next_attempt_at", now.Add(claimLease))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				continue
+			}
+			claimed++
+			s.send(ctx, job)
+		}
+		if len(jobs) < 100 || claimed == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *DBPushService) send(ctx context.Context, job *entity.PushJob) {
+	if time.Since(job.CreatedAt) > s.cfg.TTL {
+		s.finish(job, entity.PushExpired, "ttl exceeded")
+		return
+	}
+	if s.mute != nil && s.mute.PushMuted(job.UserID, job.Conversation) {
+		s.finish(job, entity.PushMuted, "")
+		return
+	}
+	var sub entity.PushSubscription
+	if err := s.db.First(&sub, job.SubscriptionID).Error; err != nil {
+		s.finish(job, entity.PushExpired, "subscription removed")
+		return
+	}
+	status, retryAfter, err := s.post(ctx, &sub, []byte(job.Payload))
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		now := time.Now()
+		s.db.Model(&sub).Update("last_push_at", &now)
+		s.finish(job, entity.PushSent, "")
+	case status == http.StatusNotFound || status == http.StatusGone:
+		// the browser dropped the subscription
+		if err := s.removeSubscription(sub.ID); err != nil {
+			log.Printf("remove push subscription %d: %v", sub.ID, err)
+		}
+		s.finish(job, entity.PushExpired, fmt.Sprintf("push service returned %d", status))
+	case errors.Is(err, ErrPrivateWebhookURL):
+		// the endpoint now resolves to an internal address; retrying won't help
+		s.finish(job, entity.PushFailed, err.Error())
+	case err == nil && status != http.StatusTooManyRequests && status < 500:
+		s.finish(job, entity.PushFailed, fmt.Sprintf("push service returned %d", status))
+	default:
+		msg := fmt.Sprintf("push service returned %d", status)
+		if err != nil {
+			msg = err.Error()
+		}
+		s.retry(job, msg, retryAfter)
+	}
+}
+
+// post encrypts and delivers payload; it returns the push service's status code.
+func (s *DBPushService) post(ctx context.Context, sub *entity.PushSubscription, payload []byte) (int, time.Duration, error) {
+	body, err := utils.EncryptWebPush(sub.P256dh, sub.Auth, payload)
+	if err != nil {
+		// keys are validated on subscribe, so this is permanent
+		return http.StatusBadRequest, 0, nil
+	}
+	auth, err := s.keys.VAPIDAuthorization(sub.Endpoint, s.cfg.Subject, 12*time.Hour)
+	if err != nil {
+		return http.StatusBadRequest, 0, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(s.cfg.TTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return resp.StatusCode, retryAfter, nil
+}
+
+// retry reschedules a job with exponential backoff, giving up after MaxAttempts.
+func (s *DBPushService) retry(job *entity.PushJob, lastErr string, retryAfter time.Duration) {
+	attempts := job.Attempts + 1
+	if attempts >= s.cfg.MaxAttempts {
+		s.db.Model(job).Updates(map[string]interface{}{"attempts": attempts, "status": entity.PushFailed, "last_error": truncate(lastErr, 255)})
+		return
+	}
+	delay := s.cfg.RetryBase << (attempts - 1)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	s.db.Model(job).Updates(map[string]interface{}{
+		"attempts":        attempts,
+		"next_attempt_at": time.Now().Add(delay),
+		"last_error":      truncate(lastErr, 255),
+	})
+}
+
+func (s *DBPushService) finish(job *entity.PushJob, status, lastErr string) {
+	updates := map[string]interface{}{"status": status}
+	if status == entity.PushSent || status == entity.PushFailed {
+		updates["attempts"] = job.Attempts + 1
+	}
+	if lastErr != "" {
+		updates["last_error"] = truncate(lastErr, 255)
+	}
+	if err := s.db.Model(job).Updates(updates).Error; err != nil {
+		log.Printf("push job %d: %v", job.ID, err)
+	}
+}
+
+func (s *DBPushService) removeSubscription(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&entity.PushJob{}).Where("subscription_id = ? AND status = ?", id, entity.PushPending).
+			Update("status", entity.PushExpired).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&entity.PushSubscription{}, id).Error
+	})
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
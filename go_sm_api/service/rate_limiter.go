@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate-limited action types.
+const (
+	ActionPrivateMessage = "private"
+	ActionGroupMessage   = "group"
+	ActionGroupDMMessage = "group_dm"
+	ActionForward        = "forward"
+	ActionRESTWrite      = "rest_write"
+)
+
+// RateLimit is a token bucket: Rate tokens are added per second up to Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var DefaultRateLimits = map[string]RateLimit{
+	ActionPrivateMessage: {Rate: 5, Burst: 10},
+	ActionGroupMessage:   {Rate: 5, Burst: 10},
+	ActionGroupDMMessage: {Rate: 5, Burst: 10},
+	ActionForward:        {Rate: 1, Burst: 5},
+	ActionRESTWrite:      {Rate: 2, Burst: 20},
+}
+
+// ParseRateLimits parses overrides such as "private=5:10,group=2:5" (rate per
+// second and burst per action) on top of DefaultRateLimits.
+func ParseRateLimits(spec string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit, len(DefaultRateLimits))
+	for k, v := range DefaultRateLimits {
+		limits[k] = v
+	}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		action, val, ok := strings.Cut(item, "=")
+		rateStr, burstStr, ok2 := strings.Cut(val, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("rate limit %q: want action=rate:burst", item)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid rate", item)
+		}
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("rate limit %q: invalid burst", item)
+		}
+		limits[strings.TrimSpace(action)] = RateLimit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// tokenBucketScript refills and takes one token atomically. It returns
+// {allowed, retry_after_ms}.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil then
+  tokens = burst
+  ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// RateLimiter enforces per-user token buckets per action. Buckets live in Redis
+// so limits hold across instances; process memory is used while Redis is down.
+type RateLimiter struct {
+	rdb    *redis.Client
+	limits map[string]RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rdb *redis.Client, limits map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{rdb: rdb, limits: limits, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token for key under action. When the bucket is empty it returns
+// false and how long until the next token is available. Unknown actions are not limited.
+func (l *RateLimiter) Allow(ctx context.Context, action, key string) (bool, time.Duration) {
+	lim, ok := l.limits[action]
+	if !ok {
+		return true, 0
+	}
+	bucketKey := "ratelimit:" + action + ":" + key
+	if l.rdb != nil {
+		res, err := tokenBucketScript.Run(ctx, l.rdb, []string{bucketKey}, lim.Rate, lim.Burst).Int64Slice()
+		if err == nil && len(res) == 2 {
+			return res[0] == 1, time.Duration(res[1]) * time.Millisecond
+		}
+		log.Printf("rate limiter: redis unavailable, using memory: %v", err)
+	}
+	return l.allowLocal(bucketKey, lim)
+}
+
+func (l *RateLimiter) allowLocal(key string, lim RateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.buckets) > 10000 {
+		// long-idle buckets have refilled and carry no state worth keeping
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > 10*time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(lim.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(lim.Burst), b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second))
+	return false, wait
+}
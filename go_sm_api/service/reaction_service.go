@@ -0,0 +1,130 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var ErrInvalidEmoji = errors.New("emoji must be 1-32 bytes without whitespace")
+
+// ReactionTarget identifies the message a reaction belongs to and who can see it.
+type ReactionTarget struct {
+	Kind        string
+	MessageID   uint
+	GroupID     uint
+	ChannelID   uint
+	SenderID    string
+	RecipientID string
+	Body        string
+	Pending     bool
+}
+
+// ReactionService manages emoji reactions on private and group messages.
+type ReactionService interface {
+	// Target loads a message the user can see; ErrMessageNotFound otherwise.
+	Target(userID, kind string, messageID uint) (*ReactionTarget, error)
+	// Add records a reaction; added is false when the user had already reacted with emoji.
+	Add(userID string, t *ReactionTarget, emoji string) (added bool, err error)
+	Remove(userID string, t *ReactionTarget, emoji string) (bool, error)
+	List(t *ReactionTarget) ([]entity.ReactionCount, error)
+}
+
+type DBReactionService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewReactionService(db *gorm.DB, groupSvc *GroupService) *DBReactionService {
+	return &DBReactionService{db: db, groupSvc: groupSvc}
+}
+
+func (s *DBReactionService) Target(userID, kind string, messageID uint) (*ReactionTarget, error) {
+	return messageTarget(s.db, s.groupSvc, userID, kind, messageID)
+}
+
+// messageTarget loads a private or group message the user can see;
+// ErrMessageNotFound otherwise.
+func messageTarget(db *gorm.DB, groupSvc *GroupService, userID, kind string, messageID uint) (*ReactionTarget, error) {
+	t := &ReactionTarget{Kind: kind, MessageID: messageID}
+	switch kind {
+	case "private":
+		var pm entity.PrivateMessage
+		if err := db.Scopes(unexpired).First(&pm, messageID).Error; err != nil {
+			return nil, notFound(err)
+		}
+		// pending requests are not visible to the recipient as conversation messages yet
+		if pm.SenderID != userID && (pm.RecipientID != userID || pm.Pending) {
+			return nil, ErrMessageNotFound
+		}
+		t.SenderID, t.RecipientID, t.Body, t.Pending = pm.SenderID, pm.RecipientID, pm.Body, pm.Pending
+	case "group":
+		var gm entity.GroupMessage
+		if err := db.Scopes(unexpired).First(&gm, messageID).Error; err != nil {
+			return nil, notFound(err)
+		}
+		ok, err := groupSvc.IsChannelMember(gm.GroupID, gm.ChannelID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrMessageNotFound
+		}
+		t.GroupID, t.ChannelID, t.SenderID, t.Body = gm.GroupID, gm.ChannelID, gm.SenderID, gm.Body
+	default:
+		return nil, ErrMessageNotFound
+	}
+	return t, nil
+}
+
+func (s *DBReactionService) Add(userID string, t *ReactionTarget, emoji string) (bool, error) {
+	if !validEmoji(emoji) {
+		return false, ErrInvalidEmoji
+	}
+	r := entity.Reaction{MessageKind: t.Kind, MessageID: t.MessageID, UserID: userID, Emoji: emoji}
+	res := s.db.Where(r).FirstOrCreate(&r)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (s *DBReactionService) Remove(userID string, t *ReactionTarget, emoji string) (bool, error) {
+	res := s.db.Where("message_kind = ? AND message_id = ? AND user_id = ? AND emoji = ?", t.Kind, t.MessageID, userID, emoji).
+		Delete(&entity.Reaction{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *DBReactionService) List(t *ReactionTarget) ([]entity.ReactionCount, error) {
+	var rs []entity.Reaction
+	if err := s.db.Where("message_kind = ? AND message_id = ?", t.Kind, t.MessageID).Order("id").Find(&rs).Error; err != nil {
+		return nil, err
+	}
+	var out []entity.ReactionCount
+	idx := map[string]int{}
+	for _, r := range rs {
+		i, ok := idx[r.Emoji]
+		if !ok {
+			i = len(out)
+			idx[r.Emoji] = i
+			out = append(out, entity.ReactionCount{Emoji: r.Emoji})
+		}
+		out[i].Count++
+		out[i].UserIDs = append(out[i].UserIDs, r.UserID)
+	}
+	return out, nil
+}
+
+func validEmoji(e string) bool {
+	return e != "" && len(e) <= 32 && !strings.ContainsAny(e, " \t\r\n")
+}
+
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrMessageNotFound
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrReportNotFound     = errors.New("report not found")
+	ErrReportTarget       = errors.New("reported item not found or not visible to reporter")
+	ErrReportNotClaimable = errors.New("report is not open")
+	ErrReportClosed       = errors.New("report is already closed or claimed by another moderator")
+)
+
+// ReportService stores user reports and drives their review workflow.
+type ReportService interface {
+	// Create validates that the reporter can see the target and files a report.
+	Create(reporterID string, req entity.CreateReportRequest) (*entity.Report, error)
+	ListByReporter(reporterID string) ([]entity.Report, error)
+	// List returns the moderator queue, oldest first. An empty status lists open reports.
+	List(status string, limit int, afterID uint) ([]entity.Report, error)
+	Get(id uint) (*entity.Report, error)
+	Claim(id uint, moderatorID string) (*entity.Report, error)
+	// Close marks the report resolved or dismissed. Carrying out the action is up to the caller.
+	Close(id uint, moderatorID, status, action, note string) (*entity.Report, error)
+	// Reopen puts a report moderatorID just closed back in their review, for
+	// when its action could not be carried out.
+	Reopen(id uint, moderatorID string) error
+}
+
+type DBReportService struct {
+	db *gorm.DB
+}
+
+func NewReportService(db *gorm.DB) *DBReportService {
+	return &DBReportService{db: db}
+}
+
+func (s *DBReportService) Create(reporterID string, req entity.CreateReportRequest) (*entity.Report, error) {
+	r := &entity.Report{
+		ReporterID: reporterID,
+		TargetType: req.TargetType,
+		TargetID:   req.TargetID,
+		Reason:     req.Reason,
+		Details:    req.Details,
+		Status:     entity.ReportOpen,
+	}
+	switch req.TargetType {
+	case entity.ReportTargetMessage:
+		id, err := strconv.ParseUint(req.TargetID, 10, 64)
+		if err != nil {
+			return nil, ErrReportTarget
+		}
+		r.MessageKind = req.MessageKind
+		if err := s.snapshotMessage(r, uint(id), reporterID); err != nil {
+			return nil, err
+		}
+	case entity.ReportTargetUser:
+		var cnt int64
+		if err := s.db.Model(&entity.User{}).Where("id = ?", req.TargetID).Count(&cnt).Error; err != nil {
+			return nil, err
+		}
+		if cnt == 0 || req.TargetID == reporterID {
+			return nil, ErrReportTarget
+		}
+		r.ReportedUserID = req.TargetID
+	case entity.ReportTargetGroup:
+		id, err := strconv.ParseUint(req.TargetID, 10, 64)
+		if err != nil {
+			return nil, ErrReportTarget
+		}
+		var g entity.Group
+		if err := s.db.First(&g, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrReportTarget
+			}
+			return nil, err
+		}
+		r.GroupID = g.ID
+		r.ReportedUserID = g.OwnerID
+	default:
+		return nil, ErrReportTarget
+	}
+	if err := s.db.Create(r).Error; err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// snapshotMessage fills the report from the message, which the reporter must be able to see.
+func (s *DBReportService) snapshotMessage(r *entity.Report, id uint, reporterID string) error {
+	switch r.MessageKind {
+	case "private":
+		var pm entity.PrivateMessage
+		err := s.db.Where("id = ? AND (sender_id = ? OR recipient_id = ?)", id, reporterID, reporterID).First(&pm).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrReportTarget
+		}
+		if err != nil {
+			return err
+		}
+		r.ReportedUserID = pm.SenderID
+		r.Snapshot = pm.Body
+	case "group":
+		var gm entity.GroupMessage
+		if err := s.db.Scopes(readableChannels(reporterID)).First(&gm, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrReportTarget
+			}
+			return err
+		}
+		var cnt int64
+		if err := s.db.Model(&entity.GroupMember{}).Where("group_id = ? AND user_id = ?", gm.GroupID, reporterID).Count(&cnt).Error; err != nil {
+			return err
+		}
+		if cnt == 0 {
+			return ErrReportTarget
+		}
+		r.GroupID = gm.GroupID
+		r.ReportedUserID = gm.SenderID
+		r.Snapshot = gm.Body
+	default:
+		return ErrReportTarget
+	}
+	if r.ReportedUserID == reporterID {
+		return ErrReportTarget
+	}
+	return nil
+}
+
+func (s *DBReportService) ListByReporter(reporterID string) ([]entity.Report, error) {
+	var reports []entity.Report
+	if err := s.db.Where("reporter_id = ?", reporterID).Order("id DESC").Limit(100).Find(&reports).Error; err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+func (s *DBReportService) List(status string, limit int, afterID uint) ([]entity.Report, error) {
+	if status == "" {
+		status = entity.ReportOpen
+	}
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := s.db.Where("status = ?", status)
+	if afterID > 0 {
+		q = q.Where("id > ?", afterID)
+	}
+	var reports []entity.Report
+	if err := q.Order("id ASC").Limit(limit).Find(&reports).Error; err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+func (s *DBReportService) Get(id uint) (*entity.Report, error) {
+	var r entity.Report
+	if err := s.db.First(&r, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrReportNotFound
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *DBReportService) Claim(id uint, moderatorID string) (*entity.Report, error) {
+	res := s.db.Model(&entity.Report{}).
+		Where("id = ? AND status = ?", id, entity.ReportOpen).
+		Updates(map[string]interface{}{"status": entity.ReportInReview, "assignee_id": moderatorID})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.Get(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrReportNotClaimable
+	}
+	return s.Get(id)
+}
+
+func (s *DBReportService) Close(id uint, moderatorID, status, action, note string) (*entity.Report, error) {
+	if action == "" {
+		action = entity.ReportActionNone
+	}
+	now := time.Now()
+	// open reports are claimed implicitly; claimed ones only by their assignee
+	res := s.db.Model(&entity.Report{}).
+		Where("id = ? AND (status = ? OR (status = ? AND assignee_id = ?))", id, entity.ReportOpen, entity.ReportInReview, moderatorID).
+		Updates(map[string]interface{}{
+			"status":          status,
+			"assignee_id":     moderatorID,
+			"resolution":      action,
+			"resolution_note": note,
+			"resolved_at":     &now,
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.Get(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrReportClosed
+	}
+	return s.Get(id)
+}
+
+func (s *DBReportService) Reopen(id uint, moderatorID string) error {
+	return s.db.Model(&entity.Report{}).
+		Where("id = ? AND assignee_id = ? AND status IN ?", id, moderatorID, []string{entity.ReportResolved, entity.ReportDismissed}).
+		Updates(map[string]interface{}{
+			"status":          entity.ReportInReview,
+			"resolution":      "",
+			"resolution_note": "",
+			"resolved_at":     nil,
+		}).Error
+}
@@ -0,0 +1,497 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrRetentionRuleNotFound = errors.New("retention rule not found")
+	ErrInvalidRetentionRule  = errors.New("global rules take no target, group rules a group_id and private rules two different user IDs")
+	ErrPurgeRunning          = errors.New("a retention purge is already running")
+)
+
+// RetentionConfig tunes the purge job. Each batch deletes up to BatchSize
+// messages in one short transaction, then the job sleeps BatchPause so
+// writers waiting on the SQLite lock get their turn.
+type RetentionConfig struct {
+	Interval   time.Duration
+	BatchSize  int
+	BatchPause time.Duration
+}
+
+var DefaultRetentionConfig = RetentionConfig{
+	Interval:   time.Hour,
+	BatchSize:  500,
+	BatchPause: 100 * time.Millisecond,
+}
+
+const (
+	retentionLeaseName = "retention_purge"
+	// retentionLeaseTTL is renewed after every batch; if the instance dies,
+	// another may purge once it lapses.
+	retentionLeaseTTL = 2 * time.Minute
+)
+
+// RetentionRuleReport is what a purge would delete under one rule right now.
+type RetentionRuleReport struct {
+	Rule            entity.RetentionRule `json:"rule"`
+	Cutoff          time.Time            `json:"cutoff"`
+	PrivateMessages int64                `json:"private_messages"`
+	GroupMessages   int64                `json:"group_messages"`
+	Oldest          *time.Time           `json:"oldest,omitempty"`
+	// GroupDMMessages falls under the global rule only.
+	GroupDMMessages int64 `json:"group_dm_messages"`
+}
+
+// RetentionReport is the dry run of a purge.
+type RetentionReport struct {
+	GeneratedAt     time.Time             `json:"generated_at"`
+	Rules           []RetentionRuleReport `json:"rules"`
+	PrivateMessages int64                 `json:"private_messages"`
+	GroupMessages   int64                 `json:"group_messages"`
+	GroupDMMessages int64                 `json:"group_dm_messages"`
+}
+
+// RetentionMetrics sums up every finished purge.
+type RetentionMetrics struct {
+	Running        bool                 `json:"running"`
+	Runs           int64                `json:"runs"`
+	FailedRuns     int64                `json:"failed_runs"`
+	PrivateDeleted int64                `json:"private_deleted"`
+	GroupDeleted   int64                `json:"group_deleted"`
+	LastRun        *entity.RetentionRun `json:"last_run,omitempty"`
+	LastDurationMS int64                `json:"last_duration_ms"`
+	LastSuccessAt  *time.Time           `json:"last_success_at,omitempty"`
+	GroupDMDeleted int64                `json:"group_dm_deleted"`
+}
+
+// RetentionService deletes messages that are older than the retention rules
+// allow. Only one instance purges at a time, guarded by a JobLease.
+type RetentionService interface {
+	ListRules() ([]entity.RetentionRule, error)
+	// SetRule creates the rule for the request's target or replaces its Days.
+	SetRule(actorID string, req entity.SetRetentionRuleRequest) (*entity.RetentionRule, error)
+	DeleteRule(id uint) error
+	// Report counts what a purge would delete now without deleting anything.
+	Report() (*RetentionReport, error)
+	// Purge deletes everything past its retention and returns the finished
+	// run, or ErrPurgeRunning when another purge holds the lease.
+	Purge(ctx context.Context, trigger, actorID string) (*entity.RetentionRun, error)
+	// StartPurge is Purge in the background; it returns the run once it has
+	// started.
+	StartPurge(trigger, actorID string) (*entity.RetentionRun, error)
+	Runs(limit int) ([]entity.RetentionRun, error)
+	Metrics() (*RetentionMetrics, error)
+	// Run purges every Interval until ctx is done. It is safe to run on
+	// every instance.
+	Run(ctx context.Context)
+}
+
+type DBRetentionService struct {
+	db     *gorm.DB
+	cfg    RetentionConfig
+	holder string
+
+	// the lease stops other instances; running stops a second purge here,
+	// since the holder may renew its own lease
+	mu      sync.Mutex
+	running bool
+}
+
+// NewRetentionService fills zero fields of cfg from DefaultRetentionConfig.
+func NewRetentionService(db *gorm.DB, cfg RetentionConfig) *DBRetentionService {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRetentionConfig.Interval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultRetentionConfig.BatchSize
+	}
+	if cfg.BatchPause <= 0 {
+		cfg.BatchPause = DefaultRetentionConfig.BatchPause
+	}
+	return &DBRetentionService{db: db, cfg: cfg, holder: generateID(8)}
+}
+
+// retentionTarget is one set of messages a rule expires.
+type retentionTarget struct {
+	rule  int // index into the rules the targets were built from
+	kind  string
+	scope func(*gorm.DB) *gorm.DB
+}
+
+func (t retentionTarget) model() interface{} {
+	switch t.kind {
+	case "private":
+		return &entity.PrivateMessage{}
+	case "group_dm":
+		return &entity.GroupDMMessage{}
+	}
+	return &entity.GroupMessage{}
+}
+
+// retentionTargets turns rules into message sets. The global rule skips
+// conversations that have their own rule, so the most specific rule wins.
+// Group DMs have no rules of their own and follow the global one.
+func retentionTargets(rules []entity.RetentionRule, now time.Time) []retentionTarget {
+	var targets []retentionTarget
+	for i, r := range rules {
+		cutoff := now.AddDate(0, 0, -r.Days)
+		switch r.Scope {
+		case entity.RetentionGlobal:
+			targets = append(targets,
+				retentionTarget{rule: i, kind: "private", scope: func(db *gorm.DB) *gorm.DB {
+					return db.Where("created_at < ?", cutoff).Where(`NOT EXISTS (SELECT 1 FROM retention_rules r WHERE r.scope = ? AND
+						((r.user_a = private_messages.sender_id AND r.user_b = private_messages.recipient_id) OR
+						 (r.user_a = private_messages.recipient_id AND r.user_b = private_messages.sender_id)))`, entity.RetentionPrivate)
+				}},
+				retentionTarget{rule: i, kind: "group", scope: func(db *gorm.DB) *gorm.DB {
+					return db.Where("created_at < ?", cutoff).
+						Where("group_id NOT IN (SELECT group_id FROM retention_rules WHERE scope = ?)", entity.RetentionGroup)
+				}},
+				retentionTarget{rule: i, kind: "group_dm", scope: func(db *gorm.DB) *gorm.DB {
+					return db.Where("created_at < ?", cutoff)
+				}})
+		case entity.RetentionGroup:
+			groupID := r.GroupID
+			targets = append(targets, retentionTarget{rule: i, kind: "group", scope: func(db *gorm.DB) *gorm.DB {
+				return db.Where("group_id = ? AND created_at < ?", groupID, cutoff)
+			}})
+		case entity.RetentionPrivate:
+			a, b := r.UserA, r.UserB
+			targets = append(targets, retentionTarget{rule: i, kind: "private", scope: func(db *gorm.DB) *gorm.DB {
+				return db.Where("((sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)) AND created_at < ?", a, b, b, a, cutoff)
+			}})
+		}
+	}
+	return targets
+}
+
+func (s *DBRetentionService) ListRules() ([]entity.RetentionRule, error) {
+	var rules []entity.RetentionRule
+	err := s.db.Order("scope, group_id, user_a, user_b").Find(&rules).Error
+	return rules, err
+}
+
+func (s *DBRetentionService) SetRule(actorID string, req entity.SetRetentionRuleRequest) (*entity.RetentionRule, error) {
+	rule := entity.RetentionRule{Scope: req.Scope, Days: req.Days, UpdatedBy: actorID}
+	switch req.Scope {
+	case entity.RetentionGlobal:
+		if req.GroupID != 0 || req.UserID != "" || req.OtherUserID != "" {
+			return nil, ErrInvalidRetentionRule
+		}
+	case entity.RetentionGroup:
+		if req.GroupID == 0 || req.UserID != "" || req.OtherUserID != "" {
+			return nil, ErrInvalidRetentionRule
+		}
+		var cnt int64
+		if err := s.db.Model(&entity.Group{}).Where("id = ?", req.GroupID).Count(&cnt).Error; err != nil {
+			return nil, err
+		}
+		if cnt == 0 {
+			return nil, ErrGroupNotFound
+		}
+		rule.GroupID = req.GroupID
+	case entity.RetentionPrivate:
+		if req.GroupID != 0 || req.UserID == "" || req.OtherUserID == "" || req.UserID == req.OtherUserID {
+			return nil, ErrInvalidRetentionRule
+		}
+		var cnt int64
+		if err := s.db.Model(&entity.User{}).Where("id IN ?", []string{req.UserID, req.OtherUserID}).Count(&cnt).Error; err != nil {
+			return nil, err
+		}
+		if cnt != 2 {
+			return nil, ErrUserNotFound
+		}
+		rule.UserA, rule.UserB = conversationPair(req.UserID, req.OtherUserID)
+	default:
+		return nil, ErrInvalidRetentionRule
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "scope"}, {Name: "group_id"}, {Name: "user_a"}, {Name: "user_b"}},
+		DoUpdates: clause.AssignmentColumns([]string{"days", "updated_by", "updated_at"}),
+	}).Create(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	// on conflict the ID is not filled in, so read the row back
+	var saved entity.RetentionRule
+	err = s.db.Where("scope = ? AND group_id = ? AND user_a = ? AND user_b = ?", rule.Scope, rule.GroupID, rule.UserA, rule.UserB).
+		First(&saved).Error
+	return &saved, err
+}
+
+func (s *DBRetentionService) DeleteRule(id uint) error {
+	res := s.db.Delete(&entity.RetentionRule{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRetentionRuleNotFound
+	}
+	return nil
+}
+
+func (s *DBRetentionService) Report() (*RetentionReport, error) {
+	rules, err := s.ListRules()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rep := &RetentionReport{GeneratedAt: now, Rules: make([]RetentionRuleReport, len(rules))}
+	for i, r := range rules {
+		rep.Rules[i] = RetentionRuleReport{Rule: r, Cutoff: now.AddDate(0, 0, -r.Days)}
+	}
+	for _, t := range retentionTargets(rules, now) {
+		rr := &rep.Rules[t.rule]
+		var cnt int64
+		if err := t.scope(s.db.Model(t.model())).Count(&cnt).Error; err != nil {
+			return nil, err
+		}
+		if cnt == 0 {
+			continue
+		}
+		var oldest struct{ CreatedAt time.Time }
+		if err := t.scope(s.db.Model(t.model())).Select("created_at").Order("created_at").Limit(1).Scan(&oldest).Error; err != nil {
+			return nil, err
+		}
+		if rr.Oldest == nil || oldest.CreatedAt.Before(*rr.Oldest) {
+			rr.Oldest = &oldest.CreatedAt
+		}
+		switch t.kind {
+		case "private":
+			rr.PrivateMessages += cnt
+			rep.PrivateMessages += cnt
+		case "group_dm":
+			rr.GroupDMMessages += cnt
+			rep.GroupDMMessages += cnt
+		default:
+			rr.GroupMessages += cnt
+			rep.GroupMessages += cnt
+		}
+	}
+	return rep, nil
+}
+
+// begin takes the lease and records the run.
+func (s *DBRetentionService) begin(trigger, actorID string) (*entity.RetentionRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil, ErrPurgeRunning
+	}
+	ok, err := acquireLease(s.db, retentionLeaseName, s.holder, retentionLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrPurgeRunning
+	}
+	run := &entity.RetentionRun{StartedAt: time.Now(), Trigger: trigger, TriggeredBy: actorID}
+	if err := s.db.Create(run).Error; err != nil {
+		_ = releaseLease(s.db, retentionLeaseName, s.holder)
+		return nil, err
+	}
+	s.running = true
+	return run, nil
+}
+
+func (s *DBRetentionService) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := releaseLease(s.db, retentionLeaseName, s.holder); err != nil {
+		log.Printf("retention purge: release lease: %v", err)
+	}
+	s.running = false
+}
+
+func (s *DBRetentionService) Purge(ctx context.Context, trigger, actorID string) (*entity.RetentionRun, error) {
+	run, err := s.begin(trigger, actorID)
+	if err != nil {
+		return nil, err
+	}
+	s.execute(ctx, run)
+	return run, nil
+}
+
+func (s *DBRetentionService) StartPurge(trigger, actorID string) (*entity.RetentionRun, error) {
+	run, err := s.begin(trigger, actorID)
+	if err != nil {
+		return nil, err
+	}
+	started := *run
+	go s.execute(context.Background(), run)
+	return &started, nil
+}
+
+// execute works through the targets batch by batch and saves the outcome on
+// run. Cutoffs are fixed when it starts, so it always finishes.
+func (s *DBRetentionService) execute(ctx context.Context, run *entity.RetentionRun) {
+	defer s.end()
+	err := s.purgeAll(ctx, run)
+	now := time.Now()
+	run.FinishedAt = &now
+	if err != nil {
+		run.Error = truncate(err.Error(), 255)
+		log.Printf("retention purge %d: %v", run.ID, err)
+	}
+	if err := s.db.Save(run).Error; err != nil {
+		log.Printf("retention purge %d: %v", run.ID, err)
+	}
+	if run.PrivateDeleted+run.GroupDeleted+run.GroupDMDeleted > 0 {
+		log.Printf("retention purge %d: deleted %d private, %d group and %d group DM messages in %d batches (%s)",
+			run.ID, run.PrivateDeleted, run.GroupDeleted, run.GroupDMDeleted, run.Batches, now.Sub(run.StartedAt).Round(time.Millisecond))
+	}
+}
+
+func (s *DBRetentionService) purgeAll(ctx context.Context, run *entity.RetentionRun) error {
+	rules, err := s.ListRules()
+	if err != nil {
+		return err
+	}
+	for _, t := range retentionTargets(rules, run.StartedAt) {
+		for {
+			n, err := s.purgeBatch(t)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				run.Batches++
+				switch t.kind {
+				case "private":
+					run.PrivateDeleted += n
+				case "group_dm":
+					run.GroupDMDeleted += n
+				default:
+					run.GroupDeleted += n
+				}
+			}
+			if n < int64(s.cfg.BatchSize) {
+				break
+			}
+			ok, err := acquireLease(s.db, retentionLeaseName, s.holder, retentionLeaseTTL)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ErrPurgeRunning
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(s.cfg.BatchPause):
+			}
+		}
+	}
+	return nil
+}
+
+// purgeBatch deletes up to BatchSize messages of t, along with their
+// mentions, reactions, pins, bookmarks and notifications, in one
+// transaction.
+func (s *DBRetentionService) purgeBatch(t retentionTarget) (int64, error) {
+	var ids []uint
+	if err := t.scope(s.db.Model(t.model())).Order("id").Limit(s.cfg.BatchSize).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	var deleted int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id IN ?", ids).Delete(t.model())
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted = res.RowsAffected
+		if t.kind == "group" {
+			if err := tx.Where("message_id IN ?", ids).Delete(&entity.Mention{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("message_kind = ? AND message_id IN ?", t.kind, ids).Delete(&entity.Reaction{}).Error; err != nil {
+			return err
+		}
+		if err := forgetMessages(tx, t.kind, ids); err != nil {
+			return err
+		}
+		return tx.Where("message_kind = ? AND message_id IN ?", t.kind, ids).Delete(&entity.Notification{}).Error
+	})
+	return deleted, err
+}
+
+func (s *DBRetentionService) Runs(limit int) ([]entity.RetentionRun, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	var runs []entity.RetentionRun
+	err := s.db.Order("started_at DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
+
+func (s *DBRetentionService) Metrics() (*RetentionMetrics, error) {
+	m := &RetentionMetrics{}
+	var err error
+	if m.Running, err = leaseHeld(s.db, retentionLeaseName); err != nil {
+		return nil, err
+	}
+	finished := s.db.Model(&entity.RetentionRun{}).Where("finished_at IS NOT NULL")
+	var sums struct{ Runs, PrivateDeleted, GroupDeleted, GroupDMDeleted int64 }
+	if err := finished.Session(&gorm.Session{}).
+		Select("COUNT(*) AS runs, COALESCE(SUM(private_deleted), 0) AS private_deleted, COALESCE(SUM(group_deleted), 0) AS group_deleted, " +
+			"COALESCE(SUM(group_dm_deleted), 0) AS group_dm_deleted").
+		Scan(&sums).Error; err != nil {
+		return nil, err
+	}
+	m.Runs, m.PrivateDeleted, m.GroupDeleted, m.GroupDMDeleted = sums.Runs, sums.PrivateDeleted, sums.GroupDeleted, sums.GroupDMDeleted
+	if err := finished.Session(&gorm.Session{}).Where("error <> ''").Count(&m.FailedRuns).Error; err != nil {
+		return nil, err
+	}
+	var runs []entity.RetentionRun
+	if err := finished.Session(&gorm.Session{}).Order("started_at DESC").Limit(1).Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	if len(runs) == 1 {
+		m.LastRun = &runs[0]
+		m.LastDurationMS = runs[0].FinishedAt.Sub(runs[0].StartedAt).Milliseconds()
+	}
+	var ok []entity.RetentionRun
+	if err := finished.Session(&gorm.Session{}).Where("error = ''").Order("started_at DESC").Limit(1).Find(&ok).Error; err != nil {
+		return nil, err
+	}
+	if len(ok) == 1 {
+		m.LastSuccessAt = ok[0].FinishedAt
+	}
+	return m, nil
+}
+
+func (s *DBRetentionService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var rules int64
+		if err := s.db.Model(&entity.RetentionRule{}).Count(&rules).Error; err != nil {
+			log.Printf("retention purge: %v", err)
+			continue
+		}
+		if rules == 0 {
+			continue
+		}
+		if _, err := s.Purge(ctx, entity.RetentionTriggerSchedule, ""); err != nil && !errors.Is(err, ErrPurgeRunning) {
+			log.Printf("retention purge: %v", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+// SavedMessageService keeps each user's private bookmarks of messages they
+// can see. Bookmarks of messages the user can no longer see (they left the
+// group, or the message expired) are hidden rather than deleted.
+type SavedMessageService interface {
+	// Save bookmarks a message, or updates the note of an existing bookmark.
+	Save(userID, kind string, messageID uint, note string) (*entity.SavedMessage, error)
+	Unsave(userID, kind string, messageID uint) (bool, error)
+	// List returns the user's bookmarks with their messages, newest first.
+	List(userID string, limit, offset int) ([]entity.SavedMessage, int64, error)
+}
+
+type DBSavedMessageService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewSavedMessageService(db *gorm.DB, groupSvc *GroupService) *DBSavedMessageService {
+	return &DBSavedMessageService{db: db, groupSvc: groupSvc}
+}
+
+func (s *DBSavedMessageService) Save(userID, kind string, messageID uint, note string) (*entity.SavedMessage, error) {
+	if _, err := messageTarget(s.db, s.groupSvc, userID, kind, messageID); err != nil {
+		return nil, err
+	}
+	sm := entity.SavedMessage{UserID: userID, MessageKind: kind, MessageID: messageID}
+	if err := s.db.Where(sm).Assign(map[string]interface{}{"note": note}).FirstOrCreate(&sm).Error; err != nil {
+		return nil, err
+	}
+	return &sm, nil
+}
+
+func (s *DBSavedMessageService) Unsave(userID, kind string, messageID uint) (bool, error) {
+	res := s.db.Where("user_id = ? AND message_kind = ? AND message_id = ?", userID, kind, messageID).
+		Delete(&entity.SavedMessage{})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *DBSavedMessageService) List(userID string, limit, offset int) ([]entity.SavedMessage, int64, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	visiblePMs := s.db.Model(&entity.PrivateMessage{}).Scopes(unexpired).Select("id").
+		Where("sender_id = ? OR (recipient_id = ? AND pending = ?)", userID, userID, false)
+	visibleGMs := s.db.Model(&entity.GroupMessage{}).Scopes(unexpired, readableChannels(userID)).Select("id").
+		Where("group_id IN (?)", s.db.Model(&entity.GroupMember{}).Select("group_id").Where("user_id = ?", userID))
+	q := s.db.Model(&entity.SavedMessage{}).Where("user_id = ?", userID).
+		Where("(message_kind = ? AND message_id IN (?)) OR (message_kind = ? AND message_id IN (?))",
+			"private", visiblePMs, "group", visibleGMs)
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var saved []entity.SavedMessage
+	if err := q.Order("id DESC").Limit(limit).Offset(offset).Find(&saved).Error; err != nil {
+		return nil, 0, err
+	}
+	ids := map[string][]uint{}
+	for _, sm := range saved {
+		ids[sm.MessageKind] = append(ids[sm.MessageKind], sm.MessageID)
+	}
+	pms, gms, err := loadMessages(s.db, userID, ids["private"], ids["group"])
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range saved {
+		if saved[i].MessageKind == "private" {
+			saved[i].PrivateMessage = pms[saved[i].MessageID]
+		} else {
+			saved[i].GroupMessage = gms[saved[i].MessageID]
+		}
+	}
+	return saved, total, nil
+}
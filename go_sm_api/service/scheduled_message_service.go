@@ -0,0 +1,262 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+var (
+	ErrScheduledNotFound = errors.New("scheduled message not found")
+	ErrInvalidSendAt     = errors.New("send_at must be in the future and within a year")
+	ErrScheduledLocked   = errors.New("scheduled message is already being sent or was sent")
+	ErrTooManyScheduled  = errors.New("too many scheduled messages")
+	ErrInvalidRecipient  = errors.New("invalid recipient")
+	ErrEmptyBody         = errors.New("body must not be empty")
+)
+
+const (
+	maxScheduledPerUser = 100
+	maxScheduleAhead    = 365 * 24 * time.Hour
+	// scheduledLease is how long a claimed message is hidden from other
+	// instances; a crashed sender's messages are retried after it.
+	scheduledLease       = time.Minute
+	scheduledMaxAttempts = 5
+	scheduledRetryBase   = 30 * time.Second
+)
+
+// ScheduledMessageService stores messages to be sent later. The scheduler
+// claims due messages with ClaimDue and reports back with MarkSent/MarkFailed.
+type ScheduledMessageService interface {
+	Create(senderID string, req entity.CreateScheduledMessageRequest) (*entity.ScheduledMessage, error)
+	List(senderID, status string, limit, offset int) ([]entity.ScheduledMessage, int64, error)
+	Get(senderID string, id uint) (*entity.ScheduledMessage, error)
+	// Update and Cancel only apply before SendAt.
+	Update(senderID string, id uint, req entity.UpdateScheduledMessageRequest) (*entity.ScheduledMessage, error)
+	Cancel(senderID string, id uint) error
+
+	// ClaimDue leases up to limit due messages to the caller. Rows are
+	// claimed with a conditional update, so instances never share one.
+	ClaimDue(limit int) ([]entity.ScheduledMessage, error)
+	MarkSent(id, messageID uint) error
+	// MarkFailed records a failed attempt. Transient failures are retried
+	// with backoff until the attempts run out; the returned bool reports
+	// whether the message failed for good.
+	MarkFailed(m *entity.ScheduledMessage, cause error, transient bool) (bool, error)
+}
+
+type DBScheduledMessageService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+}
+
+func NewScheduledMessageService(db *gorm.DB, groupSvc *GroupService) *DBScheduledMessageService {
+	return &DBScheduledMessageService{db: db, groupSvc: groupSvc}
+}
+
+func validSendAt(t time.Time) bool {
+	now := time.Now()
+	return t.After(now) && t.Before(now.Add(maxScheduleAhead))
+}
+
+func (s *DBScheduledMessageService) Create(senderID string, req entity.CreateScheduledMessageRequest) (*entity.ScheduledMessage, error) {
+	if !validSendAt(req.SendAt) {
+		return nil, ErrInvalidSendAt
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		return nil, ErrEmptyBody
+	}
+	m := &entity.ScheduledMessage{
+		SenderID:      senderID,
+		Kind:          req.Kind,
+		Body:          req.Body,
+		SendAt:        req.SendAt,
+		NextAttemptAt: req.SendAt,
+		Status:        entity.ScheduledPending,
+	}
+	switch req.Kind {
+	case "private":
+		if req.To == "" || req.To == senderID {
+			return nil, ErrInvalidRecipient
+		}
+		var cnt int64
+		if err := s.db.Model(&entity.User{}).Where("id = ?", req.To).Count(&cnt).Error; err != nil {
+			return nil, err
+		}
+		if cnt == 0 {
+			return nil, ErrUserNotFound
+		}
+		m.RecipientID = req.To
+	case "group":
+		if ok, err := s.groupSvc.IsMember(req.GroupID, senderID); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrNotGroupMember
+		}
+		// restricted channels the sender cannot see look missing, as elsewhere
+		if ok, err := s.groupSvc.IsChannelMember(req.GroupID, req.ChannelID, senderID); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrChannelNotFound
+		}
+		m.GroupID = req.GroupID
+		m.ChannelID = req.ChannelID
+		m.ReplyToID = req.ReplyTo
+	}
+	var pending int64
+	if err := s.db.Model(&entity.ScheduledMessage{}).Where("sender_id = ? AND status = ?", senderID, entity.ScheduledPending).
+		Count(&pending).Error; err != nil {
+		return nil, err
+	}
+	if pending >= maxScheduledPerUser {
+		return nil, ErrTooManyScheduled
+	}
+	if err := s.db.Create(m).Error; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *DBScheduledMessageService) List(senderID, status string, limit, offset int) ([]entity.ScheduledMessage, int64, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	q := s.db.Model(&entity.ScheduledMessage{}).Where("sender_id = ?", senderID)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var msgs []entity.ScheduledMessage
+	if err := q.Order("send_at").Limit(limit).Offset(offset).Find(&msgs).Error; err != nil {
+		return nil, 0, err
+	}
+	return msgs, total, nil
+}
+
+func (s *DBScheduledMessageService) Get(senderID string, id uint) (*entity.ScheduledMessage, error) {
+	var m entity.ScheduledMessage
+	if err := s.db.Where("id = ? AND sender_id = ?", id, senderID).First(&m).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduledNotFound
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// editable scopes an update to a pending message whose time has not come,
+// so an edit cannot race the scheduler.
+func (s *DBScheduledMessageService) editable(senderID string, id uint) *gorm.DB {
+	return s.db.Model(&entity.ScheduledMessage{}).
+		Where("id = ? AND sender_id = ? AND status = ? AND send_at > ?", id, senderID, entity.ScheduledPending, time.Now())
+}
+
+// Update writes the whole row, not a map, so the body is encrypted at rest
+// like when the message was created.
+func (s *DBScheduledMessageService) Update(senderID string, id uint, req entity.UpdateScheduledMessageRequest) (*entity.ScheduledMessage, error) {
+	m, err := s.Get(senderID, id)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	if req.Body != nil {
+		if strings.TrimSpace(*req.Body) == "" {
+			return nil, ErrEmptyBody
+		}
+		m.Body, m.BodyKeyID = *req.Body, ""
+		columns = append(columns, "body", "body_key_id")
+	}
+	if req.SendAt != nil {
+		if !validSendAt(*req.SendAt) {
+			return nil, ErrInvalidSendAt
+		}
+		m.SendAt, m.NextAttemptAt = *req.SendAt, *req.SendAt
+		columns = append(columns, "send_at", "next_attempt_at")
+	}
+	if len(columns) > 0 {
+		if err := s.lockedUpdate(senderID, id, m, columns...); err != nil {
+			return nil, err
+		}
+	}
+	return s.Get(senderID, id)
+}
+
+func (s *DBScheduledMessageService) Cancel(senderID string, id uint) error {
+	return s.lockedUpdate(senderID, id, map[string]interface{}{"status": entity.ScheduledCanceled})
+}
+
+// lockedUpdate applies updates, limited to columns when given, while the
+// message can still be edited.
+func (s *DBScheduledMessageService) lockedUpdate(senderID string, id uint, updates interface{}, columns ...string) error {
+	q := s.editable(senderID, id)
+	if len(columns) > 0 {
+		q = q.Select(columns)
+	}
+	res := q.Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		if _, err := s.Get(senderID, id); err != nil {
+			return err
+		}
+		return ErrScheduledLocked
+	}
+	return nil
+}
+
+func (s *DBScheduledMessageService) ClaimDue(limit int) ([]entity.ScheduledMessage, error) {
+	var due []entity.ScheduledMessage
+	now := time.Now()
+	if err := s.db.Where("status = ? AND next_attempt_at <= ?", entity.ScheduledPending, now).
+		Order("next_attempt_at").Limit(limit).Find(&due).Error; err != nil {
+		return nil, err
+	}
+	claimed := due[:0]
+	for _, m := range due {
+		// whoever moves next_attempt_at first owns the row until the lease ends
+		res := s.db.Model(&entity.ScheduledMessage{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", m.ID, entity.ScheduledPending, m.NextAttemptAt).
+			Update("next_attempt_at", now.Add(scheduledLease))
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			claimed = append(claimed, m)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *DBScheduledMessageService) MarkSent(id, messageID uint) error {
+	now := time.Now()
+	return s.db.Model(&entity.ScheduledMessage{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":     entity.ScheduledSent,
+		"message_id": messageID,
+		"sent_at":    &now,
+		"attempts":   gorm.Expr("attempts + 1"),
+		"last_error": "",
+	}).Error
+}
+
+func (s *DBScheduledMessageService) MarkFailed(m *entity.ScheduledMessage, cause error, transient bool) (bool, error) {
+	attempts := m.Attempts + 1
+	updates := map[string]interface{}{
+		"attempts":   attempts,
+		"last_error": truncate(cause.Error(), 255),
+	}
+	final := !transient || attempts >= scheduledMaxAttempts
+	if final {
+		updates["status"] = entity.ScheduledFailed
+	} else {
+		updates["next_attempt_at"] = time.Now().Add(scheduledRetryBase << (attempts - 1))
+	}
+	return final, s.db.Model(&entity.ScheduledMessage{}).Where("id = ?", m.ID).Updates(updates).Error
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+var (
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not set up")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorRequired    = errors.New("two-factor authentication is required for this account")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+)
+
+const recoveryCodeCount = 10
+
+// TwoFactorService manages TOTP enrollment, verification and recovery codes.
+type TwoFactorService interface {
+	// Enroll generates a new secret for a user who has not enabled 2FA yet.
+	Enroll(userID string) (secret, uri string, err error)
+	// Confirm enables 2FA after the first valid code and returns recovery codes.
+	Confirm(userID, code string) ([]string, error)
+	// Verify checks a TOTP or recovery code for a user with 2FA enabled.
+	Verify(userID, code string) error
+	Disable(userID, code string) error
+	RegenerateRecoveryCodes(userID, code string) ([]string, error)
+	// IsRequired reports whether the user must use 2FA to log in.
+	IsRequired(u *entity.User) bool
+}
+
+type DBTwoFactorService struct {
+	db         *gorm.DB
+	issuer     string
+	enforceAll bool
+}
+
+// NewTwoFactorService creates a TwoFactorService. issuer is shown in authenticator
+// apps; enforceAll requires 2FA for every account.
+func NewTwoFactorService(db *gorm.DB, issuer string, enforceAll bool) *DBTwoFactorService {
+	return &DBTwoFactorService{db: db, issuer: issuer, enforceAll: enforceAll}
+}
+
+func (s *DBTwoFactorService) getUser(userID string) (*entity.User, error) {
+	var u entity.User
+	if err := s.db.Where("id = ?", userID).First(&u).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *DBTwoFactorService) IsRequired(u *entity.User) bool {
+	return s.enforceAll || u.TwoFactorRequired || u.TOTPEnabled
+}
+
+func (s *DBTwoFactorService) Enroll(userID string) (string, string, error) {
+	u, err := s.getUser(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if u.TOTPEnabled {
+		return "", "", ErrTwoFactorEnabled
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.db.Model(&entity.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+		return "", "", err
+	}
+	return secret, utils.TOTPAuthURI(s.issuer, u.Email, secret), nil
+}
+
+func (s *DBTwoFactorService) Confirm(userID, code string) ([]string, error) {
+	u, err := s.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if u.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	step, ok := utils.ValidateTOTP(u.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+	var codes []string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&entity.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"totp_enabled": true, "totp_last_step": step}).Error; err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *DBTwoFactorService) Verify(userID, code string) error {
+	u, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+	if !u.TOTPEnabled {
+		return ErrTwoFactorNotEnrolled
+	}
+	if step, ok := utils.ValidateTOTP(u.TOTPSecret, code, time.Now()); ok {
+		// a code is only accepted once per time step
+		res := s.db.Model(&entity.User{}).
+			Where("id = ? AND totp_last_step < ?", userID, step).
+			Update("totp_last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+	return s.useRecoveryCode(userID, code)
+}
+
+func (s *DBTwoFactorService) Disable(userID, code string) error {
+	u, err := s.getUser(userID)
+	if err != nil {
+		return err
+	}
+	if s.enforceAll || u.TwoFactorRequired {
+		return ErrTwoFactorRequired
+	}
+	if err := s.Verify(userID, code); err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&entity.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&entity.RecoveryCode{}).Error
+	})
+}
+
+func (s *DBTwoFactorService) RegenerateRecoveryCodes(userID, code string) ([]string, error) {
+	if err := s.Verify(userID, code); err != nil {
+		return nil, err
+	}
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *DBTwoFactorService) useRecoveryCode(userID, code string) error {
+	now := time.Now()
+	res := s.db.Model(&entity.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", &now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and returns a fresh set in plaintext.
+func replaceRecoveryCodes(tx *gorm.DB, userID string) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&entity.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]entity.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := generateID(5)
+		code := fmt.Sprintf("%s-%s", raw[:5], raw[5:])
+		codes = append(codes, code)
+		rows = append(rows, entity.RecoveryCode{UserID: userID, CodeHash: hashToken(code)})
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
@@ -4,6 +4,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"regexp"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -12,17 +15,38 @@ import (
 )
 
 var (
-	ErrUserExists   = errors.New("user already exists")
-	ErrInvalidCreds = errors.New("invalid credentials")
-	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists    = errors.New("user already exists")
+	ErrInvalidCreds  = errors.New("invalid credentials")
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserSuspended = errors.New("account suspended")
+	ErrInvalidHandle = errors.New("handle must be 2-32 letters, digits or underscores")
+	ErrHandleTaken   = errors.New("handle already taken")
 )
 
+var handleRe = regexp.MustCompile(`^[a-z0-9_]{2,32}$`)
+
+// reservedHandles are mention keywords that cannot belong to a user.
+var reservedHandles = map[string]bool{entity.MentionHere: true, entity.MentionEveryone: true, "channel": true, "all": true}
+
 // UserService interface abstracts user ops
 type UserService interface {
 	CreateUser(email, password string) (*entity.User, error)
 	Authenticate(email, password string) (*entity.User, error)
 	GetByEmail(email string) (*entity.User, error)
 	GetByID(id string) (*entity.User, error)
+	// GetByHandle looks a user up by @handle, with or without the @.
+	GetByHandle(handle string) (*entity.User, error)
+	// SetHandle sets the user's @handle (case-insensitive); "" clears it.
+	SetHandle(userID, handle string) (string, error)
+	SetPassword(userID, password string) error
+	ChangePassword(userID, currentPassword, newPassword string) error
+	MarkEmailVerified(userID string) error
+	SetRole(userID, role string) error
+	SetTwoFactorRequired(userID string, required bool) error
+	// RevokeTokens invalidates every JWT and API token issued to the user so far.
+	RevokeTokens(userID string) error
+	// Suspend blocks the account until the given time; nil lifts the suspension.
+	Suspend(userID string, until *time.Time) error
 }
 
 type DBUserService struct {
@@ -73,6 +97,9 @@ func (s *DBUserService) Authenticate(email, password string) (*entity.User, erro
 	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
 		return nil, ErrInvalidCreds
 	}
+	if u.IsSuspended(time.Now()) {
+		return nil, ErrUserSuspended
+	}
 	return &u, nil
 }
 
@@ -98,4 +125,134 @@ func (s *DBUserService) GetByID(id string) (*entity.User, error) {
 	return &u, nil
 }
 
+func (s *DBUserService) GetByHandle(handle string) (*entity.User, error) {
+	handle = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+	if handle == "" {
+		return nil, ErrUserNotFound
+	}
+	var u entity.User
+	if err := s.db.Where("handle = ?", handle).First(&u).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *DBUserService) SetHandle(userID, handle string) (string, error) {
+	handle = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+	if handle != "" && (!handleRe.MatchString(handle) || reservedHandles[handle]) {
+		return "", ErrInvalidHandle
+	}
+	if handle != "" {
+		var cnt int64
+		if err := s.db.Model(&entity.User{}).Where("handle = ? AND id <> ?", handle, userID).Count(&cnt).Error; err != nil {
+			return "", err
+		}
+		if cnt > 0 {
+			return "", ErrHandleTaken
+		}
+	}
+	res := s.db.Model(&entity.User{}).Where("id = ?", userID).Update("handle", handle)
+	if res.Error != nil {
+		// the unique index catches a concurrent claim
+		if strings.Contains(res.Error.Error(), "UNIQUE") {
+			return "", ErrHandleTaken
+		}
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		return "", ErrUserNotFound
+	}
+	return handle, nil
+}
+
+// SetPassword replaces the user's password without checking the old one and
+// revokes existing sessions.
+func (s *DBUserService) SetPassword(userID, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.revokeSessions(userID, map[string]interface{}{"password_hash": string(hash)})
+}
+
+// revokeSessions applies updates to the user while bumping their token
+// version, and revokes their API tokens along with it, so no JWT or API token
+// issued before survives.
+func (s *DBUserService) revokeSessions(userID string, updates map[string]interface{}) error {
+	updates["token_version"] = gorm.Expr("token_version + 1")
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&entity.User{}).Where("id = ?", userID).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		now := time.Now()
+		return tx.Model(&entity.APIToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", &now).Error
+	})
+}
+
+// ChangePassword replaces the user's password after verifying the current one.
+func (s *DBUserService) ChangePassword(userID, currentPassword, newPassword string) error {
+	u, err := s.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(currentPassword)); err != nil {
+		return ErrInvalidCreds
+	}
+	return s.SetPassword(userID, newPassword)
+}
+
+func (s *DBUserService) MarkEmailVerified(userID string) error {
+	return s.db.Model(&entity.User{}).Where("id = ?", userID).Update("email_verified", true).Error
+}
+
+// SetRole changes the platform role. Admins are always required to use 2FA.
+func (s *DBUserService) SetRole(userID, role string) error {
+	updates := map[string]interface{}{"role": role}
+	if role == entity.RoleAdmin {
+		updates["two_factor_required"] = true
+	}
+	res := s.db.Model(&entity.User{}).Where("id = ?", userID).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *DBUserService) SetTwoFactorRequired(userID string, required bool) error {
+	res := s.db.Model(&entity.User{}).Where("id = ?", userID).Update("two_factor_required", required)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *DBUserService) RevokeTokens(userID string) error {
+	return s.revokeSessions(userID, map[string]interface{}{})
+}
+
+func (s *DBUserService) Suspend(userID string, until *time.Time) error {
+	res := s.db.Model(&entity.User{}).Where("id = ?", userID).Update("suspended_until", until)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
 // ...existing code...
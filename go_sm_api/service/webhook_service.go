@@ -0,0 +1,582 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/utils"
+)
+
+var (
+	ErrWebhookNotFound     = errors.New("webhook not found")
+	ErrDeliveryNotFound    = errors.New("delivery not found")
+	ErrInvalidWebhookURL   = errors.New("webhook url must be an absolute http(s) url")
+	ErrInvalidWebhookEvent = errors.New("unknown webhook event type")
+)
+
+// HubEvent is a payload the Hub fanned out, either to one user's connections
+// (UserID) or to the readers of a group channel (GroupID, ChannelID).
+type HubEvent struct {
+	UserID    string
+	GroupID   uint
+	ChannelID uint
+	Payload   []byte
+}
+
+// WebhookConfig tunes the dispatcher. A delivery is retried with exponential
+// backoff from RetryBase up to MaxBackoff and dead-lettered after MaxAttempts.
+type WebhookConfig struct {
+	MaxAttempts  int
+	RetryBase    time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+}
+
+var DefaultWebhookConfig = WebhookConfig{
+	MaxAttempts:  8,
+	RetryBase:    30 * time.Second,
+	MaxBackoff:   6 * time.Hour,
+	PollInterval: 2 * time.Second,
+}
+
+// webhookDedupWindow is how long an event is remembered so the copies the Hub
+// sends to each participant reach a global webhook only once.
+const webhookDedupWindow = 30 * time.Second
+
+// WebhookService manages webhook endpoints and their delivery queue. ownerID
+// scopes every lookup to the caller's own webhooks; "" means any webhook and
+// is reserved for admins.
+type WebhookService interface {
+	Create(ownerID string, global bool, req entity.CreateWebhookRequest) (*entity.Webhook, error)
+	List(ownerID string) ([]entity.Webhook, error)
+	Get(ownerID string, id uint) (*entity.Webhook, error)
+	Update(ownerID string, id uint, req entity.UpdateWebhookRequest) (*entity.Webhook, error)
+	Delete(ownerID string, id uint) error
+	// RotateSecret replaces the signing secret; the new one is in the result.
+	RotateSecret(ownerID string, id uint) (*entity.Webhook, error)
+	// Deliveries pages the delivery log, newest first; status may be "".
+	Deliveries(ownerID string, id uint, status string, limit, offset int) ([]entity.WebhookDelivery, int64, error)
+	// Redeliver queues a delivered or dead-lettered delivery again.
+	Redeliver(ownerID string, id, deliveryID uint) (*entity.WebhookDelivery, error)
+	// Ping queues a "ping" event for the webhook.
+	Ping(ownerID string, id uint) (*entity.WebhookDelivery, error)
+	// Publish queues a Hub event for every enabled webhook allowed to see it.
+	Publish(evt HubEvent)
+}
+
+type DBWebhookService struct {
+	db       *gorm.DB
+	groupSvc *GroupService
+	client   *http.Client
+	cfg      WebhookConfig
+
+	mu     sync.Mutex
+	recent map[string]recentEvent
+}
+
+type recentEvent struct {
+	id   string
+	seen time.Time
+}
+
+// webhookEnvelope is the JSON body POSTed to webhooks; Data is the Hub event
+// exactly as WebSocket clients receive it.
+type webhookEnvelope struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func NewWebhookService(db *gorm.DB, groupSvc *GroupService, client *http.Client, cfg WebhookConfig) *DBWebhookService {
+	if client == nil {
+		client = newOutboundClient(10 * time.Second)
+	}
+	def := DefaultWebhookConfig
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = def.MaxAttempts
+	}
+	if cfg.RetryBase <= 0 {
+		cfg.RetryBase = def.RetryBase
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = def.MaxBackoff
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = def.PollInterval
+	}
+	return &DBWebhookService{db: db, groupSvc: groupSvc, client: client, cfg: cfg, recent: make(map[string]recentEvent)}
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	return checkOutboundHost(context.Background(), u.Hostname())
+}
+
+func validateWebhookEvents(events []string) error {
+	for _, e := range events {
+		if e == entity.WebhookEventAll {
+			continue
+		}
+		known := false
+		for _, t := range entity.WebhookEventTypes {
+			if e == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrInvalidWebhookEvent, e)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() string {
+	return "whsec_" + generateID(24)
+}
+
+func (s *DBWebhookService) Create(ownerID string, global bool, req entity.CreateWebhookRequest) (*entity.Webhook, error) {
+	if err := validateWebhookURL(req.URL); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookEvents(req.Events); err != nil {
+		return nil, err
+	}
+	hook := entity.Webhook{
+		OwnerID:     ownerID,
+		Global:      global,
+		URL:         req.URL,
+		Description: req.Description,
+		Events:      req.Events,
+		Secret:      newWebhookSecret(),
+		Enabled:     true,
+	}
+	if err := s.db.Create(&hook).Error; err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (s *DBWebhookService) List(ownerID string) ([]entity.Webhook, error) {
+	q := s.db.Order("id")
+	if ownerID != "" {
+		q = q.Where("owner_id = ? AND global = ?", ownerID, false)
+	}
+	var hooks []entity.Webhook
+	if err := q.Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (s *DBWebhookService) Get(ownerID string, id uint) (*entity.Webhook, error) {
+	q := s.db.Where("id = ?", id)
+	if ownerID != "" {
+		q = q.Where("owner_id = ? AND global = ?", ownerID, false)
+	}
+	var hook entity.Webhook
+	if err := q.First(&hook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (s *DBWebhookService) Update(ownerID string, id uint, req entity.UpdateWebhookRequest) (*entity.Webhook, error) {
+	hook, err := s.Get(ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL != nil {
+		if err := validateWebhookURL(*req.URL); err != nil {
+			return nil, err
+		}
+		hook.URL = *req.URL
+	}
+	if req.Events != nil {
+		if len(req.Events) == 0 {
+			return nil, fmt.Errorf("%w: no events", ErrInvalidWebhookEvent)
+		}
+		if err := validateWebhookEvents(req.Events); err != nil {
+			return nil, err
+		}
+		hook.Events = req.Events
+	}
+	if req.Description != nil {
+		hook.Description = *req.Description
+	}
+	if req.Enabled != nil {
+		hook.Enabled = *req.Enabled
+	}
+	if err := s.db.Save(hook).Error; err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+func (s *DBWebhookService) Delete(ownerID string, id uint) error {
+	hook, err := s.Get(ownerID, id)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&entity.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+}
+
+func (s *DBWebhookService) RotateSecret(ownerID string, id uint) (*entity.Webhook, error) {
+	hook, err := s.Get(ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	hook.Secret = newWebhookSecret()
+	if err := s.db.Model(hook).Update("secret", hook.Secret).Error; err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+func (s *DBWebhookService) Deliveries(ownerID string, id uint, status string, limit, offset int) ([]entity.WebhookDelivery, int64, error) {
+	if _, err := s.Get(ownerID, id); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	q := s.db.Model(&entity.WebhookDelivery{}).Where("webhook_id = ?", id)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var deliveries []entity.WebhookDelivery
+	if err := q.Order("id DESC").Limit(limit).Offset(offset).Find(&deliveries).Error; err != nil {
+		return nil, 0, err
+	}
+	return deliveries, total, nil
+}
+
+func (s *DBWebhookService) Redeliver(ownerID string, id, deliveryID uint) (*entity.WebhookDelivery, error) {
+	if _, err := s.Get(ownerID, id); err != nil {
+		return nil, err
+	}
+	var d entity.WebhookDelivery
+	if err := s.db.Where("id = ? AND webhook_id = ?", deliveryID, id).First(&d).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeliveryNotFound
+		}
+		return nil, err
+	}
+	if d.Status == entity.WebhookPending {
+		return &d, nil
+	}
+	d.Status = entity.WebhookPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	err := s.db.Model(&d).Updates(map[string]interface{}{
+		"status":          d.Status,
+		"attempts":        d.Attempts,
+		"next_attempt_at": d.NextAttemptAt,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *DBWebhookService) Ping(ownerID string, id uint) (*entity.WebhookDelivery, error) {
+	hook, err := s.Get(ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(map[string]interface{}{"type": "ping", "webhookId": hook.ID})
+	deliveries, err := s.enqueue([]entity.Webhook{*hook}, "evt_"+generateID(12), "ping", data)
+	if err != nil {
+		return nil, err
+	}
+	return &deliveries[0], nil
+}
+
+func (s *DBWebhookService) Publish(evt HubEvent) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(evt.Payload, &head); err != nil || head.Type == "" {
+		return
+	}
+	scope := "user:" + evt.UserID
+	if evt.GroupID != 0 {
+		scope = "group:" + strconv.FormatUint(uint64(evt.GroupID), 10) + ":" + strconv.FormatUint(uint64(evt.ChannelID), 10)
+	}
+	// the same payload to the same audience is a retransmission, e.g. a local
+	// fallback after a failed redis publish
+	if _, dup := s.remember(scope + "\n" + string(evt.Payload)); dup {
+		return
+	}
+	// the same payload to another audience is the same event: DMs are sent to
+	// both participants. Global webhooks already got the first copy.
+	eventID, seen := s.remember(string(evt.Payload))
+
+	q := s.db.Where("enabled = ?", true)
+	if evt.GroupID != 0 {
+		members, err := s.groupSvc.ChannelMembers(evt.GroupID, evt.ChannelID)
+		if err != nil {
+			log.Printf("webhook publish %s: %v", head.Type, err)
+			return
+		}
+		if seen {
+			q = q.Where("global = ? AND owner_id IN ?", false, members)
+		} else {
+			q = q.Where("global = ? OR owner_id IN ?", true, members)
+		}
+	} else if seen {
+		q = q.Where("global = ? AND owner_id = ?", false, evt.UserID)
+	} else {
+		q = q.Where("global = ? OR owner_id = ?", true, evt.UserID)
+	}
+	var hooks []entity.Webhook
+	if err := q.Find(&hooks).Error; err != nil {
+		log.Printf("webhook publish %s: %v", head.Type, err)
+		return
+	}
+	subscribed := hooks[:0]
+	for _, h := range hooks {
+		if h.Subscribed(head.Type) {
+			subscribed = append(subscribed, h)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+	if _, err := s.enqueue(subscribed, eventID, head.Type, evt.Payload); err != nil {
+		log.Printf("webhook publish %s: %v", head.Type, err)
+	}
+}
+
+// remember returns the event ID assigned to key and whether key was seen
+// within webhookDedupWindow.
+func (s *DBWebhookService) remember(key string) (string, bool) {
+	key = hashToken(key)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.recent[key]; ok && now.Sub(e.seen) < webhookDedupWindow {
+		return e.id, true
+	}
+	for k, e := range s.recent {
+		if now.Sub(e.seen) >= webhookDedupWindow {
+			delete(s.recent, k)
+		}
+	}
+	id := "evt_" + generateID(12)
+	s.recent[key] = recentEvent{id: id, seen: now}
+	return id, false
+}
+
+func (s *DBWebhookService) enqueue(hooks []entity.Webhook, eventID, evtType string, data []byte) ([]entity.WebhookDelivery, error) {
+	now := time.Now()
+	body, err := json.Marshal(webhookEnvelope{ID: eventID, Type: evtType, CreatedAt: now.UTC(), Data: data})
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]entity.WebhookDelivery, 0, len(hooks))
+	for _, h := range hooks {
+		deliveries = append(deliveries, entity.WebhookDelivery{
+			WebhookID:     h.ID,
+			EventID:       eventID,
+			EventType:     evtType,
+			Payload:       string(body),
+			Status:        entity.WebhookPending,
+			NextAttemptAt: now,
+		})
+	}
+	if err := s.db.Create(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Run dispatches due deliveries until ctx is done. It is safe to run on every instance.
+func (s *DBWebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.DispatchDue(ctx); err != nil {
+			log.Printf("webhook dispatch: %v", err)
+		}
+		if time.Since(lastCleanup) > time.Hour {
+			lastCleanup = time.Now()
+			cutoff := time.Now().Add(-7 * 24 * time.Hour)
+			if err := s.db.Where("status = ? AND created_at < ?", entity.WebhookDelivered, cutoff).Delete(&entity.WebhookDelivery{}).Error; err != nil {
+				log.Printf("webhook cleanup: %v", err)
+			}
+		}
+	}
+}
+
+// DispatchDue sends every delivery whose time has come.
+func (s *DBWebhookService) DispatchDue(ctx context.Context) error {
+	for {
+		var deliveries []entity.WebhookDelivery
+		now := time.Now()
+		if err := s.db.Where("status = ? AND next_attempt_at <= ?", entity.WebhookPending, now).
+			Order("next_attempt_at").Limit(100).Find(&deliveries).Error; err != nil {
+			return err
+		}
+		claimed := 0
+		for i := range deliveries {
+			d := &deliveries[i]
+			// claim by moving the delivery past the lease, as the push dispatcher does
+			res := s.db.Model(&entity.WebhookDelivery{}).
+				Where("id = ? AND status = ? AND next_attempt_at = ?", d.ID, entity.WebhookPending, d.NextAttemptAt).
+				Update("next_attempt_at", now.Add(claimLease))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				continue
+			}
+			claimed++
+			s.send(ctx, d)
+		}
+		if len(deliveries) < 100 || claimed == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *DBWebhookService) send(ctx context.Context, d *entity.WebhookDelivery) {
+	var hook entity.Webhook
+	if err := s.db.First(&hook, d.WebhookID).Error; err != nil {
+		s.deadLetter(d, "webhook deleted")
+		return
+	}
+	if !hook.Enabled {
+		s.deadLetter(d, "webhook disabled")
+		return
+	}
+	status, retryAfter, err := s.post(ctx, &hook, d)
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		s.finish(d, entity.WebhookDelivered, status, "")
+	case status == http.StatusGone:
+		// the receiver asked us to stop
+		if err := s.db.Model(&hook).Update("enabled", false).Error; err != nil {
+			log.Printf("disable webhook %d: %v", hook.ID, err)
+		}
+		s.finish(d, entity.WebhookDead, status, "endpoint returned 410; webhook disabled")
+	default:
+		msg := fmt.Sprintf("endpoint returned %d", status)
+		if err != nil {
+			msg = err.Error()
+		}
+		s.retry(d, status, msg, retryAfter)
+	}
+}
+
+// post signs and delivers d; it returns the endpoint's status code.
+func (s *DBWebhookService) post(ctx context.Context, hook *entity.Webhook, d *entity.WebhookDelivery) (int, time.Duration, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go_sm_api-webhooks/1")
+	req.Header.Set("X-Webhook-Id", strconv.FormatUint(uint64(hook.ID), 10))
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-Webhook-Signature", utils.SignWebhook(hook.Secret, now, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return resp.StatusCode, retryAfter, nil
+}
+
+// retry reschedules a delivery with exponential backoff and dead-letters it
+// after MaxAttempts.
+func (s *DBWebhookService) retry(d *entity.WebhookDelivery, status int, lastErr string, retryAfter time.Duration) {
+	attempts := d.Attempts + 1
+	if attempts >= s.cfg.MaxAttempts {
+		s.finish(d, entity.WebhookDead, status, lastErr)
+		return
+	}
+	delay := s.cfg.RetryBase << (attempts - 1)
+	if delay > s.cfg.MaxBackoff || delay <= 0 {
+		delay = s.cfg.MaxBackoff
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	s.db.Model(d).Updates(map[string]interface{}{
+		"attempts":         attempts,
+		"next_attempt_at":  time.Now().Add(delay),
+		"last_status_code": status,
+		"last_error":       truncate(lastErr, 255),
+	})
+}
+
+func (s *DBWebhookService) finish(d *entity.WebhookDelivery, status string, code int, lastErr string) {
+	updates := map[string]interface{}{
+		"status":           status,
+		"attempts":         d.Attempts + 1,
+		"last_status_code": code,
+		"last_error":       truncate(lastErr, 255),
+	}
+	if status == entity.WebhookDelivered {
+		now := time.Now()
+		updates["delivered_at"] = &now
+	}
+	if err := s.db.Model(d).Updates(updates).Error; err != nil {
+		log.Printf("webhook delivery %d: %v", d.ID, err)
+	}
+}
+
+// deadLetter moves a delivery that was never attempted to the dead-letter list.
+func (s *DBWebhookService) deadLetter(d *entity.WebhookDelivery, reason string) {
+	if err := s.db.Model(d).Updates(map[string]interface{}{"status": entity.WebhookDead, "last_status_code": 0, "last_error": reason}).Error; err != nil {
+		log.Printf("webhook delivery %d: %v", d.ID, err)
+	}
+}
@@ -9,14 +9,27 @@ import (
 
 var jwtSecret = []byte("change-me-to-a-secure-secret")
 
+// ChallengeTTL bounds how long a login challenge stays valid.
+const ChallengeTTL = 5 * time.Minute
+
+// Token purposes other than regular API access.
+const (
+	PurposeTwoFactor = "2fa"
+)
+
 type Claims struct {
 	Email string `json:"email"`
+	// Purpose is empty for API tokens and set for short-lived challenge tokens.
+	Purpose string `json:"purpose,omitempty"`
+	// Version must match User.TokenVersion for the token to be accepted.
+	Version int `json:"ver"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID, email string) (string, error) {
+func GenerateToken(userID, email string, version int) (string, error) {
 	claims := Claims{
-		Email: email,
+		Email:   email,
+		Version: version,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   userID,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
@@ -28,7 +41,48 @@ func GenerateToken(userID, email string) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+// GenerateChallengeToken issues a short-lived token that only proves the first
+// login factor; it is rejected by ValidateToken. version is the user's current
+// TokenVersion, so a password change or forced logout also voids the challenge.
+func GenerateChallengeToken(userID, purpose string, version int) (string, error) {
+	claims := Claims{
+		Purpose: purpose,
+		Version: version,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+// ValidateChallengeToken validates a token from GenerateChallengeToken for the given purpose.
+func ValidateChallengeToken(tokenStr, purpose string) (*Claims, error) {
+	claims, err := parseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
 func ValidateToken(tokenStr string) (*Claims, error) {
+	claims, err := parseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func parseToken(tokenStr string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(t *jwt.Token) (interface{}, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("unexpected signing method")
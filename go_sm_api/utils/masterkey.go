@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Envelope encryption of message bodies: each conversation has a data key,
+// stored wrapped by a master key that never touches the database.
+
+var (
+	ErrInvalidMasterKey = errors.New("master keys must be base64 encoded 32-byte keys")
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	ErrDecrypt          = errors.New("decryption failed")
+)
+
+// MasterKey is a 256-bit key-encryption key. ID is derived from the key so a
+// wrapped data key records which master key opens it.
+type MasterKey struct {
+	ID  string
+	key []byte
+}
+
+// MasterKeys is the configured keyring. Current wraps new data keys; the rest
+// only unwrap existing ones until everything is re-wrapped.
+type MasterKeys struct {
+	Current *MasterKey
+	byID    map[string]*MasterKey
+}
+
+// GenerateMasterKey returns a new base64 master key.
+func GenerateMasterKey() (string, error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k), nil
+}
+
+// ParseMasterKeys reads base64 keys separated by commas or newlines; the
+// first is current. Blank lines and lines starting with '#' are skipped.
+func ParseMasterKeys(s string) (*MasterKeys, error) {
+	ks := &MasterKeys{byID: map[string]*MasterKey{}}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, ErrInvalidMasterKey
+		}
+		sum := sha256.Sum256(raw)
+		mk := &MasterKey{ID: hex.EncodeToString(sum[:8]), key: raw}
+		if ks.Current == nil {
+			ks.Current = mk
+		}
+		ks.byID[mk.ID] = mk
+	}
+	if ks.Current == nil {
+		return nil, ErrInvalidMasterKey
+	}
+	return ks, nil
+}
+
+// LoadMasterKeys parses value, or the file at path when value is empty. It
+// returns nil, nil when neither is set.
+func LoadMasterKeys(value, path string) (*MasterKeys, error) {
+	if value == "" && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(b)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return ParseMasterKeys(value)
+}
+
+// Get returns the master key with the given ID.
+func (ks *MasterKeys) Get(id string) (*MasterKey, error) {
+	mk, ok := ks.byID[id]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	return mk, nil
+}
+
+// GenerateDataKey returns a new random data key.
+func GenerateDataKey() ([]byte, error) {
+	k := make([]byte, 32)
+	_, err := rand.Read(k)
+	return k, err
+}
+
+// Wrap encrypts a data key; aad binds it to its owner so a wrapped key cannot
+// be moved to another conversation.
+func (mk *MasterKey) Wrap(dataKey, aad []byte) ([]byte, error) {
+	return SealAESGCM(mk.key, dataKey, aad)
+}
+
+func (mk *MasterKey) Unwrap(wrapped, aad []byte) ([]byte, error) {
+	return OpenAESGCM(mk.key, wrapped, aad)
+}
+
+// SealAESGCM encrypts with AES-256-GCM and returns nonce || ciphertext.
+func SealAESGCM(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// OpenAESGCM reverses SealAESGCM.
+func OpenAESGCM(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
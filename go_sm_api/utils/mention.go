@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// mentionRe matches "@handle" not preceded by a word character, so e-mail
+// addresses are left alone. Group 1 is the handle.
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@.])@([A-Za-z0-9_]{2,32})\b`)
+
+// MentionToken is an @handle found in a message body. Offset and Length are
+// byte positions of the whole token including the "@"; Handle is lowercase.
+type MentionToken struct {
+	Handle string
+	Offset int
+	Length int
+}
+
+// ParseMentions returns the @tokens in body in order of appearance.
+func ParseMentions(body string) []MentionToken {
+	var out []MentionToken
+	for _, m := range mentionRe.FindAllStringSubmatchIndex(body, -1) {
+		start, end := m[2]-1, m[3]
+		out = append(out, MentionToken{
+			Handle: strings.ToLower(body[m[2]:m[3]]),
+			Offset: start,
+			Length: end - start,
+		})
+	}
+	return out
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignWebhook returns the X-Webhook-Signature value for a delivery:
+// "sha256=" + hex(HMAC-SHA256(secret, "<unix timestamp>.<body>")).
+// Signing the timestamp lets receivers reject replays.
+func SignWebhook(secret string, ts time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a signature produced by SignWebhook; timestamp is the
+// X-Webhook-Timestamp header and tolerance how old it may be.
+func VerifyWebhook(secret, signature, timestamp string, body []byte, tolerance time.Duration) bool {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	ts := time.Unix(secs, 0)
+	if d := time.Since(ts); d > tolerance || d < -tolerance {
+		return false
+	}
+	want := SignWebhook(secret, ts, body)
+	return strings.HasPrefix(signature, "sha256=") && hmac.Equal([]byte(signature), []byte(want))
+}
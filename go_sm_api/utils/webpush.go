@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Web Push (RFC 8030) with VAPID (RFC 8292) and aes128gcm payload encryption (RFC 8291).
+
+const (
+	webPushRecordSize = 4096
+	// MaxWebPushPayload is the largest plaintext that fits in a single record.
+	MaxWebPushPayload = 3993
+)
+
+var (
+	b64url = base64.RawURLEncoding
+
+	ErrInvalidVAPIDKey     = errors.New("invalid VAPID key")
+	ErrInvalidSubscription = errors.New("invalid push subscription keys")
+	ErrPushPayloadTooLarge = errors.New("push payload too large")
+)
+
+// VAPIDKeys is the application server key pair. PublicKey is the base64url
+// uncompressed point handed to browsers as applicationServerKey.
+type VAPIDKeys struct {
+	PublicKey string
+	private   *ecdsa.PrivateKey
+}
+
+// GenerateVAPIDKeys returns a new base64url encoded key pair.
+func GenerateVAPIDKeys() (publicKey, privateKey string, err error) {
+	k, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return b64url.EncodeToString(k.PublicKey().Bytes()), b64url.EncodeToString(k.Bytes()), nil
+}
+
+// ParseVAPIDKeys decodes a key pair produced by GenerateVAPIDKeys.
+func ParseVAPIDKeys(publicKey, privateKey string) (*VAPIDKeys, error) {
+	d, err := b64url.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, ErrInvalidVAPIDKey
+	}
+	k, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, ErrInvalidVAPIDKey
+	}
+	pub := k.PublicKey().Bytes()
+	if publicKey != "" && strings.TrimRight(publicKey, "=") != b64url.EncodeToString(pub) {
+		return nil, fmt.Errorf("%w: public key does not match private key", ErrInvalidVAPIDKey)
+	}
+	priv := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	return &VAPIDKeys{PublicKey: b64url.EncodeToString(pub), private: priv}, nil
+}
+
+// VAPIDAuthorization builds the Authorization header for a push to endpoint.
+// subject is a mailto: or https: contact for the push service operator.
+func (k *VAPIDKeys) VAPIDAuthorization(endpoint, subject string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", ErrInvalidSubscription
+	}
+	if ttl <= 0 || ttl > 24*time.Hour {
+		ttl = 12 * time.Hour
+	}
+	claims := jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(ttl).Unix(),
+	}
+	if subject != "" {
+		claims["sub"] = subject
+	}
+	t, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(k.private)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + t + ", k=" + k.PublicKey, nil
+}
+
+// VerifyVAPIDAuthorization checks a "vapid t=..., k=..." header and returns the
+// public key it was signed with. It is used by the fake push endpoint.
+func VerifyVAPIDAuthorization(header, audience string) (string, error) {
+	var token, key string
+	for _, part := range strings.Split(strings.TrimPrefix(header, "vapid "), ",") {
+		part = strings.TrimSpace(part)
+		if v, ok := strings.CutPrefix(part, "t="); ok {
+			token = v
+		} else if v, ok := strings.CutPrefix(part, "k="); ok {
+			key = v
+		}
+	}
+	raw, err := b64url.DecodeString(key)
+	if err != nil || len(raw) != 65 || raw[0] != 4 {
+		return "", ErrInvalidVAPIDKey
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(raw[1:33]), Y: new(big.Int).SetBytes(raw[33:])}
+	_, err = jwt.Parse(token, func(t *jwt.Token) (interface{}, error) { return pub, nil },
+		jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience(audience))
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// EncryptWebPush encrypts plaintext for a subscription whose keys are the
+// base64url p256dh public key and auth secret, producing an aes128gcm body.
+func EncryptWebPush(p256dh, auth string, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MaxWebPushPayload {
+		return nil, ErrPushPayloadTooLarge
+	}
+	uaRaw, err := b64url.DecodeString(strings.TrimRight(p256dh, "="))
+	if err != nil {
+		return nil, ErrInvalidSubscription
+	}
+	authSecret, err := b64url.DecodeString(strings.TrimRight(auth, "="))
+	if err != nil || len(authSecret) == 0 {
+		return nil, ErrInvalidSubscription
+	}
+	uaPub, err := ecdh.P256().NewPublicKey(uaRaw)
+	if err != nil {
+		return nil, ErrInvalidSubscription
+	}
+	asPriv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := asPriv.ECDH(uaPub)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	asPub := asPriv.PublicKey().Bytes()
+	gcm, nonce, err := webPushCipher(shared, authSecret, salt, uaRaw, asPub)
+	if err != nil {
+		return nil, err
+	}
+	// single record: plaintext followed by the 0x02 last-record delimiter
+	record := append(append([]byte{}, plaintext...), 0x02)
+	header := make([]byte, 0, 16+4+1+len(asPub))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPub)))
+	header = append(header, asPub...)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// DecryptWebPush reverses EncryptWebPush given the subscription's private key
+// and auth secret. It is used by the fake push endpoint.
+func DecryptWebPush(uaPriv *ecdh.PrivateKey, authSecret, body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, ErrInvalidSubscription
+	}
+	salt, idLen := body[:16], int(body[20])
+	if len(body) < 21+idLen {
+		return nil, ErrInvalidSubscription
+	}
+	asRaw, ciphertext := body[21:21+idLen], body[21+idLen:]
+	asPub, err := ecdh.P256().NewPublicKey(asRaw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := uaPriv.ECDH(asPub)
+	if err != nil {
+		return nil, err
+	}
+	gcm, nonce, err := webPushCipher(shared, authSecret, salt, uaPriv.PublicKey().Bytes(), asRaw)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	// strip padding and the delimiter
+	i := len(record) - 1
+	for i >= 0 && record[i] == 0 {
+		i--
+	}
+	if i < 0 || record[i] != 0x02 {
+		return nil, errors.New("invalid push record padding")
+	}
+	return record[:i], nil
+}
+
+// webPushCipher derives the content encryption key and nonce (RFC 8291 section 3.4).
+func webPushCipher(shared, authSecret, salt, uaPub, asPub []byte) (cipher.AEAD, []byte, error) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPub...)
+	keyInfo = append(keyInfo, asPub...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, authSecret, keyInfo), ikm); err != nil {
+		return nil, nil, err
+	}
+	prk := hmac.New(sha256.New, salt)
+	prk.Write(ikm)
+	prkKey := prk.Sum(nil)
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prkKey, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prkKey, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce, nil
+}
@@ -3,10 +3,11 @@ package ws
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/abeme/go_sm_api/entity"
 	"github.com/abeme/go_sm_api/service"
 	"github.com/gorilla/websocket"
 )
@@ -14,17 +15,25 @@ import (
 const (
 	writeWait = 10 * time.Second
 	pongWait  = 60 * time.Second
+	// maxFrameSize leaves room for encrypted DMs, which carry one ciphertext
+	// per device
+	maxFrameSize = 32 << 10
 )
 
 type Client struct {
-	hub         *Hub
-	conn        *websocket.Conn
-	send        chan []byte
-	userID      string
-	pmSvc       service.PrivateMessageService
-	groupSvc    *service.GroupService
-	groupMsgSvc service.GroupMessageService
-	userSvc     service.UserService
+	hub      *Hub
+	conn     *websocket.Conn
+	send     chan []byte
+	userID   string
+	sender   *Sender
+	commands *Commands
+	limiter  *service.RateLimiter
+	// readOnly connections (API tokens without messages:write) only receive events
+	readOnly bool
+	// dropped is set by the hub once it closed the socket; owned by Hub.run
+	dropped bool
+	// done is closed when writePump stops
+	done chan struct{}
 }
 
 func (c *Client) readPump() {
@@ -32,7 +41,7 @@ func (c *Client) readPump() {
 		c.hub.UnregisterClient(c)
 		_ = c.conn.Close()
 	}()
-	c.conn.SetReadLimit(512)
+	c.conn.SetReadLimit(maxFrameSize)
 	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { _ = c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
@@ -48,110 +57,194 @@ func (c *Client) readPump() {
 			Body    string `json:"body"`
 			TempID  string `json:"tempId"`
 			GroupID uint   `json:"groupId"`
+			// ChannelID picks a channel of GroupID; 0 is the default channel
+			ChannelID uint   `json:"channelId"`
+			ReplyTo   uint   `json:"replyTo"`
+			Kind      string `json:"kind"`
+			ID        uint   `json:"id"`
+			// GroupDMID addresses a "group_dm" frame
+			GroupDMID uint `json:"groupDmId"`
+			// Envelope replaces Body in end-to-end encrypted DMs
+			Envelope *entity.EncryptedEnvelope `json:"envelope"`
+			// Messages lists the messages of a "forward" frame
+			Messages []entity.ForwardRef `json:"messages"`
 		}
 		if err := json.Unmarshal(raw, &env); err != nil {
-			c.send <- []byte(`{"type":"error","error":"invalid_json"}`)
+			c.reply([]byte(`{"type":"error","error":"invalid_json"}`))
 			continue
 		}
-		switch env.Type {
-		case "private":
-			if env.To == "" || env.Body == "" {
-				c.send <- []byte(`{"type":"error","error":"missing_fields"}`)
+		// every frame type that writes to the DB costs a token
+		if c.limiter != nil {
+			if ok, wait := c.limiter.Allow(context.Background(), env.Type, c.userID); !ok {
+				errEvt := map[string]interface{}{
+					"type":         "error",
+					"error":        "rate_limited",
+					"tempId":       env.TempID,
+					"retryAfterMs": wait.Milliseconds(),
+				}
+				if b, err := json.Marshal(errEvt); err == nil {
+					c.reply(b)
+				}
 				continue
 			}
-			pm, err := c.pmSvc.Send(c.userID, env.To, env.Body)
-			if err != nil {
-				c.send <- []byte(`{"type":"error","error":"send_failed"}`)
-				continue
-			}
-			ts := pm.CreatedAt.Unix()
-			// Ack payload
-			ack := map[string]interface{}{
-				"type":   "private_ack",
-				"tempId": env.TempID,
-				"id":     pm.ID,
-				"from":   pm.SenderID,
-				"to":     pm.RecipientID,
-				"body":   pm.Body,
-				"ts":     ts,
-			}
-			ackBytes, _ := json.Marshal(ack)
-			c.send <- ackBytes
-			// Event payload broadcast to both parties
-			evt := map[string]interface{}{
-				"type": "private",
-				"id":   pm.ID,
-				"from": pm.SenderID,
-				"to":   pm.RecipientID,
-				"body": pm.Body,
-				"ts":   ts,
-				"read": false,
-			}
-			evtBytes, _ := json.Marshal(evt)
-			// deliver to recipient
-			c.hub.SendToUser(pm.RecipientID, evtBytes)
-			// echo event to sender (in addition to ack)
-			c.send <- evtBytes
-		case "group":
-			if env.GroupID == 0 || env.Body == "" {
-				c.send <- []byte(`{"type":"error","error":"missing_fields"}`)
+		}
+		switch env.Type {
+		case "private", "group", "group_dm":
+			if c.readOnly {
+				c.reply([]byte(`{"type":"error","error":"insufficient_scope"}`))
 				continue
 			}
-			// membership check
-			ok, err := c.groupSvc.IsMember(env.GroupID, c.userID)
-			if err != nil || !ok {
-				c.send <- []byte(`{"type":"error","error":"not_a_member"}`)
+			// slash commands run in DMs and groups only
+			name, args, body, isCommand := ParseCommand(env.Body)
+			if isCommand && c.commands != nil && env.Envelope == nil && env.Type != "group_dm" {
+				c.runCommand(&Invocation{Kind: env.Type, UserID: c.userID, To: env.To, GroupID: env.GroupID, ChannelID: env.ChannelID, Name: name, Args: args}, env.TempID)
 				continue
 			}
-			// persist
-			gm, err := c.groupMsgSvc.Send(env.GroupID, c.userID, env.Body)
+			msg := Outgoing{Kind: env.Type, SenderID: c.userID, To: env.To, GroupID: env.GroupID, ChannelID: env.ChannelID, GroupDMID: env.GroupDMID, Body: body, ReplyTo: env.ReplyTo, Envelope: env.Envelope}
+			sent, err := c.sender.Send(msg)
 			if err != nil {
-				c.send <- []byte(`{"type":"error","error":"send_failed"}`)
+				c.sendError(err, env.TempID)
 				continue
 			}
-			ts := gm.CreatedAt.Unix()
-			// Ack back to sender (no local echo to avoid duplicate when pubsub returns)
-			ack := map[string]interface{}{
-				"type":    "group_ack",
-				"tempId":  env.TempID,
-				"id":      gm.ID,
-				"groupId": env.GroupID,
-				"from":    gm.SenderID,
-				"body":    gm.Body,
-				"ts":      ts,
+			// ack first; group messages are not echoed locally to avoid a
+			// duplicate when pubsub returns them
+			if b, err := json.Marshal(sent.Ack(msg, env.TempID)); err == nil {
+				c.reply(b)
 			}
-			if b, _ := json.Marshal(ack); b != nil {
-				c.send <- b
-			}
-			// Build event including sender email
-			var senderEmail string
-			if u, err := c.userSvc.GetByID(c.userID); err == nil {
-				senderEmail = u.Email
+			_ = c.sender.Deliver(context.Background(), sent)
+		case "forward":
+			if c.readOnly {
+				c.reply([]byte(`{"type":"error","error":"insufficient_scope"}`))
+				continue
 			}
-			evt := map[string]interface{}{
-				"type":      "group",
-				"id":        gm.ID,
-				"groupId":   env.GroupID,
-				"from":      gm.SenderID,
-				"fromEmail": senderEmail,
-				"body":      gm.Body,
-				"ts":        ts,
+			c.forward(env.To, env.GroupID, env.ChannelID, env.Messages, env.TempID)
+		case "ack":
+			// the client has shown the event, so no push is needed
+			if c.hub.push != nil && env.ID != 0 {
+				if err := c.hub.push.Ack(c.userID, env.Kind, env.ID); err != nil {
+					log.Printf("push ack failed: %v", err)
+				}
 			}
-			evtBytes, _ := json.Marshal(evt)
-			// publish to redis so all instances/hubs process and filter to members
-			_ = c.hub.PublishGroup(context.Background(), fmt.Sprintf("group:%d", env.GroupID), string(evtBytes))
 		default:
 			// Unknown type
-			c.send <- []byte(`{"type":"error","error":"unsupported_type"}`)
+			c.reply([]byte(`{"type":"error","error":"unsupported_type"}`))
 		}
 	}
 }
 
+// runCommand executes a slash command and answers the invoker: with the ack
+// when the command sent a message, otherwise with a command_response only
+// they see.
+func (c *Client) runCommand(inv *Invocation, tempID string) {
+	res, err := c.commands.Run(context.Background(), inv)
+	if err != nil {
+		c.sendError(err, tempID)
+		return
+	}
+	if res.Sent != nil {
+		if b, err := json.Marshal(res.Sent.Ack(res.Msg, tempID)); err == nil {
+			c.reply(b)
+		}
+		_ = c.sender.Deliver(context.Background(), res.Sent)
+		return
+	}
+	evt := map[string]interface{}{
+		"type":    "command_response",
+		"tempId":  tempID,
+		"command": inv.Name,
+		"text":    res.Text,
+	}
+	if b, err := json.Marshal(evt); err == nil {
+		c.reply(b)
+	}
+}
+
+// forward copies messages into a DM (to) or a group channel and answers with
+// one forward_ack listing the ack of every copy.
+func (c *Client) forward(to string, groupID, channelID uint, refs []entity.ForwardRef, tempID string) {
+	dest := Outgoing{Kind: "private", SenderID: c.userID, To: to}
+	if groupID != 0 {
+		dest = Outgoing{Kind: "group", SenderID: c.userID, GroupID: groupID, ChannelID: channelID}
+	}
+	sents, err := c.sender.Forward(dest, refs)
+	if len(sents) > 0 {
+		acks := make([]map[string]interface{}, 0, len(sents))
+		for _, sent := range sents {
+			acks = append(acks, sent.Ack(dest, ""))
+		}
+		if b, err := json.Marshal(map[string]interface{}{"type": "forward_ack", "tempId": tempID, "messages": acks}); err == nil {
+			c.reply(b)
+		}
+		for _, sent := range sents {
+			_ = c.sender.Deliver(context.Background(), sent)
+		}
+	}
+	if err != nil {
+		c.sendError(err, tempID)
+	}
+}
+
+// sendError reports a failed send to the client using the WebSocket error codes.
+func (c *Client) sendError(err error, tempID string) {
+	var rejected *RejectedError
+	switch {
+	case errors.As(err, &rejected):
+		errEvt := map[string]interface{}{
+			"type":    "error",
+			"error":   "message_rejected",
+			"tempId":  tempID,
+			"reasons": rejected.Reasons,
+		}
+		if b, err := json.Marshal(errEvt); err == nil {
+			c.reply(b)
+		}
+	case errors.Is(err, ErrMissingFields), errors.Is(err, ErrNotMember), errors.Is(err, ErrTooManyMessages):
+		c.reply([]byte(`{"type":"error","error":"` + err.Error() + `"}`))
+	case errors.Is(err, service.ErrBlocked):
+		c.reply([]byte(`{"type":"error","error":"blocked"}`))
+	case errors.Is(err, service.ErrInvalidReply):
+		c.reply([]byte(`{"type":"error","error":"invalid_reply"}`))
+	case errors.Is(err, service.ErrMemberMuted):
+		c.reply([]byte(`{"type":"error","error":"muted"}`))
+	case errors.Is(err, service.ErrChannelReadOnly):
+		c.reply([]byte(`{"type":"error","error":"read_only_channel"}`))
+	case errors.Is(err, service.ErrMessageNotFound), errors.Is(err, service.ErrCannotForward):
+		code := "message_not_found"
+		if errors.Is(err, service.ErrCannotForward) {
+			code = "cannot_forward"
+		}
+		if b, err := json.Marshal(map[string]interface{}{"type": "error", "error": code, "tempId": tempID}); err == nil {
+			c.reply(b)
+		}
+	case errors.Is(err, service.ErrE2ERequired), errors.Is(err, service.ErrInvalidEnvelope):
+		code := "e2e_required"
+		if errors.Is(err, service.ErrInvalidEnvelope) {
+			code = "invalid_envelope"
+		}
+		if b, err := json.Marshal(map[string]interface{}{"type": "error", "error": code, "tempId": tempID}); err == nil {
+			c.reply(b)
+		}
+	case errors.Is(err, ErrUnknownCommand), errors.Is(err, service.ErrCommandFailed):
+		code := "unknown_command"
+		if errors.Is(err, service.ErrCommandFailed) {
+			log.Printf("command failed: %v", err)
+			code = "command_failed"
+		}
+		if b, err := json.Marshal(map[string]interface{}{"type": "error", "error": code, "tempId": tempID}); err == nil {
+			c.reply(b)
+		}
+	default:
+		log.Printf("send failed: %v", err)
+		c.reply([]byte(`{"type":"error","error":"send_failed"}`))
+	}
+}
+
 func (c *Client) writePump() {
 	ticker := time.NewTicker((pongWait * 9) / 10)
 	defer func() {
 		ticker.Stop()
 		_ = c.conn.Close()
+		close(c.done)
 	}()
 	for {
 		select {
@@ -174,6 +267,15 @@ func (c *Client) writePump() {
 	}
 }
 
+// reply queues b for the client from readPump. It gives up once writePump has
+// stopped, so a dead connection cannot block readPump before it unregisters.
+func (c *Client) reply(b []byte) {
+	select {
+	case c.send <- b:
+	case <-c.done:
+	}
+}
+
 func (c *Client) Serve(ctx context.Context) {
 	go c.writePump()
 	c.readPump()
@@ -0,0 +1,390 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+)
+
+// ErrUnknownCommand is returned for a slash command that is neither built in
+// nor registered by a bot in the conversation.
+var ErrUnknownCommand = errors.New("unknown_command")
+
+const (
+	defaultMuteDuration = time.Hour
+	maxMuteDuration     = 30 * 24 * time.Hour
+	maxTopicLength      = 191
+)
+
+// Invocation is a slash command typed into a "group" or "private" frame.
+type Invocation struct {
+	Kind      string
+	UserID    string
+	To        string
+	GroupID   uint
+	ChannelID uint
+	Name      string
+	Args      string
+}
+
+// CommandResult is what a command hands back to the invoker. Text is shown
+// only to them; Sent is a message the command stored, which the caller acks
+// and delivers like a normal send.
+type CommandResult struct {
+	Text string
+	Sent *Sent
+	Msg  Outgoing
+}
+
+type builtinCommand struct {
+	usage       string
+	description string
+	groupOnly   bool
+	run         func(ctx context.Context, inv *Invocation) (*CommandResult, error)
+}
+
+// Commands routes slash commands to the built-ins or to bot endpoints.
+type Commands struct {
+	hub      *Hub
+	sender   *Sender
+	groupSvc *service.GroupService
+	userSvc  service.UserService
+	notifSvc service.NotificationService
+	cmdSvc   service.CommandService
+	auditSvc service.AuditService
+	builtins map[string]builtinCommand
+}
+
+func NewCommands(hub *Hub, sender *Sender, groupSvc *service.GroupService, userSvc service.UserService, notifSvc service.NotificationService, cmdSvc service.CommandService, auditSvc service.AuditService) *Commands {
+	c := &Commands{hub: hub, sender: sender, groupSvc: groupSvc, userSvc: userSvc, notifSvc: notifSvc, cmdSvc: cmdSvc, auditSvc: auditSvc}
+	c.builtins = map[string]builtinCommand{
+		"help":   {usage: "/help", description: "list the commands available here", run: c.help},
+		"me":     {usage: "/me <action>", description: "send an action, shown as \"* you <action>\"", run: c.me},
+		"topic":  {usage: "/topic [text]", description: "show or (owner) set the group topic", groupOnly: true, run: c.topic},
+		"invite": {usage: "/invite @handle", description: "invite someone to the group", groupOnly: true, run: c.invite},
+		"kick":   {usage: "/kick @handle", description: "(owner) remove a member; they may rejoin", groupOnly: true, run: c.kick},
+		"mute":   {usage: "/mute @handle [duration]", description: "(owner) stop a member posting, 1h by default", groupOnly: true, run: c.mute},
+		"unmute": {usage: "/unmute @handle", description: "(owner) lift a mute", groupOnly: true, run: c.unmute},
+	}
+	return c
+}
+
+// ParseCommand splits a message body of the form "/name args". A body
+// starting with "//" is an escaped slash: it is not a command and text is the
+// body with one slash removed.
+func ParseCommand(body string) (name, args, text string, ok bool) {
+	if !strings.HasPrefix(body, "/") {
+		return "", "", body, false
+	}
+	if strings.HasPrefix(body, "//") {
+		return "", "", body[1:], false
+	}
+	name, args, _ = strings.Cut(body[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(args), body, true
+}
+
+// Run executes a command for inv.UserID in the conversation inv describes.
+func (c *Commands) Run(ctx context.Context, inv *Invocation) (*CommandResult, error) {
+	switch inv.Kind {
+	case "group":
+		if inv.GroupID == 0 {
+			return nil, ErrMissingFields
+		}
+		if ok, err := c.groupSvc.IsChannelMember(inv.GroupID, inv.ChannelID, inv.UserID); err != nil || !ok {
+			return nil, ErrNotMember
+		}
+	case "private":
+		if inv.To == "" {
+			return nil, ErrMissingFields
+		}
+	default:
+		return nil, ErrMissingFields
+	}
+	if b, ok := c.builtins[inv.Name]; ok {
+		if b.groupOnly && inv.Kind != "group" {
+			return &CommandResult{Text: "/" + inv.Name + " only works in groups"}, nil
+		}
+		return b.run(ctx, inv)
+	}
+	return c.runBot(ctx, inv)
+}
+
+// Available lists the commands usable in a group (groupID != 0) or in a
+// private chat with peerID.
+func (c *Commands) Available(groupID uint, peerID string) ([]entity.CommandInfo, error) {
+	var out []entity.CommandInfo
+	for _, name := range entity.BuiltinCommands {
+		b := c.builtins[name]
+		if b.groupOnly && groupID == 0 {
+			continue
+		}
+		out = append(out, entity.CommandInfo{Name: name, Description: b.description, Usage: b.usage})
+	}
+	if c.cmdSvc == nil {
+		return out, nil
+	}
+	cmds, err := c.cmdSvc.Available(groupID, peerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		out = append(out, entity.CommandInfo{Name: cmd.Name, Description: cmd.Description, Usage: "/" + cmd.Name, BotID: cmd.BotID})
+	}
+	return out, nil
+}
+
+func (c *Commands) help(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	cmds, err := c.Available(inv.GroupID, inv.To)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for i, cmd := range cmds {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(cmd.Usage)
+		if cmd.Description != "" {
+			b.WriteString(" - " + cmd.Description)
+		}
+	}
+	return &CommandResult{Text: b.String()}, nil
+}
+
+// me sends the action as a normal message whose body keeps the "/me "
+// prefix, which clients render as an action.
+func (c *Commands) me(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	if inv.Args == "" {
+		return &CommandResult{Text: "usage: /me <action>"}, nil
+	}
+	msg := Outgoing{Kind: inv.Kind, SenderID: inv.UserID, To: inv.To, GroupID: inv.GroupID, ChannelID: inv.ChannelID, Body: "/me " + inv.Args}
+	sent, err := c.sender.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandResult{Sent: sent, Msg: msg}, nil
+}
+
+func (c *Commands) topic(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	grp, err := c.groupSvc.GetGroup(inv.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Args == "" {
+		if grp.Topic == "" {
+			return &CommandResult{Text: "no topic set"}, nil
+		}
+		return &CommandResult{Text: "topic: " + grp.Topic}, nil
+	}
+	if grp.OwnerID != inv.UserID {
+		return &CommandResult{Text: "only the group owner can change the topic"}, nil
+	}
+	if len(inv.Args) > maxTopicLength {
+		return &CommandResult{Text: fmt.Sprintf("the topic can be at most %d characters", maxTopicLength)}, nil
+	}
+	if err := c.groupSvc.SetTopic(inv.GroupID, inv.Args); err != nil {
+		return nil, err
+	}
+	c.sendGroupEvent(inv.GroupID, map[string]interface{}{"type": "group_topic", "groupId": inv.GroupID, "topic": inv.Args, "by": inv.UserID})
+	return &CommandResult{}, nil
+}
+
+func (c *Commands) invite(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	target, res := c.resolveHandle(inv, "/invite @handle")
+	if target == nil {
+		return res, nil
+	}
+	gi, err := c.groupSvc.Invite(inv.GroupID, inv.UserID, target.ID)
+	switch {
+	case errors.Is(err, service.ErrAlreadyMember):
+		return &CommandResult{Text: "@" + target.Handle + " is already a member"}, nil
+	case errors.Is(err, service.ErrBannedFromGroup):
+		return &CommandResult{Text: "@" + target.Handle + " is banned from this group"}, nil
+	case err != nil:
+		return nil, err
+	}
+	var snippet string
+	if grp, err := c.groupSvc.GetGroup(gi.GroupID); err == nil {
+		snippet = grp.Name
+	}
+	n := &entity.Notification{
+		UserID:   gi.InviteeID,
+		Kind:     entity.NotifyGroupInvite,
+		ActorID:  inv.UserID,
+		GroupID:  gi.GroupID,
+		InviteID: gi.ID,
+		Snippet:  snippet,
+	}
+	if created, err := c.notifSvc.Create(n); err != nil {
+		log.Printf("group invite notification: %v", err)
+	} else if created {
+		c.hub.PushNotifications([]entity.Notification{*n})
+	}
+	return &CommandResult{Text: "invited @" + target.Handle}, nil
+}
+
+func (c *Commands) kick(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	target, res, err := c.ownerTarget(inv, "/kick @handle")
+	if target == nil {
+		return res, err
+	}
+	if err := c.groupSvc.RemoveMember(inv.GroupID, target.ID); err != nil {
+		if errors.Is(err, service.ErrNotGroupMember) {
+			return &CommandResult{Text: "@" + target.Handle + " is not a member"}, nil
+		}
+		return nil, err
+	}
+	c.audit(inv, entity.AuditGroupKick, target.ID, nil)
+	evt := map[string]interface{}{"type": "group_kick", "groupId": inv.GroupID, "userId": target.ID, "by": inv.UserID}
+	c.sendGroupEvent(inv.GroupID, evt)
+	if b, err := json.Marshal(evt); err == nil {
+		c.hub.SendToUser(target.ID, b)
+	}
+	return &CommandResult{}, nil
+}
+
+func (c *Commands) mute(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	handle, durArg, _ := strings.Cut(inv.Args, " ")
+	d := defaultMuteDuration
+	if durArg = strings.TrimSpace(durArg); durArg != "" {
+		parsed, err := time.ParseDuration(durArg)
+		if err != nil || parsed <= 0 || parsed > maxMuteDuration {
+			return &CommandResult{Text: "usage: /mute @handle [duration], e.g. 30m or 2h (at most 720h)"}, nil
+		}
+		d = parsed
+	}
+	inv.Args = handle
+	target, res, err := c.ownerTarget(inv, "/mute @handle [duration]")
+	if target == nil {
+		return res, err
+	}
+	if ok, err := c.groupSvc.IsMember(inv.GroupID, target.ID); err != nil {
+		return nil, err
+	} else if !ok {
+		return &CommandResult{Text: "@" + target.Handle + " is not a member"}, nil
+	}
+	until := time.Now().Add(d)
+	if err := c.groupSvc.MuteMember(inv.GroupID, target.ID, inv.UserID, until); err != nil {
+		return nil, err
+	}
+	c.audit(inv, entity.AuditGroupMute, target.ID, map[string]interface{}{"until": until})
+	c.sendGroupEvent(inv.GroupID, map[string]interface{}{"type": "group_mute", "groupId": inv.GroupID, "userId": target.ID, "until": until.Unix()})
+	return &CommandResult{}, nil
+}
+
+func (c *Commands) unmute(_ context.Context, inv *Invocation) (*CommandResult, error) {
+	target, res, err := c.ownerTarget(inv, "/unmute @handle")
+	if target == nil {
+		return res, err
+	}
+	if err := c.groupSvc.UnmuteMember(inv.GroupID, target.ID); err != nil {
+		return nil, err
+	}
+	c.audit(inv, entity.AuditGroupUnmute, target.ID, nil)
+	c.sendGroupEvent(inv.GroupID, map[string]interface{}{"type": "group_mute", "groupId": inv.GroupID, "userId": target.ID, "until": 0})
+	return &CommandResult{}, nil
+}
+
+// audit records a moderation command against a group member, like the REST
+// endpoints do.
+func (c *Commands) audit(inv *Invocation, action, targetID string, details map[string]interface{}) {
+	if c.auditSvc == nil {
+		return
+	}
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["group_id"] = inv.GroupID
+	details["command"] = inv.Name
+	e := entity.AuditEvent{Action: action, ActorID: inv.UserID, TargetType: "user", TargetID: targetID, Details: details}
+	if err := c.auditSvc.Record(&e); err != nil {
+		log.Printf("audit %s: %v", action, err)
+	}
+}
+
+// resolveHandle looks up the @handle in inv.Args. When it returns no user the
+// result explains why.
+func (c *Commands) resolveHandle(inv *Invocation, usage string) (*entity.User, *CommandResult) {
+	if inv.Args == "" || strings.Contains(inv.Args, " ") {
+		return nil, &CommandResult{Text: "usage: " + usage}
+	}
+	u, err := c.userSvc.GetByHandle(inv.Args)
+	if err != nil {
+		return nil, &CommandResult{Text: "no user " + inv.Args}
+	}
+	return u, nil
+}
+
+// ownerTarget resolves the target of an owner-only command. The owner cannot
+// target themselves.
+func (c *Commands) ownerTarget(inv *Invocation, usage string) (*entity.User, *CommandResult, error) {
+	grp, err := c.groupSvc.GetGroup(inv.GroupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if grp.OwnerID != inv.UserID {
+		return nil, &CommandResult{Text: "only the group owner can use /" + inv.Name}, nil
+	}
+	target, res := c.resolveHandle(inv, usage)
+	if target == nil {
+		return nil, res, nil
+	}
+	if target.ID == grp.OwnerID {
+		return nil, &CommandResult{Text: "the group owner cannot be the target of /" + inv.Name}, nil
+	}
+	return target, nil, nil
+}
+
+func (c *Commands) sendGroupEvent(groupID uint, evt map[string]interface{}) {
+	if b, err := json.Marshal(evt); err == nil {
+		c.hub.SendToGroup(groupID, b)
+	}
+}
+
+// runBot calls a bot's command endpoint. Public replies are posted by the
+// bot: to the group, or in a private chat back to the invoker.
+func (c *Commands) runBot(ctx context.Context, inv *Invocation) (*CommandResult, error) {
+	if c.cmdSvc == nil {
+		return nil, ErrUnknownCommand
+	}
+	cmd, err := c.cmdSvc.Find(inv.GroupID, inv.To, inv.Name)
+	if errors.Is(err, service.ErrCommandNotFound) {
+		return nil, ErrUnknownCommand
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.cmdSvc.Invoke(ctx, cmd, entity.CommandInvocation{
+		Command: cmd.Name,
+		Args:    inv.Args,
+		UserID:  inv.UserID,
+		GroupID: inv.GroupID,
+		BotID:   cmd.BotID,
+		TS:      time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Text == "" || reply.ResponseType != entity.CommandReplyPublic {
+		return &CommandResult{Text: reply.Text}, nil
+	}
+	msg := Outgoing{Kind: inv.Kind, SenderID: cmd.BotID, GroupID: inv.GroupID, ChannelID: inv.ChannelID, Body: reply.Text}
+	if inv.Kind == "private" {
+		msg.To = inv.UserID
+	}
+	sent, err := c.sender.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sender.Deliver(ctx, sent); err != nil {
+		log.Printf("command reply delivery: %v", err)
+	}
+	return &CommandResult{}, nil
+}
@@ -0,0 +1,223 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/abeme/go_sm_api/service"
+
+	"github.com/abeme/go_sm_api/entity"
+)
+
+// enqueuePush queues a Web Push for userID. Connected users get the ack window
+// to acknowledge the event before it is pushed.
+func (h *Hub) enqueuePush(userID string, msg service.PushMessage) {
+	if h.push == nil {
+		return
+	}
+	online := len(h.Online([]string{userID})) > 0
+	if err := h.push.Enqueue(userID, msg, online); err != nil {
+		log.Printf("enqueue push for %s: %v", userID, err)
+	}
+}
+
+// PrivateMessageEvent builds the "private" event payload for pm.
+func PrivateMessageEvent(pm *entity.PrivateMessage) map[string]interface{} {
+	evt := map[string]interface{}{
+		"type": "private",
+		"id":   pm.ID,
+		"from": pm.SenderID,
+		"to":   pm.RecipientID,
+		"body": pm.Body,
+		"ts":   pm.CreatedAt.Unix(),
+		"read": pm.ReadAt != nil,
+	}
+	if pm.ExpiresAt != nil {
+		evt["expiresAt"] = pm.ExpiresAt.Unix()
+	}
+	if pm.Encrypted {
+		evt["encrypted"] = true
+		evt["envelope"] = pm.Envelope
+	}
+	if pm.Forwarded {
+		evt["forwarded"] = true
+		if pm.ForwardedFrom != nil {
+			evt["forwardedFrom"] = pm.ForwardedFrom
+		}
+	}
+	return evt
+}
+
+// DeliverPrivateMessage sends a stored DM to the recipient and echoes it to all of
+// the sender's connections. First contact from a stranger reaches the recipient
+// as a "message_request" event instead, or not at all once the request was ignored.
+func (h *Hub) DeliverPrivateMessage(pm *entity.PrivateMessage) {
+	evt := PrivateMessageEvent(pm)
+	evtBytes, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	recipientBytes := evtBytes
+	if pm.ForwardedFrom != nil && !h.forwardSourceVisible(pm.ForwardedFrom, []string{pm.RecipientID}) {
+		delete(evt, "forwardedFrom")
+		if b, err := json.Marshal(evt); err == nil {
+			recipientBytes = b
+		}
+	}
+	if !pm.Pending {
+		h.SendToUser(pm.RecipientID, recipientBytes)
+		// encrypted messages have no body to preview; the client fetches and
+		// decrypts them itself
+		h.enqueuePush(pm.RecipientID, service.PushMessage{
+			Kind:         service.PushKindPrivate,
+			RefID:        pm.ID,
+			Conversation: "private:" + pm.SenderID,
+			Title:        "New message",
+			Body:         service.Snippet(pm.Body),
+			Data:         map[string]interface{}{"from": pm.SenderID, "id": pm.ID, "encrypted": pm.Encrypted},
+		})
+	} else if !h.requestIgnored(pm) {
+		delete(evt, "forwardedFrom")
+		evt["type"] = "message_request"
+		if b, err := json.Marshal(evt); err == nil {
+			h.SendToUser(pm.RecipientID, b)
+		}
+	}
+	h.SendToUser(pm.SenderID, evtBytes)
+}
+
+// requestIgnored reports whether the recipient ignored the message request a
+// pending DM belongs to.
+func (h *Hub) requestIgnored(pm *entity.PrivateMessage) bool {
+	if h.requests == nil {
+		return false
+	}
+	ignored, err := h.requests.Ignored(pm.RecipientID, pm.SenderID)
+	if err != nil {
+		log.Printf("message request status for %d: %v", pm.ID, err)
+	}
+	return ignored
+}
+
+// GroupDMMessageEvent builds the "group_dm" event payload for msg.
+func GroupDMMessageEvent(msg *entity.GroupDMMessage) map[string]interface{} {
+	evt := map[string]interface{}{
+		"type":      "group_dm",
+		"id":        msg.ID,
+		"groupDmId": msg.GroupDMID,
+		"from":      msg.SenderID,
+		"body":      msg.Body,
+		"ts":        msg.CreatedAt.Unix(),
+	}
+	if msg.ExpiresAt != nil {
+		evt["expiresAt"] = msg.ExpiresAt.Unix()
+	}
+	return evt
+}
+
+// DeliverGroupDMMessage sends a stored group DM message to every participant's
+// connections, the sender's included, and queues a push for the others.
+// Group DMs are not published to redis like groups.
+func (h *Hub) DeliverGroupDMMessage(msg *entity.GroupDMMessage, participants []string) {
+	evtBytes, err := json.Marshal(GroupDMMessageEvent(msg))
+	if err != nil {
+		return
+	}
+	for _, userID := range participants {
+		h.SendToUser(userID, evtBytes)
+		if userID == msg.SenderID {
+			continue
+		}
+		h.enqueuePush(userID, service.PushMessage{
+			Kind:         service.PushKindGroupDM,
+			RefID:        msg.ID,
+			Conversation: "group_dm:" + strconv.FormatUint(uint64(msg.GroupDMID), 10),
+			Title:        "New message",
+			Body:         service.Snippet(msg.Body),
+			Data:         map[string]interface{}{"from": msg.SenderID, "groupDmId": msg.GroupDMID, "id": msg.ID},
+		})
+	}
+}
+
+// GroupMessageEvent builds the "group" event payload for gm.
+func GroupMessageEvent(gm *entity.GroupMessage, senderEmail string) map[string]interface{} {
+	evt := map[string]interface{}{
+		"type":      "group",
+		"id":        gm.ID,
+		"groupId":   gm.GroupID,
+		"from":      gm.SenderID,
+		"fromEmail": senderEmail,
+		"body":      gm.Body,
+		"ts":        gm.CreatedAt.Unix(),
+	}
+	if gm.ChannelID != 0 {
+		evt["channelId"] = gm.ChannelID
+	}
+	if gm.ReplyToID != 0 {
+		evt["replyTo"] = gm.ReplyToID
+	}
+	if len(gm.Mentions) > 0 {
+		evt["mentions"] = gm.Mentions
+	}
+	if gm.ExpiresAt != nil {
+		evt["expiresAt"] = gm.ExpiresAt.Unix()
+	}
+	if gm.Forwarded {
+		evt["forwarded"] = true
+		if gm.ForwardedFrom != nil {
+			evt["forwardedFrom"] = gm.ForwardedFrom
+		}
+	}
+	return evt
+}
+
+// DeliverGroupMessage records mentions and reply notifications for a stored
+// group message, then publishes it to its channel's topic in redis so all
+// instances/hubs fan it out to the channel's readers.
+func (h *Hub) DeliverGroupMessage(ctx context.Context, gm *entity.GroupMessage, senderEmail string) error {
+	if h.notifications != nil {
+		notes, err := h.notifications.NotifyGroupMessage(gm, h.Online)
+		if err != nil {
+			log.Printf("notify group message %d: %v", gm.ID, err)
+		}
+		h.PushNotifications(notes)
+	}
+	evt := GroupMessageEvent(gm, senderEmail)
+	// the event is shared by all readers, so it only names the source when
+	// every one of them can access it; the history shows it per member
+	if gm.ForwardedFrom != nil && h.groupSvc != nil {
+		members, err := h.groupSvc.ChannelMembers(gm.GroupID, gm.ChannelID)
+		if err != nil || !h.forwardSourceVisible(gm.ForwardedFrom, members) {
+			delete(evt, "forwardedFrom")
+		}
+	}
+	evtBytes, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	return h.PublishGroup(ctx, GroupTopic(gm.GroupID, gm.ChannelID), string(evtBytes))
+}
+
+// PushNotifications sends each notification to its user as a "notification"
+// event; mentions are also queued for Web Push.
+func (h *Hub) PushNotifications(notes []entity.Notification) {
+	for i := range notes {
+		n := &notes[i]
+		evt := map[string]interface{}{"type": "notification", "notification": n}
+		if b, err := json.Marshal(evt); err == nil {
+			h.SendToUser(n.UserID, b)
+		}
+		if n.Kind == entity.NotifyMention {
+			h.enqueuePush(n.UserID, service.PushMessage{
+				Kind:         service.PushKindNotification,
+				RefID:        n.ID,
+				Conversation: "group:" + strconv.FormatUint(uint64(n.GroupID), 10),
+				Title:        "You were mentioned",
+				Body:         n.Snippet,
+				Data:         map[string]interface{}{"groupId": n.GroupID, "channelId": n.ChannelID, "messageId": n.MessageID},
+			})
+		}
+	}
+}
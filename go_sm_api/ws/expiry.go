@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/abeme/go_sm_api/service"
+)
+
+// ExpirySweeper deletes disappearing messages once they expire and tells the
+// clients holding copies with a "message_expired" event.
+type ExpirySweeper struct {
+	svc      service.MessageTTLService
+	gdmSvc   service.GroupDMService
+	hub      *Hub
+	interval time.Duration
+}
+
+func NewExpirySweeper(svc service.MessageTTLService, gdmSvc service.GroupDMService, hub *Hub, interval time.Duration) *ExpirySweeper {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return &ExpirySweeper{svc: svc, gdmSvc: gdmSvc, hub: hub, interval: interval}
+}
+
+func (s *ExpirySweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Sweep(ctx); err != nil {
+			log.Printf("expiry sweep: %v", err)
+		}
+	}
+}
+
+// Sweep deletes everything that has expired, in batches.
+func (s *ExpirySweeper) Sweep(ctx context.Context) error {
+	const batch = 500
+	for {
+		pms, gms, dms, err := s.svc.DeleteExpired(batch)
+		if err != nil {
+			return err
+		}
+		// one event per conversation, listing its expired message IDs
+		private := map[[2]string][]uint{}
+		for _, pm := range pms {
+			key := [2]string{pm.SenderID, pm.RecipientID}
+			if key[0] > key[1] {
+				key[0], key[1] = key[1], key[0]
+			}
+			private[key] = append(private[key], pm.ID)
+		}
+		for users, ids := range private {
+			evt := map[string]interface{}{"type": "message_expired", "kind": "private", "ids": ids}
+			if b, err := json.Marshal(evt); err == nil {
+				s.hub.SendToUser(users[0], b)
+				s.hub.SendToUser(users[1], b)
+			}
+		}
+		group := map[[2]uint][]uint{}
+		for _, gm := range gms {
+			key := [2]uint{gm.GroupID, gm.ChannelID}
+			group[key] = append(group[key], gm.ID)
+		}
+		for key, ids := range group {
+			evt := map[string]interface{}{"type": "message_expired", "kind": "group", "groupId": key[0], "ids": ids}
+			if key[1] != 0 {
+				evt["channelId"] = key[1]
+			}
+			if b, err := json.Marshal(evt); err == nil {
+				if err := s.hub.PublishGroup(ctx, GroupTopic(key[0], key[1]), string(b)); err != nil {
+					log.Printf("publish message_expired: %v", err)
+				}
+			}
+		}
+		groupDM := map[uint][]uint{}
+		for _, dm := range dms {
+			groupDM[dm.GroupDMID] = append(groupDM[dm.GroupDMID], dm.ID)
+		}
+		for id, ids := range groupDM {
+			participants, err := s.gdmSvc.Participants(id)
+			if err != nil {
+				log.Printf("message_expired participants of group DM %d: %v", id, err)
+				continue
+			}
+			evt := map[string]interface{}{"type": "message_expired", "kind": "group_dm", "groupDmId": id, "ids": ids}
+			if b, err := json.Marshal(evt); err == nil {
+				for _, userID := range participants {
+					s.hub.SendToUser(userID, b)
+				}
+			}
+		}
+		if len(pms) < batch && len(gms) < batch && len(dms) < batch {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+)
+
+// maxForward caps the messages forwarded at once.
+const maxForward = 20
+
+// Forward copies the messages in refs into the DM or group dest names,
+// attributed to their original sender and conversation. The sender must
+// still see every source, so group sources are checked with IsChannelMember
+// just like the destination. All sources are checked before anything is sent; if
+// a copy then fails, the copies already stored are returned with the error
+// and should still be delivered.
+func (s *Sender) Forward(dest Outgoing, refs []entity.ForwardRef) ([]*Sent, error) {
+	if len(refs) == 0 {
+		return nil, ErrMissingFields
+	}
+	if len(refs) > maxForward {
+		return nil, ErrTooManyMessages
+	}
+	msgs := make([]Outgoing, 0, len(refs))
+	for _, ref := range refs {
+		body, src, err := s.forwardSource(dest.SenderID, ref)
+		if err != nil {
+			return nil, err
+		}
+		msg := dest
+		msg.Body, msg.ReplyTo, msg.Envelope, msg.Forward = body, 0, nil, src
+		msgs = append(msgs, msg)
+	}
+	var sents []*Sent
+	for _, msg := range msgs {
+		sent, err := s.Send(msg)
+		if err != nil {
+			return sents, err
+		}
+		sents = append(sents, sent)
+	}
+	return sents, nil
+}
+
+// forwardSource loads a message userID can see and returns its body and
+// attribution.
+func (s *Sender) forwardSource(userID string, ref entity.ForwardRef) (string, *entity.ForwardSource, error) {
+	switch ref.Kind {
+	case "private":
+		pm, err := s.pmSvc.Get(ref.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		// pending requests are not visible to the recipient as conversation messages yet
+		if pm.SenderID != userID && (pm.RecipientID != userID || pm.Pending) {
+			return "", nil, service.ErrMessageNotFound
+		}
+		if pm.Encrypted {
+			return "", nil, service.ErrCannotForward
+		}
+		return pm.Body, service.PrivateForwardSource(pm), nil
+	case "group":
+		gm, err := s.gmSvc.Get(ref.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		ok, err := s.groupSvc.IsChannelMember(gm.GroupID, gm.ChannelID, userID)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			return "", nil, service.ErrMessageNotFound
+		}
+		return gm.Body, service.GroupForwardSource(gm), nil
+	}
+	return "", nil, service.ErrMessageNotFound
+}
+
+// forwardSourceVisible reports whether every one of userIDs can access the
+// conversation src came from.
+func (h *Hub) forwardSourceVisible(src *entity.ForwardSource, userIDs []string) bool {
+	if src.Kind == "private" {
+		for _, id := range userIDs {
+			if id != src.UserA && id != src.UserB {
+				return false
+			}
+		}
+		return true
+	}
+	if h.groupSvc == nil {
+		return false
+	}
+	members, err := h.groupSvc.ChannelMembers(src.GroupID, src.ChannelID)
+	if err != nil {
+		return false
+	}
+	memberSet := make(map[string]bool, len(members))
+	for _, id := range members {
+		memberSet[id] = true
+	}
+	for _, id := range userIDs {
+		if !memberSet[id] {
+			return false
+		}
+	}
+	return true
+}
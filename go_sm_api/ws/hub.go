@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/abeme/go_sm_api/service"
 	"github.com/redis/go-redis/v9"
@@ -12,40 +13,73 @@ import (
 
 // Hub holds connections and subscribes to Redis channels for cross-instance delivery
 type Hub struct {
-	rdb      *redis.Client
-	groupSvc *service.GroupService
+	rdb           *redis.Client
+	groupSvc      *service.GroupService
+	notifications service.NotificationService
+	push          service.PushService
+	webhooks      service.WebhookService
+	requests      service.MessageRequestService
 	// maps
 	clients    map[string]map[*Client]bool // userID -> set of clients
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan *Message
+	kick       chan string
+	events     chan service.HubEvent
+	statsReq   chan chan HubStats
+	onlineReq  chan onlineQuery
+}
+
+// onlineQuery asks the run loop which of userIDs have a connection here.
+type onlineQuery struct {
+	userIDs []string
+	reply   chan []string
+}
+
+// HubStats describes the connections held by this instance.
+type HubStats struct {
+	Users       int `json:"users"`
+	Connections int `json:"connections"`
 }
 
 type Message struct {
 	TargetUser string // if set, private
-	Group      string // channel name like group:<id>
+	Group      string // channel name like group:<id> or group:<id>:channel:<id>
 	Payload    []byte
 }
 
-func NewHub(rdb *redis.Client, groupSvc *service.GroupService) *Hub {
+func NewHub(rdb *redis.Client, groupSvc *service.GroupService, notifications service.NotificationService, push service.PushService, webhooks service.WebhookService, requests service.MessageRequestService) *Hub {
 	h := &Hub{
-		rdb:        rdb,
-		groupSvc:   groupSvc,
-		clients:    make(map[string]map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan *Message, 256),
+		rdb:           rdb,
+		groupSvc:      groupSvc,
+		notifications: notifications,
+		push:          push,
+		webhooks:      webhooks,
+		requests:      requests,
+		clients:       make(map[string]map[*Client]bool),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		broadcast:     make(chan *Message, 256),
+		kick:          make(chan string, 16),
+		events:        make(chan service.HubEvent, 1024),
+		statsReq:      make(chan chan HubStats),
+		onlineReq:     make(chan onlineQuery),
 	}
 	go h.run()
+	go h.runEvents()
 	return h
 }
 
 func (h *Hub) run() {
 	// subscribe to Redis pubsub for group and private channels pattern
-	pubsub := h.rdb.PSubscribe(context.Background(), "group:*", "private:*")
+	pubsub := h.rdb.PSubscribe(context.Background(), "group:*", "private:*", "kick:*")
 	ch := pubsub.Channel()
 	go func() {
 		for msg := range ch {
+			if strings.HasPrefix(msg.Channel, "kick:") {
+				h.kick <- strings.TrimPrefix(msg.Channel, "kick:")
+				continue
+			}
 			// incoming pubsub message -> broadcast to local clients
 			// topic is msg.Channel, payload is msg.Payload
 			m := &Message{Group: msg.Channel, Payload: []byte(msg.Payload)}
@@ -71,48 +105,47 @@ func (h *Hub) run() {
 					delete(h.clients, c.userID)
 				}
 			}
+		case reply := <-h.statsReq:
+			st := HubStats{Users: len(h.clients)}
+			for _, conns := range h.clients {
+				st.Connections += len(conns)
+			}
+			reply <- st
+		case q := <-h.onlineReq:
+			var online []string
+			for _, id := range q.userIDs {
+				if len(h.clients[id]) > 0 {
+					online = append(online, id)
+				}
+			}
+			q.reply <- online
+		case userID := <-h.kick:
+			for c := range h.clients[userID] {
+				h.drop(c)
+			}
 		case m := <-h.broadcast:
 			if m.TargetUser != "" {
 				// send to specific user
 				if conns, ok := h.clients[m.TargetUser]; ok {
 					for c := range conns {
-						select {
-						case c.send <- m.Payload:
-						default:
-							close(c.send)
-							delete(conns, c)
-						}
+						h.deliver(c, m.Payload)
 					}
 				}
 			} else if m.Group != "" {
-				// m.Group is channel name like "group:123"
-				// extract ID
-				var groupID uint64
-				if parts := m.Group; parts != "" {
-					// parts expected "group:<id>"
-					if idx := len("group:"); len(parts) > idx {
-						if id, err := strconv.ParseUint(parts[idx:], 10, 64); err == nil {
-							groupID = id
-						}
-					}
-				}
-				if groupID == 0 {
+				// m.Group is channel name like "group:123" or "group:123:channel:7"
+				groupID, channelID, ok := parseGroupTopic(m.Group)
+				if !ok {
 					// fallback: broadcast to all
 					for _, conns := range h.clients {
 						for c := range conns {
-							select {
-							case c.send <- m.Payload:
-							default:
-								close(c.send)
-								delete(conns, c)
-							}
+							h.deliver(c, m.Payload)
 						}
 					}
 					continue
 				}
-				// lookup members and send only to them
+				// lookup the channel's readers and send only to them
 				if h.groupSvc != nil {
-					if members, err := h.groupSvc.GetMembers(uint(groupID)); err == nil {
+					if members, err := h.groupSvc.ChannelMembers(groupID, channelID); err == nil {
 						// create a set for fast lookup
 						memberSet := make(map[string]bool, len(members))
 						for _, id := range members {
@@ -123,12 +156,7 @@ func (h *Hub) run() {
 								continue
 							}
 							for c := range conns {
-								select {
-								case c.send <- m.Payload:
-								default:
-									close(c.send)
-									delete(conns, c)
-								}
+								h.deliver(c, m.Payload)
 							}
 						}
 					}
@@ -138,6 +166,26 @@ func (h *Hub) run() {
 	}
 }
 
+// deliver queues payload for c, dropping connections that fall too far behind.
+// It runs on the run loop only.
+func (h *Hub) deliver(c *Client, payload []byte) {
+	if c.dropped {
+		return
+	}
+	select {
+	case c.send <- payload:
+	default:
+		h.drop(c)
+	}
+}
+
+// drop closes the socket of c. readPump then fails and unregisters c, which
+// is the only place send gets closed: readPump may still be writing to it.
+func (h *Hub) drop(c *Client) {
+	c.dropped = true
+	_ = c.conn.Close()
+}
+
 func (h *Hub) RegisterClient(c *Client) {
 	h.register <- c
 }
@@ -147,16 +195,99 @@ func (h *Hub) UnregisterClient(c *Client) {
 }
 
 func (h *Hub) PublishGroup(ctx context.Context, channel string, payload string) error {
+	if groupID, channelID, ok := parseGroupTopic(channel); ok {
+		h.publishEvent(service.HubEvent{GroupID: groupID, ChannelID: channelID, Payload: []byte(payload)})
+	}
 	return h.rdb.Publish(ctx, channel, payload).Err()
 }
 
+// GroupTopic names the pub/sub channel of a group channel. The default
+// channel (0) keeps the plain "group:<id>" name.
+func GroupTopic(groupID, channelID uint) string {
+	if channelID == 0 {
+		return fmt.Sprintf("group:%d", groupID)
+	}
+	return fmt.Sprintf("group:%d:channel:%d", groupID, channelID)
+}
+
+// parseGroupTopic returns the group and channel a GroupTopic name refers to.
+func parseGroupTopic(topic string) (groupID, channelID uint, ok bool) {
+	rest, found := strings.CutPrefix(topic, "group:")
+	if !found {
+		return 0, 0, false
+	}
+	group, channel, hasChannel := strings.Cut(rest, ":channel:")
+	gid, err := strconv.ParseUint(group, 10, 64)
+	if err != nil || gid == 0 {
+		return 0, 0, false
+	}
+	if !hasChannel {
+		return uint(gid), 0, true
+	}
+	cid, err := strconv.ParseUint(channel, 10, 64)
+	if err != nil || cid == 0 {
+		return 0, 0, false
+	}
+	return uint(gid), uint(cid), true
+}
+
+// publishEvent hands an event to the outgoing webhooks. It runs on the
+// publishing instance only, so each event is queued once cluster-wide. Events
+// are queued for runEvents so senders never wait on the database; when the
+// queue is full they are dropped.
+func (h *Hub) publishEvent(evt service.HubEvent) {
+	if h.webhooks == nil {
+		return
+	}
+	select {
+	case h.events <- evt:
+	default:
+		log.Printf("webhook event queue full, dropping event")
+	}
+}
+
+// runEvents passes queued events to the webhooks one at a time, in order.
+func (h *Hub) runEvents() {
+	for evt := range h.events {
+		h.webhooks.Publish(evt)
+	}
+}
+
+// Stats returns the number of users and connections on this instance.
+func (h *Hub) Stats() HubStats {
+	reply := make(chan HubStats, 1)
+	h.statsReq <- reply
+	return <-reply
+}
+
+// Online returns those of userIDs connected to this instance.
+func (h *Hub) Online(userIDs []string) []string {
+	reply := make(chan []string, 1)
+	h.onlineReq <- onlineQuery{userIDs: userIDs, reply: reply}
+	return <-reply
+}
+
+// DisconnectUser closes every connection of a user on all instances,
+// e.g. after a suspension.
+func (h *Hub) DisconnectUser(userID string) {
+	if err := h.rdb.Publish(context.Background(), "kick:"+userID, "").Err(); err != nil {
+		h.kick <- userID
+	}
+}
+
 // SendToUser enqueues a payload for delivery to all active connections of a user.
 func (h *Hub) SendToUser(userID string, payload []byte) {
+	h.publishEvent(service.HubEvent{UserID: userID, Payload: payload})
 	h.broadcast <- &Message{TargetUser: userID, Payload: payload}
 }
 
 // SendToGroup enqueues a payload locally for a group; it will be processed like a pubsub message.
 func (h *Hub) SendToGroup(groupID uint, payload []byte) {
-	ch := fmt.Sprintf("group:%d", groupID)
-	h.broadcast <- &Message{Group: ch, Payload: payload}
+	h.SendToChannel(groupID, 0, payload)
+}
+
+// SendToChannel enqueues a payload locally for the readers of a group channel.
+func (h *Hub) SendToChannel(groupID, channelID uint, payload []byte) {
+	h.publishEvent(service.HubEvent{GroupID: groupID, ChannelID: channelID, Payload: payload})
+	h.broadcast <- &Message{Group: GroupTopic(groupID, channelID), Payload: payload}
 }
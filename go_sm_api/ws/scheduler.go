@@ -0,0 +1,115 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+)
+
+// Scheduler sends scheduled messages when they fall due. Every instance may
+// run one: rows are leased through ScheduledMessageService.ClaimDue, and
+// pending messages live in the database so they survive restarts.
+type Scheduler struct {
+	svc          service.ScheduledMessageService
+	sender       *Sender
+	hub          *Hub
+	pollInterval time.Duration
+}
+
+func NewScheduler(svc service.ScheduledMessageService, sender *Sender, hub *Hub, pollInterval time.Duration) *Scheduler {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	return &Scheduler{svc: svc, sender: sender, hub: hub, pollInterval: pollInterval}
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.SendDue(ctx); err != nil {
+			log.Printf("scheduled messages: %v", err)
+		}
+	}
+}
+
+// SendDue sends every message whose time has come.
+func (s *Scheduler) SendDue(ctx context.Context) error {
+	for {
+		due, err := s.svc.ClaimDue(100)
+		if err != nil {
+			return err
+		}
+		for i := range due {
+			s.send(ctx, &due[i])
+		}
+		if len(due) < 100 {
+			return nil
+		}
+	}
+}
+
+// send goes through the same checks as a live message, so membership,
+// blocks and moderation apply as of the send time.
+func (s *Scheduler) send(ctx context.Context, m *entity.ScheduledMessage) {
+	msg := Outgoing{Kind: m.Kind, SenderID: m.SenderID, To: m.RecipientID, GroupID: m.GroupID, ChannelID: m.ChannelID, Body: m.Body, ReplyTo: m.ReplyToID}
+	sent, err := s.sender.Send(msg)
+	if err != nil {
+		final, markErr := s.svc.MarkFailed(m, err, IsTransientSendError(err))
+		if markErr != nil {
+			log.Printf("scheduled message %d: %v", m.ID, markErr)
+		}
+		if final {
+			s.notify(m.SenderID, map[string]interface{}{"type": "scheduled_failed", "id": m.ID, "error": err.Error()})
+		}
+		return
+	}
+	var messageID uint
+	switch {
+	case sent.Private != nil:
+		messageID = sent.Private.ID
+	case sent.Group != nil:
+		messageID = sent.Group.ID
+	}
+	if err := s.svc.MarkSent(m.ID, messageID); err != nil {
+		log.Printf("scheduled message %d: %v", m.ID, err)
+	}
+	if err := s.sender.Deliver(ctx, sent); err != nil {
+		log.Printf("scheduled message %d delivery: %v", m.ID, err)
+	}
+	s.notify(m.SenderID, map[string]interface{}{"type": "scheduled_sent", "id": m.ID, "kind": m.Kind, "messageId": messageID})
+}
+
+func (s *Scheduler) notify(userID string, evt map[string]interface{}) {
+	if b, err := json.Marshal(evt); err == nil {
+		s.hub.SendToUser(userID, b)
+	}
+}
+
+// IsTransientSendError tells storage failures, worth a retry, from the
+// sender no longer being allowed to send the message.
+func IsTransientSendError(err error) bool {
+	var rejected *RejectedError
+	switch {
+	case errors.As(err, &rejected),
+		errors.Is(err, ErrMissingFields),
+		errors.Is(err, ErrNotMember),
+		errors.Is(err, service.ErrBlocked),
+		errors.Is(err, service.ErrInvalidReply),
+		errors.Is(err, service.ErrMemberMuted),
+		errors.Is(err, service.ErrChannelReadOnly),
+		errors.Is(err, service.ErrE2ERequired):
+		return false
+	}
+	return true
+}
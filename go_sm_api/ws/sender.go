@@ -0,0 +1,319 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/abeme/go_sm_api/entity"
+	"github.com/abeme/go_sm_api/service"
+)
+
+// Errors returned by Sender.Send; their text is the WebSocket error code.
+var (
+	ErrMissingFields   = errors.New("missing_fields")
+	ErrNotMember       = errors.New("not_a_member")
+	ErrTooManyMessages = errors.New("too_many_messages")
+)
+
+// RejectedError is returned when moderation rejects a message.
+type RejectedError struct {
+	Reasons []string
+}
+
+func (e *RejectedError) Error() string { return "message_rejected" }
+
+// Outgoing is a message a user or bot wants to send. Kind is "private" (To is
+// the recipient), "group" (ChannelID 0 is the default channel) or "group_dm".
+// End-to-end encrypted DMs set Envelope instead of Body; forwarded copies set
+// Forward. Approved marks a held message a moderator approved: it skips
+// moderation but not the access checks, which run again as of approval.
+type Outgoing struct {
+	Kind      string
+	SenderID  string
+	To        string
+	GroupID   uint
+	ChannelID uint
+	GroupDMID uint
+	Body      string
+	ReplyTo   uint
+	Envelope  *entity.EncryptedEnvelope
+	Forward   *entity.ForwardSource
+	Approved  bool
+}
+
+// Sent is a message that passed the checks. Held messages were shadow-held by
+// moderation: nothing is stored or delivered, but the sender is acked as if
+// it had been sent so the hold is not revealed.
+type Sent struct {
+	Kind     string
+	Private  *entity.PrivateMessage
+	Group    *entity.GroupMessage
+	GroupDM  *entity.GroupDMMessage
+	Held     bool
+	HeldBody string
+}
+
+// Sender is the one path messages take into the system: membership checks,
+// moderation, persistence and delivery. WebSocket clients and the REST and
+// bot endpoints share it.
+type Sender struct {
+	hub       *Hub
+	pmSvc     service.PrivateMessageService
+	groupSvc  *service.GroupService
+	gmSvc     service.GroupMessageService
+	gdmSvc    service.GroupDMService
+	userSvc   service.UserService
+	moderator *service.Moderator
+}
+
+func NewSender(hub *Hub, pmSvc service.PrivateMessageService, groupSvc *service.GroupService, gmSvc service.GroupMessageService, gdmSvc service.GroupDMService, userSvc service.UserService, moderator *service.Moderator) *Sender {
+	return &Sender{hub: hub, pmSvc: pmSvc, groupSvc: groupSvc, gmSvc: gmSvc, gdmSvc: gdmSvc, userSvc: userSvc, moderator: moderator}
+}
+
+// Send checks and stores msg. Call Deliver afterwards to fan it out; callers
+// ack the sender in between so the ack arrives before the echo.
+func (s *Sender) Send(msg Outgoing) (*Sent, error) {
+	switch msg.Kind {
+	case "private":
+		if msg.Envelope != nil {
+			if msg.To == "" {
+				return nil, ErrMissingFields
+			}
+			if msg.Body != "" {
+				return nil, service.ErrInvalidEnvelope
+			}
+			// moderation needs the plaintext, which the server never has
+			pm, err := s.pmSvc.SendEncrypted(msg.SenderID, msg.To, msg.Envelope)
+			if err != nil {
+				return nil, err
+			}
+			return &Sent{Kind: msg.Kind, Private: pm}, nil
+		}
+		if msg.To == "" || msg.Body == "" {
+			return nil, ErrMissingFields
+		}
+		body, held, err := s.moderate(msg, service.ModerationMessage{Kind: "private", SenderID: msg.SenderID, RecipientID: msg.To, Body: msg.Body, Forward: msg.Forward})
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			return &Sent{Kind: msg.Kind, Held: true, HeldBody: body}, nil
+		}
+		var pm *entity.PrivateMessage
+		if msg.Forward != nil {
+			pm, err = s.pmSvc.Forward(msg.SenderID, msg.To, body, msg.Forward)
+		} else {
+			pm, err = s.pmSvc.Send(msg.SenderID, msg.To, body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Sent{Kind: msg.Kind, Private: pm}, nil
+	case "group":
+		if msg.Envelope != nil {
+			return nil, service.ErrInvalidEnvelope
+		}
+		if msg.GroupID == 0 || msg.Body == "" {
+			return nil, ErrMissingFields
+		}
+		ok, err := s.groupSvc.IsChannelMember(msg.GroupID, msg.ChannelID, msg.SenderID)
+		if err != nil || !ok {
+			return nil, ErrNotMember
+		}
+		if until, err := s.groupSvc.MutedUntil(msg.GroupID, msg.SenderID); err != nil {
+			return nil, err
+		} else if until != nil {
+			return nil, service.ErrMemberMuted
+		}
+		if err := s.checkPostPolicy(msg); err != nil {
+			return nil, err
+		}
+		body, held, err := s.moderate(msg, service.ModerationMessage{Kind: "group", SenderID: msg.SenderID, GroupID: msg.GroupID, ChannelID: msg.ChannelID, Body: msg.Body,
+			ReplyToID: msg.ReplyTo, Forward: msg.Forward})
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			return &Sent{Kind: msg.Kind, Held: true, HeldBody: body}, nil
+		}
+		var gm *entity.GroupMessage
+		switch {
+		case msg.Forward != nil:
+			gm, err = s.gmSvc.Forward(msg.GroupID, msg.ChannelID, msg.SenderID, body, msg.Forward)
+		case msg.ReplyTo != 0:
+			gm, err = s.gmSvc.SendReply(msg.GroupID, msg.ChannelID, msg.SenderID, body, msg.ReplyTo)
+		default:
+			gm, err = s.gmSvc.Send(msg.GroupID, msg.ChannelID, msg.SenderID, body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Sent{Kind: msg.Kind, Group: gm}, nil
+	case "group_dm":
+		if msg.Envelope != nil {
+			return nil, service.ErrInvalidEnvelope
+		}
+		if msg.GroupDMID == 0 || msg.Body == "" {
+			return nil, ErrMissingFields
+		}
+		ok, err := s.gdmSvc.IsParticipant(msg.GroupDMID, msg.SenderID)
+		if err != nil || !ok {
+			return nil, ErrNotMember
+		}
+		body, held, err := s.moderate(msg, service.ModerationMessage{Kind: "group_dm", SenderID: msg.SenderID, GroupDMID: msg.GroupDMID, Body: msg.Body})
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			return &Sent{Kind: msg.Kind, Held: true, HeldBody: body}, nil
+		}
+		dm, err := s.gdmSvc.Send(msg.GroupDMID, msg.SenderID, body)
+		if err != nil {
+			return nil, err
+		}
+		return &Sent{Kind: msg.Kind, GroupDM: dm}, nil
+	}
+	return nil, ErrMissingFields
+}
+
+// checkPostPolicy fails with ErrChannelReadOnly when only the group owner may
+// post in the channel and msg is from someone else.
+func (s *Sender) checkPostPolicy(msg Outgoing) error {
+	if msg.ChannelID == 0 {
+		return nil
+	}
+	ch, err := s.groupSvc.GetChannel(msg.GroupID, msg.ChannelID)
+	if err != nil {
+		return err
+	}
+	if ch.PostPolicy != entity.ChannelPostOwner {
+		return nil
+	}
+	grp, err := s.groupSvc.GetGroup(msg.GroupID)
+	if err != nil {
+		return err
+	}
+	if grp.OwnerID != msg.SenderID {
+		return service.ErrChannelReadOnly
+	}
+	return nil
+}
+
+// moderate runs the moderation chain on msg, the moderation view of out, and
+// returns the body to store, or the held body when the message was
+// shadow-held. Approved messages pass unchanged.
+func (s *Sender) moderate(out Outgoing, msg service.ModerationMessage) (string, bool, error) {
+	if s.moderator == nil || out.Approved {
+		return msg.Body, false, nil
+	}
+	res, err := s.moderator.Moderate(msg)
+	if err != nil {
+		return "", false, err
+	}
+	switch res.Action {
+	case entity.ModerationReject:
+		return "", false, &RejectedError{Reasons: res.Reasons}
+	case entity.ModerationHold:
+		msg.Body = res.Body
+		if _, err := s.moderator.Hold(msg, res.Reasons); err != nil {
+			return "", false, err
+		}
+		return res.Body, true, nil
+	}
+	return res.Body, false, nil
+}
+
+// Deliver fans a stored message out to its recipients.
+func (s *Sender) Deliver(ctx context.Context, sent *Sent) error {
+	switch {
+	case sent.Held:
+		return nil
+	case sent.Private != nil:
+		s.hub.DeliverPrivateMessage(sent.Private)
+	case sent.Group != nil:
+		var senderEmail string
+		if u, err := s.userSvc.GetByID(sent.Group.SenderID); err == nil {
+			senderEmail = u.Email
+		}
+		// publish to redis so all instances/hubs process and filter to members
+		return s.hub.DeliverGroupMessage(ctx, sent.Group, senderEmail)
+	case sent.GroupDM != nil:
+		participants, err := s.gdmSvc.Participants(sent.GroupDM.GroupDMID)
+		if err != nil {
+			return err
+		}
+		s.hub.DeliverGroupDMMessage(sent.GroupDM, participants)
+	}
+	return nil
+}
+
+// Ack builds the "<kind>_ack" event confirming a send to its sender.
+func (sent *Sent) Ack(msg Outgoing, tempID string) map[string]interface{} {
+	ack := map[string]interface{}{"type": msg.Kind + "_ack", "tempId": tempID}
+	switch {
+	case sent.Held:
+		ack["id"] = 0
+		ack["from"] = msg.SenderID
+		ack["body"] = sent.HeldBody
+		ack["ts"] = time.Now().Unix()
+		switch msg.Kind {
+		case "group":
+			ack["groupId"] = msg.GroupID
+			if msg.ChannelID != 0 {
+				ack["channelId"] = msg.ChannelID
+			}
+		case "group_dm":
+			ack["groupDmId"] = msg.GroupDMID
+		default:
+			ack["to"] = msg.To
+		}
+	case sent.Private != nil:
+		pm := sent.Private
+		ack["id"] = pm.ID
+		ack["from"] = pm.SenderID
+		ack["to"] = pm.RecipientID
+		ack["body"] = pm.Body
+		ack["ts"] = pm.CreatedAt.Unix()
+		ack["pending"] = pm.Pending
+		if pm.Encrypted {
+			ack["encrypted"] = true
+		}
+		if pm.Forwarded {
+			ack["forwarded"] = true
+		}
+		if pm.ExpiresAt != nil {
+			ack["expiresAt"] = pm.ExpiresAt.Unix()
+		}
+	case sent.Group != nil:
+		gm := sent.Group
+		ack["id"] = gm.ID
+		ack["groupId"] = gm.GroupID
+		if gm.ChannelID != 0 {
+			ack["channelId"] = gm.ChannelID
+		}
+		ack["from"] = gm.SenderID
+		ack["body"] = gm.Body
+		ack["ts"] = gm.CreatedAt.Unix()
+		if gm.ReplyToID != 0 {
+			ack["replyTo"] = gm.ReplyToID
+		}
+		if gm.ExpiresAt != nil {
+			ack["expiresAt"] = gm.ExpiresAt.Unix()
+		}
+		if gm.Forwarded {
+			ack["forwarded"] = true
+		}
+	case sent.GroupDM != nil:
+		dm := sent.GroupDM
+		ack["id"] = dm.ID
+		ack["groupDmId"] = dm.GroupDMID
+		ack["from"] = dm.SenderID
+		ack["body"] = dm.Body
+		ack["ts"] = dm.CreatedAt.Unix()
+		if dm.ExpiresAt != nil {
+			ack["expiresAt"] = dm.ExpiresAt.Unix()
+		}
+	}
+	return ack
+}
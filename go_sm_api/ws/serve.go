@@ -5,7 +5,9 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/abeme/go_sm_api/entity"
 	"github.com/abeme/go_sm_api/service"
 	"github.com/abeme/go_sm_api/utils"
 	"github.com/gin-gonic/gin"
@@ -16,9 +18,10 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-// ServeWS upgrades the HTTP connection to a WebSocket, authenticates the user via JWT,
-// registers the client with the hub, and starts pumps.
-func ServeWS(h *Hub, pmSvc service.PrivateMessageService, groupSvc *service.GroupService, gmSvc service.GroupMessageService, userSvc service.UserService, c *gin.Context) {
+// ServeWS upgrades the HTTP connection to a WebSocket, authenticates the user via JWT
+// or API token, registers the client with the hub, and starts pumps. API tokens
+// need messages:read, and messages:write to send.
+func ServeWS(h *Hub, sender *Sender, commands *Commands, userSvc service.UserService, botSvc service.BotService, limiter *service.RateLimiter, c *gin.Context) {
 	// get token from Authorization header
 	auth := c.GetHeader("Authorization")
 	if auth == "" {
@@ -30,10 +33,35 @@ func ServeWS(h *Hub, pmSvc service.PrivateMessageService, groupSvc *service.Grou
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid Authorization header"})
 		return
 	}
-	claims, err := utils.ValidateToken(parts[1])
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
-		return
+	var userID string
+	readOnly := false
+	if strings.HasPrefix(parts[1], entity.APITokenPrefix) {
+		u, tok, err := botSvc.Authenticate(parts[1])
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if !tok.HasScope(entity.ScopeMessagesRead) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "token lacks scope " + entity.ScopeMessagesRead})
+			return
+		}
+		if u.IsSuspended(time.Now()) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "account suspended or removed"})
+			return
+		}
+		userID = u.ID
+		readOnly = !tok.HasScope(entity.ScopeMessagesWrite)
+	} else {
+		claims, err := utils.ValidateToken(parts[1])
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if u, err := userSvc.GetByID(claims.Subject); err != nil || u.TokenVersion != claims.Version || u.IsSuspended(time.Now()) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "account suspended or removed"})
+			return
+		}
+		userID = claims.Subject
 	}
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -43,14 +71,15 @@ func ServeWS(h *Hub, pmSvc service.PrivateMessageService, groupSvc *service.Grou
 	}
 
 	client := &Client{
-		hub:         h,
-		conn:        conn,
-		send:        make(chan []byte, 256),
-		userID:      claims.Subject,
-		pmSvc:       pmSvc,
-		groupSvc:    groupSvc,
-		groupMsgSvc: gmSvc,
-		userSvc:     userSvc,
+		hub:      h,
+		conn:     conn,
+		send:     make(chan []byte, 256),
+		done:     make(chan struct{}),
+		userID:   userID,
+		sender:   sender,
+		commands: commands,
+		limiter:  limiter,
+		readOnly: readOnly,
 	}
 
 	h.RegisterClient(client)